@@ -0,0 +1,20 @@
+package upnp
+
+// maxAsyncForwards bounds the number of ForwardAsync calls that may be
+// talking to the router at once. Consumer routers handle bursts of concurrent
+// SOAP requests poorly.
+const maxAsyncForwards = 4
+
+// ForwardAsync performs Forward in a new goroutine, and delivers its result
+// on the returned channel, which is buffered so that the result may be
+// ignored. Any number of ForwardAsync calls may be made; at most
+// maxAsyncForwards of them run concurrently.
+func (d *IGD) ForwardAsync(port uint16, desc string) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		d.asyncSem <- struct{}{}
+		defer func() { <-d.asyncSem }()
+		errCh <- d.Forward(port, desc)
+	}()
+	return errCh
+}
@@ -0,0 +1,109 @@
+package upnp
+
+// A PortResult records the outcome of forwarding one port in a call to
+// ForwardMany.
+type PortResult struct {
+	Port uint16
+	// Err is nil if the port was forwarded.
+	Err error
+}
+
+// ForwardMany forwards each of the specified ports like Forward, and reports
+// the outcome for each in the order given. The returned error is only
+// non-nil if forwarding could not be attempted at all, e.g. because the
+// internal IP could not be determined; the failure of individual ports is
+// reported in the results. If rollback is true and any port fails, the ports
+// that were forwarded are cleared again once every port has been attempted,
+// so that either all of the ports are forwarded or none are; their results
+// still report that forwarding them succeeded.
+func (d *IGD) ForwardMany(ports []uint16, desc string, rollback bool) ([]PortResult, error) {
+	ip, err := d.getInternalIP()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]PortResult, len(ports))
+	var keys []MappingKey
+	failed := false
+	for i, port := range ports {
+		key, err := d.ForwardAdvanced(MappingSpec{
+			ExternalPort: port,
+			InternalIP:   ip,
+			TCP:          ProtocolEnabled,
+			UDP:          ProtocolEnabled,
+			Description:  desc,
+		})
+		results[i] = PortResult{Port: port, Err: err}
+		if err != nil {
+			failed = true
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if failed && rollback {
+		for _, key := range keys {
+			d.ClearKey(key)
+		}
+	}
+	return results, nil
+}
+
+// A MappingResult records the outcome of creating one mapping in a call to
+// ForwardAll.
+type MappingResult struct {
+	Spec MappingSpec
+	// Key identifies the mapping, if it was created.
+	Key MappingKey
+	// Err is nil if the mapping was created, or the reason it was not. It is
+	// ErrNotAttempted for the mappings after the one that failed.
+	Err error
+	// RolledBack is true if the mapping was created, but then removed again
+	// because another one failed.
+	RolledBack bool
+	// RollbackErr is the reason the mapping could not be removed again
+	// after another one failed, in which case it remains on the router.
+	RollbackErr error
+}
+
+// ForwardAll creates the mappings described by specs, in order, as a unit:
+// if any of them fails, the ones already created are removed again, and the
+// rest are not attempted, so that either every mapping exists or none do. It
+// returns the outcome for each spec in the order given, and the error of the
+// one that failed, if any. A spec in BestEffort mode that forwards only some
+// of its protocols counts as failed. If a mapping cannot be removed again,
+// its result records why, and a *RollbackError wrapping the error of the one
+// that failed is returned.
+func (d *IGD) ForwardAll(specs []MappingSpec) ([]MappingResult, error) {
+	results := make([]MappingResult, len(specs))
+	for i, spec := range specs {
+		results[i] = MappingResult{Spec: spec, Err: ErrNotAttempted}
+	}
+	for i, spec := range specs {
+		key, err := d.ForwardAdvanced(spec)
+		results[i].Key, results[i].Err = key, err
+		if err == nil {
+			continue
+		}
+		// a partial forward leaves the protocols that succeeded in place
+		var rollbackErr error
+		if len(key.protocols) > 0 {
+			rollbackErr = d.ClearKey(key)
+			results[i].RollbackErr = rollbackErr
+		}
+		for j := 0; j < i; j++ {
+			if clearErr := d.ClearKey(results[j].Key); clearErr != nil {
+				results[j].RollbackErr = clearErr
+				if rollbackErr == nil {
+					rollbackErr = clearErr
+				}
+				continue
+			}
+			results[j].RolledBack = true
+		}
+		if rollbackErr != nil {
+			return results, &RollbackError{Err: err, RollbackErr: rollbackErr}
+		}
+		return results, err
+	}
+	return results, nil
+}
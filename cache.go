@@ -0,0 +1,127 @@
+package upnp
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiscoverCached connects to the router whose location is saved in the file
+// at path, falling back to Discover if the file is missing or unreadable, or
+// the router can no longer be loaded from the saved location. After a
+// successful Discover, the router's location is saved to path, so that the
+// next call is nearly instant. Failing to save the location is not an error;
+// it only makes the next call slower.
+func DiscoverCached(path string, opts ...Option) (*IGD, error) {
+	if loc, err := ioutil.ReadFile(path); err == nil {
+		if d, err := Load(strings.TrimSpace(string(loc)), opts...); err == nil {
+			return d, nil
+		}
+	}
+	d, err := Discover(opts...)
+	if err != nil {
+		return nil, err
+	}
+	ioutil.WriteFile(path, []byte(d.Location()+"\n"), 0600)
+	return d, nil
+}
+
+// A DiscoveryCache remembers the routers it discovers, so that applications
+// that want an IGD for every operation do not pay for a search each time.
+// A router found within the TTL is returned at once. Once the TTL has
+// passed, the remembered router is still returned, but is searched for again
+// in the background; if that search fails, the router is forgotten, and the
+// next call searches itself. Routers are remembered separately for each
+// network interface. A DiscoveryCache is safe for concurrent use.
+type DiscoveryCache struct {
+	ttl      time.Duration
+	discover func(iface *net.Interface) (*IGD, error)
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// A cacheEntry is a router remembered by a DiscoveryCache.
+type cacheEntry struct {
+	d          *IGD
+	found      time.Time
+	refreshing bool
+}
+
+// NewDiscoveryCache returns a DiscoveryCache that remembers routers for ttl.
+// opts are passed to Discover and DiscoverInterface.
+func NewDiscoveryCache(ttl time.Duration, opts ...Option) *DiscoveryCache {
+	return &DiscoveryCache{
+		ttl: ttl,
+		discover: func(iface *net.Interface) (*IGD, error) {
+			if iface == nil {
+				return Discover(opts...)
+			}
+			return DiscoverInterface(iface, opts...)
+		},
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// Discover returns the router remembered from an earlier call, or calls
+// Discover if there is none.
+func (c *DiscoveryCache) Discover() (*IGD, error) {
+	return c.get("", nil)
+}
+
+// DiscoverInterface returns the router on iface remembered from an earlier
+// call, or calls DiscoverInterface if there is none.
+func (c *DiscoveryCache) DiscoverInterface(iface *net.Interface) (*IGD, error) {
+	return c.get(iface.Name, iface)
+}
+
+// Invalidate forgets every remembered router, so that the next calls search
+// for them again. It should be called when a remembered router stops
+// answering.
+func (c *DiscoveryCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*cacheEntry)
+}
+
+// get returns the router remembered under key, refreshing it in the
+// background if it is older than the TTL, or discovers it on iface.
+func (c *DiscoveryCache) get(key string, iface *net.Interface) (*IGD, error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Since(e.found) >= c.ttl && !e.refreshing {
+		e.refreshing = true
+		go c.refresh(key, iface, e)
+	}
+	c.mu.Unlock()
+	if ok {
+		return e.d, nil
+	}
+
+	d, err := c.discover(iface)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[key] = &cacheEntry{d: d, found: time.Now()}
+	c.mu.Unlock()
+	return d, nil
+}
+
+// refresh discovers the router remembered as old again, replacing it, or
+// forgetting it if the search fails.
+func (c *DiscoveryCache) refresh(key string, iface *net.Interface, old *cacheEntry) {
+	d, err := c.discover(iface)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[key] != old {
+		// invalidated, or replaced, in the meantime
+		return
+	} else if err != nil {
+		delete(c.entries, key)
+		return
+	}
+	c.entries[key] = &cacheEntry{d: d, found: time.Now()}
+}
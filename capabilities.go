@@ -0,0 +1,108 @@
+package upnp
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway1"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway2"
+)
+
+// scpdTimeout bounds the request for the connection service's description
+// made by Capabilities.
+const scpdTimeout = 5 * time.Second
+
+// Capabilities describes which of the optional features of UPnP a router
+// offers, so that an application can choose how to use it up front, rather
+// than by running into errors.
+type Capabilities struct {
+	// Actions lists the actions declared in the connection service's
+	// description (SCPD), or is nil if it could not be fetched.
+	Actions []string
+
+	// AddAnyPortMapping is true if the router can choose a free external
+	// port itself, which ForwardAny then relies on instead of probing.
+	AddAnyPortMapping bool
+	// DeletePortMappingRange is true if the router can delete a range of
+	// mappings in a single request, which ClearRange then uses.
+	DeletePortMappingRange bool
+	// ConnectionControl is true if the WAN connection can be redialed with
+	// RequestConnection and ForceTermination.
+	ConnectionControl bool
+
+	// MaxLease is the longest lease the router declares that it accepts, or
+	// zero if it declares no limit. PermanentOnly is true if it declares that
+	// it accepts only permanent mappings.
+	MaxLease      time.Duration
+	PermanentOnly bool
+
+	// NATEnabled is false if the router reports that it does not perform
+	// NAT, as in bridge mode (see IGD.NATEnabled).
+	NATEnabled bool
+	// TrafficStats is true if the router reports WAN traffic counters (see
+	// IGD.Stats).
+	TrafficStats bool
+	// IPv6Firewall is true if the router has an IPv6 firewall that can be
+	// managed (see IGD.IPv6), and InboundPinholes is true if that firewall
+	// currently allows pinholes to be opened.
+	IPv6Firewall    bool
+	InboundPinholes bool
+}
+
+// Capabilities reports which optional features the router offers. It reads
+// the connection service's description, and performs a few actions that do
+// not change the router's configuration. It does not fail: features whose
+// presence cannot be determined are reported as absent, except that NAT is
+// assumed to be enabled. Whether a router accepts remote hosts other than the
+// wildcard cannot be learned without creating a mapping, and so is not
+// reported; ForwardRestricted returns ErrUnsupported if it does not.
+func (d *IGD) Capabilities() Capabilities {
+	caps := Capabilities{NATEnabled: true}
+	if enabled, err := d.NATEnabled(); err == nil {
+		caps.NATEnabled = enabled
+	}
+	if _, ok := d.connection().(*natpmpClient); ok {
+		return caps
+	}
+
+	sc := d.client.GetServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), scpdTimeout)
+	defer cancel()
+	ctx = goupnp.WithHTTPClient(ctx, &sc.SOAPClient.HTTPClient)
+	if desc, err := sc.Service.RequestSCDPCtx(ctx); err == nil {
+		desc.Clean()
+		caps.Actions = []string{}
+		for _, a := range desc.Actions {
+			caps.Actions = append(caps.Actions, a.Name)
+		}
+		caps.AddAnyPortMapping = desc.GetAction("AddAnyPortMapping") != nil
+		caps.DeletePortMappingRange = desc.GetAction("DeletePortMappingRange") != nil
+		caps.ConnectionControl = desc.GetAction("RequestConnection") != nil && desc.GetAction("ForceTermination") != nil
+		if v := desc.GetStateVariable("PortMappingLeaseDuration"); v != nil && v.AllowedValueRange != nil {
+			if max, err := strconv.ParseUint(v.AllowedValueRange.Maximum, 10, 32); err == nil {
+				caps.MaxLease = time.Duration(max) * time.Second
+				caps.PermanentOnly = max == 0
+			}
+		}
+	} else {
+		// fall back to what the service type promises
+		caps.AddAnyPortMapping = d.IsV2()
+		caps.DeletePortMappingRange = d.IsV2()
+		caps.ConnectionControl = d.IsPPP()
+	}
+
+	if clients, err := internetgateway1.NewWANCommonInterfaceConfig1ClientsFromRootDevice(sc.RootDevice, sc.Location); err == nil && len(clients) > 0 {
+		caps.TrafficStats = true
+	}
+	if clients, err := internetgateway2.NewWANIPv6FirewallControl1ClientsFromRootDevice(sc.RootDevice, sc.Location); err == nil && len(clients) > 0 {
+		caps.IPv6Firewall = true
+		d.shareHTTPClient(clients[0].SOAPClient)
+		time.Sleep(time.Millisecond)
+		if _, allowed, err := clients[0].GetFirewallStatus(); err == nil {
+			caps.InboundPinholes = allowed
+		}
+	}
+	return caps
+}
@@ -0,0 +1,42 @@
+package upnp
+
+import "time"
+
+// A Clock is a source of time. The lease renewal machinery reads time
+// exclusively through a Clock, so that tests can control its passage.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// A Ticker delivers ticks at intervals, like a time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the default Clock, backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+// realTicker adapts a time.Ticker to the Ticker interface.
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+
+func (t realTicker) Stop() { t.t.Stop() }
+
+// SetClock replaces the Clock used by d, by which it renews leases and, on
+// NAT-PMP gateways, expires the mappings it has recorded. It is intended for
+// tests; by default, an IGD uses the system clock.
+func (d *IGD) SetClock(c Clock) {
+	d.clock = c
+	if n, ok := d.client.(*natpmpClient); ok {
+		n.setClock(c)
+	}
+}
@@ -0,0 +1,216 @@
+// Command upnpc inspects and manages the port mappings of the router on the
+// local network, using the upnp package.
+//
+// Usage:
+//
+//	upnpc [flags] discover
+//	upnpc [flags] ip
+//	upnpc [flags] forward port [description]
+//	upnpc [flags] list
+//	upnpc [flags] clear port
+//	upnpc [flags] stats
+//	upnpc [flags] diagnose
+//
+// diagnose prints, as JSON, what upnpc sees of the network, including every
+// SSDP response and device description, for attaching to bug reports; it
+// succeeds even if no router is found.
+//
+// The flags are:
+//
+//	-json
+//		print results as JSON, for scripts and bug reports
+//	-location url
+//		connect to the router at url, as printed by discover, instead of
+//		searching for it
+//	-debug
+//		log every SOAP action performed to standard error
+//	-v
+//		log the progress of discovery and port mapping to standard error
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"gitlab.com/NebulousLabs/go-upnp"
+)
+
+// commands are the commands that upnpc accepts.
+var commands = map[string]bool{
+	"discover": true,
+	"ip":       true,
+	"forward":  true,
+	"list":     true,
+	"clear":    true,
+	"stats":    true,
+	"diagnose": true,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage:
+	upnpc [flags] discover
+	upnpc [flags] ip
+	upnpc [flags] forward port [description]
+	upnpc [flags] list
+	upnpc [flags] clear port
+	upnpc [flags] stats
+	upnpc [flags] diagnose
+
+Flags:`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("upnpc: ")
+	jsonOutput := flag.Bool("json", false, "print results as JSON")
+	location := flag.String("location", "", "connect to the router at `url` instead of searching for it")
+	debug := flag.Bool("debug", false, "log every SOAP action to standard error")
+	verbose := flag.Bool("v", false, "log the progress of discovery and port mapping to standard error")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	} else if !commands[args[0]] {
+		// checked before searching, which takes seconds
+		log.Printf("unknown command %q", args[0])
+		usage()
+		os.Exit(2)
+	}
+
+	var opts []upnp.Option
+	if *verbose {
+		opts = append(opts, upnp.WithLogger(log.New(os.Stderr, "", log.Lmicroseconds)))
+	}
+	if *debug {
+		opts = append(opts, upnp.WithDebug())
+	}
+	out := output{json: *jsonOutput}
+	if args[0] == "diagnose" {
+		r, err := upnp.Diagnose(context.Background(), opts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		output{json: true}.print(r, nil)
+		return
+	}
+
+	var d *upnp.IGD
+	var err error
+	if *location != "" {
+		d, err = upnp.Load(*location, opts...)
+	} else {
+		d, err = upnp.Discover(opts...)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "discover":
+		info, _ := d.DeviceInfo()
+		out.print(struct {
+			Location string
+			UDN      string
+			Info     upnp.Info
+		}{d.Location(), d.UDN(), info}, func() {
+			fmt.Println(d.Location())
+			fmt.Printf("%s (%s %s)\n", info.FriendlyName, info.Manufacturer, info.ModelName)
+		})
+	case "ip":
+		ip, err := d.ExternalIP()
+		if err != nil {
+			log.Fatal(err)
+		}
+		out.print(struct{ ExternalIP string }{ip}, func() { fmt.Println(ip) })
+	case "forward":
+		if len(args) < 1 || len(args) > 2 {
+			usage()
+			os.Exit(2)
+		}
+		port := parsePort(args[0])
+		desc := "upnpc"
+		if len(args) == 2 {
+			desc = args[1]
+		}
+		if err := d.Forward(port, desc); err != nil {
+			log.Fatal(err)
+		}
+		out.print(struct{ Forwarded uint16 }{port}, func() {})
+	case "list":
+		ms, err := d.ListMappings()
+		if err != nil {
+			log.Fatal(err)
+		}
+		out.print(ms, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "EXTERNAL\tPROTO\tINTERNAL\tENABLED\tLEASE\tDESCRIPTION")
+			for _, m := range ms {
+				ext := strconv.Itoa(int(m.ExternalPort))
+				if m.RemoteHost != "" {
+					ext = m.RemoteHost + " -> " + ext
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s:%d\t%v\t%v\t%s\n", ext, m.Protocol, m.InternalClient, m.InternalPort, m.Enabled, m.LeaseDuration, m.Description)
+			}
+			w.Flush()
+		})
+	case "clear":
+		if len(args) != 1 {
+			usage()
+			os.Exit(2)
+		}
+		port := parsePort(args[0])
+		if err := d.Clear(port); err != nil {
+			log.Fatal(err)
+		}
+		out.print(struct{ Cleared uint16 }{port}, func() {})
+	case "stats":
+		s, err := d.Stats()
+		if err != nil {
+			log.Fatal(err)
+		}
+		out.print(s, func() {
+			fmt.Printf("sent:     %d bytes, %d packets\n", s.BytesSent, s.PacketsSent)
+			fmt.Printf("received: %d bytes, %d packets\n", s.BytesReceived, s.PacketsReceived)
+		})
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// output prints results as JSON or as text.
+type output struct {
+	json bool
+}
+
+// print prints v as JSON if JSON output was requested, and otherwise calls
+// text to print it.
+func (o output) print(v interface{}, text func()) {
+	if !o.json {
+		text()
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parsePort parses a port number, exiting on failure.
+func parsePort(s string) uint16 {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		log.Fatalf("invalid port %q", s)
+	}
+	return uint16(port)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"gitlab.com/NebulousLabs/go-upnp"
+	"gitlab.com/NebulousLabs/go-upnp/upnptest"
+)
+
+// TestMain runs upnpc instead of the tests when the test binary is started
+// by upnpc, so that commands that exit the process can be tested.
+func TestMain(m *testing.M) {
+	if os.Getenv("UPNPC_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// upnpc runs upnpc with args, returning what it printed to standard output,
+// and what it printed to standard error if it failed.
+func upnpc(args ...string) (string, error) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "UPNPC_TEST_MAIN=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("upnpc %v: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.String(), nil
+}
+
+// TestCommands tests the discover, ip, forward, list and clear commands
+// against a fake router, with and without JSON output.
+func TestCommands(t *testing.T) {
+	s := upnptest.NewServer("203.0.113.1")
+	defer s.Close()
+
+	if out, err := upnpc("-location", s.URL, "discover"); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(out, s.URL+"\n") {
+		t.Fatalf("expected the router's location, got %q", out)
+	}
+	if out, err := upnpc("-location", s.URL, "ip"); err != nil || out != "203.0.113.1\n" {
+		t.Fatalf("expected 203.0.113.1, got %q, %v", out, err)
+	}
+	var ip struct{ ExternalIP string }
+	if out, err := upnpc("-location", s.URL, "-json", "ip"); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal([]byte(out), &ip); err != nil || ip.ExternalIP != "203.0.113.1" {
+		t.Fatalf("expected 203.0.113.1, got %q, %v", out, err)
+	}
+
+	if _, err := upnpc("-location", s.URL, "forward", "9980", "upnpc test"); err != nil {
+		t.Fatal(err)
+	}
+	if ms := s.Mappings(); len(ms) != 2 || ms[0].ExternalPort != 9980 || ms[0].Description != "upnpc test" {
+		t.Fatalf("wrong mappings: %+v", ms)
+	}
+	var ms []upnp.Mapping
+	if out, err := upnpc("-location", s.URL, "-json", "list"); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal([]byte(out), &ms); err != nil || len(ms) != 2 || ms[0].ExternalPort != 9980 {
+		t.Fatalf("expected the two mappings of 9980, got %q, %v", out, err)
+	}
+	if out, err := upnpc("-location", s.URL, "list"); err != nil || strings.Count(out, "upnpc test") != 2 {
+		t.Fatalf("expected a table of the two mappings, got %q, %v", out, err)
+	}
+
+	if _, err := upnpc("-location", s.URL, "clear", "9980"); err != nil {
+		t.Fatal(err)
+	} else if ms := s.Mappings(); len(ms) != 0 {
+		t.Fatalf("mappings were not cleared: %+v", ms)
+	}
+	if _, err := upnpc("-location", s.URL, "clear", "9980"); err == nil {
+		t.Fatal("expected clearing an unmapped port to fail")
+	}
+}
+
+// TestUsage tests that upnpc fails without running a command when it is
+// given no command, an unknown one, or an invalid port.
+func TestUsage(t *testing.T) {
+	s := upnptest.NewServer("203.0.113.1")
+	defer s.Close()
+	for _, args := range [][]string{
+		{},
+		{"-location", s.URL, "frobnicate"},
+		{"-location", s.URL, "forward"},
+		{"-location", s.URL, "forward", "99999"},
+		{"-location", s.URL, "clear", "zero"},
+	} {
+		if out, err := upnpc(args...); err == nil {
+			t.Errorf("%q: expected to fail, got %q", args, out)
+		}
+	}
+	if ms := s.Mappings(); len(ms) != 0 {
+		t.Fatalf("wrong mappings: %+v", ms)
+	}
+	// an unknown command is rejected before searching for a router
+	if out, err := upnpc("frobnicate"); err == nil || !strings.Contains(err.Error(), `unknown command "frobnicate"`) {
+		t.Fatalf("expected the unknown command to be reported, got %q, %v", out, err)
+	}
+}
+
+// TestVerbose tests that the library's log is only printed with -v.
+func TestVerbose(t *testing.T) {
+	s := upnptest.NewServer("203.0.113.1")
+	defer s.Close()
+	if _, err := upnpc("-location", s.URL, "clear", "9980"); err == nil {
+		t.Fatal("expected clearing an unmapped port to fail")
+	} else if strings.Contains(err.Error(), "upnp: ") {
+		t.Fatal("expected no log without -v, got", err)
+	}
+	if _, err := upnpc("-v", "-location", s.URL, "clear", "9980"); err == nil {
+		t.Fatal("expected clearing an unmapped port to fail")
+	} else if !strings.Contains(err.Error(), "upnp: ") {
+		t.Fatal("expected a log with -v, got", err)
+	}
+}
+
+// TestStatsCommand tests that the stats command prints the router's traffic
+// counters, and fails on a router that does not report them.
+func TestStatsCommand(t *testing.T) {
+	const (
+		ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+		common = "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1"
+	)
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + common + `</serviceType>` +
+		`<serviceId>urn:upnp-org:serviceId:WANCommonIFC1</serviceId><controlURL>/common</controlURL></service>` +
+		`<service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	// the argument and value returned by each action
+	counters := map[string][2]string{
+		"GetTotalBytesSent":       {"NewTotalBytesSent", "1000"},
+		"GetTotalBytesReceived":   {"NewTotalBytesReceived", "2000"},
+		"GetTotalPacketsSent":     {"NewTotalPacketsSent", "10"},
+		"GetTotalPacketsReceived": {"NewTotalPacketsReceived", "20"},
+	}
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rootDesc.xml" {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+			return
+		}
+		action := r.Header.Get("SOAPAction")
+		action = strings.Trim(action[strings.Index(action, "#")+1:], `"`)
+		counter := counters[action]
+		arg := "<" + counter[0] + ">" + counter[1] + "</" + counter[0] + ">"
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+			`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+			`<u:` + action + `Response xmlns:u="` + common + `">` + arg + `</u:` + action + `Response>` +
+			`</s:Body></s:Envelope>`))
+	}))
+	defer router.Close()
+	loc := router.URL + "/rootDesc.xml"
+
+	want := "sent:     1000 bytes, 10 packets\nreceived: 2000 bytes, 20 packets\n"
+	if out, err := upnpc("-location", loc, "stats"); err != nil || out != want {
+		t.Fatalf("expected %q, got %q, %v", want, out, err)
+	}
+	var s upnp.Stats
+	if out, err := upnpc("-location", loc, "-json", "stats"); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal([]byte(out), &s); err != nil || s != (upnp.Stats{BytesSent: 1000, BytesReceived: 2000, PacketsSent: 10, PacketsReceived: 20}) {
+		t.Fatalf("wrong counters: %q, %v", out, err)
+	}
+
+	fake := upnptest.NewServer("203.0.113.1")
+	defer fake.Close()
+	if out, err := upnpc("-location", fake.URL, "stats"); err == nil || !strings.Contains(err.Error(), upnp.ErrUnsupported.Error()) {
+		t.Fatalf("expected ErrUnsupported, got %q, %v", out, err)
+	}
+}
@@ -0,0 +1,192 @@
+package upnp
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway1"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway2"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/soap"
+)
+
+// performAction performs a SOAP action on the router's connection service,
+// aborting it when ctx is done. If ctx is done, ctx.Err() is returned in
+// place of the error from the aborted request. NAT-PMP gateways do not
+// perform SOAP actions, so ErrUnsupported is returned for them. In dry-run
+// mode, actions that would change the router are reported instead. The
+// arguments are adapted to the router's quirks, and the action is retried
+// if WithAutoHeal finds the router elsewhere, as for the igdClient methods.
+func (d *IGD) performAction(ctx context.Context, action string, request, response interface{}) error {
+	if _, ok := d.client.(*natpmpClient); ok {
+		return ErrUnsupported
+	}
+	if mutating(action) && d.dryRun(action, soap.ActionArgs(request)) {
+		return nil
+	}
+	request = d.Quirks().adaptArgs(request)
+	return d.do(ctx, func(c igdClient) error {
+		sc := c.GetServiceClient()
+		time.Sleep(time.Millisecond)
+		return sc.SOAPClient.PerformActionCtx(ctx, sc.Service.ServiceType, action, request, response)
+	})
+}
+
+// do calls action with d's client bound to ctx. If WithAutoHeal was given,
+// action is called through the healingClient, and so once more with the
+// client found if the router could not be reached; it should use the client
+// it is passed. Errors reported by the router are returned as a *UPnPError.
+func (d *IGD) do(ctx context.Context, action func(igdClient) error) error {
+	c := bindContext(ctx, d.client)
+	if h, ok := c.(*healingClient); ok {
+		return upnpError(ctxErr(ctx, h.do(action)))
+	}
+	return upnpError(ctxErr(ctx, action(c)))
+}
+
+// Invoke performs the named SOAP action of one of the router's services, as
+// an escape hatch for actions that this package does not wrap, such as those
+// of vendor-specific services. in and out are pointers to structs with a
+// string field for each argument, as for soap.SOAPClient.PerformAction;
+// either may be nil. If serviceType is empty, the action is performed on the
+// router's connection service; otherwise it is performed on the first
+// service of that type, and ErrUnsupported is returned if there is none. The
+// HTTP client and options that d was created with apply. In dry-run mode,
+// any action whose name does not begin with "Get" is reported instead of
+// performed. Errors reported by the router are returned as a *UPnPError.
+func (d *IGD) Invoke(ctx context.Context, serviceType, action string, in, out interface{}) error {
+	if serviceType == "" {
+		return d.performAction(ctx, action, in, out)
+	} else if _, ok := d.client.(*natpmpClient); ok {
+		return ErrUnsupported
+	}
+	srvs := d.client.GetServiceClient().RootDevice.Device.FindService(serviceType)
+	if len(srvs) == 0 {
+		return ErrUnsupported
+	}
+	if mutating(action) && d.dryRun(action, soap.ActionArgs(in)) {
+		return nil
+	}
+	c := d.shareHTTPClient(srvs[0].NewSOAPClient())
+	time.Sleep(time.Millisecond)
+	err := c.PerformActionCtx(ctx, serviceType, action, in, out)
+	return upnpError(ctxErr(ctx, err))
+}
+
+// ExternalIPCtx is the same as ExternalIP, but aborts the request and
+// returns ctx.Err() when ctx is done.
+func (d *IGD) ExternalIPCtx(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	ip, err := bindContext(ctx, d.client).GetExternalIPAddress()
+	if err != nil {
+		return "", upnpError(ctxErr(ctx, err))
+	} else if ip == "" {
+		return "", ErrNoExternalIP
+	}
+	return ip, nil
+}
+
+// Ping checks that the router still answers, by asking for the status of its
+// connection service, so that a supervisor can detect a stale IGD, e.g.
+// after the router has rebooted at a new address or been replaced, and
+// discover it again before other calls fail. It returns nil if the router
+// answered, and aborts with ctx.Err() when ctx is done.
+func (d *IGD) Ping(ctx context.Context) error {
+	if _, ok := d.client.(*natpmpClient); ok {
+		errc := make(chan error, 1)
+		go func() {
+			_, _, _, err := d.client.GetStatusInfo()
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return d.performAction(ctx, "GetStatusInfo", nil, &struct {
+		NewConnectionStatus    string
+		NewLastConnectionError string
+		NewUptime              string
+	}{})
+}
+
+// ForwardCtx is the same as Forward, but aborts and returns ctx.Err() when
+// ctx is done. If only one protocol was forwarded when ctx is done, its
+// mapping is removed again, which may take as long as the router allows.
+func (d *IGD) ForwardCtx(ctx context.Context, port uint16, desc string) error {
+	_, err := d.forwardAdvanced(ctx, MappingSpec{
+		ExternalPort: port,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Description:  desc,
+	})
+	return err
+}
+
+// ClearCtx is the same as Clear, but aborts and returns ctx.Err() when ctx is
+// done.
+func (d *IGD) ClearCtx(ctx context.Context, port uint16) error {
+	var errs []error
+	for _, proto := range []string{"TCP", "UDP"} {
+		if err := d.clearProtocol(ctx, port, proto); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	// only return an error if both deletions failed
+	if len(errs) == 2 {
+		return errs[0]
+	}
+	return nil
+}
+
+// bindContext returns a client that performs the actions of client, aborting
+// them when ctx is done. The healingClient and quirkClient wrapping d's
+// connection service are bound along with it, so that healing and quirks
+// still apply. NAT-PMP requests cannot be aborted, so NAT-PMP gateways are
+// returned unchanged, as are clients bound to a context that is never done.
+func bindContext(ctx context.Context, client igdClient) igdClient {
+	if ctx.Done() == nil {
+		return client
+	}
+	switch c := client.(type) {
+	case *healingClient:
+		return c.withContext(ctx)
+	case *quirkClient:
+		return &quirkClient{igdClient: bindContext(ctx, c.igdClient), quirks: c.quirks}
+	case *internetgateway2.WANIPConnection2:
+		b := *c
+		b.SOAPClient = c.SOAPClient.WithContext(ctx)
+		return &b
+	case *internetgateway1.WANPPPConnection1:
+		b := *c
+		b.SOAPClient = c.SOAPClient.WithContext(ctx)
+		return &b
+	case *internetgateway1.WANIPConnection1:
+		b := *c
+		b.SOAPClient = c.SOAPClient.WithContext(ctx)
+		return &b
+	}
+	return client
+}
+
+// ctxErr returns ctx.Err() in place of err if ctx is done, since a request
+// aborted by ctx fails with an error that does not say why.
+func ctxErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// marshalUi2 formats v as a SOAP ui2 argument.
+func marshalUi2(v uint16) string {
+	s, _ := soap.MarshalUi2(v)
+	return s
+}
@@ -0,0 +1,206 @@
+package upnp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/httpu"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/ssdp"
+)
+
+// A Report records what Diagnose found, for attaching to a bug report when
+// a router cannot be found or used. It is meant to be serialized with
+// encoding/json; errors are recorded as strings for that reason, and are
+// empty if there was none.
+type Report struct {
+	Time time.Time
+	// Interfaces lists this host's network interfaces, which determine
+	// where the SSDP search is sent.
+	Interfaces []ReportInterface
+	// Responses lists every response to an SSDP search for all devices, with
+	// its raw headers, whether or not it came from a router. SearchError is
+	// the error that prevented the search, if any.
+	Responses   []ReportResponse
+	SearchError string `json:",omitempty"`
+	// Descriptions lists the result of fetching the device description at
+	// each location that responded.
+	Descriptions []ReportDescription
+	// DiscoverError is the error returned by DiscoverCtx, if any; otherwise
+	// Gateway describes the router that it chose.
+	DiscoverError string         `json:",omitempty"`
+	Gateway       *ReportGateway `json:",omitempty"`
+}
+
+// A ReportInterface describes one of this host's network interfaces.
+type ReportInterface struct {
+	Name  string
+	Flags string
+	Addrs []string
+}
+
+// A ReportResponse is a response to an SSDP search.
+type ReportResponse struct {
+	DeviceEntry
+	Header http.Header
+}
+
+// A ReportDescription describes the device description served at Location.
+type ReportDescription struct {
+	Location     string
+	FriendlyName string `json:",omitempty"`
+	Manufacturer string `json:",omitempty"`
+	ModelName    string `json:",omitempty"`
+	// Services lists the service types that the root device and its
+	// embedded devices offer.
+	Services []string `json:",omitempty"`
+	Error    string   `json:",omitempty"`
+}
+
+// A ReportGateway describes the router chosen by discovery, and the results
+// of probing it.
+type ReportGateway struct {
+	Location    string
+	ServiceType string
+	UDN         string
+	Info        Info
+	Quirks      Quirks
+
+	ExternalIP      string `json:",omitempty"`
+	ExternalIPError string `json:",omitempty"`
+
+	ConnectionStatus string        `json:",omitempty"`
+	Uptime           time.Duration `json:",omitempty"`
+	StatusError      string        `json:",omitempty"`
+
+	Capabilities Capabilities
+}
+
+// Diagnose records what this package sees of the local network, in as much
+// detail as is useful for working out why a router cannot be found or used:
+// the interfaces on this host, every response to an SSDP search, the result
+// of fetching each responder's description, the router chosen by
+// DiscoverCtx given opts, and the results of a few harmless actions on it.
+// Failures along the way are recorded in the Report rather than returned;
+// an error is returned only if ctx is done, along with what was recorded so
+// far. Diagnose does not change the router's configuration.
+func Diagnose(ctx context.Context, opts ...Option) (*Report, error) {
+	o := newOptions(opts)
+	r := &Report{Time: time.Now()}
+	r.recordInterfaces()
+	if err := r.recordResponses(ctx, o); err != nil {
+		return r, err
+	}
+	r.recordDescriptions(ctx)
+	if err := ctx.Err(); err != nil {
+		return r, err
+	}
+
+	d, err := DiscoverCtx(ctx, opts...)
+	if err != nil {
+		r.DiscoverError = err.Error()
+		return r, ctx.Err()
+	}
+	r.probe(d)
+	return r, ctx.Err()
+}
+
+// recordInterfaces records this host's network interfaces.
+func (r *Report) recordInterfaces() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, iface := range ifaces {
+		ri := ReportInterface{Name: iface.Name, Flags: iface.Flags.String()}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ri.Addrs = append(ri.Addrs, addr.String())
+		}
+		r.Interfaces = append(r.Interfaces, ri)
+	}
+}
+
+// recordResponses records every response to an SSDP search for all
+// devices. Only ctx's error is returned; others are recorded as the
+// SearchError.
+func (r *Report) recordResponses(ctx context.Context, o *options) error {
+	client, err := httpu.NewHTTPUClient()
+	if err != nil {
+		r.SearchError = err.Error()
+		return nil
+	}
+	defer client.Close()
+	err = ssdp.SSDPRawSearchFunc(ctx, client, "ssdp:all", o.searchWait(), 3, func(resp *http.Response) {
+		r.Responses = append(r.Responses, ReportResponse{
+			DeviceEntry: newDeviceEntry(resp),
+			Header:      resp.Header,
+		})
+	})
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	} else if err != nil {
+		r.SearchError = err.Error()
+	}
+	return nil
+}
+
+// recordDescriptions fetches the description at each location that
+// responded to the SSDP search.
+func (r *Report) recordDescriptions(ctx context.Context) {
+	seen := make(map[string]bool)
+	for _, resp := range r.Responses {
+		if resp.Location == "" || seen[resp.Location] {
+			continue
+		}
+		seen[resp.Location] = true
+		desc := ReportDescription{Location: resp.Location}
+		loc, err := url.Parse(resp.Location)
+		var root *goupnp.RootDevice
+		if err == nil {
+			root, err = goupnp.DeviceByURLCtx(ctx, loc)
+		}
+		if err != nil {
+			desc.Error = err.Error()
+			r.Descriptions = append(r.Descriptions, desc)
+			continue
+		}
+		desc.FriendlyName = root.Device.FriendlyName
+		desc.Manufacturer = root.Device.Manufacturer
+		desc.ModelName = root.Device.ModelName
+		root.Device.VisitServices(func(srv *goupnp.Service) {
+			desc.Services = append(desc.Services, srv.ServiceType)
+		})
+		r.Descriptions = append(r.Descriptions, desc)
+	}
+}
+
+// probe records what d reports about itself. None of the actions it
+// performs change the router's configuration.
+func (r *Report) probe(d *IGD) {
+	sc := d.client.GetServiceClient()
+	g := &ReportGateway{
+		Location: d.Location(),
+		UDN:      d.UDN(),
+		Quirks:   d.Quirks(),
+	}
+	if sc.Service != nil {
+		g.ServiceType = sc.Service.ServiceType
+	}
+	g.Info, _ = d.DeviceInfo()
+	if ip, err := d.ExternalIP(); err != nil {
+		g.ExternalIPError = err.Error()
+	} else {
+		g.ExternalIP = ip
+	}
+	if status, uptime, err := d.ConnectionStatus(); err != nil {
+		g.StatusError = err.Error()
+	} else {
+		g.ConnectionStatus, g.Uptime = status, uptime
+	}
+	g.Capabilities = d.Capabilities()
+	r.Gateway = g
+}
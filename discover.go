@@ -0,0 +1,341 @@
+package upnp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway1"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway2"
+)
+
+// connectionServices lists the WAN connection services that an IGD can be
+// built on, in order of preference. WANIPConnection:2 comes first, since
+// routers that offer it alongside a v1 service handle AddPortMapping more
+// predictably through it.
+var connectionServices = []struct {
+	urn  string
+	wrap func(goupnp.ServiceClient) igdClient
+}{
+	{internetgateway2.URN_WANIPConnection_2, func(sc goupnp.ServiceClient) igdClient {
+		return &internetgateway2.WANIPConnection2{ServiceClient: sc}
+	}},
+	{internetgateway1.URN_WANPPPConnection_1, func(sc goupnp.ServiceClient) igdClient {
+		return &internetgateway1.WANPPPConnection1{ServiceClient: sc}
+	}},
+	{internetgateway1.URN_WANIPConnection_1, func(sc goupnp.ServiceClient) igdClient {
+		return &internetgateway1.WANIPConnection1{ServiceClient: sc}
+	}},
+}
+
+// A ConnectionPreference chooses between the kinds of WAN connection service
+// that a router may offer, for routers that offer more than one.
+type ConnectionPreference int
+
+const (
+	// PreferDefault uses the connection named as the default by the router's
+	// Layer3Forwarding service, if it has one, and otherwise prefers
+	// WANIPConnection:2, then WANPPPConnection:1, then WANIPConnection:1.
+	PreferDefault ConnectionPreference = iota
+	// PreferIP prefers a WANIPConnection service to a WANPPPConnection one,
+	// regardless of the router's default.
+	PreferIP
+	// PreferPPP prefers a WANPPPConnection service to a WANIPConnection one,
+	// regardless of the router's default.
+	PreferPPP
+	// PreferConnected asks each connection service found for its status, and
+	// uses the first that reports being connected, falling back to the
+	// PreferDefault choice if none does. It suits gateways that expose a dead
+	// connection service alongside the live one, at the cost of a request per
+	// service during discovery.
+	PreferConnected
+)
+
+// isPPP reports whether urn is the URN of a WANPPPConnection service.
+func isPPP(urn string) bool {
+	return urn == internetgateway1.URN_WANPPPConnection_1
+}
+
+// services returns connectionServices in the order given by the
+// ConnectionPreference set with WithConnectionPreference.
+func (o *options) services() []struct {
+	urn  string
+	wrap func(goupnp.ServiceClient) igdClient
+} {
+	if o.connPref != PreferIP && o.connPref != PreferPPP {
+		return connectionServices
+	}
+	wantPPP := o.connPref == PreferPPP
+	srvs := append(connectionServices[:0:0], connectionServices...)
+	sort.SliceStable(srvs, func(i, j int) bool {
+		return isPPP(srvs[i].urn) == wantPPP && isPPP(srvs[j].urn) != wantPPP
+	})
+	return srvs
+}
+
+// connectionClient returns the client for sc, a service found by searching
+// for a connection service, which wrap turns into an igdClient. Unless the
+// ConnectionPreference overrides it, the router's default connection is used
+// instead, if it names one, and asking for it is aborted when ctx is done.
+func (o *options) connectionClient(ctx context.Context, sc goupnp.ServiceClient, wrap func(goupnp.ServiceClient) igdClient) igdClient {
+	if o.connPref == PreferIP || o.connPref == PreferPPP {
+		return wrap(sc)
+	}
+	return defaultConnectionClient(ctx, sc, o.httpClientFor(sc, wrap), wrap(sc))
+}
+
+// httpClientFor returns the HTTP client that configure gives the connection
+// service sc, for requests made before its IGD is configured. It is built on
+// a copy of sc's SOAP client, so that configure does not layer the transport
+// twice.
+func (o *options) httpClientFor(sc goupnp.ServiceClient, wrap func(goupnp.ServiceClient) igdClient) http.Client {
+	c := *sc.SOAPClient
+	sc.SOAPClient = &c
+	o.configureTransport(newIGD(wrap(sc)))
+	return c.HTTPClient
+}
+
+// probe returns the IGD for the connection service urn of maybe, a router
+// that answered a search, configured by o, or nil if the router could not be
+// probed or fails validation.
+func (o *options) probe(ctx context.Context, maybe goupnp.MaybeRootDevice, urn string, wrap func(goupnp.ServiceClient) igdClient) *IGD {
+	if maybe.Err != nil {
+		o.logf("upnp: probing %s device: %v", urn, maybe.Err)
+		return nil
+	}
+	clients, err := goupnp.NewServiceClientsFromRootDevice(maybe.Root, maybe.Location, urn)
+	if err != nil {
+		return nil
+	}
+	d := newIGD(o.connectionClient(ctx, clients[0], wrap))
+	o.configure(d)
+	if err := o.validate(d); err != nil {
+		o.logf("upnp: rejecting %s: %v", d.Location(), err)
+		return nil
+	}
+	return d
+}
+
+// connected reports whether d's connection service reports that it is
+// connected.
+func connected(d *IGD) bool {
+	time.Sleep(time.Millisecond)
+	status, _, _, err := d.client.GetStatusInfo()
+	return err == nil && status == "Connected"
+}
+
+// DiscoverStream scans the local network for routers, and sends each
+// UPnP-enabled router on the returned channel as soon as it responds, rather
+// than waiting for the search to finish. A router exposing more than one
+// connection service is sent once per service. The options apply as for
+// Discover: each router is configured by them, and routers that fail the
+// validators given with WithValidator are skipped. Both channels are closed
+// when the search window ends or ctx is cancelled. The error channel receives
+// the errors, if any, that prevented a search from being performed; routers
+// that respond but cannot be probed are skipped.
+func DiscoverStream(ctx context.Context, opts ...Option) (<-chan *IGD, <-chan error) {
+	o := newOptions(opts)
+	ctx = o.context(ctx)
+	igds := make(chan *IGD)
+	errs := make(chan error, len(connectionServices))
+	if err := o.checkMulticast(); err != nil {
+		errs <- err
+		close(igds)
+		close(errs)
+		return igds, errs
+	}
+
+	var wg sync.WaitGroup
+	for _, srv := range o.services() {
+		wg.Add(1)
+		go func(urn string, wrap func(goupnp.ServiceClient) igdClient) {
+			defer wg.Done()
+			err := goupnp.DiscoverDevicesFunc(ctx, urn, o.searchWait(), o.searchOptions(), func(maybe goupnp.MaybeRootDevice) {
+				d := o.probe(ctx, maybe, urn, wrap)
+				if d == nil {
+					return
+				}
+				select {
+				case igds <- d:
+				case <-ctx.Done():
+				}
+			})
+			if err != nil {
+				errs <- err
+			}
+		}(srv.urn, srv.wrap)
+	}
+	go func() {
+		wg.Wait()
+		close(igds)
+		close(errs)
+	}()
+	return igds, errs
+}
+
+// haveMulticastInterface reports whether this host has an interface that can
+// send a multicast SSDP search.
+func haveMulticastInterface() (bool, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return false, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 && iface.Flags&net.FlagLoopback == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DiscoverUnicast connects to the router at gatewayIP by sending the SSDP
+// search directly to it, rather than to the multicast group used by Discover.
+// This finds routers on networks whose switches filter multicast traffic. As
+// with Discover, a router that fails the validators given with WithValidator
+// is skipped.
+func DiscoverUnicast(gatewayIP net.IP, opts ...Option) (*IGD, error) {
+	o := newOptions(opts)
+	host := net.JoinHostPort(gatewayIP.String(), "1900")
+	var validationErrs []error
+	for _, srv := range o.services() {
+		var d *IGD
+		ctx := o.context(context.Background())
+		err := goupnp.DiscoverDevicesUnicastFunc(ctx, host, srv.urn, o.searchWait(), o.searchOptions(), func(maybe goupnp.MaybeRootDevice) {
+			if d != nil || maybe.Err != nil {
+				return
+			}
+			clients, err := goupnp.NewServiceClientsFromRootDevice(maybe.Root, maybe.Location, srv.urn)
+			if err != nil {
+				return
+			}
+			candidate := newIGD(o.connectionClient(ctx, clients[0], srv.wrap))
+			o.configure(candidate)
+			if err := o.validate(candidate); err != nil {
+				o.logf("upnp: rejecting %s: %v", candidate.Location(), err)
+				validationErrs = append(validationErrs, err)
+				return
+			}
+			d = candidate
+		})
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			return d, nil
+		}
+	}
+	if len(validationErrs) > 0 {
+		return nil, validationError(validationErrs)
+	}
+	return nil, fmt.Errorf("%w at %s", ErrNoGateway, gatewayIP)
+}
+
+// DiscoverInterface scans the network attached to iface for routers, and
+// returns the first UPnP-enabled router it encounters. On hosts with more
+// than one network interface, this ensures that the router found is the one
+// on the intended network. Ports forwarded through the returned IGD are
+// forwarded to iface's address. As with Discover, a router that fails the
+// validators given with WithValidator is skipped.
+func DiscoverInterface(iface *net.Interface, opts ...Option) (*IGD, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var localIP net.IP
+	for _, a := range addrs {
+		if x, ok := a.(*net.IPNet); ok && x.IP.To4() != nil {
+			localIP = x.IP
+			break
+		}
+	}
+	if localIP == nil {
+		return nil, fmt.Errorf("%w: no IPv4 address on interface %s", ErrNoInternalIP, iface.Name)
+	}
+
+	o := newOptions(opts)
+	laddr := net.JoinHostPort(localIP.String(), strconv.Itoa(int(o.ssdpPort)))
+	var validationErrs []error
+	for _, srv := range o.services() {
+		var d *IGD
+		ctx := o.context(context.Background())
+		err := goupnp.DiscoverDevicesAddrFunc(ctx, laddr, srv.urn, o.searchWait(), o.searchOptions(), func(maybe goupnp.MaybeRootDevice) {
+			if d != nil || maybe.Err != nil {
+				return
+			}
+			clients, err := goupnp.NewServiceClientsFromRootDevice(maybe.Root, maybe.Location, srv.urn)
+			if err != nil {
+				return
+			}
+			candidate := newIGD(o.connectionClient(ctx, clients[0], srv.wrap))
+			o.configure(candidate)
+			candidate.localIP = localIP.String()
+			if err := o.validate(candidate); err != nil {
+				o.logf("upnp: rejecting %s: %v", candidate.Location(), err)
+				validationErrs = append(validationErrs, err)
+				return
+			}
+			d = candidate
+		})
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			return d, nil
+		}
+	}
+	if len(validationErrs) > 0 {
+		return nil, validationError(validationErrs)
+	}
+	return nil, fmt.Errorf("%w on interface %s", ErrNoGateway, iface.Name)
+}
+
+// DiscoverAll scans the local network for routers, and returns every
+// UPnP-enabled router that responds and passes the validators given with
+// WithValidator. Callers can inspect each, e.g. with Location, DeviceInfo or
+// Subnet, to choose between them on networks with more than one gateway, or
+// pass OnDefaultRoute to WithValidator to have the choice made for them.
+func DiscoverAll(opts ...Option) ([]*IGD, error) {
+	return DiscoverAllCtx(context.Background(), opts...)
+}
+
+// DiscoverAllCtx is the same as DiscoverAll, but stops searching when ctx is
+// done.
+func DiscoverAllCtx(ctx context.Context, opts ...Option) ([]*IGD, error) {
+	o := newOptions(opts)
+	ctx = o.context(ctx)
+	var igds []*IGD
+	// a router may be found through more than one connection service URN,
+	// or have several connections that resolve to the same default one;
+	// with a ConnectionPreference, each connection is its own
+	seen := make(map[string]bool)
+	for _, srv := range o.services() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		clients, _, _ := o.searchClients(ctx, srv.urn)
+		for _, sc := range clients {
+			d := newIGD(o.connectionClient(ctx, sc, srv.wrap))
+			resolved := d.client.GetServiceClient()
+			id := resolved.RootDevice.Device.UDN + "," + resolved.Service.ServiceId
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			o.configure(d)
+			if o.validate(d) != nil {
+				continue
+			}
+			igds = append(igds, d)
+		}
+	}
+	if len(igds) == 0 {
+		return nil, ErrNoGateway
+	}
+	return igds, nil
+}
@@ -0,0 +1,53 @@
+package upnp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A PlannedAction is a SOAP action that would have changed the router's
+// configuration, which an IGD created with WithDryRun reports instead of
+// performing.
+type PlannedAction struct {
+	Action string
+	// Args are the action's arguments, as name-value pairs.
+	Args [][2]string
+}
+
+// String implements fmt.Stringer.
+func (a PlannedAction) String() string {
+	args := make([]string, len(a.Args))
+	for i, arg := range a.Args {
+		args[i] = arg[0] + "=" + arg[1]
+	}
+	return fmt.Sprintf("%s(%s)", a.Action, strings.Join(args, ", "))
+}
+
+// mutating reports whether action may change the router's configuration.
+// Only the Get actions of the UPnP services are known to be read-only, so
+// any other action, including vendor-specific ones performed with Invoke, is
+// assumed to change it.
+func mutating(action string) bool {
+	return !strings.HasPrefix(action, "Get")
+}
+
+// dryRun reports whether d was created with WithDryRun, in which case the
+// action, which would change the router's configuration, is logged and
+// passed to the WithDryRun callback, and must not be performed.
+func (d *IGD) dryRun(action string, args [][2]string) bool {
+	if d.plan == nil {
+		return false
+	}
+	a := PlannedAction{Action: action, Args: args}
+	d.logf("upnp: dry run: %v", a)
+	d.plan(a)
+	return true
+}
+
+// boolArg formats b as a SOAP boolean argument.
+func boolArg(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,215 @@
+package upnp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/soap"
+)
+
+// UPnP error codes reported by WAN connection services, which are found in
+// the Code of a *UPnPError.
+const (
+	// ErrCodeConflictInMappingEntry means that the port is already mapped to
+	// another host.
+	ErrCodeConflictInMappingEntry = 718
+	// ErrCodeOnlyPermanentLeasesSupported means that the router refused a
+	// mapping with a lease.
+	ErrCodeOnlyPermanentLeasesSupported = 725
+)
+
+const (
+	errCodeInvalidAction                = 401 // Invalid Action
+	errCodeOptionalActionNotImplemented = 602 // Optional Action Not Implemented
+	errCodeNotAuthorized                = 606 // Action not authorized
+	errCodeArrayIndexInvalid            = 713 // SpecifiedArrayIndexInvalid
+	errCodeNoSuchEntry                  = 714 // NoSuchEntryInArray
+	errCodeWildCardNotPermitted         = 715 // WildCardNotPermittedInSrcIP
+	errCodeWildCardNotPermittedEx       = 716 // WildCardNotPermittedInExtPort
+	errCodeSamePortValuesRequired       = 724 // SamePortValuesRequired
+	errCodeRemoteHostWildcard           = 726 // RemoteHostOnlySupportsWildcard
+	errCodeExternalPortWildcard         = 727 // ExternalPortOnlySupportsWildcard
+	errCodeNoPortMapsAvailable          = 728 // NoPortMapsAvailable
+	errCodePortMappingNotFound          = 730 // PortMappingNotFound
+)
+
+// mayRejectPermanent reports whether err could be a router's refusal of a
+// permanent mapping. Routers that refuse them do not agree on an error code,
+// so any fault is suspect except those that clearly have another cause.
+func mayRejectPermanent(err error) bool {
+	var fault *soap.SOAPFaultError
+	var upnpErr *UPnPError
+	if !errors.As(err, &fault) && !errors.As(err, &upnpErr) {
+		return false
+	}
+	switch faultCode(err) {
+	case errCodeNotAuthorized, errCodeWildCardNotPermitted, errCodeWildCardNotPermittedEx,
+		ErrCodeConflictInMappingEntry, errCodeSamePortValuesRequired, ErrCodeOnlyPermanentLeasesSupported,
+		errCodeRemoteHostWildcard, errCodeExternalPortWildcard, errCodeNoPortMapsAvailable:
+		return false
+	}
+	return true
+}
+
+// faultCode returns the UPnP error code carried by err, or 0 if err is not an
+// error reported by the router.
+func faultCode(err error) int {
+	var upnpErr *UPnPError
+	var fault *soap.SOAPFaultError
+	if errors.As(err, &upnpErr) {
+		return upnpErr.Code
+	} else if errors.As(err, &fault) {
+		return fault.UPnPError.ErrorCode
+	}
+	return 0
+}
+
+// A UPnPError is an error reported by the router, such as
+// ErrCodeConflictInMappingEntry when a port is mapped by another host. It is
+// returned by the methods that add and remove port mappings.
+type UPnPError struct {
+	Code        int
+	Description string
+}
+
+func (e *UPnPError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// Is reports whether target is a *UPnPError with the same code, so that
+// errors.Is(err, ErrMappingConflict) and the like match any description.
+func (e *UPnPError) Is(target error) bool {
+	t, ok := target.(*UPnPError)
+	return ok && t.Code == e.Code
+}
+
+// Errors reported by the router that callers commonly need to handle. They
+// are matched by code, using errors.Is; the *UPnPError returned by a failed
+// call carries the router's own description.
+var (
+	// ErrMappingConflict means that the port is already mapped to another
+	// host.
+	ErrMappingConflict = &UPnPError{Code: ErrCodeConflictInMappingEntry, Description: "ConflictInMappingEntry"}
+	// ErrNotAuthorized means that the router refused the action, typically
+	// because its UPnP settings are locked down.
+	ErrNotAuthorized = &UPnPError{Code: errCodeNotAuthorized, Description: "Action not authorized"}
+	// ErrNoSuchEntry means that the mapping does not exist.
+	ErrNoSuchEntry = &UPnPError{Code: errCodeNoSuchEntry, Description: "NoSuchEntryInArray"}
+)
+
+// upnpError converts a SOAP fault carrying a UPnP error code into a
+// *UPnPError. Other errors are returned unchanged.
+func upnpError(err error) error {
+	var f *soap.SOAPFaultError
+	if errors.As(err, &f) && f.UPnPError.ErrorCode != 0 {
+		return &UPnPError{
+			Code:        f.UPnPError.ErrorCode,
+			Description: f.UPnPError.ErrorDescription,
+		}
+	}
+	return err
+}
+
+var (
+	// ErrUnsupported is returned when the router does not implement the
+	// service or action needed for an operation.
+	ErrUnsupported = errors.New("operation not supported by router")
+
+	// ErrNoMulticastInterface is returned by Discover when it is given the
+	// WithFailFastNoMulticast option and this host has no interface capable
+	// of sending the multicast search.
+	ErrNoMulticastInterface = errors.New("no up, non-loopback, multicast-capable network interface")
+
+	// ErrNoIPv6FirewallControl is returned when the router does not offer
+	// control of its IPv6 firewall.
+	ErrNoIPv6FirewallControl = errors.New("IPv6 firewall control not supported")
+
+	// ErrNoGateway is returned by Discover and Load when no UPnP-enabled
+	// router could be found.
+	ErrNoGateway = errors.New("no UPnP-enabled gateway found")
+
+	// ErrNoInternalIP is returned when this host's address on the router's
+	// network cannot be determined.
+	ErrNoInternalIP = errors.New("could not determine internal IP")
+
+	// ErrNoExternalIP is returned by ExternalIP and ExternalIPParsed when the
+	// router answers, but does not have a usable external address, as
+	// happens before its WAN link is up. ResolveExternalIP returns it when
+	// no source has one.
+	ErrNoExternalIP = errors.New("router has no external IP address")
+
+	// ErrNoMappingStore is returned by Reconcile when the IGD was not given
+	// a MappingStore.
+	ErrNoMappingStore = errors.New("no mapping store")
+
+	// ErrPortUnreachable is returned by VerifyForward and
+	// VerifyForwardExternal when a mapping exists, but traffic to it does
+	// not arrive.
+	ErrPortUnreachable = errors.New("forwarded port is not reachable")
+
+	// ErrNotAttempted is reported by ForwardAll for the mappings it did not
+	// attempt, because an earlier one failed.
+	ErrNotAttempted = errors.New("not attempted: an earlier mapping failed")
+
+	// ErrWildcardPort is returned when a port is to be forwarded with an
+	// external port of zero, which the specification makes a wildcard
+	// matching every port.
+	ErrWildcardPort = errors.New("external port 0 is a wildcard, and cannot be forwarded")
+
+	// ErrSessionClosed is returned when a mapping is requested through a
+	// Session that has been closed.
+	ErrSessionClosed = errors.New("session closed")
+)
+
+// A PartialForwardError is returned by ForwardAdvanced in BestEffort mode
+// when some, but not all, of the requested protocols were forwarded.
+type PartialForwardError struct {
+	// Succeeded and Failed list the protocols that were and were not
+	// forwarded.
+	Succeeded []string
+	Failed    []string
+	// Err is the first error encountered.
+	Err error
+}
+
+func (e *PartialForwardError) Error() string {
+	return fmt.Sprintf("forwarded %s but not %s: %v", strings.Join(e.Succeeded, ", "), strings.Join(e.Failed, ", "), e.Err)
+}
+
+// Unwrap returns the first error encountered.
+func (e *PartialForwardError) Unwrap() error {
+	return e.Err
+}
+
+// A RollbackError is returned by ForwardAll when a mapping failed, and some
+// of the mappings already created could not be removed again, so that they
+// remain on the router. The results of ForwardAll report which.
+type RollbackError struct {
+	// Err is the error of the mapping that failed.
+	Err error
+	// RollbackErr is the first error encountered removing the others.
+	RollbackErr error
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("%v (rolling back: %v)", e.Err, e.RollbackErr)
+}
+
+// Unwrap returns the error of the mapping that failed.
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// A LeaseFallbackError is returned by ForwardTimeout when the router refused
+// the requested lease and the port was forwarded permanently instead. The
+// mapping exists, but will not expire on its own.
+type LeaseFallbackError struct {
+	// Requested is the lease that the router refused.
+	Requested time.Duration
+}
+
+func (e *LeaseFallbackError) Error() string {
+	return fmt.Sprintf("router refused a lease of %v; forwarded permanently instead", e.Requested)
+}
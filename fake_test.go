@@ -0,0 +1,236 @@
+package upnp
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/soap"
+)
+
+// fakeClient is an in-memory router, for testing without a network. Like a
+// router, it refuses to map a port that is mapped to another host. It is safe
+// for concurrent use.
+type fakeClient struct {
+	mu         sync.Mutex
+	externalIP string
+	mappings   map[mappingID]trackedMapping
+	sc         goupnp.ServiceClient
+	// ipErr, if not nil, is returned by GetExternalIPAddress.
+	ipErr error
+	// entryErr, if not nil, is returned by GetSpecificPortMappingEntry.
+	entryErr error
+	// addErr, if it has an entry for a protocol, is returned by
+	// AddPortMapping for that protocol.
+	addErr map[string]error
+	// delErr, if it has an entry for a port, is returned by
+	// DeletePortMapping for that port.
+	delErr map[uint16]error
+	// permanentErr, if not nil, is returned by AddPortMapping for a mapping
+	// with no lease.
+	permanentErr error
+	// leaseErr, if not nil, is returned by AddPortMapping for a mapping with
+	// a lease.
+	leaseErr error
+	// status, if not empty, is the connection status reported by
+	// GetStatusInfo in place of "Connected".
+	status string
+}
+
+// newFakeIGD returns an IGD backed by a fakeClient, which forwards ports to
+// internalIP.
+func newFakeIGD(internalIP string) (*IGD, *fakeClient) {
+	loc, _ := url.Parse("http://192.168.1.1:5000/rootDesc.xml")
+	fc := &fakeClient{
+		externalIP: "203.0.113.1",
+		mappings:   make(map[mappingID]trackedMapping),
+		sc: goupnp.ServiceClient{
+			SOAPClient: soap.NewSOAPClient(*loc),
+			RootDevice: &goupnp.RootDevice{URLBase: *loc},
+			Location:   loc,
+			Service:    &goupnp.Service{},
+		},
+	}
+	d := newIGD(fc)
+	d.localIP = internalIP
+	return d, fc
+}
+
+func noSuchEntry() error {
+	f := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+	f.UPnPError.ErrorCode = errCodeNoSuchEntry
+	f.UPnPError.ErrorDescription = "NoSuchEntryInArray"
+	return f
+}
+
+func (fc *fakeClient) GetExternalIPAddress() (string, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.ipErr != nil {
+		return "", fc.ipErr
+	}
+	return fc.externalIP, nil
+}
+
+func (fc *fakeClient) AddPortMapping(remoteHost string, extPort uint16, proto string, intPort uint16, client string, enabled bool, desc string, lease uint32) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := fc.addErr[proto]; err != nil {
+		return err
+	} else if lease == 0 && fc.permanentErr != nil {
+		return fc.permanentErr
+	} else if lease != 0 && fc.leaseErr != nil {
+		return fc.leaseErr
+	}
+	if m, ok := fc.mappings[mappingID{remoteHost, extPort, proto}]; ok && m.internalIP != client {
+		f := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+		f.UPnPError.ErrorCode = ErrCodeConflictInMappingEntry
+		f.UPnPError.ErrorDescription = "ConflictInMappingEntry"
+		return f
+	}
+	fc.mappings[mappingID{remoteHost, extPort, proto}] = trackedMapping{internalPort: intPort, internalIP: client, enabled: enabled, desc: desc, lease: lease}
+	return nil
+}
+
+func (fc *fakeClient) GetSpecificPortMappingEntry(remoteHost string, extPort uint16, proto string) (uint16, string, bool, string, uint32, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.entryErr != nil {
+		return 0, "", false, "", 0, fc.entryErr
+	}
+	m, ok := fc.mappings[mappingID{remoteHost, extPort, proto}]
+	if !ok {
+		return 0, "", false, "", 0, noSuchEntry()
+	}
+	return m.internalPort, m.internalIP, m.enabled, m.desc, m.lease, nil
+}
+
+func (fc *fakeClient) GetGenericPortMappingEntry(index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	// a table order that is stable between calls, as on a router
+	ids := make([]mappingID, 0, len(fc.mappings))
+	for id := range fc.mappings {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].externalPort != ids[j].externalPort {
+			return ids[i].externalPort < ids[j].externalPort
+		}
+		return ids[i].protocol < ids[j].protocol
+	})
+	if int(index) < len(ids) {
+		id := ids[index]
+		m := fc.mappings[id]
+		return id.remoteHost, id.externalPort, id.protocol, m.internalPort, m.internalIP, m.enabled, m.desc, m.lease, nil
+	}
+	f := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+	f.UPnPError.ErrorCode = errCodeArrayIndexInvalid
+	f.UPnPError.ErrorDescription = "SpecifiedArrayIndexInvalid"
+	return "", 0, "", 0, "", false, "", 0, f
+}
+
+func (fc *fakeClient) DeletePortMapping(remoteHost string, extPort uint16, proto string) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	id := mappingID{remoteHost, extPort, proto}
+	if _, ok := fc.mappings[id]; !ok {
+		return noSuchEntry()
+	} else if err := fc.delErr[extPort]; err != nil {
+		return err
+	}
+	delete(fc.mappings, id)
+	return nil
+}
+
+func (fc *fakeClient) GetStatusInfo() (string, string, uint32, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.status != "" {
+		return fc.status, "ERROR_NONE", 3600, nil
+	}
+	return "Connected", "ERROR_NONE", 3600, nil
+}
+
+func (fc *fakeClient) GetServiceClient() *goupnp.ServiceClient {
+	return &fc.sc
+}
+
+// fakeClock is a Clock whose time passes only when Advance is called. It is
+// safe for concurrent use.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// A fakeTicker is a Ticker of a fakeClock.
+type fakeTicker struct {
+	clock    *fakeClock
+	interval time.Duration
+	next     time.Time
+	c        chan time.Time
+	stopped  bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, interval: d, next: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, and delivers a tick on each ticker
+// that has come due. Like a time.Ticker, a ticker whose last tick has not
+// been received drops the new one.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if t.stopped || t.next.After(c.now) {
+			continue
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		for !t.next.After(c.now) {
+			t.next = t.next.Add(t.interval)
+		}
+	}
+}
+
+// intervals returns the intervals of the tickers that have not been stopped.
+func (c *fakeClock) intervals() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ds []time.Duration
+	for _, t := range c.tickers {
+		if !t.stopped {
+			ds = append(ds, t.interval)
+		}
+	}
+	return ds
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
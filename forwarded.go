@@ -0,0 +1,64 @@
+package upnp
+
+import "time"
+
+// A ForwardedMapping describes the port mappings installed by ForwardMapping,
+// as the router reports them.
+type ForwardedMapping struct {
+	// Key identifies the mappings, for passing to ClearKey.
+	Key MappingKey
+	// Protocols lists the protocols that were forwarded, in the order they
+	// were mapped.
+	Protocols    []string
+	RemoteHost   string
+	ExternalPort uint16
+	InternalIP   string
+	InternalPort uint16
+	Description  string
+	// Lease is the lifetime that the router granted, which may be shorter
+	// than the one requested, or a fallback lease if the router refused a
+	// permanent mapping; if the protocols were granted different leases, it
+	// is the shortest. It is zero if the mappings are permanent.
+	Lease time.Duration
+	// ExternalIP is the router's external address when the mappings were
+	// installed, or empty if it could not be determined.
+	ExternalIP string
+}
+
+// ForwardMapping creates the port mappings described by spec, like
+// ForwardAdvanced, and reports what was installed. The lease granted is read
+// back from the router where possible, since routers may shorten it without
+// reporting an error. If some protocols were forwarded and others were not,
+// the ForwardedMapping describes those that were, and a *PartialForwardError
+// is returned with it.
+func (d *IGD) ForwardMapping(spec MappingSpec) (ForwardedMapping, error) {
+	key, err := d.ForwardAdvanced(spec)
+	if len(key.protocols) == 0 {
+		return ForwardedMapping{Key: key}, err
+	}
+	fm := ForwardedMapping{
+		Key:          key,
+		Protocols:    key.protocols,
+		RemoteHost:   key.remoteHost,
+		ExternalPort: key.externalPort,
+		Description:  spec.Description,
+	}
+	for i, proto := range key.protocols {
+		id := mappingID{key.remoteHost, key.externalPort, proto}
+		d.mu.Lock()
+		m := d.tracked[id]
+		d.mu.Unlock()
+		fm.InternalIP, fm.InternalPort = m.internalIP, m.internalPort
+		lease := m.lease
+		time.Sleep(time.Millisecond)
+		if _, _, _, _, granted, err := d.client.GetSpecificPortMappingEntry(key.remoteHost, key.externalPort, proto); err == nil {
+			lease = granted
+		}
+		// a zero lease is permanent, so any other is shorter
+		if l := time.Duration(lease) * time.Second; i == 0 || (l != 0 && (fm.Lease == 0 || l < fm.Lease)) {
+			fm.Lease = l
+		}
+	}
+	fm.ExternalIP, _ = d.ExternalIP()
+	return fm, err
+}
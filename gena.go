@@ -0,0 +1,261 @@
+package upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// genaTimeout is the subscription duration requested from the router. The
+// subscription is renewed at half this interval.
+const genaTimeout = 30 * time.Minute
+
+// A subscription is a GENA event subscription to the router's connection
+// service. It receives the router's NOTIFY requests.
+type subscription struct {
+	ctx context.Context
+	// client is the IGD's HTTP client, which sends the requests.
+	client   http.Client
+	url      url.URL
+	callback string
+	events   chan MonitorEvent
+
+	// subscribing is held while a subscription is being made, so that the
+	// router's first notification, which may arrive before its response to
+	// SUBSCRIBE is processed, is checked against the new SID.
+	subscribing sync.Mutex
+
+	mu   sync.Mutex
+	sid  string
+	last map[string]string
+}
+
+// Subscribe asks the router to notify this host of changes to its external
+// IP and connection status, and reports them on the returned channel as
+// ExternalIPChanged and ConnectionStatusChanged events, without polling. A
+// small HTTP server is run on the internal IP to receive the notifications.
+// Each variable is reported when the router first sends it, which is normally
+// straight after subscribing, and again whenever it changes. The subscription
+// is renewed in the background; a MonitorError event is sent if that fails.
+// The subscription is cancelled and the channel closed when ctx is done.
+// The requests to the router are sent like its SOAP actions, so the HTTP
+// client, headers and limits that d was created with apply.
+//
+// ErrUnsupported is returned if the router does not offer events. Routers
+// that do not send them reliably are common; see Monitor for an alternative
+// that polls.
+func (d *IGD) Subscribe(ctx context.Context) (<-chan MonitorEvent, error) {
+	if _, ok := d.client.(*natpmpClient); ok {
+		return nil, ErrUnsupported
+	}
+	srv := d.client.GetServiceClient().Service
+	if !srv.EventSubURL.Ok || srv.EventSubURL.Str == "" {
+		return nil, ErrUnsupported
+	}
+	ip, err := d.getInternalIP()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &subscription{
+		ctx:      ctx,
+		client:   d.client.GetServiceClient().SOAPClient.HTTPClient,
+		url:      srv.EventSubURL.URL,
+		callback: "<http://" + ln.Addr().String() + "/>",
+		events:   make(chan MonitorEvent),
+		last:     make(map[string]string),
+	}
+	server := &http.Server{Handler: sub}
+	go server.Serve(ln)
+	if err := sub.subscribe(); err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	go func() {
+		ticker := d.clock.NewTicker(genaTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				sub.unsubscribe()
+				// let any notification in progress return before closing
+				// the channel it sends on
+				server.Shutdown(context.Background())
+				close(sub.events)
+				return
+			case <-ticker.C():
+			}
+			if err := sub.renew(); err != nil {
+				// the router may have forgotten the subscription, e.g.
+				// after a reboot; start a new one
+				if err := sub.subscribe(); err != nil {
+					sub.send(MonitorEvent{Type: MonitorError, Err: err})
+				}
+			}
+		}
+	}()
+	return sub.events, nil
+}
+
+// request sends a GENA request with the given method and headers, returning
+// the response's SID.
+func (s *subscription) request(method string, header http.Header) (string, error) {
+	ctx := s.ctx
+	if method == "UNSUBSCRIBE" {
+		// ctx is already done
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+	}
+	req, err := http.NewRequest(method, s.url.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = header
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", method, s.url.String(), resp.Status)
+	}
+	return resp.Header.Get("SID"), nil
+}
+
+// subscribe starts a new subscription, replacing any existing one.
+func (s *subscription) subscribe() error {
+	s.subscribing.Lock()
+	defer s.subscribing.Unlock()
+	sid, err := s.request("SUBSCRIBE", http.Header{
+		"CALLBACK": {s.callback},
+		"NT":       {"upnp:event"},
+		"TIMEOUT":  {"Second-" + strconv.Itoa(int(genaTimeout/time.Second))},
+	})
+	if err != nil {
+		return err
+	} else if sid == "" {
+		return errors.New("router did not return a subscription ID")
+	}
+	s.mu.Lock()
+	s.sid = sid
+	s.mu.Unlock()
+	return nil
+}
+
+// renew extends the current subscription.
+func (s *subscription) renew() error {
+	s.mu.Lock()
+	sid := s.sid
+	s.mu.Unlock()
+	_, err := s.request("SUBSCRIBE", http.Header{
+		"SID":     {sid},
+		"TIMEOUT": {"Second-" + strconv.Itoa(int(genaTimeout/time.Second))},
+	})
+	return err
+}
+
+// unsubscribe cancels the current subscription.
+func (s *subscription) unsubscribe() {
+	s.mu.Lock()
+	sid := s.sid
+	s.mu.Unlock()
+	s.request("UNSUBSCRIBE", http.Header{"SID": {sid}})
+}
+
+// send sends e on the events channel, unless ctx is done.
+func (s *subscription) send(e MonitorEvent) {
+	select {
+	case s.events <- e:
+	case <-s.ctx.Done():
+	}
+}
+
+// ServeHTTP handles a NOTIFY request from the router.
+func (s *subscription) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.subscribing.Lock()
+	s.subscribing.Unlock()
+	s.mu.Lock()
+	sid := s.sid
+	s.mu.Unlock()
+	if r.Method != "NOTIFY" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if r.Header.Get("SID") != sid {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	vars, err := decodePropertySet(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	for _, v := range vars {
+		var e MonitorEvent
+		switch v.name {
+		case "ExternalIPAddress":
+			e = MonitorEvent{Type: ExternalIPChanged, ExternalIP: v.value}
+		case "ConnectionStatus":
+			e = MonitorEvent{Type: ConnectionStatusChanged, Status: v.value}
+		default:
+			continue
+		}
+		s.mu.Lock()
+		prev, seen := s.last[v.name]
+		s.last[v.name] = v.value
+		s.mu.Unlock()
+		if !seen || prev != v.value {
+			s.send(e)
+		}
+	}
+}
+
+// A stateVar is a state variable reported in an event.
+type stateVar struct {
+	name, value string
+}
+
+// decodePropertySet returns the variables in a GENA property set, in order.
+func decodePropertySet(body io.Reader) ([]stateVar, error) {
+	var vars []stateVar
+	dec := xml.NewDecoder(body)
+	// variables are the elements at depth 3: propertyset, property, variable
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return vars, nil
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 3 {
+				vars = append(vars, stateVar{name: t.Name.Local})
+			}
+		case xml.CharData:
+			if depth == 3 {
+				vars[len(vars)-1].value += strings.TrimSpace(string(t))
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
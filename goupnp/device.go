@@ -3,6 +3,7 @@
 package goupnp
 
 import (
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -150,11 +151,17 @@ func (srv *Service) String() string {
 // RequestSCDP requests the SCPD (soap actions and state variables description)
 // for the service.
 func (srv *Service) RequestSCDP() (*scpd.SCPD, error) {
+	return srv.RequestSCDPCtx(context.Background())
+}
+
+// RequestSCDPCtx is the same as RequestSCDP, but uses the HTTP client carried
+// by ctx, if any, and aborts when ctx is done.
+func (srv *Service) RequestSCDPCtx(ctx context.Context) (*scpd.SCPD, error) {
 	if !srv.SCPDURL.Ok {
 		return nil, errors.New("bad/missing SCPD URL, or no URLBase has been set")
 	}
 	s := new(scpd.SCPD)
-	if err := requestXml(srv.SCPDURL.URL.String(), scpd.SCPDXMLNamespace, s); err != nil {
+	if err := requestXml(ctx, srv.SCPDURL.URL.String(), scpd.SCPDXMLNamespace, s); err != nil {
 		return nil, err
 	}
 	return s, nil
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"gitlab.com/NebulousLabs/go-upnp/goupnp/httpu"
@@ -64,26 +65,102 @@ func DiscoverDevices(searchTarget string) ([]MaybeRootDevice, error) {
 // while attempting to send the query. An error or RootDevice is returned for
 // each discovered RootDevice.
 func DiscoverDevicesCtx(ctx context.Context, searchTarget string) ([]MaybeRootDevice, error) {
-	httpu, err := httpu.NewHTTPUClient()
+	return DiscoverDevicesWaitCtx(ctx, searchTarget, 2)
+}
+
+// DiscoverDevicesWaitCtx is the same as DiscoverDevicesCtx, but waits
+// maxWaitSeconds, which must be at least 1, for devices to respond.
+func DiscoverDevicesWaitCtx(ctx context.Context, searchTarget string, maxWaitSeconds int) ([]MaybeRootDevice, error) {
+	return DiscoverDevicesOptsCtx(ctx, searchTarget, maxWaitSeconds, SearchOptions{})
+}
+
+// SearchOptions control the socket used for an SSDP search. The zero value
+// searches from an ephemeral port with the operating system's default
+// multicast TTL, and does not listen for announcements.
+type SearchOptions struct {
+	// LocalAddr is the "ip:port" address to send the search from, for
+	// firewalls that only admit responses to a known port. If empty,
+	// ":0" is used.
+	LocalAddr string
+	// MulticastTTL, if not zero, is the time-to-live of the search, for
+	// networks where the router is more than one hop away.
+	MulticastTTL int
+	// ListenNotify also collects the ssdp:alive announcements that devices
+	// send unprompted while the search runs, for devices that do not answer
+	// searches, or whose answers are filtered. Announcements are only
+	// received if nothing else holds the SSDP port exclusively, so the
+	// search is performed even if listening fails.
+	ListenNotify bool
+}
+
+// DiscoverDevicesOptsCtx is the same as DiscoverDevicesWaitCtx, but searches
+// as described by opts.
+func DiscoverDevicesOptsCtx(ctx context.Context, searchTarget string, maxWaitSeconds int, opts SearchOptions) ([]MaybeRootDevice, error) {
+	laddr := opts.LocalAddr
+	if laddr == "" {
+		laddr = ":0"
+	}
+	httpu, err := httpu.NewHTTPUClientAddr(laddr)
 	if err != nil {
 		return nil, err
 	}
 	defer httpu.Close()
-	responses, err := ssdp.SSDPRawSearchCtx(ctx, httpu, string(searchTarget), 2, 3)
+	if opts.MulticastTTL != 0 {
+		if err := httpu.SetMulticastTTL(opts.MulticastTTL); err != nil {
+			return nil, err
+		}
+	}
+
+	var locations []string
+	seen := make(map[string]bool)
+	add := func(usn, location string) {
+		if location == "" {
+			return
+		} else if usn == "" {
+			usn = location
+		}
+		if !seen[usn] {
+			seen[usn] = true
+			locations = append(locations, location)
+		}
+	}
+	// announcements are best effort; the search is made whether or not the
+	// listener could join the group, and the listener calls add from one
+	// goroutine at a time, never after it returns
+	stopListening := func() {}
+	if opts.ListenNotify {
+		listenCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ssdp.ListenNotify(listenCtx, searchTarget, func(r *http.Request) {
+				add(r.Header.Get("USN"), r.Header.Get("LOCATION"))
+			})
+		}()
+		stopListening = func() {
+			cancel()
+			<-done
+		}
+	}
+	responses, err := ssdp.SSDPRawSearchCtx(ctx, httpu, string(searchTarget), maxWaitSeconds, 3)
+	stopListening()
 	if err != nil {
 		return nil, err
 	}
+	for _, response := range responses {
+		add(response.Header.Get("USN"), response.Header.Get("LOCATION"))
+	}
 
-	results := make([]MaybeRootDevice, len(responses))
-	for i, response := range responses {
+	results := make([]MaybeRootDevice, len(locations))
+	for i, location := range locations {
 		maybe := &results[i]
-		loc, err := response.Location()
+		loc, err := url.Parse(location)
 		if err != nil {
 			maybe.Err = ContextError{"unexpected bad location from search", err}
 			continue
 		}
 		maybe.Location = loc
-		if root, err := DeviceByURL(loc); err != nil {
+		if root, err := DeviceByURLCtx(ctx, loc); err != nil {
 			maybe.Err = err
 		} else {
 			maybe.Root = root
@@ -93,10 +170,126 @@ func DiscoverDevicesCtx(ctx context.Context, searchTarget string) ([]MaybeRootDe
 	return results, nil
 }
 
+// DiscoverDevicesFunc performs the same search as DiscoverDevicesOptsCtx, but
+// probes each responding device as soon as its response arrives, and passes
+// the result to handler. Calls to handler are serialized, and all of them
+// complete before DiscoverDevicesFunc returns.
+func DiscoverDevicesFunc(ctx context.Context, searchTarget string, maxWaitSeconds int, opts SearchOptions, handler func(MaybeRootDevice)) error {
+	return probeDevices(ctx, searchTarget, opts, func(httpu *httpu.HTTPUClient, fn func(*http.Response)) error {
+		return ssdp.SSDPRawSearchFunc(ctx, httpu, searchTarget, maxWaitSeconds, 3, fn)
+	}, handler)
+}
+
+// DiscoverDevicesUnicastFunc performs the same search as DiscoverDevicesFunc,
+// but sends the search request directly to host, which is an "ip:port"
+// address, instead of multicasting it.
+func DiscoverDevicesUnicastFunc(ctx context.Context, host string, searchTarget string, maxWaitSeconds int, opts SearchOptions, handler func(MaybeRootDevice)) error {
+	return probeDevices(ctx, searchTarget, opts, func(httpu *httpu.HTTPUClient, fn func(*http.Response)) error {
+		return ssdp.SSDPUnicastSearchFunc(ctx, httpu, host, searchTarget, maxWaitSeconds, 3, fn)
+	}, handler)
+}
+
+// DiscoverDevicesAddrFunc performs the same search as DiscoverDevicesFunc,
+// but sends the search request from the local address laddr, which is an
+// "ip:port" address, in place of opts.LocalAddr. Using the address of a
+// network interface restricts the search to the network that interface is
+// attached to.
+func DiscoverDevicesAddrFunc(ctx context.Context, laddr string, searchTarget string, maxWaitSeconds int, opts SearchOptions, handler func(MaybeRootDevice)) error {
+	opts.LocalAddr = laddr
+	return probeDevices(ctx, searchTarget, opts, func(httpu *httpu.HTTPUClient, fn func(*http.Response)) error {
+		return ssdp.SSDPRawSearchFunc(ctx, httpu, searchTarget, maxWaitSeconds, 3, fn)
+	}, handler)
+}
+
+// probeDevices runs search from a socket set up as described by opts,
+// probing the device named by each response or announcement in its own
+// goroutine, and passes the results to handler one at a time. A device that
+// answers more than once is probed once. The probes are aborted if ctx is
+// done.
+func probeDevices(ctx context.Context, searchTarget string, opts SearchOptions, search func(*httpu.HTTPUClient, func(*http.Response)) error, handler func(MaybeRootDevice)) error {
+	laddr := opts.LocalAddr
+	if laddr == "" {
+		laddr = ":0"
+	}
+	httpu, err := httpu.NewHTTPUClientAddr(laddr)
+	if err != nil {
+		return err
+	}
+	defer httpu.Close()
+	if opts.MulticastTTL != 0 {
+		if err := httpu.SetMulticastTTL(opts.MulticastTTL); err != nil {
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex // guards seen and calls to handler
+	seen := make(map[string]bool)
+	defer wg.Wait()
+	probe := func(usn, location string) {
+		if location == "" {
+			return
+		} else if usn == "" {
+			usn = location
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if seen[usn] {
+			return
+		}
+		seen[usn] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var maybe MaybeRootDevice
+			if loc, err := url.Parse(location); err != nil {
+				maybe.Err = ContextError{"unexpected bad location from search", err}
+			} else {
+				maybe.Location = loc
+				if root, err := DeviceByURLCtx(ctx, loc); err != nil {
+					maybe.Err = err
+				} else {
+					maybe.Root = root
+				}
+			}
+			mu.Lock()
+			handler(maybe)
+			mu.Unlock()
+		}()
+	}
+	// as in DiscoverDevicesOptsCtx, announcements are best effort, and the
+	// listener is stopped before the probes are waited for
+	stopListening := func() {}
+	if opts.ListenNotify {
+		listenCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ssdp.ListenNotify(listenCtx, searchTarget, func(r *http.Request) {
+				probe(r.Header.Get("USN"), r.Header.Get("LOCATION"))
+			})
+		}()
+		stopListening = func() {
+			cancel()
+			<-done
+		}
+	}
+	defer stopListening()
+	return search(httpu, func(response *http.Response) {
+		probe(response.Header.Get("USN"), response.Header.Get("LOCATION"))
+	})
+}
+
 func DeviceByURL(loc *url.URL) (*RootDevice, error) {
+	return DeviceByURLCtx(context.Background(), loc)
+}
+
+// DeviceByURLCtx is the same as DeviceByURL, but aborts the request when ctx
+// is done.
+func DeviceByURLCtx(ctx context.Context, loc *url.URL) (*RootDevice, error) {
 	locStr := loc.String()
 	root := new(RootDevice)
-	if err := requestXml(locStr, DeviceXMLNamespace, root); err != nil {
+	if err := requestXml(ctx, locStr, DeviceXMLNamespace, root); err != nil {
 		return nil, ContextError{fmt.Sprintf("error requesting root device details from %q", locStr), err}
 	}
 	var urlBaseStr string
@@ -113,12 +306,31 @@ func DeviceByURL(loc *url.URL) (*RootDevice, error) {
 	return root, nil
 }
 
-func requestXml(url string, defaultSpace string, doc interface{}) error {
-	timeout := time.Duration(3 * time.Second)
-	client := http.Client{
-		Timeout: timeout,
+type httpClientKey struct{}
+
+// WithHTTPClient returns a copy of ctx that makes the functions of this
+// package that are given it fetch device descriptions with client, rather
+// than with a default client that times out after 3 seconds.
+func WithHTTPClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, httpClientKey{}, client)
+}
+
+// httpClient returns the client set on ctx by WithHTTPClient, or the default
+// client.
+func httpClient(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(httpClientKey{}).(*http.Client); ok {
+		return client
+	}
+	return &http.Client{Timeout: 3 * time.Second}
+}
+
+func requestXml(ctx context.Context, url string, defaultSpace string, doc interface{}) error {
+	client := httpClient(ctx)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
 	}
-	resp, err := client.Get(url)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"sync"
 	"time"
+
+	"golang.org/x/net/ipv4"
 )
 
 // HTTPUClient is a client for dealing with HTTPU (HTTP over UDP). Its typical
@@ -20,13 +22,28 @@ type HTTPUClient struct {
 // NewHTTPUClient creates a new HTTPUClient, opening up a new UDP socket for the
 // purpose.
 func NewHTTPUClient() (*HTTPUClient, error) {
-	conn, err := net.ListenPacket("udp", ":0")
+	return NewHTTPUClientAddr(":0")
+}
+
+// NewHTTPUClientAddr creates a new HTTPUClient whose UDP socket is bound to
+// the local address addr, which is an "ip:port" address. Binding to the
+// address of an interface sends requests from that interface.
+func NewHTTPUClientAddr(addr string) (*HTTPUClient, error) {
+	conn, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		return nil, err
 	}
 	return &HTTPUClient{conn: conn}, nil
 }
 
+// SetMulticastTTL sets the time-to-live of the multicast requests sent by the
+// client, which is otherwise the operating system's default, typically 1.
+func (httpu *HTTPUClient) SetMulticastTTL(ttl int) error {
+	httpu.connLock.Lock()
+	defer httpu.connLock.Unlock()
+	return ipv4.NewPacketConn(httpu.conn).SetMulticastTTL(ttl)
+}
+
 // Close shuts down the client. The client will no longer be useful following
 // this.
 func (httpu *HTTPUClient) Close() error {
@@ -43,6 +60,17 @@ func (httpu *HTTPUClient) Close() error {
 // Note that at present only one concurrent connection will happen per
 // HTTPUClient.
 func (httpu *HTTPUClient) Do(req *http.Request, timeout time.Duration, numSends int) ([]*http.Response, error) {
+	var responses []*http.Response
+	err := httpu.DoFunc(req, timeout, numSends, func(response *http.Response) {
+		responses = append(responses, response)
+	})
+	return responses, err
+}
+
+// DoFunc performs a request like Do, but passes each response to handler as
+// soon as it is received instead of collecting them. handler is called from
+// the goroutine that called DoFunc.
+func (httpu *HTTPUClient) DoFunc(req *http.Request, timeout time.Duration, numSends int, handler func(*http.Response)) error {
 	httpu.connLock.Lock()
 	defer httpu.connLock.Unlock()
 
@@ -55,21 +83,21 @@ func (httpu *HTTPUClient) Do(req *http.Request, timeout time.Duration, numSends
 		method = "GET"
 	}
 	if _, err := fmt.Fprintf(&requestBuf, "%s %s HTTP/1.1\r\n", method, req.URL.RequestURI()); err != nil {
-		return nil, err
+		return err
 	}
 	if err := req.Header.Write(&requestBuf); err != nil {
-		return nil, err
+		return err
 	}
 	if _, err := requestBuf.Write([]byte{'\r', '\n'}); err != nil {
-		return nil, err
+		return err
 	}
 
 	destAddr, err := net.ResolveUDPAddr("udp", req.Host)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if err = httpu.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Spawn cancellation goroutine
@@ -86,16 +114,15 @@ func (httpu *HTTPUClient) Do(req *http.Request, timeout time.Duration, numSends
 	// Send request.
 	for i := 0; i < numSends; i++ {
 		if n, err := httpu.conn.WriteTo(requestBuf.Bytes(), destAddr); err != nil {
-			return nil, err
+			return err
 		} else if n < len(requestBuf.Bytes()) {
-			return nil, fmt.Errorf("httpu: wrote %d bytes rather than full %d in request",
+			return fmt.Errorf("httpu: wrote %d bytes rather than full %d in request",
 				n, len(requestBuf.Bytes()))
 		}
 		time.Sleep(5 * time.Millisecond)
 	}
 
 	// Await responses until timeout.
-	var responses []*http.Response
 	responseBytes := make([]byte, 2048)
 	for {
 		// 2048 bytes should be sufficient for most networks.
@@ -111,7 +138,7 @@ func (httpu *HTTPUClient) Do(req *http.Request, timeout time.Duration, numSends
 					continue
 				}
 			}
-			return nil, err
+			return err
 		}
 
 		// Parse response.
@@ -120,7 +147,7 @@ func (httpu *HTTPUClient) Do(req *http.Request, timeout time.Duration, numSends
 			continue
 		}
 
-		responses = append(responses, response)
+		handler(response)
 	}
-	return responses, err
+	return nil
 }
@@ -29,8 +29,20 @@ func NewServiceClients(searchTarget string) (clients []ServiceClient, errors []e
 // report any error with the discovery process (blocking any device/service
 // discovery), errors reports errors on a per-root-device basis.
 func NewServiceClientsCtx(ctx context.Context, searchTarget string) (clients []ServiceClient, errors []error, err error) {
+	return NewServiceClientsWaitCtx(ctx, searchTarget, 2)
+}
+
+// NewServiceClientsWaitCtx is the same as NewServiceClientsCtx, but waits
+// maxWaitSeconds, which must be at least 1, for devices to respond.
+func NewServiceClientsWaitCtx(ctx context.Context, searchTarget string, maxWaitSeconds int) (clients []ServiceClient, errors []error, err error) {
+	return NewServiceClientsOptsCtx(ctx, searchTarget, maxWaitSeconds, SearchOptions{})
+}
+
+// NewServiceClientsOptsCtx is the same as NewServiceClientsWaitCtx, but
+// searches as described by opts.
+func NewServiceClientsOptsCtx(ctx context.Context, searchTarget string, maxWaitSeconds int, opts SearchOptions) (clients []ServiceClient, errors []error, err error) {
 	var maybeRootDevices []MaybeRootDevice
-	if maybeRootDevices, err = DiscoverDevicesCtx(ctx, searchTarget); err != nil {
+	if maybeRootDevices, err = DiscoverDevicesOptsCtx(ctx, searchTarget, maxWaitSeconds, opts); err != nil {
 		return
 	}
 
@@ -56,7 +68,13 @@ func NewServiceClientsCtx(ctx context.Context, searchTarget string) (clients []S
 // NewServiceClientsByURL creates client(s) for the given service URN, for a
 // root device at the given URL.
 func NewServiceClientsByURL(loc *url.URL, searchTarget string) ([]ServiceClient, error) {
-	rootDevice, err := DeviceByURL(loc)
+	return NewServiceClientsByURLCtx(context.Background(), loc, searchTarget)
+}
+
+// NewServiceClientsByURLCtx is the same as NewServiceClientsByURL, but aborts
+// the request for the device description when ctx is done.
+func NewServiceClientsByURLCtx(ctx context.Context, loc *url.URL, searchTarget string) ([]ServiceClient, error) {
+	rootDevice, err := DeviceByURLCtx(ctx, loc)
 	if err != nil {
 		return nil, err
 	}
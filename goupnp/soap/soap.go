@@ -4,12 +4,16 @@ package soap
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"reflect"
+	"strings"
+	"time"
 )
 
 const (
@@ -21,6 +25,39 @@ const (
 type SOAPClient struct {
 	EndpointURL url.URL
 	HTTPClient  http.Client
+	// Trace, if not nil, is called with a record of each action performed,
+	// after it completes.
+	Trace func(ActionTrace)
+
+	// ctx, if not nil, is the context of the requests made by PerformAction.
+	ctx context.Context
+}
+
+// An ActionTrace records a SOAP action performed by a SOAPClient.
+type ActionTrace struct {
+	Namespace string
+	Action    string
+	// Args are the arguments of the request, in order, as name-value pairs.
+	Args [][2]string
+	// Response is the body of the response, if one was received.
+	Response []byte
+	// Duration is how long the action took.
+	Duration time.Duration
+	// Err is the error returned by the action, such as a *SOAPFaultError.
+	Err error
+}
+
+// String formats t on one line, e.g. for logging.
+func (t ActionTrace) String() string {
+	args := make([]string, len(t.Args))
+	for i, arg := range t.Args {
+		args[i] = arg[0] + "=" + arg[1]
+	}
+	s := fmt.Sprintf("%s(%s) %v", t.Action, strings.Join(args, ", "), t.Duration.Round(time.Millisecond))
+	if t.Err != nil {
+		s += ": " + t.Err.Error()
+	}
+	return s
 }
 
 func NewSOAPClient(endpointURL url.URL) *SOAPClient {
@@ -33,12 +70,72 @@ func NewSOAPClient(endpointURL url.URL) *SOAPClient {
 // inAction and outAction must both be pointers to structs with string fields
 // only.
 func (client *SOAPClient) PerformAction(actionNamespace, actionName string, inAction interface{}, outAction interface{}) error {
+	ctx := client.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return client.PerformActionCtx(ctx, actionNamespace, actionName, inAction, outAction)
+}
+
+// WithContext returns a copy of client whose PerformAction aborts the
+// request when ctx is done, so that the generated service clients, which
+// call PerformAction, can be bound to a context.
+func (client *SOAPClient) WithContext(ctx context.Context) *SOAPClient {
+	c := *client
+	c.ctx = ctx
+	return &c
+}
+
+// PerformActionCtx is the same as PerformAction, but aborts the request when
+// ctx is done.
+func (client *SOAPClient) PerformActionCtx(ctx context.Context, actionNamespace, actionName string, inAction interface{}, outAction interface{}) error {
+	if client.Trace == nil {
+		return client.performAction(ctx, actionNamespace, actionName, inAction, outAction, nil)
+	}
+	trace := ActionTrace{
+		Namespace: actionNamespace,
+		Action:    actionName,
+		Args:      ActionArgs(inAction),
+	}
+	start := time.Now()
+	err := client.performAction(ctx, actionNamespace, actionName, inAction, outAction, &trace.Response)
+	trace.Duration = time.Since(start)
+	trace.Err = err
+	client.Trace(trace)
+	return err
+}
+
+// ActionArgs returns the arguments in inAction, a request of the kind passed
+// to PerformAction, as name-value pairs.
+func ActionArgs(inAction interface{}) [][2]string {
+	if inAction == nil {
+		return nil
+	}
+	in := reflect.Indirect(reflect.ValueOf(inAction))
+	if in.Kind() != reflect.Struct {
+		return nil
+	}
+	var args [][2]string
+	for i := 0; i < in.NumField(); i++ {
+		field := in.Type().Field(i)
+		name := field.Name
+		if nameOverride := field.Tag.Get("soap"); nameOverride != "" {
+			name = nameOverride
+		}
+		args = append(args, [2]string{name, fmt.Sprint(in.Field(i).Interface())})
+	}
+	return args
+}
+
+// performAction performs the action. If body is not nil, the response body is
+// stored in it.
+func (client *SOAPClient) performAction(ctx context.Context, actionNamespace, actionName string, inAction interface{}, outAction interface{}, body *[]byte) error {
 	requestBytes, err := encodeRequestAction(actionNamespace, actionName, inAction)
 	if err != nil {
 		return err
 	}
 
-	response, err := client.HTTPClient.Do(&http.Request{
+	req := &http.Request{
 		Method: "POST",
 		URL:    &client.EndpointURL,
 		Header: http.Header{
@@ -48,18 +145,35 @@ func (client *SOAPClient) PerformAction(actionNamespace, actionName string, inAc
 		Body: ioutil.NopCloser(bytes.NewBuffer(requestBytes)),
 		// Set ContentLength to avoid chunked encoding - some servers might not support it.
 		ContentLength: int64(len(requestBytes)),
-	})
+	}
+	httpClient := &client.HTTPClient
+	if _, ok := ctx.Deadline(); ok && httpClient.Timeout > 0 {
+		// the caller's deadline replaces the client's timeout
+		c := client.HTTPClient
+		c.Timeout = 0
+		httpClient = &c
+	}
+	response, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return fmt.Errorf("goupnp: error performing SOAP HTTP request: %v", err)
+		return fmt.Errorf("goupnp: error performing SOAP HTTP request: %w", err)
 	}
 	defer response.Body.Close()
 	if response.StatusCode != 200 {
 		resp, _ := ioutil.ReadAll(response.Body)
+		if body != nil {
+			*body = resp
+		}
 		return fmt.Errorf("goupnp: SOAP request got HTTP %s: %s", response.Status, resp)
 	}
 
+	var r io.Reader = response.Body
+	if body != nil {
+		buf := new(bytes.Buffer)
+		defer func() { *body = buf.Bytes() }()
+		r = io.TeeReader(r, buf)
+	}
 	responseEnv := newSOAPEnvelope()
-	decoder := xml.NewDecoder(response.Body)
+	decoder := xml.NewDecoder(r)
 	if err := decoder.Decode(responseEnv); err != nil {
 		return fmt.Errorf("goupnp: error decoding response body: %v", err)
 	}
@@ -151,6 +265,38 @@ type SOAPFaultError struct {
 	FaultCode   string `xml:"faultcode"`
 	FaultString string `xml:"faultstring"`
 	Detail      string `xml:"detail"`
+	// UPnPError is the error reported in the detail element by UPnP
+	// devices. Its ErrorCode is zero if the fault did not carry one.
+	UPnPError UPnPError `xml:"-"`
+}
+
+// UPnPError is the cause of a failed action, as reported by a UPnP device in
+// the detail of a SOAP fault.
+type UPnPError struct {
+	ErrorCode        int    `xml:"errorCode"`
+	ErrorDescription string `xml:"errorDescription"`
+}
+
+// UnmarshalXML decodes a SOAP fault, parsing the UPnPError in its detail.
+func (err *SOAPFaultError) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var fault struct {
+		FaultCode   string `xml:"faultcode"`
+		FaultString string `xml:"faultstring"`
+		Detail      struct {
+			Data      string    `xml:",chardata"`
+			UPnPError UPnPError `xml:"UPnPError"`
+		} `xml:"detail"`
+	}
+	if err := d.DecodeElement(&fault, &start); err != nil {
+		return err
+	}
+	*err = SOAPFaultError{
+		FaultCode:   fault.FaultCode,
+		FaultString: fault.FaultString,
+		Detail:      fault.Detail.Data,
+		UPnPError:   fault.Detail.UPnPError,
+	}
+	return nil
 }
 
 func (err *SOAPFaultError) Error() string {
@@ -3,9 +3,11 @@ package ssdp
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"gitlab.com/NebulousLabs/go-upnp/goupnp/httpu"
@@ -13,6 +15,7 @@ import (
 
 const (
 	ssdpDiscover   = `"ssdp:discover"`
+	ssdpAll        = `ssdp:all`
 	ntsAlive       = `ssdp:alive`
 	ntsByebye      = `ssdp:byebye`
 	ntsUpdate      = `ssdp:update`
@@ -35,40 +38,63 @@ func SSDPRawSearch(httpu *httpu.HTTPUClient, searchTarget string, maxWaitSeconds
 // reasonable value for this. numSends is the number of requests to send - 3 is
 // a reasonable value for this.
 func SSDPRawSearchCtx(ctx context.Context, httpu *httpu.HTTPUClient, searchTarget string, maxWaitSeconds int, numSends int) ([]*http.Response, error) {
+	var responses []*http.Response
+	err := SSDPRawSearchFunc(ctx, httpu, searchTarget, maxWaitSeconds, numSends, func(response *http.Response) {
+		responses = append(responses, response)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return responses, nil
+}
+
+// SSDPRawSearchFunc performs the same search as SSDPRawSearchCtx, but passes
+// each unique response to handler as soon as it arrives.
+func SSDPRawSearchFunc(ctx context.Context, httpu *httpu.HTTPUClient, searchTarget string, maxWaitSeconds int, numSends int, handler func(*http.Response)) error {
+	return rawSearch(ctx, httpu, ssdpUDP4Addr, searchTarget, maxWaitSeconds, numSends, handler)
+}
+
+// SSDPUnicastSearchFunc performs the same search as SSDPRawSearchFunc, but
+// sends it directly to host, which is an "ip:port" address, rather than to the
+// SSDP multicast group. This reaches devices on networks that filter
+// multicast traffic.
+func SSDPUnicastSearchFunc(ctx context.Context, httpu *httpu.HTTPUClient, host string, searchTarget string, maxWaitSeconds int, numSends int, handler func(*http.Response)) error {
+	return rawSearch(ctx, httpu, host, searchTarget, maxWaitSeconds, numSends, handler)
+}
+
+// rawSearch sends an M-SEARCH request to addr, and passes each unique valid
+// response to handler. Responses must name searchTarget as their ST, unless
+// it is "ssdp:all", to which devices respond with their own types.
+func rawSearch(ctx context.Context, httpu *httpu.HTTPUClient, addr string, searchTarget string, maxWaitSeconds int, numSends int, handler func(*http.Response)) error {
 	if maxWaitSeconds < 1 {
-		return nil, errors.New("ssdp: maxWaitSeconds must be >= 1")
+		return errors.New("ssdp: maxWaitSeconds must be >= 1")
 	}
 
 	seenUsns := make(map[string]bool)
-	var responses []*http.Response
 	req := (&http.Request{
 		Method: methodSearch,
 		// TODO: Support both IPv4 and IPv6.
-		Host: ssdpUDP4Addr,
+		Host: addr,
 		URL:  &url.URL{Opaque: "*"},
 		Header: http.Header{
 			// Putting headers in here avoids them being title-cased.
 			// (The UPnP discovery protocol uses case-sensitive headers)
-			"HOST": []string{ssdpUDP4Addr},
+			"HOST": []string{addr},
 			"MX":   []string{strconv.FormatInt(int64(maxWaitSeconds), 10)},
 			"MAN":  []string{ssdpDiscover},
 			"ST":   []string{searchTarget},
 		},
 	}).WithContext(ctx)
-	allResponses, err := httpu.Do(req, time.Duration(maxWaitSeconds)*time.Second+100*time.Millisecond, numSends)
-	if err != nil {
-		return nil, err
-	}
-	for _, response := range allResponses {
+	return httpu.DoFunc(req, time.Duration(maxWaitSeconds)*time.Second+100*time.Millisecond, numSends, func(response *http.Response) {
 		if response.StatusCode != 200 {
-			continue
+			return
 		}
-		if st := response.Header.Get("ST"); st != searchTarget {
-			continue
+		if st := response.Header.Get("ST"); st != searchTarget && searchTarget != ssdpAll {
+			return
 		}
 		location, err := response.Location()
 		if err != nil {
-			continue
+			return
 		}
 		usn := response.Header.Get("USN")
 		if usn == "" {
@@ -76,9 +102,50 @@ func SSDPRawSearchCtx(ctx context.Context, httpu *httpu.HTTPUClient, searchTarge
 		}
 		if _, alreadySeen := seenUsns[usn]; !alreadySeen {
 			seenUsns[usn] = true
-			responses = append(responses, response)
+			handler(response)
 		}
+	})
+}
+
+// ListenNotify listens on the SSDP multicast group for the ssdp:alive
+// announcements that devices send unprompted, and passes each one whose NT
+// is searchTarget, or every one if searchTarget is "ssdp:all", to handler,
+// until ctx is done. Calls to handler are serialized, and none are made
+// after ListenNotify returns. It returns nil once ctx is done, or the error
+// that prevented listening.
+func ListenNotify(ctx context.Context, searchTarget string, handler func(*http.Request)) error {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpUDP4Addr)
+	if err != nil {
+		return err
 	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
 
-	return responses, nil
+	var mu sync.Mutex
+	closed := false
+	err = httpu.Serve(conn, httpu.HandlerFunc(func(r *http.Request) {
+		if r.Method != methodNotify || r.Header.Get("NTS") != ntsAlive {
+			return
+		} else if nt := r.Header.Get("NT"); nt != searchTarget && searchTarget != ssdpAll {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !closed {
+			handler(r)
+		}
+	}))
+	mu.Lock()
+	closed = true
+	mu.Unlock()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,123 @@
+package upnp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// hairpinLease is the lease requested for the temporary mapping used by
+// HairpinSupported, so that it expires even if it is never cleared.
+const hairpinLease = time.Minute
+
+// HairpinSupported reports whether the router supports hairpinning (also
+// called NAT loopback), i.e. whether this host can reach itself at the
+// router's external address. It forwards a temporary TCP port to a local
+// listener, dials the external IP on that port, and checks that the
+// connection arrives at the listener. The mapping is cleared before
+// returning. If the connection attempt fails, HairpinSupported returns false;
+// a cancelled ctx is reported as an error. The listener waits until ctx's
+// deadline, or for verifyTimeout if it has none, and is closed as soon as ctx
+// is done.
+func (d *IGD) HairpinSupported(ctx context.Context) (bool, error) {
+	extIP, err := d.ExternalIPCtx(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return false, err
+	}
+	defer l.Close()
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(verifyTimeout)
+	}
+	l.(*net.TCPListener).SetDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-done:
+		}
+	}()
+
+	key, err := d.forwardAdvanced(ctx, MappingSpec{
+		ExternalPort: port,
+		TCP:          ProtocolEnabled,
+		Lease:        hairpinLease,
+		Description:  "upnp hairpin probe",
+	})
+	defer d.ClearKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	// The listener reports whether it received the token sent by the dialer,
+	// which distinguishes our own connection from any other.
+	token := fastrand.Bytes(16)
+	received := make(chan bool, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				received <- false
+				return
+			}
+			conn.SetDeadline(deadline)
+			buf := make([]byte, len(token))
+			_, err = io.ReadFull(conn, buf)
+			conn.Close()
+			if err == nil && bytes.Equal(buf, token) {
+				received <- true
+				return
+			}
+		}
+	}()
+
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(extIP, strconv.Itoa(int(port))))
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		return false, nil
+	}
+	defer conn.Close()
+	if _, err := conn.Write(token); err != nil {
+		return false, nil
+	}
+
+	select {
+	case ok := <-received:
+		if !ok && ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		return ok, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// SupportsHairpin is the same as HairpinSupported, but gives up on the
+// self-connect after 5 seconds, reporting that hairpinning is not supported,
+// since routers that do not support it often drop the connection attempt
+// rather than refusing it.
+func (d *IGD) SupportsHairpin() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+	ok, err := d.HairpinSupported(ctx)
+	if err == context.DeadlineExceeded {
+		return false, nil
+	}
+	return ok, err
+}
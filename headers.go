@@ -0,0 +1,46 @@
+package upnp
+
+import (
+	"net/http"
+	"time"
+)
+
+// headerTransport is an http.RoundTripper that sets header on every request
+// it sends, replacing any values already present.
+type headerTransport struct {
+	base   http.RoundTripper
+	header http.Header
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.header {
+		req.Header[k] = v
+	}
+	return t.base.RoundTrip(req)
+}
+
+// withHeader returns a copy of c, or of the default client used to fetch
+// device descriptions if c is nil, that sets header on its requests.
+func withHeader(c *http.Client, header http.Header) *http.Client {
+	if c == nil {
+		c = &http.Client{Timeout: 3 * time.Second}
+	}
+	wrapped := *c
+	base := wrapped.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	wrapped.Transport = &headerTransport{base: base, header: header}
+	return &wrapped
+}
+
+// setHeader makes d's SOAP client set header on its requests.
+func (d *IGD) setHeader(header http.Header) {
+	if len(header) == 0 {
+		return
+	}
+	c := &d.client.GetServiceClient().SOAPClient.HTTPClient
+	*c = *withHeader(c, header)
+}
@@ -0,0 +1,169 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp"
+)
+
+// unreachable reports whether err indicates that the router could not be
+// reached at all, as when it has moved to a new address, rather than that it
+// answered with a failure.
+func unreachable(err error) bool {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+// A healingClient is an igdClient that, when the router cannot be reached,
+// searches for it again and retries the action once against the router
+// found. It is installed by WithAutoHeal.
+type healingClient struct {
+	*healer
+	// ctx, if not nil, aborts the actions performed through c, and the
+	// search for the router.
+	ctx context.Context
+}
+
+// A healer holds the state shared by a healingClient and its copies bound to
+// a context by bindContext.
+type healer struct {
+	// relocate searches for the router, returning nil if it is not found.
+	relocate func(ctx context.Context) igdClient
+	logf     func(format string, v ...interface{})
+
+	mu     sync.Mutex
+	client igdClient
+	// healMu ensures that only one search is performed at a time.
+	healMu sync.Mutex
+}
+
+// current returns the client for the router as last found.
+func (h *healer) current() igdClient {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.client
+}
+
+// withContext returns a copy of c whose actions are aborted when ctx is done.
+func (c *healingClient) withContext(ctx context.Context) *healingClient {
+	return &healingClient{healer: c.healer, ctx: ctx}
+}
+
+// do performs action with the current client, and, if the router could not
+// be reached, searches for it and performs action once more with the client
+// found. If the router is not found, or c's context is done, the original
+// error is returned.
+func (c *healingClient) do(action func(igdClient) error) error {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	failed := c.current()
+	err := action(bindContext(ctx, failed))
+	if !unreachable(err) || ctx.Err() != nil {
+		return err
+	}
+
+	c.healMu.Lock()
+	defer c.healMu.Unlock()
+	// another action may have failed, and found the router, in the meantime
+	if cur := c.current(); cur != failed {
+		return action(bindContext(ctx, cur))
+	}
+	found := c.relocate(ctx)
+	if found == nil {
+		return err
+	}
+	old := failed.GetServiceClient().SOAPClient
+	sc := found.GetServiceClient().SOAPClient
+	sc.HTTPClient = old.HTTPClient
+	sc.Trace = old.Trace
+	c.logf("upnp: router moved to %s", found.GetServiceClient().Location)
+	c.mu.Lock()
+	c.client = found
+	c.mu.Unlock()
+	return action(bindContext(ctx, found))
+}
+
+// GetExternalIPAddress implements igdClient.
+func (c *healingClient) GetExternalIPAddress() (ip string, err error) {
+	err = c.do(func(client igdClient) (err error) {
+		ip, err = client.GetExternalIPAddress()
+		return err
+	})
+	return
+}
+
+// AddPortMapping implements igdClient.
+func (c *healingClient) AddPortMapping(remoteHost string, extPort uint16, proto string, intPort uint16, intClient string, enabled bool, desc string, lease uint32) error {
+	return c.do(func(client igdClient) error {
+		return client.AddPortMapping(remoteHost, extPort, proto, intPort, intClient, enabled, desc, lease)
+	})
+}
+
+// GetSpecificPortMappingEntry implements igdClient.
+func (c *healingClient) GetSpecificPortMappingEntry(remoteHost string, extPort uint16, proto string) (intPort uint16, intClient string, enabled bool, desc string, lease uint32, err error) {
+	err = c.do(func(client igdClient) (err error) {
+		intPort, intClient, enabled, desc, lease, err = client.GetSpecificPortMappingEntry(remoteHost, extPort, proto)
+		return err
+	})
+	return
+}
+
+// GetGenericPortMappingEntry implements igdClient.
+func (c *healingClient) GetGenericPortMappingEntry(index uint16) (remoteHost string, extPort uint16, proto string, intPort uint16, intClient string, enabled bool, desc string, lease uint32, err error) {
+	err = c.do(func(client igdClient) (err error) {
+		remoteHost, extPort, proto, intPort, intClient, enabled, desc, lease, err = client.GetGenericPortMappingEntry(index)
+		return err
+	})
+	return
+}
+
+// DeletePortMapping implements igdClient.
+func (c *healingClient) DeletePortMapping(remoteHost string, extPort uint16, proto string) error {
+	return c.do(func(client igdClient) error {
+		return client.DeletePortMapping(remoteHost, extPort, proto)
+	})
+}
+
+// GetStatusInfo implements igdClient.
+func (c *healingClient) GetStatusInfo() (status, lastErr string, uptime uint32, err error) {
+	err = c.do(func(client igdClient) (err error) {
+		status, lastErr, uptime, err = client.GetStatusInfo()
+		return err
+	})
+	return
+}
+
+// GetServiceClient implements igdClient.
+func (c *healingClient) GetServiceClient() *goupnp.ServiceClient {
+	return c.current().GetServiceClient()
+}
+
+// autoHeal makes d search for its router again when the router cannot be
+// reached, matching it by the UDN of its root device, with the search and
+// connection preference of o. NAT-PMP gateways are left as they are.
+func (d *IGD) autoHeal(o *options) {
+	switch d.client.(type) {
+	case *natpmpClient, *healingClient:
+		return
+	}
+	udn := d.client.GetServiceClient().RootDevice.Device.UDN
+	d.client = &healingClient{healer: &healer{
+		client: d.client,
+		logf:   d.logf,
+		relocate: func(ctx context.Context) igdClient {
+			if found := o.relocate(ctx, "", udn); found != nil {
+				return d.withQuirks(found.client)
+			}
+			return nil
+		},
+	}}
+}
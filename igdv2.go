@@ -0,0 +1,223 @@
+package upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway2"
+)
+
+// connection returns the client for d's connection service, looking through
+// the healingClient installed by WithAutoHeal and the quirkClient installed
+// for routers with known quirks, if any.
+func (d *IGD) connection() igdClient {
+	client := d.client
+	if h, ok := client.(*healingClient); ok {
+		client = h.current()
+	}
+	if q, ok := client.(*quirkClient); ok {
+		client = q.igdClient
+	}
+	return client
+}
+
+// v2 returns d's client as an IGDv2 WANIPConnection:2 client, if it is one.
+func (d *IGD) v2() (*internetgateway2.WANIPConnection2, bool) {
+	c, ok := d.connection().(*internetgateway2.WANIPConnection2)
+	return c, ok
+}
+
+// IsV2 reports whether d uses an IGDv2 connection service, which supports
+// ForwardAny.
+func (d *IGD) IsV2() bool {
+	_, ok := d.v2()
+	return ok
+}
+
+// A portListing is the document returned by GetListOfPortMappings, with one
+// entry per mapping.
+type portListing struct {
+	Entries []struct {
+		RemoteHost     string `xml:"NewRemoteHost"`
+		ExternalPort   uint16 `xml:"NewExternalPort"`
+		Protocol       string `xml:"NewProtocol"`
+		InternalPort   uint16 `xml:"NewInternalPort"`
+		InternalClient string `xml:"NewInternalClient"`
+		Enabled        string `xml:"NewEnabled"`
+		Description    string `xml:"NewDescription"`
+		LeaseTime      uint32 `xml:"NewLeaseTime"`
+	} `xml:"PortMappingEntry"`
+}
+
+// listMappingsV2 returns the entries in the router's port mapping table for
+// protocol, which must be "TCP" or "UDP", read with a single
+// GetListOfPortMappings request of IGDv2. ErrUnsupported is returned if the
+// router is not an IGDv2 router, or refuses the request, e.g. because it does
+// not implement the action or let other hosts' mappings be listed.
+func (d *IGD) listMappingsV2(protocol string) ([]Mapping, error) {
+	if !d.IsV2() {
+		return nil, ErrUnsupported
+	}
+	q := d.Quirks()
+	var listing string
+	err := d.do(context.Background(), func(c igdClient) (err error) {
+		if q, ok := c.(*quirkClient); ok {
+			c = q.igdClient
+		}
+		v2, ok := c.(*internetgateway2.WANIPConnection2)
+		if !ok {
+			return ErrUnsupported
+		}
+		time.Sleep(time.Millisecond)
+		listing, err = v2.GetListOfPortMappings(1, 65535, q.protocol(protocol), true, 0)
+		return err
+	})
+	if faultCode(err) == errCodePortMappingNotFound {
+		return []Mapping{}, nil
+	} else if faultCode(err) != 0 {
+		return nil, ErrUnsupported
+	} else if err != nil {
+		return nil, err
+	}
+	var l portListing
+	if err := xml.Unmarshal([]byte(listing), &l); err != nil {
+		return nil, fmt.Errorf("invalid port listing: %v", err)
+	}
+	mappings := make([]Mapping, 0, len(l.Entries))
+	for _, e := range l.Entries {
+		if e.RemoteHost == q.WildcardHost {
+			e.RemoteHost = ""
+		}
+		mappings = append(mappings, Mapping{
+			RemoteHost:     e.RemoteHost,
+			ExternalPort:   e.ExternalPort,
+			InternalPort:   e.InternalPort,
+			Protocol:       strings.ToUpper(e.Protocol),
+			InternalClient: e.InternalClient,
+			Description:    e.Description,
+			Enabled:        e.Enabled == "1" || strings.EqualFold(e.Enabled, "true"),
+			LeaseDuration:  time.Duration(e.LeaseTime) * time.Second,
+		})
+	}
+	return mappings, nil
+}
+
+// maxForwardAnyProbes is the number of external ports ForwardAny tries on
+// routers that cannot choose one themselves.
+const maxForwardAnyProbes = 32
+
+// ForwardAny forwards port like Forward if the router allows it, and returns
+// the external port that was forwarded. If port is already mapped to another
+// host, a free external port is forwarded to port on this host instead: on
+// IGDv2 routers, the router chooses one; on others, successive ports after
+// port are tried, up to 32 of them.
+func (d *IGD) ForwardAny(port uint16, desc string) (uint16, error) {
+	if !d.IsV2() || d.plan != nil {
+		return d.probeForward(port, desc)
+	}
+	ip, err := d.getInternalIP()
+	if err != nil {
+		return 0, err
+	}
+	extPort, err := d.addAnyPortMapping(port, ip, desc)
+	if code := faultCode(err); code == errCodeInvalidAction || code == errCodeOptionalActionNotImplemented || err == ErrUnsupported {
+		return d.probeForward(port, desc)
+	} else if err != nil {
+		return 0, err
+	}
+	tcp := mappingID{"", extPort, "TCP"}
+	d.track(tcp, trackedMapping{internalPort: port, internalIP: ip, enabled: true, desc: desc, local: true})
+
+	// UDP must use the same external port as TCP
+	time.Sleep(time.Millisecond)
+	if err := d.addPortMapping("", extPort, "UDP", port, ip, true, desc, 0); err != nil {
+		d.rollback([]mappingID{tcp})
+		return 0, err
+	}
+	d.track(mappingID{"", extPort, "UDP"}, trackedMapping{internalPort: port, internalIP: ip, enabled: true, desc: desc, local: true})
+	return extPort, nil
+}
+
+// addAnyPortMapping calls AddAnyPortMapping on the router for TCP, asking for
+// port as the external port, and returns the one granted. The request is
+// adapted to the router's quirks and retried if WithAutoHeal finds the
+// router elsewhere, like AddPortMapping, and is logged. ErrUnsupported is
+// returned if the router does not offer WANIPConnection:2.
+func (d *IGD) addAnyPortMapping(port uint16, ip, desc string) (uint16, error) {
+	q := d.Quirks()
+	remoteHost, proto, lease := q.remoteHost(""), q.protocol("TCP"), q.lease(0)
+	var extPort uint16
+	err := d.do(context.Background(), func(c igdClient) (err error) {
+		if q, ok := c.(*quirkClient); ok {
+			c = q.igdClient
+		}
+		v2, ok := c.(*internetgateway2.WANIPConnection2)
+		if !ok {
+			return ErrUnsupported
+		}
+		time.Sleep(time.Millisecond)
+		extPort, err = v2.AddAnyPortMapping(remoteHost, port, proto, port, ip, true, desc, lease)
+		return err
+	})
+	d.logf("upnp: AddAnyPortMapping(%q, %d, %s, %d, %q, true, %q, %d): %d, %v", remoteHost, port, proto, port, ip, desc, lease, extPort, err)
+	return extPort, err
+}
+
+// probeForward forwards successive external ports, starting at port, to port
+// on this host until one is not already mapped to another host.
+func (d *IGD) probeForward(port uint16, desc string) (uint16, error) {
+	var err error
+	for i := 0; i < maxForwardAnyProbes && int(port)+i <= 0xFFFF; i++ {
+		extPort := port + uint16(i)
+		err = d.ForwardAsymmetric(extPort, port, desc)
+		if faultCode(err) != ErrCodeConflictInMappingEntry {
+			return extPort, err
+		}
+	}
+	return 0, err
+}
+
+// ForwardInRange forwards a free external port between lo and hi, inclusive,
+// to internalPort on this host, and returns the external port that was
+// forwarded. If internalPort is zero, the external port itself is used. The
+// router's mapping table is consulted first so that ports already mapped are
+// skipped; ports are then tried in ascending order, up to 32 of them, until
+// one is not already mapped to another host. If every port in the range is
+// taken, the error reports the last conflict.
+func (d *IGD) ForwardInRange(lo, hi, internalPort uint16, desc string) (uint16, error) {
+	if lo == 0 || lo > hi {
+		return 0, fmt.Errorf("invalid port range %d-%d", lo, hi)
+	}
+	// the table is only a hint; if it cannot be read, every port is tried
+	used := make(map[uint16]bool)
+	if ms, err := d.ListMappings(); err == nil {
+		for _, m := range ms {
+			used[m.ExternalPort] = true
+		}
+	}
+
+	err := fmt.Errorf("no free port in range %d-%d", lo, hi)
+	tries := 0
+	for port := int(lo); port <= int(hi) && tries < maxForwardAnyProbes; port++ {
+		extPort := uint16(port)
+		if used[extPort] {
+			continue
+		}
+		tries++
+		target := internalPort
+		if target == 0 {
+			target = extPort
+		}
+		err = d.ForwardAsymmetric(extPort, target, desc)
+		if faultCode(err) != ErrCodeConflictInMappingEntry {
+			if err != nil {
+				return 0, err
+			}
+			return extPort, nil
+		}
+	}
+	return 0, err
+}
@@ -0,0 +1,66 @@
+package upnp
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// defaultMaxInFlight is the number of SOAP actions an IGD sends to the router
+// at once, unless WithMaxInFlight says otherwise. Many consumer routers
+// return garbage, or stop responding, when they receive concurrent requests.
+const defaultMaxInFlight = 1
+
+// limitTransport is an http.RoundTripper that allows only as many requests
+// to be in flight as sem has room for. A request holds its slot until its
+// response body is closed.
+type limitTransport struct {
+	base http.RoundTripper
+	sem  chan struct{}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	var once sync.Once
+	release := func() { once.Do(func() { <-t.sem }) }
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releaseBody calls release when the response body it wraps is closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+// Close implements io.Closer.
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// limitInFlight makes d's SOAP client send at most n requests to the router
+// at once. If n is not positive, the number is not limited.
+func (d *IGD) limitInFlight(n int) {
+	if n <= 0 {
+		return
+	}
+	c := &d.client.GetServiceClient().SOAPClient.HTTPClient
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c.Transport = &limitTransport{base: base, sem: make(chan struct{}, n)}
+}
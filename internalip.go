@@ -0,0 +1,243 @@
+package upnp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// An AddressFamily selects between IPv4 and IPv6 addresses.
+type AddressFamily int
+
+const (
+	// AnyFamily selects an address of whichever family the router uses.
+	AnyFamily AddressFamily = iota
+	// IPv4 selects IPv4 addresses.
+	IPv4
+	// IPv6 selects IPv6 addresses.
+	IPv6
+)
+
+// InternalIP returns this host's address on the interface it uses to reach
+// the router. With AnyFamily, this is the address on the router's subnet,
+// which is the address that Forward maps ports to. Otherwise, it is an
+// address of the requested family on the same interface. For IPv6, global
+// addresses are preferred over unique local ones, and link-local addresses
+// are never returned, making the result suitable as the target of an IPv6
+// firewall pinhole.
+func (d *IGD) InternalIP(family AddressFamily) (string, error) {
+	if family == AnyFamily {
+		return d.getInternalIP()
+	}
+	iface, addr, err := d.routerInterface()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNoInternalIP, err)
+	}
+	if family == IPv4 && addr.IP.To4() != nil {
+		return addr.IP.String(), nil
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	var uniqueLocal net.IP
+	for _, a := range addrs {
+		x, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		switch {
+		case family == IPv4 && x.IP.To4() != nil:
+			return x.IP.String(), nil
+		case family != IPv6 || x.IP.To4() != nil || !x.IP.IsGlobalUnicast():
+			// not a candidate
+		case isUniqueLocal(x.IP):
+			if uniqueLocal == nil {
+				uniqueLocal = x.IP
+			}
+		default:
+			return x.IP.String(), nil
+		}
+	}
+	if uniqueLocal != nil {
+		return uniqueLocal.String(), nil
+	}
+	return "", fmt.Errorf("%w: no suitable address on interface %s", ErrNoInternalIP, iface.Name)
+}
+
+// isUniqueLocal reports whether ip is an IPv6 unique local address
+// (fc00::/7), which is not reachable from the internet.
+func isUniqueLocal(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip.To4() == nil && ip[0]&0xfe == 0xfc
+}
+
+// getInternalIP returns the user's local IP, remembering it for
+// RefreshMappings.
+func (d *IGD) getInternalIP() (string, error) {
+	ip, err := d.lookupInternalIP()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNoInternalIP, err)
+	}
+	d.mu.Lock()
+	d.internalIP = ip
+	d.mu.Unlock()
+	return ip, nil
+}
+
+// lookupInternalIP determines the user's local IP by finding the interface
+// that shares a subnet with the router, or, if route-based resolution is
+// enabled, by consulting the route table. If d was discovered on a specific
+// interface, that interface's address is used.
+func (d *IGD) lookupInternalIP() (string, error) {
+	if d.localIP != "" {
+		return d.localIP, nil
+	} else if d.routeBasedIP {
+		return d.routeInternalIP()
+	}
+	_, addr, err := d.routerInterface()
+	if err != nil {
+		return "", err
+	}
+	return addr.IP.String(), nil
+}
+
+// routeInternalIP returns the source address that the operating system would
+// use to send packets to the router. Connecting a UDP socket selects a route
+// without sending anything.
+func (d *IGD) routeInternalIP() (string, error) {
+	devIP, err := d.routerIP()
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: devIP, Port: 1900})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// routerIP returns the router's IP on the local network. It is taken from the
+// router's URLBase, or from its location if the URLBase has no host, and is
+// resolved if it is a hostname.
+func (d *IGD) routerIP() (net.IP, error) {
+	sc := d.client.GetServiceClient()
+	host := sc.RootDevice.URLBase.Hostname()
+	if host == "" && sc.Location != nil {
+		host = sc.Location.Hostname()
+	}
+	if host == "" {
+		return nil, errors.New("could not determine router's internal IP: router reported no host")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return nil, fmt.Errorf("could not determine router's internal IP: could not resolve router host %q", host)
+	}
+	return ips[0], nil
+}
+
+// Interface returns the network interface through which d reaches the
+// router: the interface it was discovered on, if it was returned by
+// DiscoverInterface, or otherwise the one that shares a subnet with the
+// router.
+func (d *IGD) Interface() (*net.Interface, error) {
+	if d.localIP == "" {
+		iface, _, err := d.routerInterface()
+		if err != nil {
+			return nil, err
+		}
+		return &iface, nil
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if x, ok := a.(*net.IPNet); ok && x.IP.String() == d.localIP {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no interface has address %s", d.localIP)
+}
+
+// Subnet returns the local network that the router is on, as seen from this
+// host, e.g. 192.168.1.0/24. It helps tell routers apart on networks with
+// more than one.
+func (d *IGD) Subnet() (*net.IPNet, error) {
+	_, addr, err := d.routerInterface()
+	if err != nil {
+		return nil, err
+	}
+	return &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}, nil
+}
+
+// OnDefaultRoute is a validator, for use with WithValidator, that accepts
+// only routers on the same subnet as the interface this host uses for its
+// default route. On hosts with several gateways, such as behind a double NAT
+// or with a VPN, this selects the router that internet traffic actually
+// passes through.
+func OnDefaultRoute(d *IGD) error {
+	subnet, err := d.Subnet()
+	if err != nil {
+		return err
+	}
+	src, err := defaultRouteSource()
+	if err != nil {
+		return err
+	}
+	if !subnet.Contains(src) {
+		return fmt.Errorf("router's subnet %v does not contain default route address %v", subnet, src)
+	}
+	return nil
+}
+
+// defaultRouteSource returns the address this host sends internet traffic
+// from.
+func defaultRouteSource() (net.IP, error) {
+	// connecting a UDP socket selects a route without sending anything
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9})
+	if err != nil {
+		return nil, fmt.Errorf("could not determine default route: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// routerInterface returns the local interface that shares a subnet with the
+// router, along with its address on that subnet.
+func (d *IGD) routerInterface() (net.Interface, *net.IPNet, error) {
+	devIP, err := d.routerIP()
+	if err != nil {
+		return net.Interface{}, nil, err
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return net.Interface{}, nil, err
+	}
+
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return net.Interface{}, nil, err
+		}
+
+		for _, addr := range addrs {
+			if x, ok := addr.(*net.IPNet); ok && x.Contains(devIP) {
+				return iface, x, nil
+			}
+		}
+	}
+
+	return net.Interface{}, nil, errors.New("no interface shares a subnet with the router")
+}
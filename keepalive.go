@@ -0,0 +1,105 @@
+package upnp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// KeepAlive forwards the specified port like ForwardTimeout, with the given
+// lease, and then renews the mapping at roughly half the lease interval until
+// stop is called. Renewal failures, such as those caused by a router reboot
+// that dropped the mapping, are passed to onErr if it is not nil; renewal
+// continues regardless, so a later attempt may restore the mapping. Calling
+// stop does not remove the mapping, which expires at the end of its lease
+// unless it is cleared first. Clearing the port also stops renewal.
+func (d *IGD) KeepAlive(port uint16, desc string, lease time.Duration, onErr func(error)) (stop func(), err error) {
+	if lease < 2*time.Second {
+		return nil, errors.New("lease must be at least 2 seconds")
+	}
+	key, err := d.ForwardAdvanced(MappingSpec{
+		ExternalPort: port,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Lease:        lease,
+		Description:  desc,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var stops []func()
+	for _, proto := range key.protocols {
+		stops = append(stops, d.keepAlive(mappingID{key.remoteHost, key.externalPort, proto}, onErr))
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, stop := range stops {
+				stop()
+			}
+		})
+	}, nil
+}
+
+// keepAlive renews the tracked mapping id every half lease, so that it does
+// not expire, until it is untracked or the returned function is called.
+// Renewal failures are passed to onErr, if it is not nil; renewal continues
+// regardless, since a later attempt may succeed.
+func (d *IGD) keepAlive(id mappingID, onErr func(error)) (stop func()) {
+	d.mu.Lock()
+	m, ok := d.tracked[id]
+	if !ok || m.lease == 0 {
+		d.mu.Unlock()
+		return func() {}
+	}
+	if d.renewals == nil {
+		d.renewals = make(map[mappingID]chan struct{})
+	}
+	if old, ok := d.renewals[id]; ok {
+		close(old)
+	}
+	done := make(chan struct{})
+	d.renewals[id] = done
+	d.mu.Unlock()
+
+	interval := jitter(time.Duration(m.lease)*time.Second/2, d.jitter)
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := d.clock.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+			}
+			// re-read the mapping, which RefreshMappings may have moved
+			d.mu.Lock()
+			m, ok := d.tracked[id]
+			d.mu.Unlock()
+			if !ok {
+				return
+			}
+			time.Sleep(time.Millisecond)
+			err := d.addPortMapping(id.remoteHost, id.externalPort, id.protocol, m.internalPort, m.internalIP, m.enabled, m.desc, m.lease)
+			if d.metrics != nil {
+				d.metrics.Renewal(err)
+			}
+			if err != nil && onErr != nil {
+				onErr(err)
+			}
+		}
+	}()
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// the renewal may already have been stopped, or replaced by another
+		if d.renewals[id] == done {
+			close(done)
+			delete(d.renewals, id)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package upnp
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway1"
+)
+
+// defaultConnectionClient returns a client for the connection service that
+// the router's Layer3Forwarding service names as its default. On multi-WAN
+// routers, this is the connection that actually carries outbound traffic, and
+// therefore the one whose external IP and port mappings are useful. If the
+// router does not name a default, or names one that cannot be found, fallback
+// is returned, as it is if ctx is done before the router answers. The router
+// is asked through httpClient, and the client returned uses the same HTTP
+// client and trace as sc.
+func defaultConnectionClient(ctx context.Context, sc goupnp.ServiceClient, httpClient http.Client, fallback igdClient) igdClient {
+	l3clients, err := internetgateway1.NewLayer3Forwarding1ClientsFromRootDevice(sc.RootDevice, sc.Location)
+	if err != nil || ctx.Err() != nil {
+		return fallback
+	}
+	l3 := *l3clients[0]
+	l3.SOAPClient.HTTPClient = httpClient
+	l3.SOAPClient = l3.SOAPClient.WithContext(ctx)
+	time.Sleep(time.Millisecond)
+	name, err := l3.GetDefaultConnectionService()
+	if err != nil {
+		return fallback
+	}
+
+	// The default is named as "<device UDN>,<service ID>", though some routers
+	// omit the UDN.
+	udn, serviceID := "", strings.TrimSpace(name)
+	if i := strings.Index(serviceID, ","); i >= 0 {
+		udn, serviceID = serviceID[:i], serviceID[i+1:]
+	}
+
+	var found igdClient
+	sc.RootDevice.Device.VisitDevices(func(dev *goupnp.Device) {
+		if found != nil || (udn != "" && dev.UDN != udn) {
+			return
+		}
+		for i := range dev.Services {
+			srv := &dev.Services[i]
+			if srv.ServiceId != serviceID {
+				continue
+			}
+			for _, cs := range connectionServices {
+				if srv.ServiceType == cs.urn {
+					c := srv.NewSOAPClient()
+					c.HTTPClient = sc.SOAPClient.HTTPClient
+					c.Trace = sc.SOAPClient.Trace
+					found = cs.wrap(goupnp.ServiceClient{
+						SOAPClient: c,
+						RootDevice: sc.RootDevice,
+						Location:   sc.Location,
+						Service:    srv,
+					})
+					return
+				}
+			}
+		}
+	})
+	if found == nil {
+		return fallback
+	}
+	return found
+}
@@ -0,0 +1,76 @@
+package upnp
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// ForwardAndListen forwards the specified port, then opens a TCP listener on
+// the same local port. The returned cleanup function closes the listener and
+// then clears the mapping; it is safe to call more than once, and every call
+// returns the result of the first.
+func (d *IGD) ForwardAndListen(port uint16, desc string) (net.Listener, func() error, error) {
+	if err := d.Forward(port, desc); err != nil {
+		return nil, nil, err
+	}
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(int(port)))
+	if err != nil {
+		d.Clear(port)
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	var cleanupErr error
+	cleanup := func() error {
+		once.Do(func() {
+			closeErr := l.Close()
+			cleanupErr = d.Clear(port)
+			if cleanupErr == nil {
+				cleanupErr = closeErr
+			}
+		})
+		return cleanupErr
+	}
+	return l, cleanup, nil
+}
+
+// ForwardListener forwards the TCP port that l is listening on, and returns
+// the address, as "ip:port", at which l can be dialed from the internet. If l
+// is bound to a particular address, the port is forwarded to that address,
+// rather than to the internal IP. The returned clear function un-forwards
+// the port, leaving l open; it is safe to call more than once, and every
+// call returns the result of the first.
+func (d *IGD) ForwardListener(l net.Listener, desc string) (externalAddr string, clear func() error, err error) {
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return "", nil, errors.New("listener is not a TCP listener: " + l.Addr().String())
+	} else if addr.IP.IsLoopback() {
+		return "", nil, errors.New("listener is bound to a loopback address: " + addr.String())
+	}
+	port := uint16(addr.Port)
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		err = d.ForwardTCP(port, desc)
+	} else {
+		err = d.ForwardFor(addr.IP.String(), port, port, "TCP", desc)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	ip, err := d.ExternalIP()
+	if err != nil {
+		d.ClearTCP(port)
+		return "", nil, err
+	}
+
+	var once sync.Once
+	var clearErr error
+	clear = func() error {
+		once.Do(func() {
+			clearErr = d.ClearTCP(port)
+		})
+		return clearErr
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(int(port))), clear, nil
+}
@@ -0,0 +1,136 @@
+package upnp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/soap"
+)
+
+// A Logger receives debugging output. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+var (
+	loggerMu sync.RWMutex
+	logger   Logger
+)
+
+// SetLogger makes the package log the routers found during discovery, the
+// router chosen, and every port mapping added or deleted, to l. By default,
+// or if l is nil, the package does not log. WithLogger overrides it for a
+// single search and the IGD it returns.
+func SetLogger(l Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	logger = l
+}
+
+// logf logs to the Logger set with SetLogger, if any.
+func logf(format string, v ...interface{}) {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	if logger != nil {
+		logger.Printf(format, v...)
+	}
+}
+
+// logf logs to d's Logger, set with WithLogger, or to the package's.
+func (d *IGD) logf(format string, v ...interface{}) {
+	if d.logger != nil {
+		d.logger.Printf(format, v...)
+		return
+	}
+	logf(format, v...)
+}
+
+// logf logs to the Logger set with WithLogger, or to the package's.
+func (o *options) logf(format string, v ...interface{}) {
+	if o.logger != nil {
+		o.logger.Printf(format, v...)
+		return
+	}
+	logf(format, v...)
+}
+
+// A SOAPTrace records a SOAP action performed on the router: its name and
+// arguments, the response, how long it took, and the error, if any.
+type SOAPTrace = soap.ActionTrace
+
+// trace returns the function to pass each SOAPTrace of d's actions to, or
+// nil if they are not traced.
+func (o *options) trace(d *IGD) func(SOAPTrace) {
+	if !o.debug && o.metrics == nil {
+		return o.soapTrace
+	}
+	return func(t SOAPTrace) {
+		if o.debug {
+			d.logf("upnp: %v", t)
+		}
+		if o.metrics != nil {
+			o.metrics.SOAPCall(t.Action, t.Duration, soapCallCode(t.Err))
+		}
+		if o.soapTrace != nil {
+			o.soapTrace(t)
+		}
+	}
+}
+
+// addPortMapping calls AddPortMapping on the router, logging the request and
+// its result, unless d is in dry-run mode. Errors reported by the router are
+// returned as a *UPnPError.
+func (d *IGD) addPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, desc string, lease uint32) error {
+	return d.addPortMappingCtx(context.Background(), remoteHost, externalPort, protocol, internalPort, internalClient, enabled, desc, lease)
+}
+
+// addPortMappingCtx is the same as addPortMapping, but aborts the request and
+// returns ctx.Err() when ctx is done.
+func (d *IGD) addPortMappingCtx(ctx context.Context, remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, desc string, lease uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.dryRun("AddPortMapping", [][2]string{
+		{"NewRemoteHost", remoteHost},
+		{"NewExternalPort", marshalUi2(externalPort)},
+		{"NewProtocol", protocol},
+		{"NewInternalPort", marshalUi2(internalPort)},
+		{"NewInternalClient", internalClient},
+		{"NewEnabled", boolArg(enabled)},
+		{"NewPortMappingDescription", desc},
+		{"NewLeaseDuration", fmt.Sprint(lease)},
+	}) {
+		return nil
+	}
+	err := bindContext(ctx, d.client).AddPortMapping(remoteHost, externalPort, protocol, internalPort, internalClient, enabled, desc, lease)
+	err = upnpError(ctxErr(ctx, err))
+	d.logf("upnp: AddPortMapping(%q, %d, %s, %d, %q, %v, %q, %d): %v", remoteHost, externalPort, protocol, internalPort, internalClient, enabled, desc, lease, err)
+	return err
+}
+
+// deletePortMapping calls DeletePortMapping on the router, logging the
+// request and its result, unless d is in dry-run mode. Errors reported by the
+// router are returned as a *UPnPError.
+func (d *IGD) deletePortMapping(remoteHost string, externalPort uint16, protocol string) error {
+	return d.deletePortMappingCtx(context.Background(), remoteHost, externalPort, protocol)
+}
+
+// deletePortMappingCtx is the same as deletePortMapping, but aborts the
+// request and returns ctx.Err() when ctx is done.
+func (d *IGD) deletePortMappingCtx(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.dryRun("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", remoteHost},
+		{"NewExternalPort", marshalUi2(externalPort)},
+		{"NewProtocol", protocol},
+	}) {
+		return nil
+	}
+	err := bindContext(ctx, d.client).DeletePortMapping(remoteHost, externalPort, protocol)
+	err = upnpError(ctxErr(ctx, err))
+	d.logf("upnp: DeletePortMapping(%q, %d, %s): %v", remoteHost, externalPort, protocol, err)
+	return err
+}
@@ -0,0 +1,345 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// managerMaxFailures is the number of consecutive checks that must fail
+// before a Manager gives up on its router and discovers it again.
+const managerMaxFailures = 3
+
+// A PortHealth reports the state of a port kept forwarded by a Manager.
+type PortHealth struct {
+	Port uint16
+	// Err is nil if the port is forwarded, or the reason it is not.
+	Err error
+	// Restored is true if the port's mapping had been lost, e.g. to a router
+	// reboot, and has been re-created.
+	Restored bool
+}
+
+// A Reconnect reports that a Manager's router came back after losing its WAN
+// connection, and that the Manager re-applied its mappings, so that the
+// application can announce its external address again.
+type Reconnect struct {
+	// Rebooted is true if the router rebooted, as detected by its
+	// connection uptime going backwards, and false if its connection went
+	// down and came back up.
+	Rebooted bool
+	// ExternalIP is the router's external IP after the reconnection, which
+	// may have changed. It is empty if the router did not report one.
+	ExternalIP string
+}
+
+// A Manager keeps a set of ports forwarded without further attention. It
+// discovers the router, forwards the ports with leases that the IGD renews
+// as KeepAlive does, and checks them every interval, re-creating any
+// mappings the router has lost, as when it reboots. A reboot
+// is also detected by the router's connection uptime going backwards, in
+// which case every port is forwarded again, as it is when the router's
+// connection status goes from anything else to "Connected". If the router
+// stops answering, it is discovered again, in case it has moved or been
+// replaced. Since the mappings are leased, they expire soon after a process
+// that did not stop its Manager has gone.
+type Manager struct {
+	discover   func(ctx context.Context) (*IGD, error)
+	interval   time.Duration
+	onHealth   func(PortHealth)
+	wake       chan struct{}
+	reconnects chan Reconnect
+	clock      Clock
+
+	mu    sync.Mutex
+	d     *IGD
+	ports map[uint16]string
+	// renewals stops the renewal of each port's mappings by d.
+	renewals map[uint16]func()
+	healthy  map[uint16]bool
+	uptime   time.Duration
+	status   string
+	failures int
+}
+
+// NewManager returns a Manager that checks its ports every interval, and
+// passes changes in their health to onHealth, if it is not nil: when a port
+// is first forwarded, when it fails, and when it is restored. opts are passed
+// to DiscoverCtx. The Manager does nothing until Run is called.
+func NewManager(interval time.Duration, onHealth func(PortHealth), opts ...Option) *Manager {
+	return &Manager{
+		discover: func(ctx context.Context) (*IGD, error) {
+			return DiscoverCtx(ctx, opts...)
+		},
+		interval:   interval,
+		onHealth:   onHealth,
+		wake:       make(chan struct{}, 1),
+		reconnects: make(chan Reconnect, 1),
+		clock:      realClock{},
+		ports:      make(map[uint16]string),
+		renewals:   make(map[uint16]func()),
+		healthy:    make(map[uint16]bool),
+	}
+}
+
+// managerLease returns the lease with which a Manager that checks its ports
+// every interval forwards them. It outlasts a missed check, and is at least
+// the 2 seconds that KeepAlive requires.
+func managerLease(interval time.Duration) time.Duration {
+	if lease := 2 * interval; lease > 2*time.Second {
+		return lease
+	}
+	return 2 * time.Second
+}
+
+// SetClock replaces the Clock by which m schedules its checks, and which the
+// IGDs it discovers use. It is intended for tests, and must be called before
+// Run; by default, a Manager uses the system clock.
+func (m *Manager) SetClock(c Clock) {
+	m.clock = c
+}
+
+// Reconnects returns a channel that receives a Reconnect each time m's
+// router reboots or its connection comes back up, once m has forwarded its
+// ports again. It is buffered; if the previous Reconnect has not been
+// received, it is replaced by the new one.
+func (m *Manager) Reconnects() <-chan Reconnect {
+	return m.reconnects
+}
+
+// Add makes m keep port forwarded, for both TCP and UDP, with the
+// description desc. If m is running, the port is forwarded straight away.
+func (m *Manager) Add(port uint16, desc string) {
+	m.mu.Lock()
+	m.ports[port] = desc
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Remove stops m from keeping port forwarded, and un-forwards it if m has a
+// router.
+func (m *Manager) Remove(port uint16) error {
+	m.mu.Lock()
+	_, ok := m.ports[port]
+	delete(m.ports, port)
+	delete(m.healthy, port)
+	if stop, ok := m.renewals[port]; ok {
+		stop()
+		delete(m.renewals, port)
+	}
+	d := m.d
+	m.mu.Unlock()
+	if !ok || d == nil {
+		return nil
+	}
+	return d.Clear(port)
+}
+
+// IGD returns the router that m is currently using, or nil if it has none.
+func (m *Manager) IGD() *IGD {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.d
+}
+
+// Run forwards m's ports and keeps them forwarded until ctx is done, and then
+// un-forwards them. Failures are reported through the Manager's health
+// callback, and retried at the next check. Run returns the error from
+// clearing the ports, if any.
+func (m *Manager) Run(ctx context.Context) error {
+	if m.interval <= 0 {
+		return errors.New("manager interval must be positive")
+	}
+	ticker := m.clock.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.check(ctx)
+		select {
+		case <-ctx.Done():
+			return m.clear()
+		case <-ticker.C():
+		case <-m.wake:
+		}
+	}
+}
+
+// check makes sure that m has a router, and that each of its ports is
+// forwarded.
+func (m *Manager) check(ctx context.Context) {
+	m.mu.Lock()
+	d := m.d
+	m.mu.Unlock()
+	if d == nil {
+		var err error
+		if d, err = m.discover(ctx); err != nil {
+			m.reportAll(err)
+			return
+		}
+		d.SetClock(m.clock)
+		m.mu.Lock()
+		m.d, m.failures, m.uptime, m.status = d, 0, 0, ""
+		m.healthy = make(map[uint16]bool)
+		m.mu.Unlock()
+	}
+
+	status, err := d.Status()
+	m.mu.Lock()
+	if err != nil {
+		m.failures++
+		if m.failures >= managerMaxFailures {
+			d.logf("upnp: router at %s stopped answering; discovering it again", d.Location())
+			m.d = nil
+			m.stopRenewals()
+		}
+		m.mu.Unlock()
+		m.reportAll(err)
+		return
+	}
+	m.failures = 0
+	rebooted := status.Uptime < m.uptime
+	reconnected := m.status != "" && m.status != "Connected" && status.ConnectionStatus == "Connected"
+	m.uptime, m.status = status.Uptime, status.ConnectionStatus
+	ports := make(map[uint16]string, len(m.ports))
+	for port, desc := range m.ports {
+		ports[port] = desc
+	}
+	m.mu.Unlock()
+	if rebooted {
+		d.logf("upnp: router at %s appears to have rebooted", d.Location())
+	} else if reconnected {
+		d.logf("upnp: router at %s has reconnected", d.Location())
+	}
+
+	for port, desc := range ports {
+		if ctx.Err() != nil {
+			return
+		}
+		forwarded := false
+		if !rebooted && !reconnected {
+			tcp, err1 := d.IsForwardedTCP(port)
+			udp, err2 := d.IsForwardedUDP(port)
+			forwarded = err1 == nil && err2 == nil && tcp && udp
+		}
+		if forwarded {
+			m.report(port, nil, false)
+			continue
+		}
+		err := m.forward(d, port, desc)
+		m.mu.Lock()
+		_, seen := m.healthy[port]
+		m.mu.Unlock()
+		m.report(port, err, seen && err == nil)
+	}
+	if rebooted || reconnected {
+		r := Reconnect{Rebooted: rebooted}
+		r.ExternalIP, _ = d.ExternalIP()
+		m.notify(r)
+	}
+}
+
+// forward forwards port on d with a lease, which d renews until m stops
+// keeping the port or gives up on d. Renewal failures are reported as the
+// port's health. If the router only supports permanent mappings, the port is
+// forwarded permanently instead.
+func (m *Manager) forward(d *IGD, port uint16, desc string) error {
+	stop, err := d.KeepAlive(port, desc, managerLease(m.interval), func(err error) {
+		m.report(port, err, false)
+	})
+	if faultCode(err) == ErrCodeOnlyPermanentLeasesSupported {
+		stop, err = func() {}, d.Forward(port, desc)
+	}
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.renewals[port]; ok {
+		old()
+	}
+	if _, ok := m.ports[port]; !ok || m.d != d {
+		// removed, or the router given up on, in the meantime
+		stop()
+		return nil
+	}
+	m.renewals[port] = stop
+	return nil
+}
+
+// stopRenewals stops the renewal of every port's mappings. m.mu must be
+// held.
+func (m *Manager) stopRenewals() {
+	for port, stop := range m.renewals {
+		stop()
+		delete(m.renewals, port)
+	}
+}
+
+// notify sends r on m's Reconnects channel, replacing an unreceived
+// Reconnect.
+func (m *Manager) notify(r Reconnect) {
+	select {
+	case <-m.reconnects:
+	default:
+	}
+	select {
+	case m.reconnects <- r:
+	default:
+	}
+}
+
+// report records the health of port, passing it to m's callback if it has
+// changed, or if the port's mapping was restored.
+func (m *Manager) report(port uint16, err error, restored bool) {
+	m.mu.Lock()
+	if _, ok := m.ports[port]; !ok {
+		// removed in the meantime
+		m.mu.Unlock()
+		return
+	}
+	healthy, seen := m.healthy[port]
+	m.healthy[port] = err == nil
+	m.mu.Unlock()
+	if m.onHealth == nil || (seen && healthy == (err == nil) && !restored) {
+		return
+	}
+	m.onHealth(PortHealth{Port: port, Err: err, Restored: restored})
+}
+
+// reportAll records that every port failed with err.
+func (m *Manager) reportAll(err error) {
+	m.mu.Lock()
+	ports := make([]uint16, 0, len(m.ports))
+	for port := range m.ports {
+		ports = append(ports, port)
+	}
+	m.mu.Unlock()
+	for _, port := range ports {
+		m.report(port, err, false)
+	}
+}
+
+// clear un-forwards every port, returning the first error.
+func (m *Manager) clear() error {
+	m.mu.Lock()
+	m.stopRenewals()
+	d := m.d
+	ports := make([]uint16, 0, len(m.ports))
+	for port := range m.ports {
+		ports = append(ports, port)
+	}
+	m.mu.Unlock()
+	if d == nil {
+		return nil
+	}
+	var firstErr error
+	for _, port := range ports {
+		if err := d.Clear(port); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,408 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway2"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/soap"
+)
+
+// controlNamespace is the namespace of the QueryStateVariable action, which
+// is implicitly supported by every UPnP 1.0 service.
+const controlNamespace = "urn:schemas-upnp-org:control-1-0"
+
+// TotalMappings returns the number of entries in the router's port mapping
+// table. IGDv2 routers are asked for the table with one GetListOfPortMappings
+// request per protocol. Other routers are asked for their
+// PortMappingNumberOfEntries state variable, and the table is only walked one
+// entry at a time if the router reports neither.
+func (d *IGD) TotalMappings() (int, error) {
+	if tcp, err := d.listMappingsV2("TCP"); err == nil {
+		if udp, err := d.listMappingsV2("UDP"); err == nil {
+			return len(tcp) + len(udp), nil
+		}
+	}
+	if n, err := d.queryStateVariable("PortMappingNumberOfEntries"); err == nil {
+		if count, err := strconv.Atoi(n); err == nil {
+			return count, nil
+		}
+	}
+	return d.countMappings()
+}
+
+// PortMappingCount returns the number of entries in the router's port
+// mapping table, using the GetPortMappingNumberOfEntries action. Few routers
+// implement this optional action; ErrUnsupported is returned by the rest.
+// Unlike TotalMappings, it never walks the table.
+func (d *IGD) PortMappingCount() (uint16, error) {
+	response := &struct {
+		NewPortMappingNumberOfEntries string
+	}{}
+	err := d.performAction(context.Background(), "GetPortMappingNumberOfEntries", nil, response)
+	if code := faultCode(err); code == errCodeInvalidAction || code == errCodeOptionalActionNotImplemented {
+		return 0, ErrUnsupported
+	} else if err != nil {
+		return 0, err
+	}
+	return soap.UnmarshalUi2(response.NewPortMappingNumberOfEntries)
+}
+
+// queryStateVariable returns the value of the named state variable of the
+// router's connection service.
+func (d *IGD) queryStateVariable(name string) (string, error) {
+	request := &struct {
+		VarName string `soap:"varName"`
+	}{name}
+	response := &struct {
+		Return string `xml:"return"`
+	}{}
+
+	time.Sleep(time.Millisecond)
+	err := d.client.GetServiceClient().SOAPClient.PerformAction(controlNamespace, "QueryStateVariable", request, response)
+	if err != nil {
+		return "", upnpError(err)
+	}
+	return response.Return, nil
+}
+
+// A Mapping is an entry in the router's port mapping table.
+type Mapping struct {
+	// RemoteHost is the only host allowed to use the mapping. It is empty if
+	// the mapping accepts traffic from any host.
+	RemoteHost     string
+	ExternalPort   uint16
+	InternalPort   uint16
+	Protocol       string
+	InternalClient string
+	Description    string
+	Enabled        bool
+	// LeaseDuration is the remaining lifetime of the mapping, or zero if it
+	// is permanent.
+	LeaseDuration time.Duration
+}
+
+// A PortMapping is an entry in the router's port mapping table. It is the
+// same type as Mapping.
+type PortMapping = Mapping
+
+// Mappings returns every entry in the router's port mapping table, for
+// auditing it or reconciling it with the mappings an application expects. It
+// is the same as ListMappings.
+func (d *IGD) Mappings() ([]PortMapping, error) {
+	return d.ListMappings()
+}
+
+// ListMappings returns every entry in the router's port mapping table.
+//
+// The table is read one entry at a time, so it is not an atomic snapshot: if
+// the table changes while it is being read, entries may be missed, and some
+// routers reorder entries between requests. Entries that are reported more
+// than once are returned only once. An empty table yields an empty slice.
+func (d *IGD) ListMappings() ([]Mapping, error) {
+	mappings := []Mapping{}
+	err := d.walkMappings(func(m Mapping) {
+		mappings = append(mappings, m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// GetMapping returns the router's mapping of the specified external port and
+// protocol ("TCP" or "UDP", in any case), or nil if there is none. Routers
+// forget mappings when they reboot, so this can be used to check that a
+// mapping still exists before forwarding it again. See also IsForwarded.
+func (d *IGD) GetMapping(port uint16, proto string) (*PortMapping, error) {
+	proto, err := normalizeProtocol(proto)
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(time.Millisecond)
+	intPort, client, enabled, desc, lease, err := d.client.GetSpecificPortMappingEntry("", port, proto)
+	if faultCode(err) == errCodeNoSuchEntry {
+		return nil, nil
+	} else if err != nil {
+		return nil, upnpError(err)
+	}
+	return &PortMapping{
+		ExternalPort:   port,
+		InternalPort:   intPort,
+		Protocol:       proto,
+		InternalClient: client,
+		Description:    desc,
+		Enabled:        enabled,
+		LeaseDuration:  time.Duration(lease) * time.Second,
+	}, nil
+}
+
+// ListMappingsByProtocol returns the entries in the router's port mapping
+// table for the given protocol, which must be "TCP" or "UDP". IGDv2 routers
+// are asked for them with a single GetListOfPortMappings request; on other
+// routers, or if that request is refused, the whole table is walked.
+func (d *IGD) ListMappingsByProtocol(protocol string) ([]Mapping, error) {
+	protocol, err := normalizeProtocol(protocol)
+	if err != nil {
+		return nil, err
+	}
+	if mappings, err := d.listMappingsV2(protocol); err != ErrUnsupported {
+		return mappings, err
+	}
+	mappings := []Mapping{}
+	err = d.walkMappings(func(m Mapping) {
+		if strings.EqualFold(m.Protocol, protocol) {
+			mappings = append(mappings, m)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// MappingsForClient returns the entries in the router's port mapping table
+// that forward to internalIP.
+func (d *IGD) MappingsForClient(internalIP string) ([]Mapping, error) {
+	ip := net.ParseIP(internalIP)
+	if ip == nil {
+		return nil, errors.New("invalid internal IP " + internalIP)
+	}
+	mappings := []Mapping{}
+	err := d.walkMappings(func(m Mapping) {
+		if ip.Equal(net.ParseIP(m.InternalClient)) {
+			mappings = append(mappings, m)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// ClearRange removes every mapping for the given protocol whose external port
+// lies between start and end, inclusive. IGDv2 routers are asked to delete
+// the whole range with a single DeletePortMappingRange request. On other
+// routers, or if that request is refused, the mapping table is read once,
+// and only the entries that actually exist are deleted, so clearing a large
+// range does not cost a request per port. Deletion continues past failures,
+// and the first error is returned. A range whose start is after its end is an
+// error.
+func (d *IGD) ClearRange(start, end uint16, protocol string) error {
+	if start > end {
+		return fmt.Errorf("invalid port range %d-%d", start, end)
+	}
+	protocol, err := normalizeProtocol(protocol)
+	if err != nil {
+		return err
+	}
+	if d.IsV2() {
+		if d.dryRun("DeletePortMappingRange", [][2]string{
+			{"NewStartPort", marshalUi2(start)},
+			{"NewEndPort", marshalUi2(end)},
+			{"NewProtocol", protocol},
+			{"NewManage", "1"},
+		}) {
+			d.untrackRange(start, end, protocol)
+			return nil
+		}
+		proto := d.Quirks().protocol(protocol)
+		err := d.do(context.Background(), func(c igdClient) error {
+			if q, ok := c.(*quirkClient); ok {
+				c = q.igdClient
+			}
+			v2, ok := c.(*internetgateway2.WANIPConnection2)
+			if !ok {
+				return ErrUnsupported
+			}
+			time.Sleep(time.Millisecond)
+			return v2.DeletePortMappingRange(start, end, proto, true)
+		})
+		d.logf("upnp: DeletePortMappingRange(%d, %d, %s): %v", start, end, proto, err)
+		var upnpErr *UPnPError
+		var fault *soap.SOAPFaultError
+		if err == nil || faultCode(err) == errCodePortMappingNotFound {
+			d.untrackRange(start, end, protocol)
+			return nil
+		} else if err != ErrUnsupported && !errors.As(err, &upnpErr) && !errors.As(err, &fault) {
+			return err
+		}
+		// the router refused, e.g. because the action is not implemented
+		// or the other hosts' mappings may not be managed, or a healed
+		// connection is not IGDv2; delete them one at a time instead
+	}
+	_, err = d.clearMatching(func(m Mapping) bool {
+		return strings.EqualFold(m.Protocol, protocol) && start <= m.ExternalPort && m.ExternalPort <= end
+	})
+	return err
+}
+
+// ClearAllByDescription removes every mapping in the router's table with the
+// description desc, whichever host it forwards to, and returns the number
+// removed. Applications that give their mappings a distinctive description
+// can call it at startup to clean up after a crash. Deletion continues past
+// failures, and the first error is returned.
+func (d *IGD) ClearAllByDescription(desc string) (int, error) {
+	return d.clearMatching(func(m Mapping) bool {
+		return m.Description == desc
+	})
+}
+
+// ClearAllByDescriptionPrefix is the same as ClearAllByDescription, but
+// removes every mapping whose description starts with prefix, for
+// applications that tag their mappings, e.g. "myapp: web".
+func (d *IGD) ClearAllByDescriptionPrefix(prefix string) (int, error) {
+	return d.clearMatching(func(m Mapping) bool {
+		return strings.HasPrefix(m.Description, prefix)
+	})
+}
+
+// untrackRange forgets the tracked mappings for protocol whose external port
+// lies between start and end, inclusive.
+func (d *IGD) untrackRange(start, end uint16, protocol string) {
+	d.mu.Lock()
+	var ids []mappingID
+	for id := range d.tracked {
+		if id.protocol == protocol && start <= id.externalPort && id.externalPort <= end {
+			ids = append(ids, id)
+		}
+	}
+	d.mu.Unlock()
+	for _, id := range ids {
+		d.untrack(id)
+	}
+}
+
+// clearMatching reads the mapping table once, and removes every entry for
+// which match returns true. It returns the number removed, and the first
+// error encountered.
+func (d *IGD) clearMatching(match func(Mapping) bool) (int, error) {
+	var matches []Mapping
+	err := d.walkMappings(func(m Mapping) {
+		if match(m) {
+			matches = append(matches, m)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var firstErr error
+	removed := 0
+	for _, m := range matches {
+		proto := strings.ToUpper(m.Protocol)
+		time.Sleep(time.Millisecond)
+		if err := d.deletePortMapping(m.RemoteHost, m.ExternalPort, proto); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		d.untrack(mappingID{m.RemoteHost, m.ExternalPort, proto})
+		removed++
+	}
+	return removed, firstErr
+}
+
+// normalizeProtocol validates a protocol name, returning it in the upper
+// case form expected by routers.
+func normalizeProtocol(protocol string) (string, error) {
+	p := strings.ToUpper(protocol)
+	if p != "TCP" && p != "UDP" {
+		return "", errors.New("unrecognized protocol " + protocol)
+	}
+	return p, nil
+}
+
+// countMappings counts the entries in the port mapping table by walking it.
+func (d *IGD) countMappings() (int, error) {
+	count := 0
+	err := d.walkMappings(func(Mapping) {
+		count++
+	})
+	return count, err
+}
+
+// MappingsIter reads the router's port mapping table like ListMappings, but
+// sends each entry on the returned channel as soon as it is read, so that
+// tools can show a large table as it arrives. The mapping channel is closed
+// when the table has been read, or ctx is done; the error channel then
+// receives the error that ended the walk, if any, which is ctx.Err() if ctx
+// was done, and is closed. ctx is checked between entries, so an entry that
+// has been requested is still waited for.
+func (d *IGD) MappingsIter(ctx context.Context) (<-chan Mapping, <-chan error) {
+	mappings := make(chan Mapping)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		err := d.walkMappingsCtx(ctx, func(m Mapping) bool {
+			select {
+			case mappings <- m:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		close(mappings)
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return mappings, errs
+}
+
+// walkMappings calls fn for each entry in the port mapping table, requesting
+// them in index order until the router reports that the index is out of
+// range. The standard fault for this is SpecifiedArrayIndexInvalid, but some
+// routers report NoSuchEntryInArray instead, which is accepted after the
+// first entry; any other fault is returned. Entries are identified the same way the
+// router identifies them, by remote host, external port and protocol, and
+// each is passed to fn at most once.
+func (d *IGD) walkMappings(fn func(Mapping)) error {
+	return d.walkMappingsCtx(context.Background(), func(m Mapping) bool {
+		fn(m)
+		return true
+	})
+}
+
+// walkMappingsCtx is the same as walkMappings, but stops, returning
+// ctx.Err(), when ctx is done or fn returns false.
+func (d *IGD) walkMappingsCtx(ctx context.Context, fn func(Mapping) bool) error {
+	seen := make(map[mappingID]bool)
+	for i := 0; i <= 0xFFFF; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond)
+		remoteHost, extPort, proto, intPort, client, enabled, desc, lease, err := d.client.GetGenericPortMappingEntry(uint16(i))
+		if code := faultCode(err); code == errCodeArrayIndexInvalid || (code == errCodeNoSuchEntry && i > 0) {
+			return nil
+		} else if err != nil {
+			return upnpError(err)
+		}
+		id := mappingID{remoteHost, extPort, strings.ToUpper(proto)}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ok := fn(Mapping{
+			RemoteHost:     remoteHost,
+			ExternalPort:   extPort,
+			InternalPort:   intPort,
+			Protocol:       proto,
+			InternalClient: client,
+			Description:    desc,
+			Enabled:        enabled,
+			LeaseDuration:  time.Duration(lease) * time.Second,
+		})
+		if !ok {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
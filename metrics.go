@@ -0,0 +1,48 @@
+package upnp
+
+import "time"
+
+// A Metrics receives measurements of the package's interactions with routers,
+// so that long-running programs can export them to a monitoring system such
+// as Prometheus, e.g. as counters and histograms labelled by action and error
+// code. Its methods are called synchronously, and must be fast and safe for
+// concurrent use.
+type Metrics interface {
+	// DiscoveryAttempt is called after each search for a router, with its
+	// duration and whether a router was found.
+	DiscoveryAttempt(found bool, duration time.Duration)
+	// SOAPCall is called after each SOAP action, with the action's name and
+	// latency, and the UPnP error code it failed with. The code is 0 if the
+	// action succeeded, and -1 if it failed without a UPnP error, e.g.
+	// because the router could not be reached.
+	SOAPCall(action string, latency time.Duration, code int)
+	// Renewal is called after each attempt to renew a lease kept alive by
+	// KeepAlive, with the error, if any.
+	Renewal(err error)
+}
+
+// WithMetrics makes Discover report its searches to m, and the returned IGD
+// report its SOAP actions and lease renewals.
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// soapCallCode returns the code to report to Metrics.SOAPCall for err.
+func soapCallCode(err error) int {
+	if err == nil {
+		return 0
+	} else if code := faultCode(err); code != 0 {
+		return code
+	}
+	return -1
+}
+
+// discoveryAttempt reports a search that started at start to o's Metrics, if
+// it has one.
+func (o *options) discoveryAttempt(start time.Time, found bool) {
+	if o.metrics != nil {
+		o.metrics.DiscoveryAttempt(found, time.Since(start))
+	}
+}
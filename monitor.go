@@ -0,0 +1,178 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// A MonitorEventType identifies the kind of change reported by Monitor.
+type MonitorEventType int
+
+const (
+	// ExternalIPChanged means the router's external IP changed.
+	ExternalIPChanged MonitorEventType = iota
+	// ConnectionStatusChanged means the router's WAN connection status
+	// changed, e.g. from "Connected" to "Disconnected".
+	ConnectionStatusChanged
+	// MappingLost means a mapping created through the IGD is no longer in
+	// the router's table.
+	MappingLost
+	// MonitorError means a check could not be performed.
+	MonitorError
+)
+
+// A MonitorEvent is a change observed by Monitor.
+type MonitorEvent struct {
+	Type MonitorEventType
+	// ExternalIP is the new external IP, for ExternalIPChanged events.
+	ExternalIP string
+	// Status is the new connection status, for ConnectionStatusChanged
+	// events.
+	Status string
+	// ExternalPort and Protocol identify the lost mapping, for MappingLost
+	// events.
+	ExternalPort uint16
+	Protocol     string
+	// Err is the error encountered, for MonitorError events.
+	Err error
+}
+
+// Monitor checks the router every interval, and reports changes to its
+// connection status or external IP, and the disappearance of any mapping
+// created through d, on the returned channel. The initial state is queried
+// before Monitor returns; an error is returned if that fails. The channel is
+// closed when ctx is cancelled. A lost mapping is reported once, and again
+// only if it reappears and is then lost again.
+func (d *IGD) Monitor(ctx context.Context, interval time.Duration) (<-chan MonitorEvent, error) {
+	if interval <= 0 {
+		return nil, errors.New("monitor interval must be positive")
+	}
+	status, _, _, err := d.client.GetStatusInfo()
+	if err != nil {
+		return nil, err
+	}
+	ip, err := d.ExternalIP()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan MonitorEvent)
+	go func() {
+		defer close(events)
+		send := func(e MonitorEvent) bool {
+			select {
+			case events <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		lost := make(map[mappingID]bool)
+		ticker := d.clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+			}
+
+			time.Sleep(time.Millisecond)
+			if newStatus, _, _, err := d.client.GetStatusInfo(); err != nil {
+				if !send(MonitorEvent{Type: MonitorError, Err: err}) {
+					return
+				}
+			} else if newStatus != status {
+				status = newStatus
+				if !send(MonitorEvent{Type: ConnectionStatusChanged, Status: status}) {
+					return
+				}
+			}
+
+			time.Sleep(time.Millisecond)
+			if newIP, err := d.ExternalIP(); err != nil {
+				if !send(MonitorEvent{Type: MonitorError, Err: err}) {
+					return
+				}
+			} else if newIP != ip {
+				ip = newIP
+				if !send(MonitorEvent{Type: ExternalIPChanged, ExternalIP: ip}) {
+					return
+				}
+			}
+
+			d.mu.Lock()
+			ids := make([]mappingID, 0, len(d.tracked))
+			for id := range d.tracked {
+				ids = append(ids, id)
+			}
+			d.mu.Unlock()
+			for _, id := range ids {
+				time.Sleep(time.Millisecond)
+				_, _, _, _, _, err := d.client.GetSpecificPortMappingEntry(id.remoteHost, id.externalPort, id.protocol)
+				switch {
+				case faultCode(err) == errCodeNoSuchEntry:
+					if lost[id] {
+						continue
+					}
+					lost[id] = true
+					if !send(MonitorEvent{Type: MappingLost, ExternalPort: id.externalPort, Protocol: id.protocol}) {
+						return
+					}
+				case err != nil:
+					if !send(MonitorEvent{Type: MonitorError, Err: err}) {
+						return
+					}
+				default:
+					delete(lost, id)
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// WatchExternalIP checks the router's external IP every interval, and sends
+// it on the returned channel: first the current address, then each new
+// address as it changes. The initial address is queried before
+// WatchExternalIP returns; an error is returned if that fails. Later failures
+// are retried at the next check. The channel is closed when ctx is cancelled.
+// See Monitor for reporting errors and other changes too.
+func (d *IGD) WatchExternalIP(ctx context.Context, interval time.Duration) (<-chan string, error) {
+	if interval <= 0 {
+		return nil, errors.New("watch interval must be positive")
+	}
+	ip, err := d.ExternalIP()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make(chan string, 1)
+	ips <- ip
+	go func() {
+		defer close(ips)
+		ticker := d.clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+			}
+			time.Sleep(time.Millisecond)
+			newIP, err := d.ExternalIP()
+			if err != nil || newIP == ip {
+				continue
+			}
+			ip = newIP
+			select {
+			case ips <- ip:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ips, nil
+}
@@ -0,0 +1,151 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// privateNets are the address ranges reserved for private networks by
+// RFC 1918 and RFC 4193.
+var privateNets = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+// mustParseCIDRs parses a list of CIDR literals, panicking on failure.
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// inNets reports whether ip falls within any of nets.
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectDoubleNAT reports whether the router appears to be behind another
+// NAT, in which case forwarding ports on it will not expose this host to the
+// internet. This is the case when the external IP reported by the router is
+// not publicly routable, e.g. a private or carrier-grade NAT (100.64.0.0/10)
+// address, as IsPubliclyRoutable would report, or lies within a subnet of one
+// of this host's interfaces. It explains why inbound connections can still
+// fail after a successful Forward. The request is aborted, and ctx.Err()
+// returned, when ctx is done.
+func (d *IGD) DetectDoubleNAT(ctx context.Context) (bool, error) {
+	ip, err := d.ExternalIPCtx(ctx)
+	if err != nil {
+		return false, err
+	}
+	extIP := net.ParseIP(ip)
+	if extIP == nil {
+		return false, errors.New("router returned an invalid external IP: " + ip)
+	} else if extIP.IsUnspecified() {
+		return false, ErrNoExternalIP
+	}
+
+	if checkRoutable(extIP) != nil {
+		return true, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if x, ok := addr.(*net.IPNet); ok && !x.IP.IsLoopback() && x.Contains(extIP) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// natStatusClient is implemented by the connection services that report
+// whether the router performs NAT.
+type natStatusClient interface {
+	GetNATRSIPStatus() (rsipAvailable, natEnabled bool, err error)
+}
+
+// NATEnabled reports whether the router performs NAT, as reported by its
+// GetNATRSIPStatus action. A router in bridge mode does not, and its port
+// mappings have no effect, so applications can skip UPnP entirely when it
+// returns false. NAT-PMP gateways are always reported as performing NAT. If
+// the router does not implement the action, ErrUnsupported is returned.
+func (d *IGD) NATEnabled() (bool, error) {
+	client := d.connection()
+	if _, ok := client.(*natpmpClient); ok {
+		return true, nil
+	}
+	c, ok := client.(natStatusClient)
+	if !ok {
+		return false, ErrUnsupported
+	}
+	time.Sleep(time.Millisecond)
+	_, enabled, err := c.GetNATRSIPStatus()
+	if err != nil {
+		return false, upnpError(err)
+	}
+	return enabled, nil
+}
+
+// cgnatNets is the shared address space used by carrier-grade NAT, reserved
+// by RFC 6598.
+var cgnatNets = mustParseCIDRs("100.64.0.0/10")
+
+// A NotRoutableError is returned by IsPubliclyRoutable when the router's
+// external IP cannot be reached from the internet.
+type NotRoutableError struct {
+	IP net.IP
+	// Reason describes the kind of address, e.g. "private (RFC 1918)".
+	Reason string
+}
+
+func (e *NotRoutableError) Error() string {
+	return "external IP " + e.IP.String() + " is not publicly routable: it is " + e.Reason
+}
+
+// IsPubliclyRoutable reports whether the router's external IP can be reached
+// from the internet. If it cannot, as when the router is behind another NAT
+// or its ISP uses carrier-grade NAT, forwarding ports on the router will not
+// make this host reachable; false is returned along with a *NotRoutableError
+// describing the address.
+func (d *IGD) IsPubliclyRoutable() (bool, error) {
+	ip, err := d.ExternalIPParsed()
+	if err != nil {
+		return false, err
+	}
+	if err := checkRoutable(ip); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkRoutable returns a *NotRoutableError if ip cannot be reached from the
+// internet.
+func checkRoutable(ip net.IP) error {
+	var reason string
+	switch {
+	case inNets(ip, privateNets):
+		reason = "private (RFC 1918 or RFC 4193)"
+	case inNets(ip, cgnatNets):
+		reason = "carrier-grade NAT shared address space (RFC 6598)"
+	case ip.IsLoopback():
+		reason = "a loopback address"
+	case ip.IsLinkLocalUnicast():
+		reason = "link-local"
+	case ip.IsUnspecified():
+		reason = "unspecified"
+	default:
+		return nil
+	}
+	return &NotRoutableError{IP: ip, Reason: reason}
+}
@@ -0,0 +1,349 @@
+package upnp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/soap"
+	"gitlab.com/NebulousLabs/go-upnp/natpmp"
+)
+
+// natpmpLifetime is the lifetime requested for mappings that are meant to be
+// permanent, which NAT-PMP does not support. Gateways shorten it to their own
+// maximum.
+const natpmpLifetime = 7 * 24 * 60 * 60
+
+// A natpmpMapping is a mapping created through a natpmpClient.
+type natpmpMapping struct {
+	trackedMapping
+	expires time.Time
+}
+
+// natpmpClient implements igdClient for NAT-PMP gateways, and for PCP
+// gateways that do not answer NAT-PMP. Neither protocol can list or query
+// mappings, so the mappings created through the client are recorded, and
+// queries are answered from the record.
+type natpmpClient struct {
+	client  *natpmp.Client
+	localIP string
+	sc      goupnp.ServiceClient
+
+	mu       sync.Mutex
+	mappings map[mappingID]natpmpMapping
+	// clock is the Clock of the IGD using the client, by which the
+	// mappings expire.
+	clock Clock
+}
+
+// newNATPMPClient returns a natpmpClient for the gateway at gw, or an error
+// if it answers neither NAT-PMP nor PCP requests. PCP is only used if the
+// gateway reports that it does not speak NAT-PMP.
+func newNATPMPClient(gw net.IP, port int) (*natpmpClient, error) {
+	c := &natpmp.Client{Gateway: gw, Port: port}
+	if _, err := c.ExternalAddress(); err != nil {
+		var re *natpmp.ResultError
+		if !errors.As(err, &re) || re.Code != natpmp.ResultUnsupportedVersion {
+			return nil, err
+		}
+		c.PCP = true
+		if _, err := c.ExternalAddress(); err != nil {
+			return nil, err
+		}
+	}
+	if port == 0 {
+		port = natpmp.Port
+	}
+	// NAT-PMP mappings always point at the host that requested them
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gw, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP.String()
+	conn.Close()
+
+	loc := url.URL{Scheme: "natpmp", Host: net.JoinHostPort(gw.String(), strconv.Itoa(port))}
+	root := &goupnp.RootDevice{URLBase: loc}
+	root.Device.FriendlyName = "NAT-PMP gateway"
+	if c.PCP {
+		root.Device.FriendlyName = "PCP gateway"
+	}
+	return &natpmpClient{
+		client:  c,
+		localIP: localIP,
+		sc: goupnp.ServiceClient{
+			SOAPClient: soap.NewSOAPClient(loc),
+			RootDevice: root,
+			Location:   &loc,
+			Service:    &goupnp.Service{ServiceType: "natpmp"},
+		},
+		mappings: make(map[mappingID]natpmpMapping),
+		clock:    realClock{},
+	}, nil
+}
+
+// natpmpFault returns a SOAP fault carrying the UPnP error code that best
+// describes a failure, so that NAT-PMP gateways report errors the same way
+// UPnP routers do.
+func natpmpFault(code int, desc string) error {
+	f := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+	f.UPnPError.ErrorCode = code
+	f.UPnPError.ErrorDescription = desc
+	return f
+}
+
+func (c *natpmpClient) GetExternalIPAddress() (string, error) {
+	ip, err := c.client.ExternalAddress()
+	if err != nil {
+		return "", err
+	}
+	if ip.IsUnspecified() {
+		return "", nil
+	}
+	return ip.String(), nil
+}
+
+func (c *natpmpClient) AddPortMapping(remoteHost string, extPort uint16, proto string, intPort uint16, client string, enabled bool, desc string, lease uint32) error {
+	if remoteHost != "" {
+		return natpmpFault(errCodeRemoteHostWildcard, "RemoteHostOnlySupportsWildcard")
+	} else if client != c.localIP {
+		return natpmpFault(errCodeNotAuthorized, "Action not authorized")
+	}
+	lifetime := lease
+	if lifetime == 0 {
+		lifetime = natpmpLifetime
+	}
+	proto = strings.ToUpper(proto)
+	mapped, granted, err := c.client.AddPortMapping(proto, intPort, extPort, lifetime)
+	if err != nil {
+		return err
+	}
+	if mapped != extPort {
+		// the requested port is taken; don't leave the substitute behind
+		c.client.DeletePortMapping(proto, intPort)
+		return natpmpFault(ErrCodeConflictInMappingEntry, "ConflictInMappingEntry")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mappings[mappingID{"", extPort, proto}] = natpmpMapping{
+		trackedMapping: trackedMapping{internalPort: intPort, internalIP: client, enabled: enabled, desc: desc, lease: lease},
+		expires:        c.clock.Now().Add(time.Duration(granted) * time.Second),
+	}
+	return nil
+}
+
+// setClock makes the recorded mappings expire by clock.
+func (c *natpmpClient) setClock(clock Clock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock = clock
+}
+
+// lookup returns the recorded mapping id, forgetting it if it has expired,
+// and the lease to report for it: the time left before it expires, or 0 if
+// it was requested permanently.
+func (c *natpmpClient) lookup(id mappingID) (m natpmpMapping, remaining uint32, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok = c.mappings[id]
+	now := c.clock.Now()
+	if ok && now.After(m.expires) {
+		delete(c.mappings, id)
+		return m, 0, false
+	} else if ok && m.lease != 0 {
+		remaining = uint32(m.expires.Sub(now) / time.Second)
+	}
+	return m, remaining, ok
+}
+
+func (c *natpmpClient) GetSpecificPortMappingEntry(remoteHost string, extPort uint16, proto string) (uint16, string, bool, string, uint32, error) {
+	m, remaining, ok := c.lookup(mappingID{remoteHost, extPort, strings.ToUpper(proto)})
+	if !ok {
+		return 0, "", false, "", 0, natpmpFault(errCodeNoSuchEntry, "NoSuchEntryInArray")
+	}
+	return m.internalPort, m.internalIP, m.enabled, m.desc, remaining, nil
+}
+
+func (c *natpmpClient) GetGenericPortMappingEntry(index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	c.mu.Lock()
+	ids := make([]mappingID, 0, len(c.mappings))
+	for id := range c.mappings {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].externalPort != ids[j].externalPort {
+			return ids[i].externalPort < ids[j].externalPort
+		}
+		return ids[i].protocol < ids[j].protocol
+	})
+	for _, id := range ids {
+		m, remaining, ok := c.lookup(id)
+		if !ok {
+			continue
+		}
+		if index == 0 {
+			return "", id.externalPort, id.protocol, m.internalPort, m.internalIP, m.enabled, m.desc, remaining, nil
+		}
+		index--
+	}
+	return "", 0, "", 0, "", false, "", 0, natpmpFault(errCodeArrayIndexInvalid, "SpecifiedArrayIndexInvalid")
+}
+
+func (c *natpmpClient) DeletePortMapping(remoteHost string, extPort uint16, proto string) error {
+	id := mappingID{remoteHost, extPort, strings.ToUpper(proto)}
+	m, _, ok := c.lookup(id)
+	if !ok {
+		return natpmpFault(errCodeNoSuchEntry, "NoSuchEntryInArray")
+	}
+	if err := c.client.DeletePortMapping(id.protocol, m.internalPort); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.mappings, id)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *natpmpClient) GetStatusInfo() (string, string, uint32, error) {
+	ip, err := c.client.ExternalAddress()
+	if err != nil {
+		return "", "", 0, err
+	} else if ip.IsUnspecified() {
+		return "Disconnected", "ERROR_NONE", 0, nil
+	}
+	return "Connected", "ERROR_NONE", 0, nil
+}
+
+func (c *natpmpClient) GetServiceClient() *goupnp.ServiceClient {
+	return &c.sc
+}
+
+// loadNATPMP returns an IGD for the NAT-PMP gateway at gw.
+func loadNATPMP(gw net.IP, port int, o *options) (*IGD, error) {
+	c, err := newNATPMPClient(gw, port)
+	if err != nil {
+		return nil, err
+	}
+	d := newIGD(c)
+	o.configure(d)
+	d.localIP = c.localIP
+	return d, nil
+}
+
+// loadNATPMPURL returns an IGD for the NAT-PMP gateway at loc, a URL returned
+// by the Location of an IGD that uses NAT-PMP.
+func loadNATPMPURL(loc *url.URL, o *options) (*IGD, error) {
+	gw := net.ParseIP(loc.Hostname())
+	if gw == nil {
+		return nil, fmt.Errorf("%w at URL %s", ErrNoGateway, loc)
+	}
+	port := natpmp.Port
+	if p := loc.Port(); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, err
+		}
+		port = n
+	}
+	d, err := loadNATPMP(gw, port, o)
+	if err != nil {
+		return nil, fmt.Errorf("%w at URL %s: %v", ErrNoGateway, loc, err)
+	}
+	return d, nil
+}
+
+// discoverNATPMP looks for a NAT-PMP or PCP gateway at each of the likely addresses
+// of the default gateway, returning the first that passes o's validators.
+func discoverNATPMP(ctx context.Context, o *options) (*IGD, error) {
+	for _, gw := range gatewayCandidates() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		d, err := loadNATPMP(gw, 0, o)
+		if err != nil {
+			o.logf("upnp: no NAT-PMP gateway at %s: %v", gw, err)
+			continue
+		} else if err := o.validate(d); err != nil {
+			o.logf("upnp: rejecting %s: %v", d.Location(), err)
+			continue
+		}
+		o.logf("upnp: using %s", d.Location())
+		return d, nil
+	}
+	return nil, ErrNoGateway
+}
+
+// gatewayCandidates returns the addresses at which the default gateway may be
+// found. On Linux, the default routes are read from the routing table; on
+// other systems, or if there are none, the first address of each attached
+// IPv4 subnet is used instead, which is where most routers sit.
+func gatewayCandidates() []net.IP {
+	if gws := routeTableGateways(); len(gws) > 0 {
+		return gws
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var gws []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			x, ok := a.(*net.IPNet)
+			if !ok || x.IP.To4() == nil {
+				continue
+			}
+			gw := x.IP.To4().Mask(x.Mask)
+			gw[3]++
+			if !gw.Equal(x.IP) {
+				gws = append(gws, gw)
+			}
+		}
+	}
+	return gws
+}
+
+// routeTableGateways returns the gateways of the default routes listed in
+// /proc/net/route.
+func routeTableGateways() []net.IP {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var gws []net.IP
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Iface Destination Gateway ..., with addresses in little-endian hex
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		gw := make(net.IP, 4)
+		binary.BigEndian.PutUint32(gw, binary.LittleEndian.Uint32(b))
+		if !gw.IsUnspecified() {
+			gws = append(gws, gw)
+		}
+	}
+	return gws
+}
@@ -0,0 +1,269 @@
+// Package natpmp is a client for the NAT Port Mapping Protocol (NAT-PMP), as
+// described in RFC 6886, and its successor, the Port Control Protocol (PCP),
+// as described in RFC 6887. NAT-PMP is offered by many routers that do not
+// offer UPnP, notably those made by Apple. Most routers that speak PCP
+// answer NAT-PMP requests too; for those that do not, a Client can be set to
+// speak PCP instead.
+package natpmp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Port is the UDP port on which NAT-PMP and PCP gateways listen.
+const Port = 5351
+
+const (
+	opExternalAddress = 0
+	opMapUDP          = 1
+	opMapTCP          = 2
+)
+
+const (
+	pcpVersion = 2
+	pcpOpMap   = 1
+	// pcpDiscardPort is the port briefly mapped to learn the external
+	// address, which PCP has no request for.
+	pcpDiscardPort = 9
+	// pcpProbeLifetime is the lifetime requested for that mapping, the
+	// shortest that RFC 6887 asks gateways to accept.
+	pcpProbeLifetime = 120
+)
+
+// ResultUnsupportedVersion is the result code with which a gateway reports
+// that it does not speak the protocol of the request, in both NAT-PMP and
+// PCP.
+const ResultUnsupportedVersion = 1
+
+// A ResultError is a failure reported by the gateway.
+type ResultError struct {
+	Code uint16
+	// PCP is true if the gateway answered a PCP request, whose result codes
+	// differ from NAT-PMP's above ResultUnsupportedVersion.
+	PCP bool
+}
+
+var pcpResults = []string{
+	1:  "unsupported version",
+	2:  "not authorized",
+	3:  "malformed request",
+	4:  "unsupported opcode",
+	5:  "unsupported option",
+	6:  "malformed option",
+	7:  "network failure",
+	8:  "out of resources",
+	9:  "unsupported protocol",
+	10: "user exceeded quota",
+	11: "cannot provide external address",
+	12: "address mismatch",
+	13: "excessive remote peers",
+}
+
+func (e *ResultError) Error() string {
+	if e.PCP {
+		if int(e.Code) < len(pcpResults) && e.Code != 0 {
+			return "pcp: " + pcpResults[e.Code]
+		}
+		return "pcp: result code " + strconv.Itoa(int(e.Code))
+	}
+	switch e.Code {
+	case 1:
+		return "natpmp: unsupported version"
+	case 2:
+		return "natpmp: not authorized"
+	case 3:
+		return "natpmp: network failure"
+	case 4:
+		return "natpmp: out of resources"
+	case 5:
+		return "natpmp: unsupported opcode"
+	default:
+		return "natpmp: result code " + strconv.Itoa(int(e.Code))
+	}
+}
+
+// A Client sends NAT-PMP or PCP requests to a gateway.
+type Client struct {
+	// Gateway is the address of the NAT-PMP gateway, which is normally the
+	// default gateway of the local network.
+	Gateway net.IP
+	// Port is the port the gateway listens on. It defaults to Port.
+	Port int
+	// Tries is the number of times each request is sent before giving up,
+	// waiting twice as long for a response each time, starting at 250ms. It
+	// defaults to 4.
+	Tries int
+	// PCP makes the client speak PCP rather than NAT-PMP, for gateways that
+	// answer NAT-PMP requests with ResultUnsupportedVersion. Mappings are
+	// then made with PCP's MAP request.
+	PCP bool
+
+	nonceOnce sync.Once
+	// nonce identifies this client to a PCP gateway as the owner of its
+	// mappings, so that it can renew and remove them.
+	nonce [12]byte
+}
+
+// NewClient returns a Client for the gateway at the given address.
+func NewClient(gateway net.IP) *Client {
+	return &Client{Gateway: gateway}
+}
+
+// ExternalAddress returns the gateway's external IPv4 address. PCP has no
+// request for the address alone, so a PCP client learns it by mapping the
+// discard port briefly, and removes the mapping again.
+func (c *Client) ExternalAddress() (net.IP, error) {
+	if c.PCP {
+		resp, err := c.pcpMap("UDP", pcpDiscardPort, 0, pcpProbeLifetime)
+		if err != nil {
+			return nil, err
+		}
+		c.pcpMap("UDP", pcpDiscardPort, 0, 0)
+		return net.IP(append([]byte(nil), resp[44:60]...)), nil
+	}
+	resp, err := c.rpc([]byte{0, opExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// AddPortMapping asks the gateway to forward externalPort to internalPort on
+// this host for protocol ("TCP" or "UDP") for lifetime seconds. The gateway
+// may choose a different external port, or a shorter lifetime; those it chose
+// are returned.
+func (c *Client) AddPortMapping(protocol string, internalPort, externalPort uint16, lifetime uint32) (mappedPort uint16, mappedLifetime uint32, err error) {
+	if lifetime == 0 {
+		return 0, 0, errors.New("natpmp: lifetime must not be zero")
+	}
+	return c.mapPort(protocol, internalPort, externalPort, lifetime)
+}
+
+// DeletePortMapping asks the gateway to remove the mapping of internalPort on
+// this host for protocol ("TCP" or "UDP").
+func (c *Client) DeletePortMapping(protocol string, internalPort uint16) error {
+	_, _, err := c.mapPort(protocol, internalPort, 0, 0)
+	return err
+}
+
+func (c *Client) mapPort(protocol string, internalPort, externalPort uint16, lifetime uint32) (uint16, uint32, error) {
+	if c.PCP {
+		resp, err := c.pcpMap(protocol, internalPort, externalPort, lifetime)
+		if err != nil {
+			return 0, 0, err
+		}
+		return binary.BigEndian.Uint16(resp[42:]), binary.BigEndian.Uint32(resp[4:]), nil
+	}
+	var op byte
+	switch protocol {
+	case "UDP":
+		op = opMapUDP
+	case "TCP":
+		op = opMapTCP
+	default:
+		return 0, 0, errors.New("natpmp: unrecognized protocol " + protocol)
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], internalPort)
+	binary.BigEndian.PutUint16(req[6:], externalPort)
+	binary.BigEndian.PutUint32(req[8:], lifetime)
+	resp, err := c.rpc(req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	return binary.BigEndian.Uint16(resp[10:]), binary.BigEndian.Uint32(resp[12:]), nil
+}
+
+// pcpMap sends a PCP MAP request for internalPort on this host, suggesting
+// externalPort, or removing the mapping if lifetime is zero, and returns the
+// response.
+func (c *Client) pcpMap(protocol string, internalPort, externalPort uint16, lifetime uint32) ([]byte, error) {
+	var proto byte
+	switch protocol {
+	case "UDP":
+		proto = 17
+	case "TCP":
+		proto = 6
+	default:
+		return nil, errors.New("natpmp: unrecognized protocol " + protocol)
+	}
+	c.nonceOnce.Do(func() { rand.Read(c.nonce[:]) })
+	req := make([]byte, 60)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], lifetime)
+	// req[8:24] holds this host's address, which rpc fills in
+	copy(req[24:36], c.nonce[:])
+	req[36] = proto
+	binary.BigEndian.PutUint16(req[40:], internalPort)
+	binary.BigEndian.PutUint16(req[42:], externalPort)
+	// no preference for the external address
+	copy(req[44:60], net.IPv4zero.To16())
+	return c.rpc(req, 60)
+}
+
+// rpc sends req to the gateway, retrying until a valid response of at least
+// respLen bytes is received. The protocol is that of req's version; for PCP,
+// the address of this host is filled in, and a response must carry req's
+// nonce.
+func (c *Client) rpc(req []byte, respLen int) ([]byte, error) {
+	port, tries := c.Port, c.Tries
+	if port == 0 {
+		port = Port
+	}
+	if tries == 0 {
+		tries = 4
+	}
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: c.Gateway, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	pcp := req[0] == pcpVersion
+	if pcp {
+		copy(req[8:24], conn.LocalAddr().(*net.UDPAddr).IP.To16())
+	}
+
+	buf := make([]byte, 1100) // the largest PCP message
+	timeout := 250 * time.Millisecond
+	for try := 0; try < tries; try++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		timeout *= 2
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break // timed out; resend
+			}
+			if n >= 4 && buf[0] != req[0] && buf[3] == ResultUnsupportedVersion {
+				// the gateway speaks the other protocol
+				return nil, &ResultError{Code: ResultUnsupportedVersion, PCP: pcp}
+			}
+			// ignore anything that is not a response to req
+			if n < respLen || buf[0] != req[0] || buf[1] != req[1]|0x80 {
+				continue
+			} else if pcp && string(buf[24:36]) != string(req[24:36]) {
+				continue
+			}
+			code := binary.BigEndian.Uint16(buf[2:])
+			if pcp {
+				code = uint16(buf[3])
+			}
+			if code != 0 {
+				return nil, &ResultError{Code: code, PCP: pcp}
+			}
+			return buf[:n], nil
+		}
+	}
+	return nil, fmt.Errorf("natpmp: no response from %v", c.Gateway)
+}
@@ -0,0 +1,170 @@
+package natpmp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+)
+
+// serve runs a fake gateway that answers each request with handle, and
+// returns a Client for it.
+func serve(t *testing.T, handle func(req []byte) []byte) *Client {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(handle(buf[:n]), addr)
+		}
+	}()
+	return &Client{
+		Gateway: net.IPv4(127, 0, 0, 1),
+		Port:    conn.LocalAddr().(*net.UDPAddr).Port,
+		Tries:   2,
+	}
+}
+
+// TestExternalAddress tests that the external address is decoded.
+func TestExternalAddress(t *testing.T) {
+	c := serve(t, func(req []byte) []byte {
+		return []byte{0, 128, 0, 0, 0, 0, 0, 1, 203, 0, 113, 7}
+	})
+	ip, err := c.ExternalAddress()
+	if err != nil {
+		t.Fatal(err)
+	} else if !ip.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Fatal("wrong external address:", ip)
+	}
+}
+
+// TestAddPortMapping tests that a mapping request is encoded, and the
+// gateway's choice of port and lifetime is returned.
+func TestAddPortMapping(t *testing.T) {
+	c := serve(t, func(req []byte) []byte {
+		resp := make([]byte, 16)
+		resp[1] = req[1] | 0x80
+		copy(resp[8:10], req[4:6])                  // internal port
+		binary.BigEndian.PutUint16(resp[10:], 9002) // external port
+		binary.BigEndian.PutUint32(resp[12:], 3600) // lifetime
+		if req[1] != opMapTCP || binary.BigEndian.Uint32(req[8:]) != 7200 {
+			resp[3] = 2
+		}
+		return resp
+	})
+	port, lifetime, err := c.AddPortMapping("TCP", 9001, 9001, 7200)
+	if err != nil {
+		t.Fatal(err)
+	} else if port != 9002 || lifetime != 3600 {
+		t.Fatalf("expected port 9002 for 3600s, got port %v for %vs", port, lifetime)
+	}
+}
+
+// TestResultError tests that a failure reported by the gateway is returned as
+// a *ResultError.
+func TestResultError(t *testing.T) {
+	c := serve(t, func(req []byte) []byte {
+		return []byte{0, req[1] | 0x80, 0, 4, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	})
+	err := c.DeletePortMapping("UDP", 9001)
+	if re, ok := err.(*ResultError); !ok || re.Code != 4 {
+		t.Fatalf("expected result code 4, got %v", err)
+	}
+}
+
+// pcpResponse returns the response of a PCP gateway to the MAP request req,
+// assigning port for lifetime seconds from 203.0.113.7.
+func pcpResponse(req []byte, port uint16, lifetime uint32) []byte {
+	resp := make([]byte, 60)
+	copy(resp, req)
+	resp[1] = req[1] | 0x80
+	binary.BigEndian.PutUint32(resp[4:], lifetime)
+	copy(resp[8:24], make([]byte, 16)) // epoch and reserved
+	binary.BigEndian.PutUint16(resp[42:], port)
+	copy(resp[44:], net.IPv4(203, 0, 113, 7).To16())
+	return resp
+}
+
+// TestPCPMap tests that a PCP client maps ports with MAP requests carrying
+// this host's address and the same nonce, and learns the external address by
+// mapping the discard port.
+func TestPCPMap(t *testing.T) {
+	var mu sync.Mutex
+	var sent [][]byte
+	c := serve(t, func(req []byte) []byte {
+		mu.Lock()
+		sent = append(sent, append([]byte(nil), req...))
+		mu.Unlock()
+		if len(req) != 60 || req[0] != pcpVersion || req[1] != pcpOpMap || req[36] != 6 && req[36] != 17 {
+			resp := pcpResponse(req, 0, 0)
+			resp[3] = 3 // malformed request
+			return resp
+		} else if !net.IP(req[8:24]).Equal(net.IPv4(127, 0, 0, 1)) {
+			resp := pcpResponse(req, 0, 0)
+			resp[3] = 12 // address mismatch
+			return resp
+		}
+		return pcpResponse(req, 9002, binary.BigEndian.Uint32(req[4:])/2)
+	})
+	c.PCP = true
+	requests := func() [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		reqs := sent
+		sent = nil
+		return reqs
+	}
+
+	port, lifetime, err := c.AddPortMapping("TCP", 9001, 9001, 7200)
+	if err != nil {
+		t.Fatal(err)
+	} else if port != 9002 || lifetime != 3600 {
+		t.Fatalf("expected port 9002 for 3600s, got port %v for %vs", port, lifetime)
+	}
+	added := requests()[0]
+	if binary.BigEndian.Uint16(added[40:]) != 9001 || binary.BigEndian.Uint16(added[42:]) != 9001 {
+		t.Fatal("wrong ports requested:", added)
+	}
+	if err := c.DeletePortMapping("TCP", 9001); err != nil {
+		t.Fatal(err)
+	} else if deleted := requests()[0]; binary.BigEndian.Uint32(deleted[4:]) != 0 || string(deleted[24:36]) != string(added[24:36]) {
+		t.Fatal("the mapping was not removed with its nonce:", deleted)
+	}
+
+	ip, err := c.ExternalAddress()
+	reqs := requests()
+	if err != nil {
+		t.Fatal(err)
+	} else if !ip.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Fatal("wrong external address:", ip)
+	} else if len(reqs) != 2 || reqs[0][36] != 17 || binary.BigEndian.Uint16(reqs[0][40:]) != pcpDiscardPort || binary.BigEndian.Uint32(reqs[1][4:]) != 0 {
+		t.Fatal("the discard port was not mapped and removed:", reqs)
+	}
+}
+
+// TestUnsupportedVersion tests that a gateway answering in the other protocol
+// is reported as not supporting the version of the request.
+func TestUnsupportedVersion(t *testing.T) {
+	c := serve(t, func(req []byte) []byte {
+		resp := make([]byte, 24)
+		resp[0], resp[1], resp[3] = pcpVersion, req[1]|0x80, 1
+		if req[0] == pcpVersion {
+			resp[0] = 0
+		}
+		return resp
+	})
+	for _, pcp := range []bool{false, true} {
+		c.PCP = pcp
+		_, err := c.ExternalAddress()
+		if re, ok := err.(*ResultError); !ok || re.Code != ResultUnsupportedVersion || re.PCP != pcp {
+			t.Errorf("PCP %v: expected ResultUnsupportedVersion, got %v", pcp, err)
+		}
+	}
+}
@@ -0,0 +1,522 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp"
+)
+
+// An Option configures the behavior of Discover and Load, and of the IGDs
+// they return. Options are applied in order, so a later Option overrides an
+// earlier one that sets the same thing. New Options may be added without
+// changing the signatures of the functions that accept them.
+type Option func(*options)
+
+// options holds the configuration assembled from a set of Options.
+type options struct {
+	validators        []func(*IGD) error
+	failFastMulticast bool
+	routeBasedIP      bool
+	defaultTimeout    time.Duration
+	refreshLocation   bool
+	refreshUDN        string
+	leaseFallback     time.Duration
+	natpmp            bool
+	searchTimeout     time.Duration
+	retries           int
+	backoff           time.Duration
+	httpClient        *http.Client
+	stunServers       []string
+	store             MappingStore
+	logger            Logger
+	soapTrace         func(SOAPTrace)
+	debug             bool
+	metrics           Metrics
+	subnet            *net.IPNet
+	maxInFlight       int
+	autoHeal          bool
+	plan              func(PlannedAction)
+	rateInterval      time.Duration
+	jitter            float64
+	header            http.Header
+	connPref          ConnectionPreference
+	quirks            []quirkEntry
+	noQuirks          bool
+	ssdpPort          uint16
+	multicastTTL      int
+	listenNotify      bool
+	resolvers         []IPResolver
+	// search, if not nil, replaces the SSDP search for a connection service
+	// made by Discover, DiscoverAll and WithLocationRefresh, so that tests
+	// need no network.
+	search func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error)
+}
+
+// newOptions returns the configuration described by opts.
+func newOptions(opts []Option) *options {
+	o := &options{natpmp: true, maxInFlight: defaultMaxInFlight}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithValidator adds a check that a discovered router must pass in order to
+// be returned. Routers for which validate returns an error are skipped. If no
+// router passes, the validation errors are returned together. Multiple
+// validators may be supplied, and all of them must pass. Discover searches
+// for each kind of connection service at once, so validate may be called
+// concurrently.
+func WithValidator(validate func(*IGD) error) Option {
+	return func(o *options) {
+		o.validators = append(o.validators, validate)
+	}
+}
+
+// WithFailFastNoMulticast makes Discover check for a network interface that
+// can send the multicast search before searching, and return
+// ErrNoMulticastInterface immediately if there is none. Without it, Discover
+// waits out its full search window on such hosts before failing.
+func WithFailFastNoMulticast() Option {
+	return func(o *options) {
+		o.failFastMulticast = true
+	}
+}
+
+// WithRouteBasedInternalIP makes the returned IGD determine this host's
+// internal IP by asking the operating system which source address it would
+// use to reach the router, instead of looking for an interface on the
+// router's subnet. This is more accurate on hosts with policy routing, or
+// with several interfaces on matching subnets.
+func WithRouteBasedInternalIP() Option {
+	return func(o *options) {
+		o.routeBasedIP = true
+	}
+}
+
+// WithDefaultTimeout bounds every SOAP action performed by the returned IGD,
+// such as ExternalIP, Forward and Clear, to the duration t. Actions that do
+// not complete in time fail with an error. Each action is bounded on its
+// own, including the time taken to connect, so a dead router makes a call
+// fail within t rather than after the operating system's TCP timeout; the
+// search is bounded separately, by WithSearchTimeout. The deadline of the
+// context passed to ExternalIPCtx, ForwardCtx, ClearCtx and the other Ctx
+// variants replaces t for that call, whether it is earlier or later.
+func WithDefaultTimeout(t time.Duration) Option {
+	return func(o *options) {
+		o.defaultTimeout = t
+	}
+}
+
+// WithLocationRefresh makes Load recover when the router's description is no
+// longer served at the supplied URL, as happens when a firmware update moves
+// it. If the URL cannot be loaded, Load searches the network for a router at
+// the same host, and with the given UDN (see IGD.UDN) unless udn is empty, and
+// returns it instead. Its Location should then be saved in place of the old
+// one.
+func WithLocationRefresh(udn string) Option {
+	return func(o *options) {
+		o.refreshLocation = true
+		o.refreshUDN = udn
+	}
+}
+
+// WithAutoHeal makes the returned IGD recover when the router moves to a new
+// address, as when its DHCP lease changes, instead of failing permanently.
+// When an action fails because the router cannot be reached, the network is
+// searched once for the router with the same UDN (see IGD.UDN), and the
+// action is retried against it; Location then reports its new URL, which
+// should be saved in place of the old one. WithLocationRefresh does the same
+// when the router has already moved by the time Load is called.
+func WithAutoHeal() Option {
+	return func(o *options) {
+		o.autoHeal = true
+	}
+}
+
+// WithDryRun makes the returned IGD read from the router as usual, but not
+// change its configuration: each action that would add, delete or renew a
+// port mapping or pinhole, or redial the connection, and each other action
+// performed with Invoke whose name does not begin with "Get", is logged and
+// passed to plan, if it is not nil, and then reported as having succeeded. It lets
+// security-conscious deployments review what an application would do to the
+// router before allowing it. Since nothing is created, later reads of the
+// mapping table do not show the planned mappings.
+func WithDryRun(plan func(PlannedAction)) Option {
+	return func(o *options) {
+		if plan == nil {
+			plan = func(PlannedAction) {}
+		}
+		o.plan = plan
+	}
+}
+
+// WithLeaseFallback makes the returned IGD cope with routers that refuse
+// permanent mappings. When such a router rejects a permanent mapping, it is
+// requested again with a lease of d, and renewed in the background until it
+// is cleared. Note that this turns a permanent mapping into a managed one:
+// once this process exits, the mapping expires within d.
+func WithLeaseFallback(d time.Duration) Option {
+	return func(o *options) {
+		o.leaseFallback = d
+	}
+}
+
+// WithSearchTimeout sets how long Discover and DiscoverAll wait for routers
+// to answer each search, in place of the default of 2 seconds. SSDP counts in
+// whole seconds, so t is rounded up, to a minimum of 1 second.
+func WithSearchTimeout(t time.Duration) Option {
+	return func(o *options) {
+		o.searchTimeout = t
+	}
+}
+
+// WithRetries sets the number of searches Discover makes before giving up,
+// in place of the default of 3.
+func WithRetries(n int) Option {
+	return func(o *options) {
+		o.retries = n
+	}
+}
+
+// WithBackoff makes Discover sleep for d after its first failed search, and
+// twice as long after each subsequent one, in place of the default random
+// sleep of up to 5 seconds.
+func WithBackoff(d time.Duration) Option {
+	return func(o *options) {
+		o.backoff = d
+	}
+}
+
+// WithHTTPClient makes Discover and Load fetch device descriptions with c,
+// and makes the returned IGD perform its SOAP actions with a copy of it,
+// instead of with the default clients, e.g. to set a proxy or TLS
+// configuration. WithDefaultTimeout and SetTimeout replace c's Timeout in the
+// copy.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
+
+// WithMaxInFlight makes the returned IGD send at most n SOAP actions to the
+// router at once, queueing the rest, so that it can be shared freely between
+// goroutines. The default is 1, which suits most consumer routers; if n is
+// not positive, the number is not limited.
+func WithMaxInFlight(n int) Option {
+	return func(o *options) {
+		o.maxInFlight = n
+	}
+}
+
+// WithRateLimit makes the returned IGD send its SOAP actions to the router at
+// least interval apart, delaying those that would come too soon, so that
+// many hosts sharing a router do not overwhelm it. By default, the rate is
+// not limited.
+func WithRateLimit(interval time.Duration) Option {
+	return func(o *options) {
+		o.rateInterval = interval
+	}
+}
+
+// WithJitter randomizes the waits between discovery retries, and the
+// renewal interval of each mapping kept alive by the returned IGD, by
+// shortening them by up to fraction (between 0 and 1) of their length. This
+// keeps hosts that start at the same moment from searching and renewing in
+// lockstep. Without it, the waits of Discover's default backoff are already
+// random, but those given by WithBackoff and renewal intervals are not.
+func WithJitter(fraction float64) Option {
+	return func(o *options) {
+		o.jitter = fraction
+	}
+}
+
+// WithHeader makes Discover and Load set the HTTP header key to value when
+// fetching device descriptions, and makes the returned IGD set it on its SOAP
+// requests, for gateways that filter requests by their headers. It may be
+// given more than once, for different headers; a later value for the same key
+// replaces an earlier one.
+func WithHeader(key, value string) Option {
+	return func(o *options) {
+		if o.header == nil {
+			o.header = make(http.Header)
+		}
+		o.header.Set(key, value)
+	}
+}
+
+// WithUserAgent is the same as WithHeader("User-Agent", ua). Without it, Go's
+// default User-Agent is sent.
+func WithUserAgent(ua string) Option {
+	return WithHeader("User-Agent", ua)
+}
+
+// WithConnectionPreference chooses which WAN connection service Discover
+// uses on routers that offer more than one, in place of PreferDefault.
+func WithConnectionPreference(p ConnectionPreference) Option {
+	return func(o *options) {
+		o.connPref = p
+	}
+}
+
+// WithQuirks applies the workarounds q to routers whose manufacturer and
+// model name, as reported by DeviceInfo, contain manufacturer and model,
+// ignoring case; either may be empty to match any. It is for routers that
+// this package does not yet know to be broken. Entries given this way take
+// precedence over the built-in ones, and over those given earlier.
+func WithQuirks(manufacturer, model string, q Quirks) Option {
+	return func(o *options) {
+		o.quirks = append([]quirkEntry{{manufacturer, model, q}}, o.quirks...)
+	}
+}
+
+// WithoutQuirks disables the workarounds otherwise applied to routers known
+// to depart from the specification, including those given with WithQuirks.
+func WithoutQuirks() Option {
+	return func(o *options) {
+		o.noQuirks = true
+	}
+}
+
+// quirkTable returns the quirk entries to match routers against.
+func (o *options) quirkTable() []quirkEntry {
+	if o.noQuirks {
+		return nil
+	}
+	return append(o.quirks[:len(o.quirks):len(o.quirks)], knownQuirks...)
+}
+
+// WithSSDPSourcePort makes the search be sent from port, in place of an
+// ephemeral one, for firewalls that only admit responses to a known port.
+// As only one search can use the port at a time, the connection services are
+// then searched for one after another rather than at once, which makes
+// discovery slower when the first is not found.
+func WithSSDPSourcePort(port uint16) Option {
+	return func(o *options) {
+		o.ssdpPort = port
+	}
+}
+
+// WithMulticastTTL sets the time-to-live of the search, which is otherwise
+// the operating system's default, typically 1. A larger TTL is needed to
+// reach a router more than one hop away, as from inside some containers.
+func WithMulticastTTL(ttl int) Option {
+	return func(o *options) {
+		o.multicastTTL = ttl
+	}
+}
+
+// WithNotifyListen makes the search also collect the ssdp:alive
+// announcements that routers send unprompted, for routers whose responses to
+// searches are lost or filtered. An announcement is only seen if the router
+// sends one during the search, and only if this host can join the SSDP
+// multicast group; the search proceeds regardless.
+func WithNotifyListen() Option {
+	return func(o *options) {
+		o.listenNotify = true
+	}
+}
+
+// searchOptions returns the socket options of the SSDP search.
+func (o *options) searchOptions() goupnp.SearchOptions {
+	so := goupnp.SearchOptions{
+		MulticastTTL: o.multicastTTL,
+		ListenNotify: o.listenNotify,
+	}
+	if o.ssdpPort != 0 {
+		so.LocalAddr = net.JoinHostPort("", strconv.Itoa(int(o.ssdpPort)))
+	}
+	return so
+}
+
+// WithSubnetFilter makes Discover accept only routers whose address lies in
+// subnet, in place of its preference for the router on the default route's
+// subnet. It is for hosts where internet traffic should not take the
+// default route, e.g. on a VPN that carries only some traffic.
+func WithSubnetFilter(subnet *net.IPNet) Option {
+	return func(o *options) {
+		o.subnet = subnet
+	}
+}
+
+// WithSTUNServers sets the STUN servers, as host:port, that the returned IGD's
+// ExternalAddresses asks for this host's external IP, in place of
+// stun.DefaultServers.
+func WithSTUNServers(servers ...string) Option {
+	return func(o *options) {
+		o.stunServers = servers
+	}
+}
+
+// WithIPResolvers adds sources of this host's external IP that the returned
+// IGD's ResolveExternalIP consults, in order, when the router cannot report
+// a usable one, e.g. HTTPResolver, STUNResolver and InterfaceResolver.
+func WithIPResolvers(resolvers ...IPResolver) Option {
+	return func(o *options) {
+		o.resolvers = append(o.resolvers, resolvers...)
+	}
+}
+
+// WithMappingStore makes the returned IGD record every mapping it creates,
+// and forget every one it removes, in s, so that Reconcile can restore them.
+func WithMappingStore(s MappingStore) Option {
+	return func(o *options) {
+		o.store = s
+	}
+}
+
+// WithLogger makes Discover and Load, and the returned IGD, log to l instead
+// of to the Logger set with SetLogger.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithSOAPTrace makes the returned IGD pass a record of each SOAP action it
+// performs to fn, after the action completes, e.g. to be attached to a bug
+// report about a router's behavior. fn must be safe for concurrent use if
+// the IGD is used concurrently.
+func WithSOAPTrace(fn func(SOAPTrace)) Option {
+	return func(o *options) {
+		o.soapTrace = fn
+	}
+}
+
+// WithDebug makes the returned IGD log each SOAP action it performs, with its
+// arguments, latency and fault, to its Logger.
+func WithDebug() Option {
+	return func(o *options) {
+		o.debug = true
+	}
+}
+
+// WithoutNATPMP stops Discover from falling back to NAT-PMP or PCP when no
+// UPnP router is found.
+func WithoutNATPMP() Option {
+	return func(o *options) {
+		o.natpmp = false
+	}
+}
+
+// searchWait returns the number of seconds to wait for routers to answer a
+// search.
+func (o *options) searchWait() int {
+	if o.searchTimeout <= 0 {
+		return 2
+	}
+	secs := int((o.searchTimeout + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+// checkMulticast returns ErrNoMulticastInterface if the search should fail
+// fast, and this host cannot send it.
+func (o *options) checkMulticast() error {
+	if !o.failFastMulticast {
+		return nil
+	}
+	if ok, err := haveMulticastInterface(); err != nil {
+		return err
+	} else if !ok {
+		return ErrNoMulticastInterface
+	}
+	return nil
+}
+
+// context returns ctx, carrying the HTTP client set by WithHTTPClient, and
+// the headers set by WithHeader.
+func (o *options) context(ctx context.Context) context.Context {
+	if len(o.header) > 0 {
+		return goupnp.WithHTTPClient(ctx, withHeader(o.httpClient, o.header))
+	} else if o.httpClient == nil {
+		return ctx
+	}
+	return goupnp.WithHTTPClient(ctx, o.httpClient)
+}
+
+// configure applies the options that affect an IGD's behavior to d.
+func (o *options) configure(d *IGD) {
+	d.routeBasedIP = o.routeBasedIP
+	d.leaseFallback = o.leaseFallback
+	d.stunServers = o.stunServers
+	d.resolvers = o.resolvers
+	d.store = o.store
+	d.logger = o.logger
+	d.metrics = o.metrics
+	d.plan = o.plan
+	d.jitter = o.jitter
+	if trace := o.trace(d); trace != nil {
+		d.client.GetServiceClient().SOAPClient.Trace = trace
+	}
+	o.configureTransport(d)
+	d.quirkTable = o.quirkTable()
+	d.client = d.withQuirks(d.client)
+	if o.autoHeal {
+		d.autoHeal(o)
+	}
+	if o.defaultTimeout > 0 {
+		d.SetTimeout(o.defaultTimeout)
+	}
+}
+
+// configureTransport gives d's SOAP client the HTTP client given with
+// WithHTTPClient, and layers the headers, rate limit and in-flight limit of o
+// on its transport.
+func (o *options) configureTransport(d *IGD) {
+	if o.httpClient != nil {
+		d.client.GetServiceClient().SOAPClient.HTTPClient = *o.httpClient
+	}
+	d.setHeader(o.header)
+	d.limitRate(o.rateInterval)
+	d.limitInFlight(o.maxInFlight)
+}
+
+// choose returns the router to use among candidates, which all answered the
+// same search and passed validation, or nil if there are none. Without
+// WithSubnetFilter, the first on the default route's subnet is preferred;
+// otherwise, or if there is none, the first is chosen.
+func (o *options) choose(candidates []*IGD) *IGD {
+	if len(candidates) == 0 {
+		return nil
+	} else if len(candidates) > 1 && o.subnet == nil {
+		for _, d := range candidates {
+			if OnDefaultRoute(d) == nil {
+				return d
+			}
+		}
+	}
+	return candidates[0]
+}
+
+// validate checks that d is on the subnet given to WithSubnetFilter, if any,
+// and runs every validator against it, returning the first error.
+func (o *options) validate(d *IGD) error {
+	if o.subnet != nil {
+		if ip, err := d.routerIP(); err != nil {
+			return err
+		} else if !o.subnet.Contains(ip) {
+			return fmt.Errorf("router %v is not on subnet %v", ip, o.subnet)
+		}
+	}
+	for _, validate := range o.validators {
+		if err := validate(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validationError combines the errors returned by validators into one, which
+// errors.Is and errors.As see through.
+func validationError(errs []error) error {
+	return fmt.Errorf("no UPnP-enabled gateway passed validation: %w", errors.Join(errs...))
+}
@@ -0,0 +1,125 @@
+package upnp
+
+import "time"
+
+// A ForwardOutcome describes what ForwardStatus did to the router's port
+// mapping table.
+type ForwardOutcome int
+
+const (
+	// Created means that no mapping existed, and one was created.
+	Created ForwardOutcome = iota
+	// AlreadyExists means that an identical mapping was already present, so
+	// nothing was changed.
+	AlreadyExists
+	// Replaced means that a different mapping for the port was present, and
+	// was overwritten.
+	Replaced
+)
+
+// String implements fmt.Stringer.
+func (o ForwardOutcome) String() string {
+	switch o {
+	case Created:
+		return "Created"
+	case AlreadyExists:
+		return "AlreadyExists"
+	case Replaced:
+		return "Replaced"
+	default:
+		return "ForwardOutcome(?)"
+	}
+}
+
+// ForwardStatus forwards the specified port like Forward, but first checks
+// for existing mappings, and reports what it changed. A mapping is identical
+// if it forwards to the same internal IP and port, is enabled, and has the
+// same description; identical mappings are left untouched. When the two
+// protocols differ, Replaced takes precedence over Created, and Created over
+// AlreadyExists. If a mapping cannot be created, any created for the other
+// protocol is removed.
+func (d *IGD) ForwardStatus(port uint16, desc string) (ForwardOutcome, error) {
+	ip, err := d.getInternalIP()
+	if err != nil {
+		return 0, err
+	}
+
+	outcome := AlreadyExists
+	var created []mappingID
+	for _, proto := range []string{"TCP", "UDP"} {
+		time.Sleep(time.Millisecond)
+		intPort, client, enabled, curDesc, _, err := d.client.GetSpecificPortMappingEntry("", port, proto)
+		var o ForwardOutcome
+		switch {
+		case faultCode(err) == errCodeNoSuchEntry:
+			o = Created
+		case err != nil:
+			d.rollback(created)
+			return 0, upnpError(err)
+		case intPort == port && client == ip && enabled && curDesc == desc:
+			continue
+		default:
+			o = Replaced
+		}
+
+		time.Sleep(time.Millisecond)
+		if err := d.addPortMapping("", port, proto, port, ip, true, desc, 0); err != nil {
+			d.rollback(created)
+			return 0, err
+		}
+		id := mappingID{"", port, proto}
+		d.track(id, trackedMapping{internalPort: port, internalIP: ip, enabled: true, desc: desc, local: true})
+		if o == Created {
+			created = append(created, id)
+		}
+		if o == Replaced || outcome == AlreadyExists {
+			outcome = o
+		}
+	}
+	return outcome, nil
+}
+
+// ForwardWithRetry forwards the specified port like Forward, but recovers
+// from a ConflictInMappingEntry error caused by a stale mapping of our own,
+// e.g. one left behind for an old internal IP after a DHCP change. If the
+// conflicting mapping of either protocol has the description desc, it is
+// deleted and the forward is retried once; if it has any other description,
+// it belongs to someone else, and the conflict is returned. Either both
+// protocols are forwarded, or neither is.
+func (d *IGD) ForwardWithRetry(port uint16, desc string) error {
+	err := d.Forward(port, desc)
+	if faultCode(err) != ErrCodeConflictInMappingEntry {
+		return err
+	}
+	var stale []string
+	for _, proto := range []string{"TCP", "UDP"} {
+		time.Sleep(time.Millisecond)
+		_, _, _, curDesc, _, lookupErr := d.client.GetSpecificPortMappingEntry("", port, proto)
+		if faultCode(lookupErr) == errCodeNoSuchEntry {
+			continue
+		} else if lookupErr != nil {
+			return upnpError(lookupErr)
+		} else if curDesc != desc {
+			return err
+		}
+		stale = append(stale, proto)
+	}
+	for _, proto := range stale {
+		time.Sleep(time.Millisecond)
+		if err := d.deletePortMapping("", port, proto); err != nil && faultCode(err) != errCodeNoSuchEntry {
+			return err
+		}
+		d.untrack(mappingID{"", port, proto})
+	}
+	return d.Forward(port, desc)
+}
+
+// rollback removes the mappings ids, which were just created.
+func (d *IGD) rollback(ids []mappingID) {
+	for _, id := range ids {
+		time.Sleep(time.Millisecond)
+		if d.deletePortMapping(id.remoteHost, id.externalPort, id.protocol) == nil {
+			d.untrack(id)
+		}
+	}
+}
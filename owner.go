@@ -0,0 +1,64 @@
+package upnp
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// TagFor returns a new ownership tag for app, of the form "app:id", where id
+// is random. Mappings created with ForwardOwned carry the tag in their
+// description, so that OwnedMappings and ClearOwned can tell them apart from
+// those of other applications, or of other instances of app, however their
+// descriptions are otherwise chosen. The tag should be saved and reused
+// across restarts, so that mappings left behind by a crash can be found.
+// Colons in app are replaced with dashes.
+func TagFor(app string) string {
+	return strings.Replace(app, ":", "-", -1) + ":" + hex.EncodeToString(fastrand.Bytes(16))
+}
+
+// OwnedDescription returns the description given by ForwardOwned to a
+// mapping of port owned by tag, "app:id:port".
+func OwnedDescription(tag string, port uint16) string {
+	return tag + ":" + strconv.Itoa(int(port))
+}
+
+// ownedBy reports whether m is owned by tag. The port is part of the
+// description so that an entry whose description was copied to another port,
+// e.g. by a router's web interface, is not mistaken for one of tag's.
+func ownedBy(m Mapping, tag string) bool {
+	return m.Description == OwnedDescription(tag, m.ExternalPort)
+}
+
+// ForwardOwned forwards port like Forward, marking the mapping as owned by
+// tag, which should come from TagFor.
+func (d *IGD) ForwardOwned(tag string, port uint16) error {
+	return d.Forward(port, OwnedDescription(tag, port))
+}
+
+// OwnedMappings returns the entries in the router's port mapping table that
+// are owned by tag, i.e. that were created by ForwardOwned with the same tag.
+func (d *IGD) OwnedMappings(tag string) ([]Mapping, error) {
+	mappings := []Mapping{}
+	err := d.walkMappings(func(m Mapping) {
+		if ownedBy(m, tag) {
+			mappings = append(mappings, m)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// ClearOwned removes every mapping owned by tag, and no other, and returns
+// the number removed. Unlike ClearAllByDescriptionPrefix, it cannot remove
+// another application's mappings by accident. Deletion continues past
+// failures, and the first error is returned.
+func (d *IGD) ClearOwned(tag string) (int, error) {
+	return d.clearMatching(func(m Mapping) bool {
+		return ownedBy(m, tag)
+	})
+}
@@ -0,0 +1,122 @@
+package upnp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway2"
+)
+
+// IANA protocol numbers, which identify the protocol of a pinhole.
+const (
+	protoNumTCP = 6
+	protoNumUDP = 17
+)
+
+// An IGDv6 manages the IPv6 firewall of a router. IPv6 is not subject to NAT,
+// so instead of port mappings, hosts behind the router are made reachable by
+// opening pinholes in its firewall.
+type IGDv6 struct {
+	client *internetgateway2.WANIPv6FirewallControl1
+	// gateway is the IGD on the same router, used to find this host's
+	// address.
+	gateway *IGD
+}
+
+// DiscoverIPv6 discovers a router like Discover, and returns its IPv6
+// firewall. If the router has no WANIPv6FirewallControl service,
+// ErrNoIPv6FirewallControl is returned.
+func DiscoverIPv6(opts ...Option) (*IGDv6, error) {
+	d, err := Discover(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return d.IPv6()
+}
+
+// IPv6 returns the IPv6 firewall of d's router. If the router has no
+// WANIPv6FirewallControl service, ErrNoIPv6FirewallControl is returned.
+func (d *IGD) IPv6() (*IGDv6, error) {
+	sc := d.client.GetServiceClient()
+	clients, err := internetgateway2.NewWANIPv6FirewallControl1ClientsFromRootDevice(sc.RootDevice, sc.Location)
+	if err != nil || len(clients) == 0 {
+		return nil, ErrNoIPv6FirewallControl
+	}
+	d.shareHTTPClient(clients[0].SOAPClient)
+	return &IGDv6{client: clients[0], gateway: d}, nil
+}
+
+// OpenPinhole allows inbound traffic from any host to the specified port of
+// this host's global IPv6 address, for the given protocol ("TCP" or "UDP", in
+// any case). The router closes the pinhole after lease, which must be between
+// 1 second and 24 hours. The returned id identifies the pinhole to
+// ClosePinhole.
+func (d *IGDv6) OpenPinhole(port uint16, proto string, lease time.Duration) (id uint16, err error) {
+	if lease < time.Second || lease > 24*time.Hour {
+		return 0, errors.New("pinhole lease must be between 1 second and 24 hours")
+	}
+	proto, err = normalizeProtocol(proto)
+	if err != nil {
+		return 0, err
+	}
+	protoNum := uint16(protoNumTCP)
+	if proto == "UDP" {
+		protoNum = protoNumUDP
+	}
+	ip, err := d.gateway.ExternalIPv6()
+	if err != nil {
+		return 0, err
+	}
+	if d.gateway.dryRun("AddPinhole", [][2]string{
+		{"RemoteHost", ""},
+		{"RemotePort", "0"},
+		{"InternalClient", ip},
+		{"InternalPort", marshalUi2(port)},
+		{"Protocol", marshalUi2(protoNum)},
+		{"LeaseTime", fmt.Sprint(uint32(lease / time.Second))},
+	}) {
+		return 0, nil
+	}
+	time.Sleep(time.Millisecond)
+	// an empty remote host and a remote port of 0 are wildcards
+	id, err = d.client.AddPinhole("", 0, ip, port, protoNum, uint32(lease/time.Second))
+	return id, upnpError(err)
+}
+
+// ClosePinhole closes the pinhole identified by id.
+func (d *IGDv6) ClosePinhole(id uint16) error {
+	if d.gateway.dryRun("DeletePinhole", [][2]string{{"UniqueID", marshalUi2(id)}}) {
+		return nil
+	}
+	time.Sleep(time.Millisecond)
+	return upnpError(d.client.DeletePinhole(id))
+}
+
+// RenewPinhole extends the pinhole identified by id to close after lease,
+// which must be between 1 second and 24 hours, from now.
+func (d *IGDv6) RenewPinhole(id uint16, lease time.Duration) error {
+	if lease < time.Second || lease > 24*time.Hour {
+		return errors.New("pinhole lease must be between 1 second and 24 hours")
+	}
+	if d.gateway.dryRun("UpdatePinhole", [][2]string{
+		{"UniqueID", marshalUi2(id)},
+		{"NewLeaseTime", fmt.Sprint(uint32(lease / time.Second))},
+	}) {
+		return nil
+	}
+	time.Sleep(time.Millisecond)
+	return upnpError(d.client.UpdatePinhole(id, uint32(lease/time.Second)))
+}
+
+// PinholeWorking reports whether traffic is passing through the pinhole
+// identified by id, according to the router. The CheckPinholeWorking action
+// is optional; ErrUnsupported is returned by routers that lack it.
+func (d *IGDv6) PinholeWorking(id uint16) (bool, error) {
+	time.Sleep(time.Millisecond)
+	working, err := d.client.CheckPinholeWorking(id)
+	if code := faultCode(err); code == errCodeInvalidAction || code == errCodeOptionalActionNotImplemented {
+		return false, ErrUnsupported
+	}
+	return working, upnpError(err)
+}
@@ -0,0 +1,77 @@
+package upnp
+
+import (
+	"sync"
+	"time"
+)
+
+// A PortMapper forwards ports with leases, renews them before they expire,
+// and removes them all when it is closed. Because the router expires leased
+// mappings by itself, they do not outlive a process that dies without
+// calling Close by more than one lease.
+type PortMapper struct {
+	d *IGD
+
+	mu    sync.Mutex
+	ports map[uint16]func() // stops renewal of each port
+}
+
+// NewPortMapper returns a PortMapper that forwards ports on d.
+func NewPortMapper(d *IGD) *PortMapper {
+	return &PortMapper{
+		d:     d,
+		ports: make(map[uint16]func()),
+	}
+}
+
+// ForwardLease forwards the specified port with a lease of lease, which must
+// be at least 2 seconds, and renews it until the port is cleared or the
+// PortMapper is closed. If the router only supports permanent mappings, the
+// port is forwarded permanently instead, and is removed by Close all the
+// same. Renewal failures are retried at the next renewal.
+func (pm *PortMapper) ForwardLease(port uint16, desc string, lease time.Duration) error {
+	stop, err := pm.d.KeepAlive(port, desc, lease, nil)
+	if faultCode(err) == ErrCodeOnlyPermanentLeasesSupported {
+		stop, err = func() {}, pm.d.Forward(port, desc)
+	}
+	if err != nil {
+		return err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if old, ok := pm.ports[port]; ok {
+		old()
+	}
+	pm.ports[port] = stop
+	return nil
+}
+
+// Clear stops renewing the specified port, and un-forwards it.
+func (pm *PortMapper) Clear(port uint16) error {
+	pm.mu.Lock()
+	stop, ok := pm.ports[port]
+	delete(pm.ports, port)
+	pm.mu.Unlock()
+	if ok {
+		stop()
+	}
+	return pm.d.Clear(port)
+}
+
+// Close stops renewing every port forwarded by pm, and un-forwards them. All
+// of the ports are attempted; the first error is returned.
+func (pm *PortMapper) Close() error {
+	pm.mu.Lock()
+	ports := pm.ports
+	pm.ports = make(map[uint16]func())
+	pm.mu.Unlock()
+
+	var firstErr error
+	for port, stop := range ports {
+		stop()
+		if err := pm.d.Clear(port); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
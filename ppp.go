@@ -0,0 +1,50 @@
+package upnp
+
+import (
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway1"
+)
+
+// ppp returns d's client as a WANPPPConnection:1 client, if it is one.
+func (d *IGD) ppp() (*internetgateway1.WANPPPConnection1, bool) {
+	c, ok := d.connection().(*internetgateway1.WANPPPConnection1)
+	return c, ok
+}
+
+// IsPPP reports whether d uses a WANPPPConnection service, which supports
+// RequestConnection and ForceTermination.
+func (d *IGD) IsPPP() bool {
+	_, ok := d.ppp()
+	return ok
+}
+
+// RequestConnection asks a PPP-based router to dial its WAN connection, if it
+// is not already connected. Together with ForceTermination, it can be used to
+// re-dial the connection, which usually yields a fresh external IP. Routers
+// that do not use PPP return ErrUnsupported.
+func (d *IGD) RequestConnection() error {
+	c, ok := d.ppp()
+	if !ok {
+		return ErrUnsupported
+	} else if d.dryRun("RequestConnection", nil) {
+		return nil
+	}
+	time.Sleep(time.Millisecond)
+	return upnpError(c.RequestConnection())
+}
+
+// ForceTermination asks a PPP-based router to hang up its WAN connection
+// immediately. The connection stays down until RequestConnection is called,
+// or the router re-dials it by itself, so this host may lose its internet
+// access until then. Routers that do not use PPP return ErrUnsupported.
+func (d *IGD) ForceTermination() error {
+	c, ok := d.ppp()
+	if !ok {
+		return ErrUnsupported
+	} else if d.dryRun("ForceTermination", nil) {
+		return nil
+	}
+	time.Sleep(time.Millisecond)
+	return upnpError(c.ForceTermination())
+}
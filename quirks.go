@@ -0,0 +1,171 @@
+package upnp
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Quirks describes how a router departs from the IGD specification, and so
+// how the arguments of its port mapping actions must be adapted. The zero
+// value describes a router that follows the specification.
+type Quirks struct {
+	// WildcardHost is sent as the remote host of mappings that accept
+	// traffic from any host, in place of the empty string prescribed by the
+	// specification. Entries the router reports under it are returned with
+	// an empty RemoteHost.
+	WildcardHost string
+	// PermanentLeases makes every mapping permanent, for routers that refuse
+	// leases without reporting OnlyPermanentLeasesSupported, so that the
+	// usual fallbacks never trigger.
+	PermanentLeases bool
+	// LowercaseProtocol sends "tcp" and "udp" in place of "TCP" and "UDP",
+	// for routers that compare protocols case-sensitively.
+	LowercaseProtocol bool
+}
+
+// A quirkEntry gives the Quirks of the routers whose manufacturer and model
+// name contain those of the entry, ignoring case.
+type quirkEntry struct {
+	manufacturer string
+	model        string
+	quirks       Quirks
+}
+
+// knownQuirks lists the routers known to depart from the specification.
+var knownQuirks = []quirkEntry{
+	// certain FRITZ!Box firmwares treat an empty remote host as matching no
+	// host, and store and report wildcard mappings under 0.0.0.0
+	{"AVM", "FRITZ!Box", Quirks{WildcardHost: "0.0.0.0"}},
+	// the WRT54G answers any lease with 501 ActionFailed
+	{"Linksys", "WRT54G", Quirks{PermanentLeases: true}},
+}
+
+// lookupQuirks returns the quirks given by the first entry of table that
+// matches the router with the given manufacturer and model name.
+func lookupQuirks(table []quirkEntry, manufacturer, model string) (q Quirks, ok bool) {
+	manufacturer, model = strings.ToLower(manufacturer), strings.ToLower(model)
+	for _, k := range table {
+		if strings.Contains(manufacturer, strings.ToLower(k.manufacturer)) && strings.Contains(model, strings.ToLower(k.model)) {
+			return k.quirks, true
+		}
+	}
+	return Quirks{}, false
+}
+
+// A quirkClient is an igdClient that adapts the arguments of the port
+// mapping actions to a router's quirks, so that the rest of the package can
+// follow the specification.
+type quirkClient struct {
+	igdClient
+	quirks Quirks
+}
+
+// remoteHost returns the remote host to send to the router for host.
+func (q Quirks) remoteHost(host string) string {
+	if host == "" && q.WildcardHost != "" {
+		return q.WildcardHost
+	}
+	return host
+}
+
+// protocol returns the protocol to send to the router for proto.
+func (q Quirks) protocol(proto string) string {
+	if q.LowercaseProtocol {
+		return strings.ToLower(proto)
+	}
+	return proto
+}
+
+// lease returns the lease duration to send to the router for lease.
+func (q Quirks) lease(lease uint32) uint32 {
+	if q.PermanentLeases {
+		return 0
+	}
+	return lease
+}
+
+// adaptArgs returns the arguments of a SOAP action, a pointer to a struct of
+// the kind passed to soap.SOAPClient.PerformAction, adapted to q, for
+// actions that are performed without an igdClient method. The remote host,
+// protocol and lease duration are adapted if the struct has the fields
+// NewRemoteHost, NewProtocol and NewLeaseDuration; request itself is left
+// unchanged, and is returned if there is nothing to adapt.
+func (q Quirks) adaptArgs(request interface{}) interface{} {
+	v := reflect.ValueOf(request)
+	if q == (Quirks{}) || v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return request
+	}
+	adapted := reflect.New(v.Elem().Type())
+	adapted.Elem().Set(v.Elem())
+	args := adapted.Elem()
+	if f := args.FieldByName("NewRemoteHost"); f.Kind() == reflect.String && f.CanSet() {
+		f.SetString(q.remoteHost(f.String()))
+	}
+	if f := args.FieldByName("NewProtocol"); f.Kind() == reflect.String && f.CanSet() {
+		f.SetString(q.protocol(f.String()))
+	}
+	if f := args.FieldByName("NewLeaseDuration"); f.Kind() == reflect.String && f.CanSet() && q.PermanentLeases {
+		f.SetString("0")
+	}
+	return adapted.Interface()
+}
+
+// AddPortMapping implements igdClient.
+func (c *quirkClient) AddPortMapping(remoteHost string, extPort uint16, proto string, intPort uint16, intClient string, enabled bool, desc string, lease uint32) error {
+	return c.igdClient.AddPortMapping(c.quirks.remoteHost(remoteHost), extPort, c.quirks.protocol(proto), intPort, intClient, enabled, desc, c.quirks.lease(lease))
+}
+
+// GetSpecificPortMappingEntry implements igdClient.
+func (c *quirkClient) GetSpecificPortMappingEntry(remoteHost string, extPort uint16, proto string) (uint16, string, bool, string, uint32, error) {
+	return c.igdClient.GetSpecificPortMappingEntry(c.quirks.remoteHost(remoteHost), extPort, c.quirks.protocol(proto))
+}
+
+// GetGenericPortMappingEntry implements igdClient.
+func (c *quirkClient) GetGenericPortMappingEntry(index uint16) (remoteHost string, extPort uint16, proto string, intPort uint16, intClient string, enabled bool, desc string, lease uint32, err error) {
+	remoteHost, extPort, proto, intPort, intClient, enabled, desc, lease, err = c.igdClient.GetGenericPortMappingEntry(index)
+	if c.quirks.WildcardHost != "" && remoteHost == c.quirks.WildcardHost {
+		remoteHost = ""
+	}
+	if c.quirks.LowercaseProtocol {
+		proto = strings.ToUpper(proto)
+	}
+	return
+}
+
+// DeletePortMapping implements igdClient.
+func (c *quirkClient) DeletePortMapping(remoteHost string, extPort uint16, proto string) error {
+	return c.igdClient.DeletePortMapping(c.quirks.remoteHost(remoteHost), extPort, c.quirks.protocol(proto))
+}
+
+// withQuirks wraps client in a quirkClient if d's quirk table has an entry
+// for the router it belongs to.
+func (d *IGD) withQuirks(client igdClient) igdClient {
+	switch client.(type) {
+	case *natpmpClient, *quirkClient, *healingClient:
+		return client
+	}
+	root := client.GetServiceClient().RootDevice
+	if root == nil {
+		return client
+	}
+	dev := root.Device
+	q, ok := lookupQuirks(d.quirkTable, dev.Manufacturer, dev.ModelName)
+	if !ok || q == (Quirks{}) {
+		return client
+	}
+	d.logf("upnp: adapting to the quirks of %s %s: %+v", dev.Manufacturer, dev.ModelName, q)
+	return &quirkClient{igdClient: client, quirks: q}
+}
+
+// Quirks returns the workarounds applied to d's router, which are the zero
+// Quirks if it follows the specification, or if WithoutQuirks was given.
+func (d *IGD) Quirks() Quirks {
+	client := d.client
+	if h, ok := client.(*healingClient); ok {
+		client = h.current()
+	}
+	if q, ok := client.(*quirkClient); ok {
+		return q.quirks
+	}
+	return Quirks{}
+}
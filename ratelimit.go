@@ -0,0 +1,72 @@
+package upnp
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// rateTransport is an http.RoundTripper that spaces the requests it sends at
+// least interval apart, delaying those that would come too soon.
+type rateTransport struct {
+	base     http.RoundTripper
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(t.interval)
+	t.mu.Unlock()
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// limitRate makes d's SOAP client send requests to the router at least
+// interval apart. If interval is not positive, the rate is not limited.
+func (d *IGD) limitRate(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	c := &d.client.GetServiceClient().SOAPClient.HTTPClient
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c.Transport = &rateTransport{base: base, interval: interval}
+}
+
+// jitter shortens d by a random amount of up to fraction of it, so that the
+// waits of many hosts started at the same moment drift apart. Waits are only
+// ever shortened, so that leases renewed after a jittered wait do not expire.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || d <= 0 {
+		return d
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	max := int(float64(d) * fraction)
+	if max <= 0 {
+		return d
+	}
+	return d - time.Duration(fastrand.Intn(max))
+}
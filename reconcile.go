@@ -0,0 +1,127 @@
+package upnp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReconcileMappings converges the router's port mapping table on desired,
+// the complete set of mappings that the caller wants, and reports what it
+// did: the mappings it added, those it removed, and those that were already
+// as desired. Only the entries for which owns returns true are considered
+// the caller's; the others are never touched. If owns is nil, the entries
+// that forward to this host are the caller's. An OwnedDescription tag makes
+// a more precise owns:
+//
+//	d.ReconcileMappings(desired, func(m upnp.Mapping) bool {
+//		return strings.HasPrefix(m.Description, tag+":")
+//	})
+//
+// In desired, an empty InternalClient means this host, a zero InternalPort
+// means ExternalPort, LeaseDuration is the lease requested, and Enabled must
+// be set for the mapping to forward traffic. A desired mapping is unchanged
+// if the router holds it with the same internal client, internal port,
+// description and enabled state; one of the caller's entries that differs is
+// removed and added again, and so is reported in both removed and added. A
+// desired mapping whose port the router holds for someone else is not added,
+// and ErrMappingConflict is reported. Every other entry of the caller's is
+// removed. Work continues past failures, and the first error is returned.
+//
+// Unlike Reconcile, which restores the mappings recorded in a MappingStore,
+// ReconcileMappings is given the desired state on each call, which suits
+// long-running programs that re-apply their configuration periodically.
+func (d *IGD) ReconcileMappings(desired []PortMapping, owns func(Mapping) bool) (added, removed, unchanged []PortMapping, err error) {
+	ip, err := d.getInternalIP()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if owns == nil {
+		owns = func(m Mapping) bool { return m.InternalClient == ip }
+	}
+
+	want := make(map[mappingID]PortMapping, len(desired))
+	order := make([]mappingID, 0, len(desired))
+	for _, m := range desired {
+		if m.Protocol, err = normalizeProtocol(m.Protocol); err != nil {
+			return nil, nil, nil, err
+		}
+		if m.InternalClient == "" {
+			m.InternalClient = ip
+		}
+		if m.InternalPort == 0 {
+			m.InternalPort = m.ExternalPort
+		}
+		id := mappingID{m.RemoteHost, m.ExternalPort, m.Protocol}
+		if _, ok := want[id]; !ok {
+			order = append(order, id)
+		}
+		want[id] = m
+	}
+	current := make(map[mappingID]Mapping)
+	var currentOrder []mappingID
+	if err := d.walkMappings(func(m Mapping) {
+		id := mappingID{m.RemoteHost, m.ExternalPort, strings.ToUpper(m.Protocol)}
+		current[id] = m
+		currentOrder = append(currentOrder, id)
+	}); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	remove := func(id mappingID, m Mapping) bool {
+		time.Sleep(time.Millisecond)
+		if err := d.deletePortMapping(id.remoteHost, id.externalPort, id.protocol); err != nil && faultCode(err) != errCodeNoSuchEntry {
+			fail(err)
+			return false
+		}
+		d.untrack(id)
+		removed = append(removed, m)
+		return true
+	}
+
+	// remove the caller's entries that are not wanted first, so that their
+	// slots are free for the ones that are
+	for _, id := range currentOrder {
+		if m := current[id]; owns(m) {
+			if _, ok := want[id]; !ok {
+				remove(id, m)
+			}
+		}
+	}
+	for _, id := range order {
+		m := want[id]
+		if cur, ok := current[id]; ok {
+			if cur.InternalClient == m.InternalClient && cur.InternalPort == m.InternalPort &&
+				cur.Description == m.Description && cur.Enabled == m.Enabled {
+				unchanged = append(unchanged, cur)
+				continue
+			} else if !owns(cur) {
+				fail(fmt.Errorf("%d/%s forwards to %s: %w", id.externalPort, id.protocol, cur.InternalClient, ErrMappingConflict))
+				continue
+			} else if !remove(id, cur) {
+				continue
+			}
+		}
+		lease := uint32(m.LeaseDuration / time.Second)
+		time.Sleep(time.Millisecond)
+		if err := d.addPortMapping(id.remoteHost, id.externalPort, id.protocol, m.InternalPort, m.InternalClient, m.Enabled, m.Description, lease); err != nil {
+			fail(err)
+			continue
+		}
+		d.track(id, trackedMapping{
+			internalPort: m.InternalPort,
+			internalIP:   m.InternalClient,
+			enabled:      m.Enabled,
+			desc:         m.Description,
+			lease:        lease,
+		})
+		added = append(added, m)
+	}
+	return added, removed, unchanged, firstErr
+}
@@ -0,0 +1,164 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultResolverTimeout bounds each source consulted by ResolveExternalIP
+// that does not set its own timeout.
+const defaultResolverTimeout = 5 * time.Second
+
+// SourceUPnP is the source reported by ResolveExternalIP when the router's
+// answer was used.
+const SourceUPnP = "upnp"
+
+// An IPResolver is a source of this host's external IP other than the
+// router, consulted by ResolveExternalIP when the router cannot report a
+// usable one. HTTPResolver, STUNResolver and InterfaceResolver return
+// common ones; others can be built by setting the fields.
+type IPResolver struct {
+	// Name identifies the resolver in the source reported by
+	// ResolveExternalIP and in its errors.
+	Name string
+	// Resolve returns the external IP, and should give up when ctx is done.
+	Resolve func(ctx context.Context) (string, error)
+	// Timeout bounds each call of Resolve. If zero, 5 seconds is used.
+	Timeout time.Duration
+}
+
+// HTTPResolver returns an IPResolver that fetches url, a "what's my IP"
+// service such as https://api.ipify.org that answers with the address alone,
+// using http.DefaultClient.
+func HTTPResolver(url string) IPResolver {
+	return IPResolver{
+		Name: url,
+		Resolve: func(ctx context.Context) (string, error) {
+			req, err := http.NewRequest("GET", url, nil)
+			if err != nil {
+				return "", err
+			}
+			resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return "", errors.New("unexpected status " + resp.Status)
+			}
+			body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(string(body)), nil
+		},
+	}
+}
+
+// STUNResolver returns an IPResolver that asks the STUN servers, as
+// LookupExternalIP does.
+func STUNResolver(servers ...string) IPResolver {
+	return IPResolver{
+		Name: "stun",
+		Resolve: func(ctx context.Context) (string, error) {
+			return LookupExternalIP(ctx, servers...)
+		},
+	}
+}
+
+// InterfaceResolver returns an IPResolver that reports the first publicly
+// routable IPv4 address assigned to one of this host's interfaces, for hosts
+// that are directly attached to the internet.
+func InterfaceResolver() IPResolver {
+	return IPResolver{
+		Name: "interface",
+		Resolve: func(context.Context) (string, error) {
+			addrs, err := net.InterfaceAddrs()
+			if err != nil {
+				return "", err
+			}
+			for _, addr := range addrs {
+				if x, ok := addr.(*net.IPNet); ok && x.IP.To4() != nil && checkRoutable(x.IP) == nil {
+					return x.IP.String(), nil
+				}
+			}
+			return "", errors.New("no publicly routable IPv4 address on any interface")
+		},
+	}
+}
+
+// ResolveExternalIP returns this host's external IP, and the source that
+// produced it: SourceUPnP if the router reported it, or the Name of the
+// IPResolver given with WithIPResolvers that did. The router is asked
+// first, and the resolvers are then consulted in order; the first answer
+// that is a publicly routable address is returned, so a router that reports
+// no address, or a private one because it is behind another NAT, is passed
+// over. Each source is bounded by its own timeout, so one that hangs delays
+// the answer but does not prevent it. If no source answers usably,
+// ErrNoExternalIP is returned, describing why each failed.
+func (d *IGD) ResolveExternalIP(ctx context.Context) (ip, source string, err error) {
+	sources := append([]IPResolver{{
+		Name: SourceUPnP,
+		Resolve: func(context.Context) (string, error) {
+			return d.ExternalIP()
+		},
+	}}, d.resolvers...)
+	var errs []string
+	for _, r := range sources {
+		ip, err := r.resolve(ctx)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", "", ctxErr
+		} else if err != nil {
+			d.logf("upnp: resolving external IP via %s: %v", r.Name, err)
+			errs = append(errs, r.Name+": "+err.Error())
+			continue
+		}
+		return ip, r.Name, nil
+	}
+	return "", "", fmt.Errorf("%w: %s", ErrNoExternalIP, strings.Join(errs, "; "))
+}
+
+// resolve calls r.Resolve within its timeout, and checks that the answer is
+// a publicly routable address. A Resolve that ignores ctx is abandoned once
+// the timeout passes.
+func (r IPResolver) resolve(ctx context.Context) (string, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultResolverTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type result struct {
+		ip  string
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		ip, err := r.Resolve(ctx)
+		ch <- result{ip, err}
+	}()
+	var res result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	answer, err := res.ip, res.err
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(strings.TrimSpace(answer))
+	if ip == nil {
+		return "", fmt.Errorf("invalid address %q", answer)
+	} else if err := checkRoutable(ip); err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
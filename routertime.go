@@ -0,0 +1,33 @@
+package upnp
+
+import (
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/soap"
+)
+
+// urnTime1 is the TR-064 time service, which some routers expose alongside
+// their IGD services.
+const urnTime1 = "urn:dslforum-org:service:Time:1"
+
+// RouterTime returns the router's current local time. This is useful when
+// correlating the router's logs or mapping expiry times with local events.
+// Only routers that expose the TR-064 Time service report their time;
+// ErrUnsupported is returned for all others.
+func (d *IGD) RouterTime() (time.Time, error) {
+	srvs := d.client.GetServiceClient().RootDevice.Device.FindService(urnTime1)
+	if len(srvs) == 0 {
+		return time.Time{}, ErrUnsupported
+	}
+	response := &struct {
+		NewCurrentLocalTime string
+	}{}
+	time.Sleep(time.Millisecond)
+	if err := d.shareHTTPClient(srvs[0].NewSOAPClient()).PerformAction(urnTime1, "GetInfo", nil, response); err != nil {
+		return time.Time{}, err
+	}
+	if t, err := soap.UnmarshalDateTimeTz(response.NewCurrentLocalTime); err == nil {
+		return t, nil
+	}
+	return soap.UnmarshalDateTime(response.NewCurrentLocalTime)
+}
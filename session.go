@@ -0,0 +1,126 @@
+package upnp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultSessionTimeout bounds Session.Close when NewSession is given no
+// timeout.
+const defaultSessionTimeout = 5 * time.Second
+
+// A Session ties a set of mappings to the lifetime of a process. Mappings
+// created through it are remembered, and removed again by a single call to
+// Close, which can be deferred in main or called from a signal handler. Close
+// gives up after a bounded time, so that a router that has stopped answering
+// cannot hang the process on its way out; any mappings it could not remove
+// are left to expire, or to be cleared at the next startup. A Session is
+// safe for concurrent use.
+type Session struct {
+	d       *IGD
+	timeout time.Duration
+
+	mu     sync.Mutex
+	keys   []MappingKey
+	closed bool
+}
+
+// NewSession returns a Session that creates mappings through d. Close spends
+// at most timeout removing them; if timeout is zero, five seconds is used.
+func (d *IGD) NewSession(timeout time.Duration) *Session {
+	if timeout <= 0 {
+		timeout = defaultSessionTimeout
+	}
+	return &Session{d: d, timeout: timeout}
+}
+
+// Forward is the same as IGD.Forward, but the mappings are removed when s is
+// closed.
+func (s *Session) Forward(port uint16, desc string) error {
+	_, err := s.ForwardAdvanced(MappingSpec{
+		ExternalPort: port,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Description:  desc,
+	})
+	return err
+}
+
+// ForwardAdvanced is the same as IGD.ForwardAdvanced, but the mappings are
+// removed when s is closed. In BestEffort mode, the protocols that were
+// forwarded are removed too, even if the others failed. ErrSessionClosed is
+// returned once s is closed.
+func (s *Session) ForwardAdvanced(spec MappingSpec) (MappingKey, error) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return MappingKey{}, ErrSessionClosed
+	}
+	key, err := s.d.ForwardAdvanced(spec)
+	if len(key.protocols) == 0 {
+		return key, err
+	}
+	s.mu.Lock()
+	closed = s.closed
+	if !closed {
+		s.keys = append(s.keys, key)
+	}
+	s.mu.Unlock()
+	if closed {
+		// s was closed while the mapping was being created
+		s.d.ClearKey(key)
+		return MappingKey{}, ErrSessionClosed
+	}
+	return key, err
+}
+
+// Close removes every mapping created through s, spending at most the
+// timeout given to NewSession. The mappings are attempted even if some cannot
+// be removed; the returned error reports how many were left, and wraps the
+// first failure, which is context.DeadlineExceeded if time ran out. Closing a
+// closed Session does nothing.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	keys := s.keys
+	closed := s.closed
+	s.keys, s.closed = nil, true
+	s.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	var firstErr error
+	failed, total := 0, 0
+	for _, key := range keys {
+		for _, proto := range key.protocols {
+			total++
+			id := mappingID{key.remoteHost, key.externalPort, proto}
+			err := s.d.deleteCtx(ctx, id)
+			if err != nil && faultCode(err) != errCodeNoSuchEntry {
+				if firstErr == nil {
+					firstErr = err
+				}
+				failed++
+				continue
+			}
+			s.d.untrack(id)
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("could not clear %d of %d mappings: %w", failed, total, firstErr)
+	}
+	return nil
+}
+
+// deleteCtx removes the mapping id, aborting when ctx is done. NAT-PMP
+// requests cannot be aborted, so for NAT-PMP gateways ctx is only checked
+// before the request is made.
+func (d *IGD) deleteCtx(ctx context.Context, id mappingID) error {
+	time.Sleep(time.Millisecond)
+	return d.deletePortMappingCtx(ctx, id.remoteHost, id.externalPort, id.protocol)
+}
@@ -0,0 +1,121 @@
+package upnp
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/url"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp"
+)
+
+// A snapshot is the serialized form of an IGD.
+type snapshot struct {
+	Location string
+	// Description is the router's device description, re-encoded as XML.
+	Description []byte `json:",omitempty"`
+	// DeviceUDN, ServiceID and ServiceType identify the connection service
+	// within the description.
+	DeviceUDN   string `json:",omitempty"`
+	ServiceID   string `json:",omitempty"`
+	ServiceType string `json:",omitempty"`
+	LocalIP     string `json:",omitempty"`
+	InternalIP  string `json:",omitempty"`
+}
+
+// Snapshot serializes what d knows about the router: its location, its
+// device description, the connection service in use and this host's
+// internal IP. Restore turns the result back into an IGD without contacting
+// the router, which is faster than Load, which fetches the description again.
+func (d *IGD) Snapshot() ([]byte, error) {
+	sc := d.client.GetServiceClient()
+	d.mu.Lock()
+	s := snapshot{
+		Location:   d.Location(),
+		LocalIP:    d.localIP,
+		InternalIP: d.internalIP,
+	}
+	d.mu.Unlock()
+	if _, ok := d.client.(*natpmpClient); !ok {
+		desc, err := xml.Marshal(sc.RootDevice)
+		if err != nil {
+			return nil, err
+		}
+		s.Description = desc
+		s.ServiceID = sc.Service.ServiceId
+		s.ServiceType = sc.Service.ServiceType
+		sc.RootDevice.Device.VisitDevices(func(dev *goupnp.Device) {
+			for i := range dev.Services {
+				if &dev.Services[i] == sc.Service {
+					s.DeviceUDN = dev.UDN
+				}
+			}
+		})
+	}
+	return json.Marshal(s)
+}
+
+// Restore returns the IGD serialized by Snapshot. It does not contact the
+// router, so it succeeds even if the router has gone away; the first action
+// performed on the IGD will fail in that case, and the caller should then
+// fall back to Discover. NAT-PMP gateways have no description to restore;
+// they are loaded again from their location. The options that affect the
+// IGD's behavior are applied to it, as with Load.
+func Restore(data []byte, opts ...Option) (*IGD, error) {
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	o := newOptions(opts)
+	loc, err := url.Parse(s.Location)
+	if err != nil {
+		return nil, err
+	}
+	if loc.Scheme == "natpmp" {
+		return loadNATPMPURL(loc, o)
+	}
+
+	root := new(goupnp.RootDevice)
+	if err := xml.Unmarshal(s.Description, root); err != nil {
+		return nil, err
+	}
+	urlBase := loc
+	if root.URLBaseStr != "" {
+		if urlBase, err = url.Parse(root.URLBaseStr); err != nil {
+			return nil, err
+		}
+	}
+	root.SetURLBase(urlBase)
+
+	var client igdClient
+	root.Device.VisitDevices(func(dev *goupnp.Device) {
+		if client != nil || dev.UDN != s.DeviceUDN {
+			return
+		}
+		for i := range dev.Services {
+			srv := &dev.Services[i]
+			if srv.ServiceId != s.ServiceID || srv.ServiceType != s.ServiceType {
+				continue
+			}
+			for _, cs := range connectionServices {
+				if srv.ServiceType == cs.urn {
+					client = cs.wrap(goupnp.ServiceClient{
+						SOAPClient: srv.NewSOAPClient(),
+						RootDevice: root,
+						Location:   loc,
+						Service:    srv,
+					})
+					return
+				}
+			}
+		}
+	})
+	if client == nil {
+		return nil, errors.New("snapshot does not name a connection service of the router")
+	}
+	d := newIGD(client)
+	o.configure(d)
+	d.localIP = s.LocalIP
+	d.internalIP = s.InternalIP
+	return d, nil
+}
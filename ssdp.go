@@ -0,0 +1,84 @@
+package upnp
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/httpu"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/ssdp"
+)
+
+// A DeviceEntry is a response to an SSDP search. A device responds once for
+// itself and once for each of its embedded devices and services that match
+// the search.
+type DeviceEntry struct {
+	// Location is the URL of the root device's description.
+	Location string
+	// USN is the Unique Service Name of the response, e.g.
+	// "uuid:...::urn:schemas-upnp-org:device:MediaRenderer:1".
+	USN string
+	// ST is the search target that the response answers.
+	ST string
+	// Server describes the responder's operating system and UPnP stack.
+	Server string
+	// DeviceType is the device type named by the response, e.g.
+	// "urn:schemas-upnp-org:device:MediaRenderer:1", or empty if it names a
+	// service or only a UUID.
+	DeviceType string
+}
+
+// DiscoverDevices searches the local network for UPnP devices of every kind,
+// not only routers, and returns the response of each responder without
+// fetching its description. st is the search target, e.g. a device or service
+// URN, "upnp:rootdevice", or "ssdp:all" for everything; if empty, "ssdp:all"
+// is used. timeout is how long to wait for responses, rounded up to whole
+// seconds; if zero, 2 seconds are allowed.
+func DiscoverDevices(st string, timeout time.Duration) ([]DeviceEntry, error) {
+	return DiscoverDevicesCtx(context.Background(), st, timeout)
+}
+
+// DiscoverDevicesCtx is the same as DiscoverDevices, but stops searching when
+// ctx is done, returning the responses received so far with ctx's error.
+func DiscoverDevicesCtx(ctx context.Context, st string, timeout time.Duration) ([]DeviceEntry, error) {
+	if st == "" {
+		st = "ssdp:all"
+	}
+	client, err := httpu.NewHTTPUClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	o := &options{searchTimeout: timeout}
+	var entries []DeviceEntry
+	err = ssdp.SSDPRawSearchFunc(ctx, client, st, o.searchWait(), 3, func(resp *http.Response) {
+		entries = append(entries, newDeviceEntry(resp))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, ctx.Err()
+}
+
+// newDeviceEntry returns the DeviceEntry describing an SSDP response.
+func newDeviceEntry(resp *http.Response) DeviceEntry {
+	e := DeviceEntry{
+		Location: resp.Header.Get("LOCATION"),
+		USN:      resp.Header.Get("USN"),
+		ST:       resp.Header.Get("ST"),
+		Server:   resp.Header.Get("SERVER"),
+	}
+	types := []string{e.ST}
+	if i := strings.Index(e.USN, "::"); i >= 0 {
+		types = append(types, e.USN[i+2:])
+	}
+	for _, s := range types {
+		if strings.HasPrefix(s, "urn:") && strings.Contains(s, ":device:") {
+			e.DeviceType = s
+			break
+		}
+	}
+	return e
+}
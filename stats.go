@@ -0,0 +1,142 @@
+package upnp
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway1"
+)
+
+// Stats holds the router's WAN traffic counters.
+type Stats struct {
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+}
+
+// Stats returns the router's WAN traffic counters, as reported by its
+// WANCommonInterfaceConfig service. The service reports 32-bit counters,
+// which wrap around on busy links, so rates should be computed from the
+// difference between successive calls rather than from the totals. If the
+// router has no such service, ErrUnsupported is returned.
+func (d *IGD) Stats() (Stats, error) {
+	sc := d.client.GetServiceClient()
+	clients, err := internetgateway1.NewWANCommonInterfaceConfig1ClientsFromRootDevice(sc.RootDevice, sc.Location)
+	if err != nil || len(clients) == 0 {
+		return Stats{}, ErrUnsupported
+	}
+	c := clients[0]
+	d.shareHTTPClient(c.SOAPClient)
+
+	var s Stats
+	for _, counter := range []struct {
+		get func() (uint32, error)
+		dst *uint64
+	}{
+		{c.GetTotalBytesSent, &s.BytesSent},
+		{c.GetTotalBytesReceived, &s.BytesReceived},
+		{c.GetTotalPacketsSent, &s.PacketsSent},
+		{c.GetTotalPacketsReceived, &s.PacketsReceived},
+	} {
+		time.Sleep(time.Millisecond)
+		n, err := counter.get()
+		if err != nil {
+			return Stats{}, err
+		}
+		*counter.dst = uint64(n)
+	}
+	return s, nil
+}
+
+// Status describes the state of the router's WAN connection.
+type Status struct {
+	// ConnectionStatus is e.g. "Connected" or "Disconnected".
+	ConnectionStatus string
+	// LastConnectionError is the cause of the last connection failure, or
+	// "ERROR_NONE".
+	LastConnectionError string
+	// Uptime is how long the connection has been up. It restarts when the
+	// router reboots, which also tends to clear its mappings.
+	Uptime time.Duration
+	// UpstreamMaxBitRate and DownstreamMaxBitRate are the maximum bit rates
+	// of the WAN link, and PhysicalLinkStatus is e.g. "Up" or "Down". They
+	// are zero if the router does not report its link properties.
+	UpstreamMaxBitRate   uint32
+	DownstreamMaxBitRate uint32
+	PhysicalLinkStatus   string
+	// DoubleNAT is true if the router appears to be behind another NAT, as
+	// reported by DetectDoubleNAT, so that forwarded ports are not reachable
+	// from the internet. It is false if the router is not connected, or its
+	// external IP could not be determined.
+	DoubleNAT bool
+}
+
+// A doubleNATVerdict is a result of DetectDoubleNAT, which holds for as long
+// as the connection that it was made on stays up.
+type doubleNATVerdict struct {
+	// uptime is the connection's uptime when the verdict was last
+	// confirmed.
+	uptime uint32
+	double bool
+}
+
+// Status returns the state of the router's WAN connection, combining its
+// connection service's GetStatusInfo with the link properties reported by
+// its WANCommonInterfaceConfig service, if it has one, and with the result of
+// DetectDoubleNAT. Only GetStatusInfo must succeed; the other parts are left
+// zero if the router cannot report them. Since the external IP only changes
+// when the connection restarts, DetectDoubleNAT is only consulted for a
+// connection that Status has not seen before, as told by its uptime.
+func (d *IGD) Status() (Status, error) {
+	time.Sleep(time.Millisecond)
+	status, lastErr, uptime, err := d.client.GetStatusInfo()
+	if err != nil {
+		return Status{}, upnpError(err)
+	}
+	s := Status{
+		ConnectionStatus:    status,
+		LastConnectionError: lastErr,
+		Uptime:              time.Duration(uptime) * time.Second,
+	}
+	// a disconnected router has no external IP to judge by
+	if status == "Connected" {
+		s.DoubleNAT = d.statusDoubleNAT(uptime)
+	}
+
+	sc := d.client.GetServiceClient()
+	clients, err := internetgateway1.NewWANCommonInterfaceConfig1ClientsFromRootDevice(sc.RootDevice, sc.Location)
+	if err != nil || len(clients) == 0 {
+		return s, nil
+	}
+	d.shareHTTPClient(clients[0].SOAPClient)
+	time.Sleep(time.Millisecond)
+	_, up, down, link, err := clients[0].GetCommonLinkProperties()
+	if err != nil {
+		d.logf("upnp: reading link properties: %v", upnpError(err))
+		return s, nil
+	}
+	s.UpstreamMaxBitRate, s.DownstreamMaxBitRate, s.PhysicalLinkStatus = up, down, link
+	return s, nil
+}
+
+// statusDoubleNAT returns the verdict of DetectDoubleNAT for the connection
+// that has been up for uptime seconds, reusing the last one unless the
+// connection has restarted since. It is false if no verdict can be reached.
+func (d *IGD) statusDoubleNAT(uptime uint32) bool {
+	d.mu.Lock()
+	if v := d.doubleNAT; v != nil && uptime >= v.uptime {
+		v.uptime = uptime
+		d.mu.Unlock()
+		return v.double
+	}
+	d.mu.Unlock()
+	double, err := d.DetectDoubleNAT(context.Background())
+	if err != nil {
+		return false
+	}
+	d.mu.Lock()
+	d.doubleNAT = &doubleNATVerdict{uptime: uptime, double: double}
+	d.mu.Unlock()
+	return double
+}
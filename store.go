@@ -0,0 +1,201 @@
+package upnp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A StoredMapping is a mapping recorded in a MappingStore.
+type StoredMapping struct {
+	Mapping
+	// Local is true if the mapping forwards to this host, rather than to a
+	// host named with ForwardFor. Reconcile re-creates local mappings for
+	// this host's current internal IP, should it have changed.
+	Local bool
+}
+
+// A MappingStore records the mappings created through an IGD, so that they
+// can be restored by Reconcile after the process restarts or the router
+// reboots. Its methods are called with the IGD's store lock held, so they are
+// never called concurrently by the same IGD.
+type MappingStore interface {
+	// Load returns the recorded mappings.
+	Load() ([]StoredMapping, error)
+	// Save replaces the recorded mappings with ms.
+	Save(ms []StoredMapping) error
+}
+
+// A FileStore is a MappingStore that keeps the mappings in a JSON file.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore returns a FileStore that keeps the mappings in the file at
+// path, which need not exist yet.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load implements MappingStore. A missing file holds no mappings.
+func (s *FileStore) Load() ([]StoredMapping, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ms []StoredMapping
+	if err := json.Unmarshal(b, &ms); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// Save implements MappingStore. The file is replaced atomically, so a crash
+// while saving leaves the previous mappings in place.
+func (s *FileStore) Save(ms []StoredMapping) error {
+	b, err := json.MarshalIndent(ms, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// persist saves the mappings tracked by d to its store, if it has one, along
+// with those that Reconcile could not restore. Failures are logged, as the
+// mappings themselves have been made.
+func (d *IGD) persist() {
+	if d.store == nil {
+		return
+	}
+	d.storeMu.Lock()
+	defer d.storeMu.Unlock()
+
+	d.mu.Lock()
+	ms := make([]StoredMapping, 0, len(d.tracked))
+	for id, m := range d.tracked {
+		ms = append(ms, StoredMapping{
+			Mapping: Mapping{
+				RemoteHost:     id.remoteHost,
+				ExternalPort:   id.externalPort,
+				InternalPort:   m.internalPort,
+				Protocol:       id.protocol,
+				InternalClient: m.internalIP,
+				Description:    m.desc,
+				Enabled:        m.enabled,
+				LeaseDuration:  time.Duration(m.lease) * time.Second,
+			},
+			Local: m.local,
+		})
+	}
+	for _, s := range d.unrestored {
+		ms = append(ms, s)
+	}
+	d.mu.Unlock()
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].ExternalPort != ms[j].ExternalPort {
+			return ms[i].ExternalPort < ms[j].ExternalPort
+		}
+		return ms[i].Protocol < ms[j].Protocol
+	})
+	if err := d.store.Save(ms); err != nil {
+		d.logf("upnp: could not save mappings: %v", err)
+	}
+}
+
+// Reconcile compares the mappings recorded in the store set by
+// WithMappingStore with the router's mapping table, so that mappings survive
+// both a crash of this process and a reboot of the router. It should be
+// called at startup. Recorded mappings that the router has lost are re-added,
+// and those that the router holds in a stale form, e.g. pointing at this
+// host's previous internal IP, are deleted and re-added as recorded. Entries
+// that the router holds for another host are left alone, and forgotten. The
+// mappings are then tracked as though they had just been created, and are
+// removed by Close. Leases are not renewed; call KeepAlive for that. All of
+// the mappings are attempted, and the first error is returned; mappings that
+// could not be restored stay in the store for the next call.
+func (d *IGD) Reconcile() error {
+	if d.store == nil {
+		return ErrNoMappingStore
+	}
+	d.storeMu.Lock()
+	stored, err := d.store.Load()
+	d.storeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	ip, err := d.getInternalIP()
+	if err != nil {
+		return err
+	}
+	current := make(map[mappingID]Mapping)
+	if err := d.walkMappings(func(m Mapping) {
+		current[mappingID{m.RemoteHost, m.ExternalPort, strings.ToUpper(m.Protocol)}] = m
+	}); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.unrestored = make(map[mappingID]StoredMapping)
+	d.mu.Unlock()
+	var firstErr error
+	for _, s := range stored {
+		id := mappingID{s.RemoteHost, s.ExternalPort, strings.ToUpper(s.Protocol)}
+		want := trackedMapping{
+			internalPort: s.InternalPort,
+			internalIP:   s.InternalClient,
+			enabled:      s.Enabled,
+			desc:         s.Description,
+			lease:        uint32(s.LeaseDuration / time.Second),
+			local:        s.Local,
+		}
+		if s.Local {
+			want.internalIP = ip
+		}
+		if r, ok := current[id]; ok {
+			if r.InternalClient == want.internalIP && r.InternalPort == want.internalPort {
+				d.track(id, want)
+				continue
+			} else if r.InternalClient != s.InternalClient {
+				d.logf("upnp: not restoring %d/%s: it forwards to %s", id.externalPort, id.protocol, r.InternalClient)
+				continue
+			}
+			time.Sleep(time.Millisecond)
+			d.deletePortMapping(id.remoteHost, id.externalPort, id.protocol)
+		}
+		time.Sleep(time.Millisecond)
+		err := d.addPortMapping(id.remoteHost, id.externalPort, id.protocol, want.internalPort, want.internalIP, want.enabled, want.desc, want.lease)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			d.mu.Lock()
+			d.unrestored[id] = s
+			d.mu.Unlock()
+			continue
+		}
+		d.track(id, want)
+	}
+	// record the outcome, dropping the mappings that were forgotten
+	d.persist()
+	return firstErr
+}
@@ -0,0 +1,90 @@
+package upnp
+
+import (
+	"context"
+	"fmt"
+
+	"gitlab.com/NebulousLabs/go-upnp/stun"
+)
+
+// LookupExternalIP asks the STUN servers, in order, for the address this
+// host's traffic appears to come from on the internet, and returns the first
+// answer. If no servers are given, stun.DefaultServers are used. It needs no
+// router, so it can be used where Discover finds no gateway. If the host is
+// behind more than one NAT, it returns the address of the outermost.
+func LookupExternalIP(ctx context.Context, servers ...string) (string, error) {
+	if len(servers) == 0 {
+		servers = stun.DefaultServers
+	}
+	var lastErr error
+	for _, server := range servers {
+		addr, err := stun.NewClient(server).MappedAddress(ctx)
+		if err == nil {
+			return addr.IP.String(), nil
+		} else if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		logf("upnp: STUN lookup via %s failed: %v", server, err)
+		lastErr = err
+	}
+	return "", fmt.Errorf("no STUN server answered: %v", lastErr)
+}
+
+// ExternalAddresses holds this host's external IP as reported by the router
+// and as observed by a STUN server, and its global IPv6 address, as reported
+// by ExternalIPv6. Any of them may be empty if it could not be determined.
+type ExternalAddresses struct {
+	UPnP string
+	STUN string
+	IPv6 string
+}
+
+// All returns every distinct address at which this host may be reachable,
+// IPv4 first, for dual-stack applications that advertise all of their
+// endpoints.
+func (a ExternalAddresses) All() []string {
+	var all []string
+	for _, ip := range []string{a.UPnP, a.STUN, a.IPv6} {
+		if ip != "" && (len(all) == 0 || all[len(all)-1] != ip) {
+			all = append(all, ip)
+		}
+	}
+	return all
+}
+
+// IP returns the address reported by the router, or the STUN-observed address
+// if the router did not report one.
+func (a ExternalAddresses) IP() string {
+	if a.UPnP != "" {
+		return a.UPnP
+	}
+	return a.STUN
+}
+
+// Mismatch reports whether both addresses are known and differ. This means
+// that the router is behind another NAT, or is misreporting its address;
+// either way, ports forwarded on it are unlikely to be reachable at the
+// address it reports.
+func (a ExternalAddresses) Mismatch() bool {
+	return a.UPnP != "" && a.STUN != "" && a.UPnP != a.STUN
+}
+
+// ExternalAddresses returns the router's external IP alongside the one
+// observed by the STUN servers set by WithSTUNServers, or by
+// stun.DefaultServers, and this host's global IPv6 address, if it has one.
+// An error is returned only if neither IPv4 address can be determined.
+func (d *IGD) ExternalAddresses(ctx context.Context) (ExternalAddresses, error) {
+	var a ExternalAddresses
+	ip, upnpErr := d.ExternalIPParsed()
+	if upnpErr == nil {
+		a.UPnP = ip.String()
+	}
+	var stunErr error
+	a.STUN, stunErr = LookupExternalIP(ctx, d.stunServers...)
+	if upnpErr != nil && stunErr != nil {
+		return ExternalAddresses{}, fmt.Errorf("%w; %v", upnpErr, stunErr)
+	}
+	// IPv6 is optional, so its absence is not an error
+	a.IPv6, _ = d.ExternalIPv6()
+	return a, nil
+}
@@ -0,0 +1,174 @@
+// Package stun is a minimal client for Session Traversal Utilities for NAT
+// (STUN), as described in RFC 5389. It implements only the Binding request,
+// which asks a server on the internet for the address that this host's
+// packets appear to come from, i.e. the public address of the outermost NAT.
+package stun
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultServers are public STUN servers that may be used when the caller has
+// no preference.
+var DefaultServers = []string{
+	"stun.l.google.com:19302",
+	"stun1.l.google.com:19302",
+	"stun.cloudflare.com:3478",
+}
+
+const (
+	magicCookie = 0x2112A442
+
+	bindingRequest = 0x0001
+	bindingSuccess = 0x0101
+
+	attrMappedAddress    = 0x0001
+	attrXORMappedAddress = 0x0020
+
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+)
+
+// A Client sends STUN Binding requests to a server.
+type Client struct {
+	// Server is the host:port of the STUN server.
+	Server string
+	// Tries is the number of times the request is sent before giving up,
+	// waiting twice as long for a response each time, starting at 250ms. It
+	// defaults to 4.
+	Tries int
+}
+
+// NewClient returns a Client for the server at the given host:port.
+func NewClient(server string) *Client {
+	return &Client{Server: server}
+}
+
+// MappedAddress returns the address and port from which the server received
+// this host's request.
+func (c *Client) MappedAddress(ctx context.Context) (*net.UDPAddr, error) {
+	tries := c.Tries
+	if tries == 0 {
+		tries = 4
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", c.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], bindingRequest)
+	binary.BigEndian.PutUint32(req[4:], magicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, err
+	}
+	txID := req[8:20]
+
+	buf := make([]byte, 1024)
+	timeout := 250 * time.Millisecond
+	for try := 0; try < tries; try++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		timeout *= 2
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break // timed out; resend
+			}
+			// ignore anything that is not a response to req
+			if n < 20 || binary.BigEndian.Uint16(buf[0:]) != bindingSuccess || !bytes.Equal(buf[8:20], txID) {
+				continue
+			}
+			return parseResponse(buf[:n])
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("stun: no response from %v", c.Server)
+}
+
+// parseResponse returns the mapped address in a Binding success response,
+// preferring the XOR-MAPPED-ADDRESS attribute to the older MAPPED-ADDRESS.
+func parseResponse(resp []byte) (*net.UDPAddr, error) {
+	length := int(binary.BigEndian.Uint16(resp[2:]))
+	if 20+length > len(resp) {
+		return nil, errors.New("stun: truncated response")
+	}
+	var mapped *net.UDPAddr
+	attrs := resp[20 : 20+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		alen := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+alen > len(attrs) {
+			return nil, errors.New("stun: truncated attribute")
+		}
+		val := attrs[4 : 4+alen]
+		switch typ {
+		case attrXORMappedAddress:
+			if addr := decodeAddress(val, resp[4:20]); addr != nil {
+				return addr, nil
+			}
+		case attrMappedAddress:
+			mapped = decodeAddress(val, nil)
+		}
+		// attributes are padded to a multiple of 4 bytes
+		next := 4 + (alen+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mapped == nil {
+		return nil, errors.New("stun: response has no mapped address")
+	}
+	return mapped, nil
+}
+
+// decodeAddress decodes an address attribute. If mask is not nil, it holds
+// the magic cookie and transaction ID, with which the port and address are
+// XORed in an XOR-MAPPED-ADDRESS.
+func decodeAddress(val, mask []byte) *net.UDPAddr {
+	if len(val) < 4 {
+		return nil
+	}
+	var ip net.IP
+	switch val[1] {
+	case familyIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case familyIPv6:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil
+	}
+	if len(val) < 4+len(ip) {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(val[2:])
+	copy(ip, val[4:])
+	if mask != nil {
+		port ^= magicCookie >> 16
+		for i := range ip {
+			ip[i] ^= mask[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
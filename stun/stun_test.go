@@ -0,0 +1,78 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// serve runs a fake STUN server that answers each request with the packets
+// returned by handle, and returns a Client for it.
+func serve(t *testing.T, handle func(req []byte, from *net.UDPAddr) [][]byte) *Client {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			for _, resp := range handle(buf[:n], addr) {
+				conn.WriteToUDP(resp, addr)
+			}
+		}
+	}()
+	return &Client{Server: conn.LocalAddr().String(), Tries: 2}
+}
+
+// response returns a Binding success response to req carrying attr.
+func response(req []byte, attrType uint16, attr []byte) []byte {
+	resp := make([]byte, 24, 24+len(attr))
+	binary.BigEndian.PutUint16(resp[0:], bindingSuccess)
+	binary.BigEndian.PutUint16(resp[2:], uint16(4+len(attr)))
+	copy(resp[4:20], req[4:20])
+	binary.BigEndian.PutUint16(resp[20:], attrType)
+	binary.BigEndian.PutUint16(resp[22:], uint16(len(attr)))
+	return append(resp, attr...)
+}
+
+// TestXORMappedAddress tests that an XOR-MAPPED-ADDRESS is decoded.
+func TestXORMappedAddress(t *testing.T) {
+	c := serve(t, func(req []byte, from *net.UDPAddr) [][]byte {
+		attr := make([]byte, 8)
+		attr[1] = familyIPv4
+		binary.BigEndian.PutUint16(attr[2:], uint16(from.Port)^magicCookie>>16)
+		ip := from.IP.To4()
+		for i := range ip {
+			attr[4+i] = ip[i] ^ req[4+i]
+		}
+		return [][]byte{response(req, attrXORMappedAddress, attr)}
+	})
+	addr, err := c.MappedAddress(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port == 0 {
+		t.Fatal("wrong address:", addr)
+	}
+}
+
+// TestMappedAddress tests that the older MAPPED-ADDRESS is decoded, and that
+// responses to other requests are ignored.
+func TestMappedAddress(t *testing.T) {
+	c := serve(t, func(req []byte, from *net.UDPAddr) [][]byte {
+		stale := response(req, attrMappedAddress, []byte{0, familyIPv4, 0, 1, 192, 0, 2, 1})
+		stale[19] ^= 0xFF
+		return [][]byte{stale, response(req, attrMappedAddress, []byte{0, familyIPv4, 0x23, 0x29, 203, 0, 113, 1})}
+	})
+	addr, err := c.MappedAddress(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if addr.String() != "203.0.113.1:9001" {
+		t.Fatal("wrong address:", addr)
+	}
+}
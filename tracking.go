@@ -0,0 +1,130 @@
+package upnp
+
+import (
+	"fmt"
+	"time"
+)
+
+// A mappingID is the key under which a router stores a port mapping.
+type mappingID struct {
+	remoteHost   string
+	externalPort uint16
+	protocol     string
+}
+
+// A trackedMapping is a router table entry that was created through an IGD.
+type trackedMapping struct {
+	internalPort uint16
+	internalIP   string
+	enabled      bool
+	desc         string
+	lease        uint32
+	// local is true if the mapping forwards to this host, at the address it
+	// had when the mapping was created, rather than to another host.
+	local bool
+}
+
+// track records that the mapping id was created by d.
+func (d *IGD) track(id mappingID, m trackedMapping) {
+	d.mu.Lock()
+	if d.tracked == nil {
+		d.tracked = make(map[mappingID]trackedMapping)
+	}
+	d.tracked[id] = m
+	delete(d.unrestored, id)
+	d.mu.Unlock()
+	d.persist()
+}
+
+// untrack forgets the mapping id, and stops renewing it.
+func (d *IGD) untrack(id mappingID) {
+	d.mu.Lock()
+	delete(d.tracked, id)
+	delete(d.unrestored, id)
+	if stop, ok := d.renewals[id]; ok {
+		close(stop)
+		delete(d.renewals, id)
+	}
+	d.mu.Unlock()
+	d.persist()
+}
+
+// RefreshMappings checks whether the internal IP of this host has changed, as
+// happens when a DHCP lease is renewed with a new address. Every mapping
+// created through d for this host that points at an address other than the
+// current one is deleted and re-created to point at the new one. Mappings
+// created on behalf of other hosts are left alone. An error is returned if
+// any of the mappings could not be moved, but all of them are attempted, and
+// those that could not be moved are tried again by the next call.
+func (d *IGD) RefreshMappings() error {
+	newIP, err := d.getInternalIP()
+	if err != nil {
+		return err
+	}
+
+	// each mapping is compared with the address it was created for, since
+	// mappings created since the address changed already use the new one
+	d.mu.Lock()
+	stale := make(map[mappingID]trackedMapping)
+	for id, m := range d.tracked {
+		if m.local && m.internalIP != newIP {
+			stale[id] = m
+		}
+	}
+	d.mu.Unlock()
+
+	var firstErr error
+	for id, m := range stale {
+		time.Sleep(time.Millisecond)
+		err := d.deletePortMapping(id.remoteHost, id.externalPort, id.protocol)
+		if err == nil || faultCode(err) == errCodeNoSuchEntry {
+			time.Sleep(time.Millisecond)
+			err = d.addPortMapping(id.remoteHost, id.externalPort, id.protocol, m.internalPort, newIP, m.enabled, m.desc, m.lease)
+		}
+		if err != nil {
+			// the mapping stays tracked under the old address, so that a
+			// later call tries again
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		m.internalIP = newIP
+		d.track(id, m)
+	}
+	return firstErr
+}
+
+// Close removes every mapping created through d that has not been cleared
+// already, and stops renewing any leases. Mappings that d did not create are
+// left alone. All of the mappings are attempted even if some cannot be
+// removed; the returned error reports how many failed, and wraps the first
+// failure. d should not be used after Close.
+func (d *IGD) Close() error {
+	d.mu.Lock()
+	ids := make([]mappingID, 0, len(d.tracked))
+	for id := range d.tracked {
+		ids = append(ids, id)
+	}
+	d.mu.Unlock()
+
+	var firstErr error
+	failed := 0
+	for _, id := range ids {
+		time.Sleep(time.Millisecond)
+		err := d.deletePortMapping(id.remoteHost, id.externalPort, id.protocol)
+		// the renewal is stopped even if the mapping could not be removed,
+		// so that it at least expires
+		d.untrack(id)
+		if err != nil && faultCode(err) != errCodeNoSuchEntry {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("could not clear %d of %d mappings: %w", failed, len(ids), firstErr)
+	}
+	return nil
+}
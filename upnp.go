@@ -2,59 +2,230 @@
 // routers, allowing users to forward ports and discover their external IP
 // address. Specific quirks:
 //
-// - When attempting to discover UPnP-enabled routers on the network, only the
-// first such router is returned. If you have multiple routers, this may cause
-// some trouble. But why would you do that?
+// - When attempting to discover UPnP-enabled routers on the network, only one
+// router is returned: the first on the default route's subnet, or failing
+// that the first to respond. If you have multiple routers, DiscoverAll
+// returns every one of them, and WithValidator or WithSubnetFilter narrow
+// the choice.
 //
-// - Forwarded ports are always symmetric, e.g. the router's port 9980 will be
-// mapped to the client's port 9980. This will be unacceptable for some
-// purposes, but too bad. Symmetric mappings are the desired behavior 99% of
-// the time, and they save a function argument.
+// - Forward creates symmetric mappings, e.g. the router's port 9980 will be
+// mapped to the client's port 9980. Symmetric mappings are the desired
+// behavior 99% of the time, and they save a function argument. For the rest,
+// there is ForwardAsymmetric.
 //
-// - TCP and UDP protocols are forwarded together.
+// - Forward and Clear handle TCP and UDP together. ForwardTCP, ForwardUDP,
+// ClearTCP and ClearUDP handle a single protocol.
 //
-// - Ports are forwarded permanently. Some other implementations lease a port
-// mapping for a set duration, and then renew it periodically. This is nice,
-// because it means mappings won't stick around after they've served their
-// purpose. Unfortunately, some routers only support permanent mappings, so this
-// package has chosen to support the lowest common denominator. To un-forward a
-// port, you must use the Clear function (or do it manually).
+// - Forward forwards ports permanently. Some other implementations lease a
+// port mapping for a set duration, and then renew it periodically. This is
+// nice, because it means mappings won't stick around after they've served
+// their purpose. Unfortunately, some routers only support permanent mappings,
+// so Forward supports the lowest common denominator. To un-forward a port, you
+// must use the Clear function (or do it manually). ForwardTimeout requests a
+// lease instead, on routers that support one.
+//
+// - If no UPnP-enabled router is found, Discover looks for a NAT-PMP gateway
+// (RFC 6886) instead, as offered by Apple routers and many others with UPnP
+// disabled, or a PCP gateway (RFC 6887) that does not answer NAT-PMP, and
+// returns it behind the same IGD type. Neither can create permanent
+// mappings, so a week-long lease is requested in their place, which the
+// gateway may shorten; see KeepAlive for keeping such mappings alive.
 //
 // Once you've discovered your router, you can retrieve its address by calling
 // its Location method. This address can be supplied to Load to connect to the
 // router directly, which is much faster than calling Discover.
+//
+// Discover, Load and their variants accept Options, which change how routers
+// are found and how the returned IGD behaves; with none, the behavior is as
+// described above. Searches are tuned by WithSearchTimeout, WithRetries,
+// WithBackoff, WithJitter, WithFailFastNoMulticast, WithValidator,
+// WithConnectionPreference, WithoutNATPMP, WithSSDPSourcePort,
+// WithMulticastTTL and WithNotifyListen; the IGD's behavior by
+// WithDefaultTimeout, WithRouteBasedInternalIP, WithLeaseFallback,
+// WithLocationRefresh, WithAutoHeal, WithMappingStore, WithDryRun,
+// WithSTUNServers, WithIPResolvers, WithQuirks and WithoutQuirks; and
+// transport and diagnostics by WithHTTPClient, WithHeader, WithUserAgent,
+// WithMaxInFlight, WithRateLimit, WithLogger, WithDebug, WithSOAPTrace and
+// WithMetrics.
 package upnp
 
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"gitlab.com/NebulousLabs/fastrand"
 	"gitlab.com/NebulousLabs/go-upnp/goupnp"
-	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway1"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/soap"
 )
 
+// igdClient is the set of router actions used by an IGD. It is satisfied by
+// the internetgateway1.WANIPConnection1, internetgateway1.WANPPPConnection1
+// and internetgateway2.WANIPConnection2 types.
+type igdClient interface {
+	GetExternalIPAddress() (string, error)
+	AddPortMapping(string, uint16, string, uint16, string, bool, string, uint32) error
+	GetSpecificPortMappingEntry(string, uint16, string) (uint16, string, bool, string, uint32, error)
+	GetGenericPortMappingEntry(uint16) (string, uint16, string, uint16, string, bool, string, uint32, error)
+	DeletePortMapping(string, uint16, string) error
+	GetStatusInfo() (string, string, uint32, error)
+	GetServiceClient() *goupnp.ServiceClient
+}
+
+// A Gateway is the core set of operations on a router. *IGD implements it,
+// as does upnptest.MockIGD; code that depends on a Gateway rather than an
+// *IGD can be tested without a router.
+type Gateway interface {
+	ExternalIP() (string, error)
+	Forward(port uint16, desc string) error
+	Clear(port uint16) error
+	IsForwardedTCP(port uint16) (bool, error)
+	IsForwardedUDP(port uint16) (bool, error)
+	Location() string
+	DeviceInfo() (Info, error)
+}
+
+var _ Gateway = (*IGD)(nil)
+
 // An IGD provides an interface to the most commonly used functions of an
 // Internet Gateway Device: discovering the external IP, and forwarding ports.
+// An IGD is safe for concurrent use, although concurrent operations on the
+// same port race at the router, and SetTimeout must not be called
+// concurrently with other methods.
 type IGD struct {
-	// This interface is satisfied by the internetgateway1.WANIPConnection1
-	// and internetgateway1.WANPPPConnection1 types.
-	client interface {
-		GetExternalIPAddress() (string, error)
-		AddPortMapping(string, uint16, string, uint16, string, bool, string, uint32) error
-		GetSpecificPortMappingEntry(string, uint16, string) (uint16, string, bool, string, uint32, error)
-		DeletePortMapping(string, uint16, string) error
-		GetServiceClient() *goupnp.ServiceClient
+	client igdClient
+
+	// clock is the source of time for lease renewal.
+	clock Clock
+
+	// routeBasedIP selects route-based internal IP resolution.
+	routeBasedIP bool
+	// localIP, if not empty, is the address of the interface that d was
+	// discovered on, and is used as the internal IP.
+	localIP string
+	// leaseFallback is the lease used when the router rejects a permanent
+	// mapping, or zero if such mappings should fail.
+	leaseFallback time.Duration
+	// store, if not nil, records the tracked mappings; storeMu serializes
+	// its use.
+	store   MappingStore
+	storeMu sync.Mutex
+
+	// logger, if not nil, receives d's log output in place of the package's
+	// Logger.
+	logger Logger
+	// metrics, if not nil, receives measurements of d's actions.
+	metrics Metrics
+	// plan, if not nil, receives the actions that would change the router,
+	// which are not performed; see WithDryRun.
+	plan func(PlannedAction)
+	// jitter is the fraction by which renewal intervals are randomly
+	// shortened; see WithJitter.
+	jitter float64
+
+	// stunServers are the STUN servers used by ExternalAddresses, or nil for
+	// the defaults.
+	stunServers []string
+	// resolvers are the sources consulted by ResolveExternalIP after the
+	// router.
+	resolvers []IPResolver
+
+	// quirkTable holds the quirk entries that routers found after a move
+	// are matched against.
+	quirkTable []quirkEntry
+
+	// asyncSem limits the number of concurrent ForwardAsync calls.
+	asyncSem chan struct{}
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// internalIP is the most recently determined internal IP of this host.
+	internalIP string
+	// tracked holds the mappings created through this IGD.
+	tracked map[mappingID]trackedMapping
+	// unrestored holds the stored mappings that Reconcile could not restore.
+	unrestored map[mappingID]StoredMapping
+	// renewals holds a channel for each tracked mapping that is being kept
+	// alive, which is closed to stop the renewal.
+	renewals map[mappingID]chan struct{}
+	// doubleNAT is the verdict of DetectDoubleNAT last reported by Status,
+	// or nil if there is none.
+	doubleNAT *doubleNATVerdict
+}
+
+// newIGD returns an IGD that uses the supplied client for all of its actions.
+func newIGD(client igdClient) *IGD {
+	return &IGD{
+		client:   client,
+		clock:    realClock{},
+		asyncSem: make(chan struct{}, maxAsyncForwards),
 	}
 }
 
 // ExternalIP returns the router's external IP.
 func (d *IGD) ExternalIP() (string, error) {
-	return d.client.GetExternalIPAddress()
+	return d.ExternalIPCtx(context.Background())
+}
+
+// ExternalIPParsed returns the router's external IP as a net.IP. If the
+// router reports an empty, unparseable or unspecified (e.g. "0.0.0.0")
+// address, ErrNoExternalIP is returned.
+func (d *IGD) ExternalIPParsed() (net.IP, error) {
+	ip, err := d.ExternalIP()
+	if err != nil {
+		return nil, err
+	}
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil || parsed.IsUnspecified() {
+		return nil, ErrNoExternalIP
+	}
+	return parsed, nil
+}
+
+// ExternalIPv4 returns the router's external IPv4 address. It is equivalent
+// to ExternalIP, but reports an error if the router returns an address of
+// another family.
+func (d *IGD) ExternalIPv4() (string, error) {
+	ip, err := d.ExternalIP()
+	if err != nil {
+		return "", err
+	}
+	if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() == nil {
+		return "", errors.New("router returned a non-IPv4 external address: " + ip)
+	}
+	return ip, nil
+}
+
+// ExternalIPv6 returns the IPv6 address at which this host can be reached
+// from the internet. IPv6 is not subject to NAT, so this is the host's own
+// global address on the interface it uses to reach the router, rather than an
+// address reported by the router.
+func (d *IGD) ExternalIPv6() (string, error) {
+	ip, err := d.InternalIP(IPv6)
+	if err != nil {
+		return "", err
+	}
+	if isUniqueLocal(net.ParseIP(ip)) {
+		return "", errors.New("no global IPv6 address on the router's interface")
+	}
+	return ip, nil
+}
+
+// ConnectionStatus returns the status of the router's WAN connection, e.g.
+// "Connected" or "Disconnected", and how long it has been up. The external IP
+// is meaningless unless the status is "Connected".
+func (d *IGD) ConnectionStatus() (status string, uptime time.Duration, err error) {
+	time.Sleep(time.Millisecond)
+	status, _, seconds, err := d.client.GetStatusInfo()
+	if err != nil {
+		return "", 0, upnpError(err)
+	}
+	return status, time.Duration(seconds) * time.Second, nil
 }
 
 // IsForwardedTCP checks whether a specific TCP port is forwarded to this host
@@ -67,6 +238,25 @@ func (d *IGD) IsForwardedUDP(port uint16) (bool, error) {
 	return d.checkForward(port, "UDP")
 }
 
+// IsForwarded reports whether the router has a mapping for the specified port
+// and protocol ("TCP" or "UDP", in any case). Unlike IsForwardedTCP and
+// IsForwardedUDP, it reports disabled mappings too, and mappings to any host,
+// since either would conflict with a new Forward of the port.
+func (d *IGD) IsForwarded(port uint16, proto string) (bool, error) {
+	proto, err := normalizeProtocol(proto)
+	if err != nil {
+		return false, err
+	}
+	time.Sleep(time.Millisecond)
+	_, _, _, _, _, err = d.client.GetSpecificPortMappingEntry("", port, proto)
+	if faultCode(err) == errCodeNoSuchEntry {
+		return false, nil
+	} else if err != nil {
+		return false, upnpError(err)
+	}
+	return true, nil
+}
+
 // checkForward checks whether a specific TCP or UDP port is forwarded to this host
 func (d *IGD) checkForward(port uint16, proto string) (bool, error) {
 	time.Sleep(time.Millisecond)
@@ -74,130 +264,845 @@ func (d *IGD) checkForward(port uint16, proto string) (bool, error) {
 
 	if err != nil {
 		// 714 "NoSuchEntryInArray" means that there is no such forwarding
-		if strings.Contains(err.Error(), "<errorCode>714</errorCode>") {
+		if faultCode(err) == errCodeNoSuchEntry {
 			return false, nil
 		}
-		return false, err
+		return false, upnpError(err)
 	}
 
 	return enabled, nil
 }
 
+// A ProtocolState describes whether, and how, a MappingSpec maps a protocol.
+type ProtocolState int
+
+const (
+	// ProtocolAbsent means no mapping is created for the protocol.
+	ProtocolAbsent ProtocolState = iota
+	// ProtocolEnabled means the mapping is created and enabled.
+	ProtocolEnabled
+	// ProtocolDisabled means the mapping is created, but disabled. It will be
+	// visible in the router's port mapping table without forwarding traffic.
+	ProtocolDisabled
+)
+
+// A ForwardMode determines how ForwardAdvanced handles the failure of one
+// protocol's mapping.
+type ForwardMode int
+
+const (
+	// Strict mode stops at the first failure, and removes any mapping that
+	// was already created, so that either every protocol is forwarded or none
+	// are.
+	Strict ForwardMode = iota
+	// BestEffort mode attempts every protocol, and keeps the mappings that
+	// succeeded. If only some succeed, the error is a *PartialForwardError.
+	BestEffort
+)
+
+// A MappingSpec fully describes a port mapping to be created by
+// ForwardAdvanced.
+type MappingSpec struct {
+	// RemoteHost restricts the mapping to traffic from a single IP. If
+	// empty, traffic from any host is forwarded; for routers known to spell
+	// this wildcard differently, such as certain FRITZ!Box firmwares, the
+	// spelling is adapted.
+	RemoteHost string
+	// ExternalPort is the port opened on the router. The specification
+	// makes zero a wildcard, matching every port, which few routers honor
+	// and fewer callers intend, so it is refused with ErrWildcardPort; to
+	// have the router choose a free port, use ForwardAny.
+	ExternalPort uint16
+	// InternalPort is the port that traffic is forwarded to. If zero,
+	// ExternalPort is used.
+	InternalPort uint16
+	// InternalIP is the host that traffic is forwarded to. If empty, the
+	// internal IP of this host is used.
+	InternalIP string
+
+	// TCP and UDP control the mapping created for each protocol.
+	TCP ProtocolState
+	UDP ProtocolState
+
+	// Lease is how long the router should keep the mapping. Zero requests a
+	// permanent mapping. Leases are truncated to whole seconds.
+	Lease time.Duration
+	// Description is stored alongside the mapping in the router's table.
+	Description string
+
+	// Mode determines what happens when one protocol fails to forward.
+	Mode ForwardMode
+}
+
+// A MappingKey identifies the router table entries created by a call to
+// ForwardAdvanced. The router keys its entries by remote host, external port,
+// and protocol; a MappingKey records exactly those values, so that ClearKey
+// removes precisely what was created.
+type MappingKey struct {
+	remoteHost   string
+	externalPort uint16
+	protocols    []string
+}
+
+// String implements fmt.Stringer.
+func (k MappingKey) String() string {
+	return fmt.Sprintf("%v:%d/%s", k.remoteHost, k.externalPort, strings.Join(k.protocols, ","))
+}
+
 // Forward forwards the specified port, and adds its description to the
-// router's port mapping table.
+// router's port mapping table. Both TCP and UDP are forwarded; if either
+// cannot be, the other is removed again.
 func (d *IGD) Forward(port uint16, desc string) error {
-	ip, err := d.getInternalIP()
+	return d.ForwardCtx(context.Background(), port, desc)
+}
+
+// ForwardPartial is like Forward, but does not fail when the router accepts
+// only one of TCP and UDP. It returns the protocols that were forwarded; if
+// only one was, the error is a *PartialForwardError naming the other. The
+// mapping that succeeded is kept either way.
+func (d *IGD) ForwardPartial(port uint16, desc string) (forwarded []string, err error) {
+	key, err := d.ForwardAdvanced(MappingSpec{
+		ExternalPort: port,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Description:  desc,
+		Mode:         BestEffort,
+	})
+	return key.protocols, err
+}
+
+// ForwardProtocol forwards the specified port for a single protocol, "TCP" or
+// "UDP" (in any case).
+func (d *IGD) ForwardProtocol(port uint16, proto string, desc string) error {
+	proto, err := normalizeProtocol(proto)
 	if err != nil {
 		return err
 	}
+	spec := MappingSpec{ExternalPort: port, Description: desc}
+	if proto == "TCP" {
+		spec.TCP = ProtocolEnabled
+	} else {
+		spec.UDP = ProtocolEnabled
+	}
+	_, err = d.ForwardAdvanced(spec)
+	return err
+}
 
-	time.Sleep(time.Millisecond)
-	err = d.client.AddPortMapping("", port, "TCP", port, ip, true, desc, 0)
+// ForwardTCP forwards the specified port for TCP only.
+func (d *IGD) ForwardTCP(port uint16, desc string) error {
+	return d.ForwardProtocol(port, "TCP", desc)
+}
+
+// ForwardUDP forwards the specified port for UDP only.
+func (d *IGD) ForwardUDP(port uint16, desc string) error {
+	return d.ForwardProtocol(port, "UDP", desc)
+}
+
+// ForwardAsymmetric forwards the router's externalPort to this host's
+// internalPort. It is undone with ClearExternal(externalPort).
+func (d *IGD) ForwardAsymmetric(externalPort, internalPort uint16, desc string) error {
+	_, err := d.ForwardAdvanced(MappingSpec{
+		ExternalPort: externalPort,
+		InternalPort: internalPort,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Description:  desc,
+	})
+	return err
+}
+
+// ForwardTo is the same as ForwardAsymmetric.
+func (d *IGD) ForwardTo(externalPort, internalPort uint16, desc string) error {
+	return d.ForwardAsymmetric(externalPort, internalPort, desc)
+}
+
+// ForwardFrom forwards the specified port like Forward, but to internalIP
+// rather than to the detected internal IP of this host. It is useful when
+// detection picks the wrong interface, as can happen with VPNs, container
+// bridges, or several interfaces on the router's subnet.
+func (d *IGD) ForwardFrom(internalIP string, port uint16, desc string) error {
+	return d.ForwardAsymmetricFrom(internalIP, port, port, desc)
+}
+
+// ForwardAsymmetricFrom combines ForwardAsymmetric and ForwardFrom, forwarding
+// the router's externalPort to internalPort on internalIP.
+func (d *IGD) ForwardAsymmetricFrom(internalIP string, externalPort, internalPort uint16, desc string) error {
+	if internalIP == "" {
+		return errors.New("internal IP must not be empty")
+	}
+	_, err := d.ForwardAdvanced(MappingSpec{
+		ExternalPort: externalPort,
+		InternalPort: internalPort,
+		InternalIP:   internalIP,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Description:  desc,
+	})
+	return err
+}
+
+// ForwardFor forwards the router's externalPort to internalPort on another
+// host on the LAN, internalIP, for a single protocol ("TCP" or "UDP", in any
+// case). It is meant for controllers that manage mappings on behalf of other
+// devices. The mapping is undone with ClearProtocol.
+func (d *IGD) ForwardFor(internalIP string, externalPort, internalPort uint16, proto, desc string) error {
+	if internalIP == "" {
+		return errors.New("internal IP must not be empty")
+	}
+	proto, err := normalizeProtocol(proto)
+	if err != nil {
+		return err
+	}
+	spec := MappingSpec{
+		ExternalPort: externalPort,
+		InternalPort: internalPort,
+		InternalIP:   internalIP,
+		Description:  desc,
+	}
+	if proto == "TCP" {
+		spec.TCP = ProtocolEnabled
+	} else {
+		spec.UDP = ProtocolEnabled
+	}
+	_, err = d.ForwardAdvanced(spec)
+	return err
+}
+
+// ForwardFromHost forwards the specified port like Forward, but only for
+// traffic from remoteHost, which must be an IP address, or empty to accept
+// traffic from any host, as Forward does. It is undone with ClearFromHost.
+func (d *IGD) ForwardFromHost(remoteHost string, port uint16, desc string) error {
+	if remoteHost != "" && net.ParseIP(remoteHost) == nil {
+		return errors.New("invalid remote host " + remoteHost)
+	}
+	_, err := d.ForwardAdvanced(MappingSpec{
+		RemoteHost:   remoteHost,
+		ExternalPort: port,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Description:  desc,
+	})
+	return err
+}
+
+// ForwardRestricted forwards the specified port for a single protocol, "TCP"
+// or "UDP" (in any case), accepting traffic only from remote, e.g. for a
+// tunnel to a single peer. Routers that cannot restrict mappings refuse them
+// with RemoteHostOnlySupportsWildcard, for which ErrUnsupported is returned,
+// rather than leaving the port open to every host. It is undone with
+// ClearFromHost, which clears both protocols.
+func (d *IGD) ForwardRestricted(remote net.IP, port uint16, proto, desc string) error {
+	proto, err := normalizeProtocol(proto)
 	if err != nil {
 		return err
+	} else if remote == nil || remote.IsUnspecified() {
+		return errors.New("remote host must be a specific address")
+	}
+	spec := MappingSpec{
+		RemoteHost:   remote.String(),
+		ExternalPort: port,
+		Description:  desc,
+	}
+	if proto == "TCP" {
+		spec.TCP = ProtocolEnabled
+	} else {
+		spec.UDP = ProtocolEnabled
+	}
+	_, err = d.ForwardAdvanced(spec)
+	if faultCode(err) == errCodeRemoteHostWildcard {
+		return ErrUnsupported
+	}
+	return err
+}
+
+// ForwardTimeout forwards the specified port like Forward, but asks the
+// router to remove the mapping after duration, so that it does not outlive a
+// process that crashes before calling Clear. If the router only supports
+// permanent mappings, the port is forwarded permanently instead and a
+// *LeaseFallbackError is returned.
+func (d *IGD) ForwardTimeout(port uint16, desc string, duration time.Duration) error {
+	_, err := d.ForwardAdvanced(MappingSpec{
+		ExternalPort: port,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Lease:        duration,
+		Description:  desc,
+	})
+	if faultCode(err) != ErrCodeOnlyPermanentLeasesSupported {
+		return err
+	}
+	if err := d.Forward(port, desc); err != nil {
+		return err
+	}
+	return &LeaseFallbackError{Requested: duration}
+}
+
+// ForwardAdvanced creates the port mappings described by spec, returning a
+// key that identifies them. TCP is mapped before UDP. What happens when one
+// of them fails is controlled by spec.Mode.
+func (d *IGD) ForwardAdvanced(spec MappingSpec) (MappingKey, error) {
+	return d.forwardAdvanced(context.Background(), spec)
+}
+
+// forwardAdvanced is the same as ForwardAdvanced, but aborts and returns
+// ctx.Err() when ctx is done. Mappings already created are then rolled back
+// as spec.Mode requires, without regard to ctx.
+func (d *IGD) forwardAdvanced(ctx context.Context, spec MappingSpec) (MappingKey, error) {
+	key := MappingKey{remoteHost: spec.RemoteHost, externalPort: spec.ExternalPort}
+	if spec.TCP == ProtocolAbsent && spec.UDP == ProtocolAbsent {
+		return key, errors.New("no protocols to forward")
+	} else if spec.ExternalPort == 0 {
+		return key, ErrWildcardPort
+	} else if spec.RemoteHost != "" && net.ParseIP(spec.RemoteHost) == nil {
+		return key, errors.New("invalid remote host " + spec.RemoteHost)
+	}
+	internalPort := spec.InternalPort
+	if internalPort == 0 {
+		internalPort = spec.ExternalPort
 	}
+	ip := spec.InternalIP
+	if ip == "" {
+		var err error
+		if ip, err = d.getInternalIP(); err != nil {
+			return key, err
+		}
+	} else if net.ParseIP(ip) == nil {
+		return key, errors.New("invalid internal IP " + ip)
+	}
+	lease := uint32(spec.Lease / time.Second)
 
+	var failed []string
+	var firstErr error
+	for _, p := range []struct {
+		proto string
+		state ProtocolState
+	}{{"TCP", spec.TCP}, {"UDP", spec.UDP}} {
+		if p.state == ProtocolAbsent {
+			continue
+		}
+		time.Sleep(time.Millisecond)
+		protoLease := lease
+		err := d.addPortMappingCtx(ctx, key.remoteHost, spec.ExternalPort, p.proto, internalPort, ip, p.state == ProtocolEnabled, spec.Description, protoLease)
+		if err != nil && protoLease == 0 && d.leaseFallback > 0 && mayRejectPermanent(err) {
+			// the retry's error replaces the refusal, since it is the one
+			// that explains why the port could not be forwarded at all
+			fallback := uint32(d.leaseFallback / time.Second)
+			time.Sleep(time.Millisecond)
+			err = d.addPortMappingCtx(ctx, key.remoteHost, spec.ExternalPort, p.proto, internalPort, ip, p.state == ProtocolEnabled, spec.Description, fallback)
+			if err == nil {
+				protoLease = fallback
+			}
+		}
+		if err != nil && spec.Mode == Strict {
+			// roll back whatever was already created
+			d.ClearKey(key)
+			return MappingKey{remoteHost: spec.RemoteHost, externalPort: spec.ExternalPort}, err
+		} else if err != nil {
+			failed = append(failed, p.proto)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		key.protocols = append(key.protocols, p.proto)
+		id := mappingID{key.remoteHost, spec.ExternalPort, p.proto}
+		d.track(id, trackedMapping{
+			internalPort: internalPort,
+			internalIP:   ip,
+			enabled:      p.state == ProtocolEnabled,
+			desc:         spec.Description,
+			lease:        protoLease,
+			local:        spec.InternalIP == "",
+		})
+		if protoLease != lease {
+			d.keepAlive(id, nil)
+		}
+	}
+	if firstErr != nil && len(key.protocols) == 0 {
+		return key, firstErr
+	} else if firstErr != nil {
+		return key, &PartialForwardError{
+			Succeeded: key.protocols,
+			Failed:    failed,
+			Err:       firstErr,
+		}
+	}
+	return key, nil
+}
+
+// UpdateMapping changes the description and lease of this host's existing
+// mapping of port for proto ("TCP" or "UDP", in any case), keeping its
+// internal port. Rather than clearing and re-creating the mapping, which would
+// briefly free the port, it re-issues AddPortMapping for the same port and
+// protocol, which overwrites the entry on most routers. If the mapping belongs
+// to another host, the router may refuse to overwrite it, in which case a
+// *UPnPError with the code ErrCodeConflictInMappingEntry is returned.
+func (d *IGD) UpdateMapping(port uint16, proto, desc string, lease time.Duration) error {
+	proto, err := normalizeProtocol(proto)
+	if err != nil {
+		return err
+	}
+	ip, err := d.getInternalIP()
+	if err != nil {
+		return err
+	}
+	time.Sleep(time.Millisecond)
+	intPort, _, enabled, _, _, err := d.client.GetSpecificPortMappingEntry("", port, proto)
+	if err != nil {
+		return upnpError(err)
+	}
 	time.Sleep(time.Millisecond)
-	return d.client.AddPortMapping("", port, "UDP", port, ip, true, desc, 0)
+	if err := d.addPortMapping("", port, proto, intPort, ip, enabled, desc, uint32(lease/time.Second)); err != nil {
+		return err
+	}
+	d.track(mappingID{"", port, proto}, trackedMapping{
+		internalPort: intPort,
+		internalIP:   ip,
+		enabled:      enabled,
+		desc:         desc,
+		lease:        uint32(lease / time.Second),
+		local:        true,
+	})
+	return nil
 }
 
 // Clear un-forwards a port, removing it from the router's port mapping table.
 func (d *IGD) Clear(port uint16) error {
+	return d.ClearCtx(context.Background(), port)
+}
+
+// ClearProtocol un-forwards the specified port for a single protocol, "TCP"
+// or "UDP" (in any case).
+func (d *IGD) ClearProtocol(port uint16, proto string) error {
+	proto, err := normalizeProtocol(proto)
+	if err != nil {
+		return err
+	}
+	return d.clearProtocol(context.Background(), port, proto)
+}
+
+// clearProtocol un-forwards port for proto, which must be "TCP" or "UDP",
+// aborting the request when ctx is done.
+func (d *IGD) clearProtocol(ctx context.Context, port uint16, proto string) error {
 	time.Sleep(time.Millisecond)
-	tcpErr := d.client.DeletePortMapping("", port, "TCP")
-	time.Sleep(time.Millisecond)
-	udpErr := d.client.DeletePortMapping("", port, "UDP")
+	if err := d.deletePortMappingCtx(ctx, "", port, proto); err != nil {
+		return err
+	}
+	d.untrack(mappingID{"", port, proto})
+	return nil
+}
+
+// ClearTCP un-forwards the specified TCP port.
+func (d *IGD) ClearTCP(port uint16) error {
+	return d.ClearProtocol(port, "TCP")
+}
+
+// ClearUDP un-forwards the specified UDP port.
+func (d *IGD) ClearUDP(port uint16) error {
+	return d.ClearProtocol(port, "UDP")
+}
+
+// ClearExternal removes the mappings of the router's externalPort, whichever
+// internal port they lead to.
+func (d *IGD) ClearExternal(port uint16) error {
+	return d.ClearCtx(context.Background(), port)
+}
 
-	// only return an error if both deletions failed
-	if tcpErr != nil && udpErr != nil {
-		return tcpErr
+// ClearFromHost removes the mappings of port that are restricted to
+// remoteHost, as created by ForwardFromHost, or those that accept any host if
+// remoteHost is empty. Like Clear, it only reports an error if neither
+// protocol could be cleared.
+func (d *IGD) ClearFromHost(remoteHost string, port uint16) error {
+	if remoteHost != "" && net.ParseIP(remoteHost) == nil {
+		return errors.New("invalid remote host " + remoteHost)
+	}
+	var firstErr error
+	cleared := false
+	for _, proto := range []string{"TCP", "UDP"} {
+		time.Sleep(time.Millisecond)
+		if err := d.deletePortMapping(remoteHost, port, proto); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		d.untrack(mappingID{remoteHost, port, proto})
+		cleared = true
+	}
+	if !cleared {
+		return firstErr
 	}
 	return nil
 }
 
+// ClearKey removes the mappings identified by k. Unlike Clear, it reports an
+// error if any of the mappings could not be removed.
+func (d *IGD) ClearKey(k MappingKey) error {
+	var firstErr error
+	for _, proto := range k.protocols {
+		time.Sleep(time.Millisecond)
+		if err := d.deletePortMapping(k.remoteHost, k.externalPort, proto); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		d.untrack(mappingID{k.remoteHost, k.externalPort, proto})
+	}
+	return firstErr
+}
+
+// SetTimeout bounds each SOAP action subsequently performed by d, such as
+// those made by Forward and Clear, to the duration t. Zero removes the bound.
+// Actions performed with a context that has a deadline are bounded by the
+// deadline instead. It should not be called while other calls on d are in
+// progress.
+func (d *IGD) SetTimeout(t time.Duration) {
+	d.client.GetServiceClient().SOAPClient.HTTPClient.Timeout = t
+}
+
+// shareHTTPClient makes c, a SOAP client for another of the router's
+// services, use the same HTTP client settings and trace as d's connection
+// service.
+func (d *IGD) shareHTTPClient(c *soap.SOAPClient) *soap.SOAPClient {
+	c.HTTPClient = d.client.GetServiceClient().SOAPClient.HTTPClient
+	c.Trace = d.client.GetServiceClient().SOAPClient.Trace
+	return c
+}
+
+// ServiceClient returns the goupnp client for the router's connection
+// service, for performing actions that this package does not wrap. Invoke
+// is usually simpler.
+func (d *IGD) ServiceClient() *goupnp.ServiceClient {
+	return d.client.GetServiceClient()
+}
+
 // Location returns the URL of the router, for future lookups (see Load).
 func (d *IGD) Location() string {
 	return d.client.GetServiceClient().Location.String()
 }
 
-// getInternalIP returns the user's local IP.
-func (d *IGD) getInternalIP() (string, error) {
-	host, _, _ := net.SplitHostPort(d.client.GetServiceClient().RootDevice.URLBase.Host)
-	devIP := net.ParseIP(host)
-	if devIP == nil {
-		return "", errors.New("could not determine router's internal IP")
-	}
+// UDN returns the unique device name of the router, which stays the same
+// across reboots and firmware updates. It can be supplied to
+// WithLocationRefresh.
+func (d *IGD) UDN() string {
+	return d.client.GetServiceClient().RootDevice.Device.UDN
+}
 
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return "", err
+// SpecVersion returns the UPnP specification version reported in the router's
+// device description.
+func (d *IGD) SpecVersion() (major, minor int, err error) {
+	root := d.client.GetServiceClient().RootDevice
+	if root == nil || (root.SpecVersion.Major == 0 && root.SpecVersion.Minor == 0) {
+		return 0, 0, errors.New("router did not report a spec version")
 	}
+	return int(root.SpecVersion.Major), int(root.SpecVersion.Minor), nil
+}
 
-	for _, iface := range ifaces {
-		addrs, err := iface.Addrs()
-		if err != nil {
-			return "", err
-		}
+// Info describes a router, as reported in its device description.
+type Info struct {
+	Manufacturer string
+	ModelName    string
+	ModelNumber  string
+	FriendlyName string
+	SerialNumber string
+}
 
-		for _, addr := range addrs {
-			if x, ok := addr.(*net.IPNet); ok && x.Contains(devIP) {
-				return x.IP.String(), nil
-			}
-		}
+// DeviceInfo returns the manufacturer, model and serial number of the router,
+// which are useful for logging and bug reports. It does not contact the
+// router.
+func (d *IGD) DeviceInfo() (Info, error) {
+	root := d.client.GetServiceClient().RootDevice
+	if root == nil {
+		return Info{}, errors.New("router did not provide a device description")
 	}
-
-	return "", errors.New("could not determine internal IP")
+	dev := root.Device
+	return Info{
+		Manufacturer: dev.Manufacturer,
+		ModelName:    dev.ModelName,
+		ModelNumber:  dev.ModelNumber,
+		FriendlyName: dev.FriendlyName,
+		SerialNumber: dev.SerialNumber,
+	}, nil
 }
 
 // Discover is deprecated; use DiscoverCtx instead.
-func Discover() (*IGD, error) {
-	return DiscoverCtx(context.Background())
+func Discover(opts ...Option) (*IGD, error) {
+	return DiscoverCtx(context.Background(), opts...)
 }
 
 // DiscoverCtx scans the local network for routers and returns the first
 // UPnP-enabled router it encounters.  It will try up to 3 times to find a
 // router, sleeping a random duration between each attempt.  This is to
 // mitigate a race condition with many callers attempting to discover
-// simultaneously.
-func DiscoverCtx(ctx context.Context) (*IGD, error) {
-	// TODO: if more than one client is found, only return those on the same
-	// subnet as the user?
+// simultaneously. The number of attempts, the sleep and the search window can
+// be set with WithRetries, WithBackoff and WithSearchTimeout. If no
+// UPnP-enabled router is found, it falls back to the NAT-PMP or PCP gateway
+// at the default gateway's address, unless WithoutNATPMP is given.
+//
+// If more than one router answers the same search, the one on the subnet of
+// the interface holding the default route is preferred, as that is the one
+// internet traffic passes through; WithSubnetFilter selects by another subnet
+// instead.
+func DiscoverCtx(ctx context.Context, opts ...Option) (*IGD, error) {
+	o := newOptions(opts)
+	ctx = o.context(ctx)
+	if err := o.checkMulticast(); err != nil {
+		return nil, err
+	}
 	maxTries := 3
+	if o.retries > 0 {
+		maxTries = o.retries
+	}
 	sleepTime := time.Millisecond * time.Duration(fastrand.Intn(5000))
+	if o.backoff > 0 {
+		sleepTime = o.backoff
+	}
 	for try := 0; try < maxTries; try++ {
-		pppclients, _, _ := internetgateway1.NewWANPPPConnection1Clients(ctx)
-		if len(pppclients) > 0 {
-			return &IGD{pppclients[0]}, nil
-		}
-		ipclients, _, _ := internetgateway1.NewWANIPConnection1Clients(ctx)
-		if len(ipclients) > 0 {
-			return &IGD{ipclients[0]}, nil
+		start := time.Now()
+		d, err := discoverOnce(ctx, o)
+		o.discoveryAttempt(start, err == nil)
+		if err != ErrNoGateway {
+			return d, err
+		} else if try == maxTries-1 {
+			break
 		}
 		select {
 		case <-ctx.Done():
-			return nil, context.Canceled
-		case <-time.After(sleepTime):
+			return nil, ctx.Err()
+		case <-time.After(jitter(sleepTime, o.jitter)):
 		}
 		sleepTime *= 2
 	}
-	return nil, errors.New("no UPnP-enabled gateway found")
+	if o.natpmp {
+		start := time.Now()
+		d, err := discoverNATPMP(ctx, o)
+		o.discoveryAttempt(start, err == nil)
+		return d, err
+	}
+	return nil, ErrNoGateway
+}
+
+// DiscoverRetry discovers a router like Discover, making up to attempts
+// searches. It sleeps for backoff after the first failed search, and doubles
+// the sleep after each subsequent one. The error from the last search is
+// returned if none succeed.
+func DiscoverRetry(attempts int, backoff time.Duration, opts ...Option) (*IGD, error) {
+	return DiscoverRetryCtx(context.Background(), attempts, backoff, opts...)
+}
+
+// DiscoverRetryCtx is the same as DiscoverRetry, but gives up and returns
+// ctx.Err() when ctx is done.
+func DiscoverRetryCtx(ctx context.Context, attempts int, backoff time.Duration, opts ...Option) (*IGD, error) {
+	o := newOptions(opts)
+	ctx = o.context(ctx)
+	if err := o.checkMulticast(); err != nil {
+		return nil, err
+	}
+	err := ErrNoGateway
+	for try := 0; try < attempts; try++ {
+		if try > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(jitter(backoff, o.jitter)):
+			}
+			backoff *= 2
+		}
+		var d *IGD
+		start := time.Now()
+		d, err = discoverOnce(ctx, o)
+		o.discoveryAttempt(start, err == nil)
+		if err == nil {
+			return d, nil
+		} else if err == ctx.Err() {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// discoverOnce searches the network for every connection service at once, or
+// for each in turn if WithSSDPSourcePort was given, and returns a router that
+// passes validation. The router offering the most preferred service
+// is used, as soon as the searches for every service preferred to it have
+// finished without success, and the remaining searches are cancelled; so
+// discovery takes a single search window however many services are searched
+// for, unless they are searched for in turn. If routers were found but none
+// passed, their validation errors are returned; if none were found,
+// ErrNoGateway is returned.
+func discoverOnce(ctx context.Context, o *options) (*IGD, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	srvs := o.services()
+	searchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan serviceSearch, len(srvs))
+	if o.ssdpPort != 0 {
+		// the searches must take turns on the source port
+		go func() {
+			for i, srv := range srvs {
+				r := o.searchService(searchCtx, srv.urn, srv.wrap)
+				r.index = i
+				results <- r
+			}
+		}()
+	} else {
+		for i, srv := range srvs {
+			go func(i int, urn string, wrap func(goupnp.ServiceClient) igdClient) {
+				r := o.searchService(searchCtx, urn, wrap)
+				r.index = i
+				results <- r
+			}(i, srv.urn, srv.wrap)
+		}
+	}
+
+	done := make([]*serviceSearch, len(srvs))
+	for n := 0; n < len(srvs); n++ {
+		r := <-results
+		done[r.index] = &r
+		for _, r := range done {
+			if r == nil {
+				// a more preferred search has yet to finish
+				break
+			} else if r.d != nil && (o.connPref != PreferConnected || r.connected) {
+				o.logf("upnp: using %s", r.d.Location())
+				return r.d, nil
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// with PreferConnected, no connection service is connected
+	var validationErrs []error
+	for _, r := range done {
+		if r.d != nil {
+			o.logf("upnp: no connection service is connected; using %s", r.d.Location())
+			return r.d, nil
+		}
+		validationErrs = append(validationErrs, r.validationErrs...)
+	}
+	if len(validationErrs) > 0 {
+		return nil, validationError(validationErrs)
+	}
+	return nil, ErrNoGateway
+}
+
+// A serviceSearch is the outcome of searching for one connection service.
+type serviceSearch struct {
+	// index is the position of the service in order of preference.
+	index int
+	// d is the router chosen from those offering the service, if any passed
+	// validation.
+	d *IGD
+	// connected is true if d reports that it is connected. It is only
+	// checked with PreferConnected.
+	connected      bool
+	validationErrs []error
+}
+
+// searchService searches the network for the connection service urn, and
+// chooses among the routers that offer it and pass validation.
+func (o *options) searchService(ctx context.Context, urn string, wrap func(goupnp.ServiceClient) igdClient) serviceSearch {
+	var r serviceSearch
+	clients, errs, err := o.searchClients(ctx, urn)
+	if err != nil && ctx.Err() == nil {
+		o.logf("upnp: searching for %s: %v", urn, err)
+	}
+	for _, err := range errs {
+		o.logf("upnp: probing %s device: %v", urn, err)
+	}
+	var candidates []*IGD
+	for _, sc := range clients {
+		o.logf("upnp: found %s at %s", urn, sc.Location)
+		d := newIGD(o.connectionClient(ctx, sc, wrap))
+		o.configure(d)
+		if err := o.validate(d); err != nil {
+			o.logf("upnp: rejecting %s: %v", d.Location(), err)
+			r.validationErrs = append(r.validationErrs, err)
+			continue
+		}
+		candidates = append(candidates, d)
+	}
+	r.d = o.choose(candidates)
+	if r.d != nil && o.connPref == PreferConnected {
+		r.connected = connected(r.d)
+	}
+	return r
+}
+
+// searchClients searches the network for the connection service urn, as
+// configured by o, and returns a client for each router that offers it.
+func (o *options) searchClients(ctx context.Context, urn string) ([]goupnp.ServiceClient, []error, error) {
+	if o.search != nil {
+		return o.search(ctx, urn, o.searchWait(), o.searchOptions())
+	}
+	return goupnp.NewServiceClientsOptsCtx(ctx, urn, o.searchWait(), o.searchOptions())
 }
 
 // Load connects to the router service specified by rawurl. This is much
 // faster than Discover. Generally, Load should only be called with values
 // returned by the IGD's Location method.
-func Load(rawurl string) (*IGD, error) {
+func Load(rawurl string, opts ...Option) (*IGD, error) {
+	return LoadCtx(context.Background(), rawurl, opts...)
+}
+
+// LoadCtx is the same as Load, but gives up and returns ctx.Err() if ctx is
+// done before the router has been reached.
+func LoadCtx(ctx context.Context, rawurl string, opts ...Option) (*IGD, error) {
+	o := newOptions(opts)
+	ctx = o.context(ctx)
 	loc, err := url.Parse(rawurl)
 	if err != nil {
 		return nil, err
 	}
-	pppclients, _ := internetgateway1.NewWANPPPConnection1ClientsByURL(loc)
-	if len(pppclients) > 0 {
-		return &IGD{pppclients[0]}, nil
+	if loc.Scheme == "natpmp" {
+		return loadNATPMPURL(loc, o)
+	}
+	for _, srv := range o.services() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		clients, _ := goupnp.NewServiceClientsByURLCtx(ctx, loc, srv.urn)
+		if len(clients) > 0 {
+			d := newIGD(o.connectionClient(ctx, clients[0], srv.wrap))
+			o.configure(d)
+			o.logf("upnp: using %s", d.Location())
+			return d, nil
+		}
+	}
+	if o.refreshLocation {
+		if d := o.relocate(ctx, loc.Hostname(), o.refreshUDN); d != nil {
+			o.configure(d)
+			return d, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	ipclients, _ := internetgateway1.NewWANIPConnection1ClientsByURL(loc)
-	if len(ipclients) > 0 {
-		return &IGD{ipclients[0]}, nil
+	return nil, fmt.Errorf("%w at URL %s", ErrNoGateway, rawurl)
+}
+
+// relocate searches the network for a connection service hosted at the given
+// host, unless host is empty, and, if udn is not empty, on the root device
+// with that UDN. It is used to find a router whose description has moved to a
+// new URL. The search, and the choice of connection service, follow o as
+// for Discover.
+func (o *options) relocate(ctx context.Context, host, udn string) *IGD {
+	for _, srv := range o.services() {
+		if ctx.Err() != nil {
+			return nil
+		}
+		clients, _, _ := o.searchClients(ctx, srv.urn)
+		for _, sc := range clients {
+			if (host != "" && sc.Location.Hostname() != host) || (udn != "" && sc.RootDevice.Device.UDN != udn) {
+				continue
+			}
+			return newIGD(o.connectionClient(ctx, sc, srv.wrap))
+		}
 	}
-	return nil, errors.New("no UPnP-enabled gateway found at URL " + rawurl)
+	return nil
 }
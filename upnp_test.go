@@ -2,9 +2,30 @@ package upnp
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp/goupnp"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway1"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/dcps/internetgateway2"
+	"gitlab.com/NebulousLabs/go-upnp/goupnp/soap"
 )
 
 // TestConcurrentUPNP tests that several threads calling Discover() concurrently
@@ -95,3 +116,4704 @@ func TestIGD(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestConcurrentForwardClear tests that a single IGD can be used to forward
+// and clear ports from several goroutines at once. It is most useful when run
+// with -race.
+func TestConcurrentForwardClear(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(port uint16) {
+			defer wg.Done()
+			if err := d.Forward(port, "upnp test"); err != nil {
+				t.Error(err)
+				return
+			}
+			if forwarded, err := d.IsForwardedTCP(port); err != nil {
+				t.Error(err)
+			} else if !forwarded {
+				t.Errorf("port %v was not reported as forwarded", port)
+			}
+			if err := d.Clear(port); err != nil {
+				t.Error(err)
+			}
+		}(uint16(9000 + i))
+	}
+	wg.Wait()
+
+	if len(fc.mappings) != 0 {
+		t.Errorf("expected every mapping to be cleared, %v remain", len(fc.mappings))
+	}
+	if len(d.tracked) != 0 {
+		t.Errorf("expected every mapping to be untracked, %v remain", len(d.tracked))
+	}
+}
+
+// TestRouterIP tests that the router's IP is found from the various forms of
+// URLBase that routers report.
+func TestRouterIP(t *testing.T) {
+	tests := []struct {
+		urlBase  string
+		location string
+		want     string
+	}{
+		{"http://192.168.1.1:5000/", "http://192.168.1.1:5000/rootDesc.xml", "192.168.1.1"},
+		{"http://192.168.1.1/", "http://192.168.1.1:5000/rootDesc.xml", "192.168.1.1"},
+		{"http://[fe80::1]:5000/", "http://192.168.1.1:5000/rootDesc.xml", "fe80::1"},
+		{"", "http://10.0.0.1:5000/rootDesc.xml", "10.0.0.1"},
+		// hostnames are resolved; "loopback" accepts any loopback address
+		{"http://localhost:5000/", "http://192.168.1.1:5000/rootDesc.xml", "loopback"},
+	}
+	for _, test := range tests {
+		d, fc := newFakeIGD("192.168.1.2")
+		urlBase, _ := url.Parse(test.urlBase)
+		fc.sc.RootDevice.URLBase = *urlBase
+		fc.sc.Location, _ = url.Parse(test.location)
+		ip, err := d.routerIP()
+		if err != nil {
+			t.Errorf("%q: %v", test.urlBase, err)
+		} else if ip.String() != test.want && !(test.want == "loopback" && ip.IsLoopback()) {
+			t.Errorf("%q: expected %v, got %v", test.urlBase, test.want, ip)
+		}
+	}
+
+	// with no host anywhere, the error should say so
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.sc.RootDevice.URLBase = url.URL{}
+	fc.sc.Location = &url.URL{Path: "/rootDesc.xml"}
+	if _, err := d.routerIP(); err == nil || !strings.Contains(err.Error(), "no host") {
+		t.Errorf("expected an error reporting the missing host, got %v", err)
+	}
+	// an unresolvable hostname should be reported
+	fc.sc.RootDevice.URLBase = url.URL{Scheme: "http", Host: "router.invalid:5000"}
+	if _, err := d.routerIP(); err == nil || !strings.Contains(err.Error(), "router.invalid") {
+		t.Errorf("expected an error naming the unresolvable host, got %v", err)
+	}
+}
+
+// TestForwardRollback tests that Forward removes the TCP mapping when the UDP
+// mapping cannot be created, and that ForwardTCP is unaffected.
+func TestForwardRollback(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.addErr = map[string]error{"UDP": errors.New("UDP refused")}
+
+	if err := d.Forward(9001, "upnp test"); err == nil {
+		t.Fatal("expected Forward to fail")
+	}
+	if forwarded, err := d.IsForwardedTCP(9001); err != nil {
+		t.Fatal(err)
+	} else if forwarded {
+		t.Fatal("TCP mapping was not rolled back")
+	}
+
+	if err := d.ForwardTCP(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	if forwarded, err := d.IsForwardedTCP(9001); err != nil {
+		t.Fatal(err)
+	} else if !forwarded {
+		t.Fatal("port 9001 was not reported as forwarded")
+	}
+	if err := d.ClearTCP(9001); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNATPMP tests that an IGD loaded from a NAT-PMP gateway forwards and
+// clears ports, and answers queries about the mappings it created.
+func TestNATPMP(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			} else if n < 2 {
+				continue
+			}
+			if buf[1] == 0 {
+				conn.WriteToUDP([]byte{0, 128, 0, 0, 0, 0, 0, 1, 203, 0, 113, 7}, addr)
+				continue
+			}
+			// grant every mapping as requested
+			resp := make([]byte, 16)
+			resp[1] = buf[1] | 0x80
+			copy(resp[8:], buf[4:n])
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+
+	d, err := Load("natpmp://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := d.ExternalIP(); err != nil {
+		t.Fatal(err)
+	} else if ip != "203.0.113.7" {
+		t.Fatal("wrong external IP:", ip)
+	}
+	if err := d.Forward(9001, "natpmp test"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.IsForwardedTCP(9001); err != nil || !ok {
+		t.Fatal("port was not forwarded:", err)
+	}
+	if err := d.Clear(9001); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.IsForwardedUDP(9001); err != nil || ok {
+		t.Fatal("port was not cleared:", err)
+	}
+	// recorded mappings expire by the IGD's clock
+	clock := newFakeClock()
+	d.SetClock(clock)
+	if err := d.ForwardTimeout(9004, "natpmp test", time.Minute); err != nil {
+		t.Fatal(err)
+	} else if ok, err := d.IsForwardedTCP(9004); err != nil || !ok {
+		t.Fatal("port was not forwarded:", err)
+	}
+	clock.Advance(2 * time.Minute)
+	if ok, err := d.IsForwardedTCP(9004); err != nil || ok {
+		t.Fatal("mapping did not expire:", err)
+	}
+	if err := d.ForwardCtx(context.Background(), 9003, "natpmp test"); err != nil {
+		t.Fatal(err)
+	} else if ok, err := d.IsForwardedUDP(9003); err != nil || !ok {
+		t.Fatal("port was not forwarded by ForwardCtx:", err)
+	} else if err := d.ClearCtx(context.Background(), 9003); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ForwardFromHost("203.0.113.8", 9002, "natpmp test"); faultCode(err) != errCodeRemoteHostWildcard {
+		t.Fatal("expected remote host to be refused, got", err)
+	}
+}
+
+// TestPCP tests that an IGD loaded from a gateway that only speaks PCP
+// forwards and clears ports with PCP requests.
+func TestPCP(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	var mu sync.Mutex
+	lifetimes := make(map[uint16]uint32)
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			} else if n < 2 {
+				continue
+			}
+			if buf[0] != 2 {
+				conn.WriteToUDP([]byte{2, buf[1] | 0x80, 0, 1, 0, 0, 0, 0}, addr)
+				continue
+			}
+			// grant every mapping as requested, from 203.0.113.7
+			resp := make([]byte, 60)
+			copy(resp, buf[:n])
+			resp[1] = buf[1] | 0x80
+			copy(resp[44:], net.IPv4(203, 0, 113, 7).To16())
+			mu.Lock()
+			lifetimes[binary.BigEndian.Uint16(buf[40:])] = binary.BigEndian.Uint32(buf[4:])
+			mu.Unlock()
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+	lifetime := func(port uint16) (uint32, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		l, ok := lifetimes[port]
+		return l, ok
+	}
+
+	d, err := Load("natpmp://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	} else if info, _ := d.DeviceInfo(); info.FriendlyName != "PCP gateway" {
+		t.Fatal("expected a PCP gateway, got", info.FriendlyName)
+	}
+	if ip, err := d.ExternalIP(); err != nil || ip != "203.0.113.7" {
+		t.Fatalf("expected 203.0.113.7, got %q, %v", ip, err)
+	}
+	if err := d.Forward(9001, "pcp test"); err != nil {
+		t.Fatal(err)
+	} else if l, ok := lifetime(9001); !ok || l != natpmpLifetime {
+		t.Fatal("port was not mapped with PCP:", l, ok)
+	}
+	if err := d.Clear(9001); err != nil {
+		t.Fatal(err)
+	} else if l, _ := lifetime(9001); l != 0 {
+		t.Fatal("port was not removed with PCP")
+	}
+}
+
+// TestGetMapping tests that GetMapping reports a forwarded port, and nil once
+// it is cleared.
+func TestGetMapping(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := d.GetMapping(9001, "tcp")
+	if err != nil {
+		t.Fatal(err)
+	} else if m == nil || m.InternalClient != "192.168.1.2" || m.Description != "upnp test" || m.Protocol != "TCP" {
+		t.Fatalf("wrong mapping: %+v", m)
+	}
+	if err := d.Clear(9001); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := d.GetMapping(9001, "TCP"); err != nil || m != nil {
+		t.Fatalf("expected no mapping, got %+v, %v", m, err)
+	}
+}
+
+// TestSubnet tests that Subnet reports the network of the interface that
+// shares a subnet with the router.
+func TestSubnet(t *testing.T) {
+	d, fc := newFakeIGD("127.0.0.1")
+	loc, _ := url.Parse("http://127.0.0.1:5000/rootDesc.xml")
+	fc.sc.RootDevice.URLBase = *loc
+	subnet, err := d.Subnet()
+	if err != nil {
+		t.Skip(err) // no loopback interface
+	}
+	if !subnet.Contains(net.IPv4(127, 0, 0, 1)) || !subnet.IP.Equal(subnet.IP.Mask(subnet.Mask)) {
+		t.Fatal("wrong subnet:", subnet)
+	}
+}
+
+// TestInterface tests that Interface finds the interface holding the address
+// that ports are forwarded to.
+func TestInterface(t *testing.T) {
+	d, _ := newFakeIGD("127.0.0.1")
+	iface, err := d.Interface()
+	if err != nil {
+		t.Skip(err) // no loopback interface
+	}
+	if iface.Flags&net.FlagLoopback == 0 {
+		t.Fatal("expected the loopback interface, got", iface.Name)
+	}
+}
+
+// TestSearchWait tests that WithSearchTimeout is rounded up to whole seconds.
+func TestSearchWait(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		secs    int
+	}{
+		{0, 2},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+	}
+	for _, test := range tests {
+		if secs := newOptions([]Option{WithSearchTimeout(test.timeout)}).searchWait(); secs != test.secs {
+			t.Errorf("%v: expected %v seconds, got %v", test.timeout, test.secs, secs)
+		}
+	}
+}
+
+// TestSearchOptions tests that the SSDP socket options are passed to the
+// search.
+func TestSearchOptions(t *testing.T) {
+	if so := newOptions(nil).searchOptions(); so.LocalAddr != "" || so.MulticastTTL != 0 || so.ListenNotify {
+		t.Error("expected default search options, got", so)
+	}
+	so := newOptions([]Option{WithSSDPSourcePort(1901), WithMulticastTTL(4), WithNotifyListen()}).searchOptions()
+	if so.LocalAddr != ":1901" || so.MulticastTTL != 4 || !so.ListenNotify {
+		t.Error("unexpected search options:", so)
+	}
+}
+
+// TestUPnPErrorIs tests that errors reported by the router match the
+// sentinel with the same code.
+func TestUPnPErrorIs(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	err := d.Clear(9001)
+	if !errors.Is(err, ErrNoSuchEntry) {
+		t.Fatal("expected ErrNoSuchEntry, got", err)
+	} else if errors.Is(err, ErrMappingConflict) {
+		t.Fatal("ErrNoSuchEntry matched ErrMappingConflict")
+	}
+	var upnpErr *UPnPError
+	if !errors.As(err, &upnpErr) || upnpErr.Code != errCodeNoSuchEntry {
+		t.Fatal("expected a *UPnPError, got", err)
+	}
+}
+
+// TestSOAPFault tests that the UPnP error in a SOAP fault is parsed, and
+// converted to a *UPnPError even when wrapped.
+func TestSOAPFault(t *testing.T) {
+	const body = `<Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>` +
+		`<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>718</errorCode>` +
+		`<errorDescription>ConflictInMappingEntry</errorDescription></UPnPError></detail></Fault>`
+	var f soap.SOAPFaultError
+	if err := xml.Unmarshal([]byte(body), &f); err != nil {
+		t.Fatal(err)
+	} else if f.FaultString != "UPnPError" || f.UPnPError.ErrorCode != 718 || f.UPnPError.ErrorDescription != "ConflictInMappingEntry" {
+		t.Fatalf("unexpected fault: %+v", f)
+	} else if f.Error() != "SOAP fault: UPnPError" {
+		t.Error("unexpected error text:", f.Error())
+	}
+	err := upnpError(fmt.Errorf("adding mapping: %w", &f))
+	if !errors.Is(err, ErrMappingConflict) {
+		t.Fatal("expected ErrMappingConflict, got", err)
+	} else if faultCode(err) != ErrCodeConflictInMappingEntry {
+		t.Error("unexpected fault code", faultCode(err))
+	}
+	if err := upnpError(&soap.SOAPFaultError{FaultString: "other"}); errors.Is(err, ErrMappingConflict) {
+		t.Error("a fault without a code should be returned unchanged, got", err)
+	}
+}
+
+// TestSubscribe tests that Subscribe reports the variables sent by the
+// router, and unsubscribes when its context is cancelled, sending its
+// requests with the IGD's HTTP client.
+func TestSubscribe(t *testing.T) {
+	unsubscribed := make(chan struct{})
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Client") != "upnp test" {
+			// the request was not sent with the IGD's HTTP client
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case "SUBSCRIBE":
+			callback := strings.Trim(r.Header.Get("CALLBACK"), "<>")
+			w.Header().Set("SID", "uuid:test")
+			w.WriteHeader(http.StatusOK)
+			go func() {
+				body := `<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">` +
+					`<e:property><ConnectionStatus>Connected</ConnectionStatus></e:property>` +
+					`<e:property><ExternalIPAddress>203.0.113.9</ExternalIPAddress></e:property>` +
+					`</e:propertyset>`
+				req, _ := http.NewRequest("NOTIFY", callback, strings.NewReader(body))
+				req.Header.Set("SID", "uuid:test")
+				if resp, err := http.DefaultClient.Do(req); err == nil {
+					resp.Body.Close()
+				}
+			}()
+		case "UNSUBSCRIBE":
+			close(unsubscribed)
+		}
+	}))
+	defer router.Close()
+
+	d, fc := newFakeIGD("127.0.0.1")
+	fc.sc.Service.EventSubURL.Str = router.URL
+	fc.sc.Service.EventSubURL.URL = *mustParse(router.URL)
+	fc.sc.Service.EventSubURL.Ok = true
+	d.setHeader(http.Header{"X-Client": {"upnp test"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := d.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.Type != ConnectionStatusChanged || e.Status != "Connected" {
+		t.Fatalf("wrong event: %+v", e)
+	}
+	if e := <-events; e.Type != ExternalIPChanged || e.ExternalIP != "203.0.113.9" {
+		t.Fatalf("wrong event: %+v", e)
+	}
+	cancel()
+	for range events {
+	}
+	select {
+	case <-unsubscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription was not cancelled")
+	}
+}
+
+func mustParse(rawurl string) *url.URL {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// TestWatchExternalIP tests that WatchExternalIP sends the current external
+// IP, and then each new one.
+func TestWatchExternalIP(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ips, err := d.WatchExternalIP(ctx, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := <-ips; ip != "203.0.113.1" {
+		t.Fatal("wrong initial IP:", ip)
+	}
+	fc.mu.Lock()
+	fc.externalIP = "203.0.113.2"
+	fc.mu.Unlock()
+	if ip := <-ips; ip != "203.0.113.2" {
+		t.Fatal("wrong new IP:", ip)
+	}
+	cancel()
+	for range ips {
+	}
+}
+
+// TestStatus tests that Status reports the connection status of a router
+// without link properties.
+func TestStatus(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	s, err := d.Status()
+	if err != nil {
+		t.Fatal(err)
+	} else if s.ConnectionStatus != "Connected" || s.Uptime != time.Hour || s.UpstreamMaxBitRate != 0 {
+		t.Fatalf("wrong status: %+v", s)
+	}
+}
+
+// TestStatusBestEffort tests that Status only requires GetStatusInfo to
+// succeed, and only checks for double NAT when the connection restarts.
+func TestStatusBestEffort(t *testing.T) {
+	const (
+		ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+		common = "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1"
+	)
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + common + `</serviceType>` +
+		`<serviceId>urn:upnp-org:serviceId:WANCommonIFC1</serviceId><controlURL>/common</controlURL></service>` +
+		`<service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	var mu sync.Mutex
+	uptime, ipRequests := 100, 0
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch action := r.Header.Get("SOAPAction"); {
+		case r.URL.Path == "/rootDesc.xml":
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+			return
+		case strings.Contains(action, "#GetStatusInfo"):
+			mu.Lock()
+			body = `<u:GetStatusInfoResponse xmlns:u="` + ipConn + `"><NewConnectionStatus>Connected</NewConnectionStatus>` +
+				`<NewLastConnectionError>ERROR_NONE</NewLastConnectionError><NewUptime>` + strconv.Itoa(uptime) +
+				`</NewUptime></u:GetStatusInfoResponse>`
+			mu.Unlock()
+		case strings.Contains(action, "#GetExternalIPAddress"):
+			mu.Lock()
+			ipRequests++
+			mu.Unlock()
+			body = `<u:GetExternalIPAddressResponse xmlns:u="` + ipConn + `">` +
+				`<NewExternalIPAddress>10.0.0.2</NewExternalIPAddress></u:GetExternalIPAddressResponse>`
+		default:
+			w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+				`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>` +
+				`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>501</errorCode>` +
+				`<errorDescription>Action Failed</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`))
+			return
+		}
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+			`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` + body + `</s:Body></s:Envelope>`))
+	}))
+	defer router.Close()
+	requests := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return ipRequests
+	}
+
+	d, err := Load(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if s, err := d.Status(); err != nil {
+			t.Fatal("a link properties failure failed Status:", err)
+		} else if !s.DoubleNAT || s.PhysicalLinkStatus != "" {
+			t.Fatalf("wrong status: %+v", s)
+		}
+	}
+	if n := requests(); n != 1 {
+		t.Fatalf("expected the external IP to be read once, got %v requests", n)
+	}
+	mu.Lock()
+	uptime = 5
+	mu.Unlock()
+	if _, err := d.Status(); err != nil {
+		t.Fatal(err)
+	} else if n := requests(); n != 2 {
+		t.Fatal("double NAT was not checked again after the connection restarted")
+	}
+}
+
+// TestDetectDoubleNAT tests that private and carrier-grade NAT external
+// addresses are reported as double NAT.
+func TestDetectDoubleNAT(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	for _, test := range []struct {
+		ip     string
+		double bool
+	}{
+		{"203.0.113.1", false},
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"169.254.1.1", true},
+		{"fd00::1", true},
+	} {
+		fc.externalIP = test.ip
+		if double, err := d.DetectDoubleNAT(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if double != test.double {
+			t.Errorf("%v: expected %v, got %v", test.ip, test.double, double)
+		}
+	}
+	if s, err := d.Status(); err != nil || !s.DoubleNAT {
+		t.Fatalf("Status did not report double NAT: %+v, %v", s, err)
+	}
+	fc.externalIP = "0.0.0.0"
+	if _, err := d.DetectDoubleNAT(context.Background()); err != ErrNoExternalIP {
+		t.Fatal("expected ErrNoExternalIP, got", err)
+	}
+}
+
+// TestForwardFor tests that ForwardFor maps a single protocol to another
+// host.
+func TestForwardFor(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	if err := d.ForwardFor("192.168.1.3", 9001, 80, "tcp", "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := d.GetMapping(9001, "TCP"); err != nil || m == nil || m.InternalClient != "192.168.1.3" || m.InternalPort != 80 {
+		t.Fatalf("wrong mapping: %+v, %v", m, err)
+	}
+	if m, err := d.GetMapping(9001, "UDP"); err != nil || m != nil {
+		t.Fatalf("UDP was mapped: %+v, %v", m, err)
+	}
+}
+
+// TestForwardAnyProbe tests that ForwardAny tries the next port on routers
+// without AddAnyPortMapping when the preferred one is taken.
+func TestForwardAnyProbe(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.mappings[mappingID{"", 9001, "UDP"}] = trackedMapping{internalPort: 9001, internalIP: "192.168.1.3", enabled: true}
+
+	port, err := d.ForwardAny(9001, "upnp test")
+	if err != nil {
+		t.Fatal(err)
+	} else if port != 9002 {
+		t.Fatal("expected port 9002, got", port)
+	}
+	if m, err := d.GetMapping(9001, "TCP"); err != nil || m != nil {
+		t.Fatalf("partial mapping of 9001 was not rolled back: %+v, %v", m, err)
+	}
+	if m, err := d.GetMapping(9002, "UDP"); err != nil || m == nil || m.InternalPort != 9001 {
+		t.Fatalf("wrong mapping: %+v, %v", m, err)
+	}
+}
+
+// TestForwardWithRetry tests that ForwardWithRetry replaces a stale mapping
+// with the same description, but not someone else's.
+func TestForwardWithRetry(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.mappings[mappingID{"", 9001, "TCP"}] = trackedMapping{internalPort: 9001, internalIP: "192.168.1.9", enabled: true, desc: "upnp test"}
+	fc.mappings[mappingID{"", 9002, "UDP"}] = trackedMapping{internalPort: 9002, internalIP: "192.168.1.9", enabled: true, desc: "other app"}
+
+	if err := d.ForwardWithRetry(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := d.GetMapping(9001, "TCP"); err != nil || m == nil || m.InternalClient != "192.168.1.2" {
+		t.Fatalf("stale mapping was not replaced: %+v, %v", m, err)
+	}
+	if err := d.ForwardWithRetry(9002, "upnp test"); faultCode(err) != ErrCodeConflictInMappingEntry {
+		t.Fatal("expected a conflict, got", err)
+	}
+	if m, err := d.GetMapping(9002, "TCP"); err != nil || m != nil {
+		t.Fatalf("TCP mapping was not rolled back: %+v, %v", m, err)
+	}
+}
+
+// TestMappingsIter tests that the mapping table is streamed entry by entry,
+// and that the walk stops when ctx is cancelled.
+func TestMappingsIter(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	for _, port := range []uint16{9001, 9002} {
+		if err := d.Forward(port, "upnp test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mappings, errs := d.MappingsIter(context.Background())
+	n := 0
+	for range mappings {
+		n++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	} else if n != 4 {
+		t.Fatal("expected 4 mappings, got", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mappings, errs = d.MappingsIter(ctx)
+	<-mappings
+	cancel()
+	for range mappings {
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+}
+
+// TestReconcileMappings tests that the router's table is converged on the
+// desired mappings, leaving other hosts' entries alone.
+func TestReconcileMappings(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.mappings[mappingID{"", 9001, "TCP"}] = trackedMapping{internalPort: 9001, internalIP: "192.168.1.2", enabled: true, desc: "upnp test", lease: 0}
+	fc.mappings[mappingID{"", 9002, "TCP"}] = trackedMapping{internalPort: 9002, internalIP: "192.168.1.2", enabled: true, desc: "stale", lease: 0}
+	fc.mappings[mappingID{"", 9003, "TCP"}] = trackedMapping{internalPort: 9003, internalIP: "192.168.1.2", enabled: true, desc: "unwanted", lease: 0}
+	fc.mappings[mappingID{"", 9005, "TCP"}] = trackedMapping{internalPort: 9005, internalIP: "192.168.1.9", enabled: true, desc: "other host", lease: 0}
+
+	desired := []PortMapping{
+		{ExternalPort: 9001, Protocol: "tcp", Description: "upnp test", Enabled: true},
+		{ExternalPort: 9002, Protocol: "TCP", Description: "upnp test", Enabled: true},
+		{ExternalPort: 9004, Protocol: "UDP", Description: "upnp test", Enabled: true},
+		{ExternalPort: 9005, Protocol: "TCP", Description: "upnp test", Enabled: true},
+	}
+	added, removed, unchanged, err := d.ReconcileMappings(desired, nil)
+	if !errors.Is(err, ErrMappingConflict) {
+		t.Fatal("expected ErrMappingConflict for 9005, got", err)
+	}
+	if len(unchanged) != 1 || unchanged[0].ExternalPort != 9001 {
+		t.Fatalf("wrong unchanged mappings: %+v", unchanged)
+	} else if len(added) != 2 || added[0].ExternalPort != 9002 || added[1].ExternalPort != 9004 {
+		t.Fatalf("wrong added mappings: %+v", added)
+	} else if len(removed) != 2 {
+		t.Fatalf("wrong removed mappings: %+v", removed)
+	}
+	if m := fc.mappings[mappingID{"", 9002, "TCP"}]; m.desc != "upnp test" {
+		t.Fatal("stale mapping was not replaced:", m)
+	} else if _, ok := fc.mappings[mappingID{"", 9003, "TCP"}]; ok {
+		t.Fatal("unwanted mapping was not removed")
+	} else if m := fc.mappings[mappingID{"", 9005, "TCP"}]; m.internalIP != "192.168.1.9" {
+		t.Fatal("other host's mapping was touched:", m)
+	}
+
+	// a second pass has nothing to do
+	desired = desired[:3]
+	if added, removed, unchanged, err := d.ReconcileMappings(desired, nil); err != nil || len(added) != 0 || len(removed) != 0 || len(unchanged) != 3 {
+		t.Fatalf("expected no changes, got %+v, %+v, %+v, %v", added, removed, unchanged, err)
+	}
+}
+
+// TestQuirks tests that the wildcard remote host is adapted for routers that
+// spell it differently, and that wildcard external ports are refused.
+func TestQuirks(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.sc.RootDevice.Device.Manufacturer = "AVM Berlin"
+	fc.sc.RootDevice.Device.ModelName = "FRITZ!Box 7590"
+	d.quirkTable = knownQuirks
+	d.client = d.withQuirks(d.client)
+	if q, ok := d.client.(*quirkClient); !ok || q.quirks.WildcardHost != "0.0.0.0" {
+		t.Fatal("quirks were not applied")
+	} else if d.connection() != fc {
+		t.Fatal("connection did not look through the quirkClient")
+	}
+
+	if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := fc.mappings[mappingID{"0.0.0.0", 9001, "TCP"}]; !ok {
+		t.Fatal("wildcard remote host was not adapted:", fc.mappings)
+	}
+	if ms, err := d.ListMappings(); err != nil || len(ms) != 2 || ms[0].RemoteHost != "" {
+		t.Fatalf("wrong mappings: %+v, %v", ms, err)
+	} else if ok, err := d.IsForwarded(9001, "udp"); err != nil || !ok {
+		t.Fatal("expected 9001 to be forwarded:", ok, err)
+	}
+	if err := d.Clear(9001); err != nil {
+		t.Fatal(err)
+	} else if len(fc.mappings) != 0 {
+		t.Fatal("mappings were not cleared:", fc.mappings)
+	}
+
+	if err := d.Forward(0, "upnp test"); err != ErrWildcardPort {
+		t.Fatal("expected ErrWildcardPort, got", err)
+	}
+}
+
+// TestClearAllByDescription tests that only mappings with the description
+// are removed, whichever host they forward to.
+func TestClearAllByDescription(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.mappings[mappingID{"", 9001, "TCP"}] = trackedMapping{internalPort: 9001, internalIP: "192.168.1.9", enabled: true, desc: "upnp test"}
+	if err := d.Forward(9002, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Forward(9003, "upnp test 2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := d.ClearAllByDescription("upnp test"); err != nil || n != 3 {
+		t.Fatalf("expected 3 mappings removed, got %v, %v", n, err)
+	}
+	if ms, _ := d.ListMappings(); len(ms) != 2 || ms[0].Description != "upnp test 2" {
+		t.Fatalf("wrong mappings left: %+v", ms)
+	}
+	if n, err := d.ClearAllByDescriptionPrefix("upnp"); err != nil || n != 2 {
+		t.Fatalf("expected 2 mappings removed, got %v, %v", n, err)
+	}
+}
+
+// TestVerifyForwardExternal tests that a failed probe is reported as
+// ErrPortUnreachable, and is given the external address.
+func TestVerifyForwardExternal(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	var probed string
+	err := d.VerifyForwardExternal(context.Background(), 9001, func(ctx context.Context, addr string) error {
+		probed = addr
+		return errors.New("connection refused")
+	})
+	if !errors.Is(err, ErrPortUnreachable) {
+		t.Fatal("expected ErrPortUnreachable, got", err)
+	} else if probed != "203.0.113.1:9001" {
+		t.Fatal("wrong address probed:", probed)
+	}
+}
+
+// TestExternalAddresses tests that the STUN-observed address is reported
+// alongside the router's, and used when the router reports none.
+func TestExternalAddresses(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	go func() {
+		// answer with a MAPPED-ADDRESS of 198.51.100.7:9001
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil || n < 20 {
+				return
+			}
+			resp := append([]byte{0x01, 0x01, 0, 12}, buf[4:20]...)
+			resp = append(resp, 0, 0x01, 0, 8, 0, 0x01, 0x23, 0x29, 198, 51, 100, 7)
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+
+	d, fc := newFakeIGD("192.168.1.2")
+	d.stunServers = []string{conn.LocalAddr().String()}
+	a, err := d.ExternalAddresses(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if a.UPnP != "203.0.113.1" || a.STUN != "198.51.100.7" || !a.Mismatch() {
+		t.Fatalf("wrong addresses: %+v", a)
+	}
+	fc.externalIP = ""
+	if a, err := d.ExternalAddresses(context.Background()); err != nil || a.IP() != "198.51.100.7" {
+		t.Fatalf("wrong addresses: %+v, %v", a, err)
+	}
+
+	a = ExternalAddresses{UPnP: "198.51.100.7", STUN: "198.51.100.7", IPv6: "2001:db8::1"}
+	if all := a.All(); len(all) != 2 || all[0] != "198.51.100.7" || all[1] != "2001:db8::1" {
+		t.Fatal("wrong addresses:", all)
+	}
+}
+
+// TestReconcile tests that mappings recorded in a FileStore are restored
+// after the router forgets them.
+func TestReconcile(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "mappings.json"))
+	d, _ := newFakeIGD("192.168.1.2")
+	d.store = store
+	if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	if ms, err := store.Load(); err != nil || len(ms) != 2 || !ms[0].Local {
+		t.Fatalf("wrong stored mappings: %+v, %v", ms, err)
+	}
+
+	// a rebooted router, which has lost one mapping and holds a stale
+	// version of the other
+	d, fc := newFakeIGD("192.168.1.2")
+	d.store = store
+	fc.mappings[mappingID{"", 9001, "UDP"}] = trackedMapping{internalPort: 9002, internalIP: "192.168.1.2", enabled: true}
+	if err := d.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, proto := range []string{"TCP", "UDP"} {
+		if m, ok := fc.mappings[mappingID{"", 9001, proto}]; !ok || m.internalPort != 9001 || m.desc != "upnp test" {
+			t.Fatalf("%v mapping not restored: %+v", proto, m)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	} else if ms, err := store.Load(); err != nil || len(ms) != 0 {
+		t.Fatalf("mappings still stored after Close: %+v, %v", ms, err)
+	}
+}
+
+// TestManager tests that a Manager forwards its ports, and restores them
+// when the router loses them.
+func TestManager(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	health := make(chan PortHealth, 10)
+	m := NewManager(10*time.Millisecond, func(h PortHealth) { health <- h })
+	m.discover = func(context.Context) (*IGD, error) { return d, nil }
+	m.Add(9001, "upnp test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+	if h := <-health; h.Port != 9001 || h.Err != nil || h.Restored {
+		t.Fatalf("wrong health: %+v", h)
+	}
+
+	// the router reboots
+	fc.mu.Lock()
+	fc.mappings = make(map[mappingID]trackedMapping)
+	fc.mu.Unlock()
+	if h := <-health; h.Err != nil || !h.Restored {
+		t.Fatalf("wrong health: %+v", h)
+	} else if ok, err := d.IsForwardedUDP(9001); err != nil || !ok {
+		t.Fatal("port not restored:", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if len(fc.mappings) != 0 {
+		t.Fatal("mappings not cleared:", fc.mappings)
+	}
+}
+
+// TestManagerReconnect tests that a Manager re-applies its mappings and
+// reports a Reconnect when the router's connection comes back up.
+func TestManagerReconnect(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	health := make(chan PortHealth, 10)
+	m := NewManager(10*time.Millisecond, func(h PortHealth) { health <- h })
+	m.discover = func(context.Context) (*IGD, error) { return d, nil }
+	m.Add(9001, "upnp test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+	<-health
+
+	// the connection drops, and the router forgets the mapping silently
+	fc.mu.Lock()
+	fc.status = "Disconnected"
+	fc.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	fc.mu.Lock()
+	fc.status = "Connected"
+	fc.externalIP = "203.0.113.2"
+	fc.mappings = make(map[mappingID]trackedMapping)
+	fc.mu.Unlock()
+
+	select {
+	case r := <-m.Reconnects():
+		if r.Rebooted || r.ExternalIP != "203.0.113.2" {
+			t.Fatalf("wrong reconnect: %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnect reported")
+	}
+	if ok, err := d.IsForwardedTCP(9001); err != nil || !ok {
+		t.Fatal("port not restored:", err)
+	}
+}
+
+// TestManagerRenewal tests that a Manager forwards its ports with leases,
+// which its IGD renews by the Manager's Clock until the port is removed.
+func TestManagerRenewal(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	clock := newFakeClock()
+	health := make(chan PortHealth, 10)
+	m := NewManager(10*time.Minute, func(h PortHealth) { health <- h })
+	m.SetClock(clock)
+	m.discover = func(context.Context) (*IGD, error) { return d, nil }
+	m.Add(9001, "upnp test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+	if h := <-health; h.Err != nil {
+		t.Fatal(h.Err)
+	}
+	fc.mu.Lock()
+	lease := fc.mappings[mappingID{"", 9001, "TCP"}].lease
+	fc.mu.Unlock()
+	if lease != 20*60 {
+		t.Fatal("expected a 20 minute lease, got", lease)
+	} else if iv := clock.intervals(); len(iv) != 3 {
+		t.Fatal("expected the checks and a renewal for each protocol, got", iv)
+	}
+
+	waitTickers := func(n int) {
+		for start := time.Now(); len(clock.intervals()) != n; time.Sleep(time.Millisecond) {
+			if time.Since(start) > time.Second {
+				t.Fatalf("expected %v tickers, got %v", n, clock.intervals())
+			}
+		}
+	}
+	if err := m.Remove(9001); err != nil {
+		t.Fatal(err)
+	}
+	waitTickers(1)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	waitTickers(0)
+}
+
+// TestDiagnoseProbe tests that a Report records what the router reports
+// about itself, and survives a round trip through JSON.
+func TestDiagnoseProbe(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	r := &Report{Time: time.Now()}
+	r.probe(d)
+	if g := r.Gateway; g == nil || g.ExternalIP != "203.0.113.1" || g.ConnectionStatus != "Connected" || g.Uptime != time.Hour {
+		t.Fatalf("wrong gateway: %+v", r.Gateway)
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	} else if decoded.Gateway == nil || decoded.Gateway.Location != d.Location() {
+		t.Fatalf("wrong decoded report: %s", data)
+	}
+}
+
+// TestNewDeviceEntry tests that the device type is taken from an SSDP
+// response's ST or USN.
+func TestNewDeviceEntry(t *testing.T) {
+	for _, test := range []struct {
+		st, usn, deviceType string
+	}{
+		{"urn:schemas-upnp-org:device:MediaRenderer:1", "uuid:1::urn:schemas-upnp-org:device:MediaRenderer:1", "urn:schemas-upnp-org:device:MediaRenderer:1"},
+		{"upnp:rootdevice", "uuid:1::upnp:rootdevice", ""},
+		{"uuid:1", "uuid:1", ""},
+		{"urn:schemas-upnp-org:service:WANIPConnection:1", "uuid:1::urn:schemas-upnp-org:service:WANIPConnection:1", ""},
+	} {
+		resp := &http.Response{Header: http.Header{
+			"Location": {"http://192.168.1.1:5000/rootDesc.xml"},
+			"St":       {test.st},
+			"Usn":      {test.usn},
+			"Server":   {"Linux UPnP/1.1 MiniUPnPd/2.2"},
+		}}
+		e := newDeviceEntry(resp)
+		if e.DeviceType != test.deviceType || e.Location == "" || e.Server == "" || e.USN != test.usn {
+			t.Errorf("wrong entry for %v: %+v", test.st, e)
+		}
+	}
+}
+
+// TestForwardListener tests that ForwardListener forwards a listener's port
+// and returns its external address.
+func TestForwardListener(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+
+	d, fc := newFakeIGD("192.168.1.2")
+	addr, clear, err := d.ForwardListener(l, "upnp test")
+	if err != nil {
+		t.Fatal(err)
+	} else if addr != net.JoinHostPort("203.0.113.1", strconv.Itoa(int(port))) {
+		t.Fatal("wrong external address:", addr)
+	} else if _, ok := fc.mappings[mappingID{"", port, "TCP"}]; !ok {
+		t.Fatal("port was not forwarded")
+	}
+	if err := clear(); err != nil {
+		t.Fatal(err)
+	} else if len(fc.mappings) != 0 {
+		t.Fatal("port was not cleared")
+	}
+}
+
+// TestWithSubnetFilter tests that routers off the filtered subnet are
+// rejected.
+func TestWithSubnetFilter(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+	if err := newOptions([]Option{WithSubnetFilter(lan)}).validate(d); err != nil {
+		t.Fatal(err)
+	} else if err := newOptions([]Option{WithSubnetFilter(other)}).validate(d); err == nil {
+		t.Fatal("router off the subnet was accepted")
+	}
+	if c := newOptions([]Option{WithSubnetFilter(lan)}).choose([]*IGD{d}); c != d {
+		t.Fatal("wrong router chosen")
+	}
+}
+
+// TestForwardRestricted tests that ForwardRestricted maps a single protocol
+// for the remote host only.
+func TestForwardRestricted(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.ForwardRestricted(net.ParseIP("198.51.100.7"), 9001, "udp", "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fc.mappings[mappingID{"198.51.100.7", 9001, "UDP"}]; !ok || len(fc.mappings) != 1 {
+		t.Fatal("wrong mappings:", fc.mappings)
+	}
+	if err := d.ForwardRestricted(nil, 9001, "udp", "upnp test"); err == nil {
+		t.Fatal("expected an error for a missing remote host")
+	}
+	if err := d.ClearFromHost("198.51.100.7", 9001); err != nil || len(fc.mappings) != 0 {
+		t.Fatal("mapping not cleared:", err)
+	}
+}
+
+// TestForwardFromHost tests that ForwardFromHost restricts the mappings to
+// the remote host, or to none if it is empty, and that ClearFromHost removes
+// only the mappings for the host it is given.
+func TestForwardFromHost(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.ForwardFromHost("198.51.100.7", 9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if err := d.ForwardFromHost("", 9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"198.51.100.7", ""} {
+		for _, proto := range []string{"TCP", "UDP"} {
+			if _, ok := fc.mappings[mappingID{host, 9001, proto}]; !ok {
+				t.Fatalf("9001/%v was not forwarded for %q", proto, host)
+			}
+		}
+	}
+	for _, bad := range []string{"host.example", "198.51.100"} {
+		if err := d.ForwardFromHost(bad, 9002, "upnp test"); err == nil {
+			t.Errorf("%q: expected an invalid remote host to be rejected", bad)
+		} else if err := d.ClearFromHost(bad, 9001); err == nil {
+			t.Errorf("%q: expected an invalid remote host to be rejected", bad)
+		}
+	}
+
+	if err := d.ClearFromHost("198.51.100.7", 9001); err != nil {
+		t.Fatal(err)
+	} else if len(fc.mappings) != 2 {
+		t.Fatal("expected the unrestricted mappings to remain, got", fc.mappings)
+	} else if err := d.ClearFromHost("", 9001); err != nil {
+		t.Fatal(err)
+	} else if len(fc.mappings) != 0 {
+		t.Fatal("expected no mappings, got", fc.mappings)
+	}
+}
+
+func TestForwardPartial(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.addErr = map[string]error{"UDP": errors.New("UDP not supported")}
+	forwarded, err := d.ForwardPartial(9001, "upnp test")
+	var perr *PartialForwardError
+	if !errors.As(err, &perr) || len(perr.Failed) != 1 || perr.Failed[0] != "UDP" {
+		t.Fatal("expected a PartialForwardError for UDP, got", err)
+	}
+	if len(forwarded) != 1 || forwarded[0] != "TCP" {
+		t.Fatal("wrong protocols forwarded:", forwarded)
+	}
+	if _, ok := fc.mappings[mappingID{"", 9001, "TCP"}]; !ok || len(fc.mappings) != 1 {
+		t.Fatal("wrong mappings:", fc.mappings)
+	}
+
+	fc.addErr = nil
+	if forwarded, err := d.ForwardPartial(9002, "upnp test"); err != nil || len(forwarded) != 2 {
+		t.Fatal("expected both protocols to be forwarded:", forwarded, err)
+	}
+}
+
+func TestForwardAll(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.addErr = map[string]error{"UDP": errors.New("UDP refused")}
+	specs := []MappingSpec{
+		{ExternalPort: 9001, TCP: ProtocolEnabled, Description: "upnp test"},
+		{ExternalPort: 9002, TCP: ProtocolEnabled, UDP: ProtocolEnabled, Description: "upnp test"},
+		{ExternalPort: 9003, TCP: ProtocolEnabled, Description: "upnp test"},
+	}
+	results, err := d.ForwardAll(specs)
+	if err == nil {
+		t.Fatal("expected an error")
+	} else if len(results) != 3 {
+		t.Fatal("expected 3 results, got", len(results))
+	}
+	if results[0].Err != nil || !results[0].RolledBack {
+		t.Fatal("expected the first mapping to be rolled back:", results[0])
+	}
+	if results[1].Err != err || results[1].RolledBack {
+		t.Fatal("expected the second mapping to fail:", results[1])
+	}
+	if results[2].Err != ErrNotAttempted {
+		t.Fatal("expected the third mapping not to be attempted:", results[2])
+	}
+	if len(fc.mappings) != 0 {
+		t.Fatal("expected no mappings to remain:", fc.mappings)
+	}
+
+	// a mapping that cannot be removed is not reported as rolled back
+	fc.delErr = map[uint16]error{9001: errors.New("delete refused")}
+	results, err = d.ForwardAll(specs)
+	var rbErr *RollbackError
+	if !errors.As(err, &rbErr) || rbErr.Err != results[1].Err || rbErr.RollbackErr != fc.delErr[9001] {
+		t.Fatal("expected a RollbackError, got", err)
+	} else if results[0].RolledBack || results[0].RollbackErr != fc.delErr[9001] {
+		t.Fatal("expected the first mapping to remain:", results[0])
+	} else if len(fc.mappings) != 1 {
+		t.Fatal("expected the first mapping to remain:", fc.mappings)
+	}
+	fc.delErr = nil
+	if err := d.Clear(9001); err != nil {
+		t.Fatal(err)
+	}
+
+	fc.addErr = nil
+	if results, err := d.ForwardAll(specs); err != nil {
+		t.Fatal(err)
+	} else if len(fc.mappings) != 4 || results[2].Err != nil {
+		t.Fatal("wrong mappings:", fc.mappings)
+	}
+}
+
+func TestForwardInRange(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	// 50000 is taken by another host, and 50001 by this one
+	fc.mappings[mappingID{"", 50000, "TCP"}] = trackedMapping{internalPort: 50000, internalIP: "192.168.1.3", enabled: true, desc: "other", lease: 0}
+	if err := d.Forward(50001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	port, err := d.ForwardInRange(50000, 50010, 9980, "upnp test")
+	if err != nil {
+		t.Fatal(err)
+	} else if port != 50002 {
+		t.Fatal("expected port 50002, got", port)
+	}
+	if m := fc.mappings[mappingID{"", 50002, "UDP"}]; m.internalPort != 9980 || m.internalIP != "192.168.1.2" {
+		t.Fatal("wrong mapping:", m)
+	}
+
+	if _, err := d.ForwardInRange(50000, 50001, 0, "upnp test"); err == nil {
+		t.Fatal("expected an error for a full range")
+	}
+	if _, err := d.ForwardInRange(10, 5, 0, "upnp test"); err == nil {
+		t.Fatal("expected an error for an invalid range")
+	}
+}
+
+func TestAutoHeal(t *testing.T) {
+	d, old := newFakeIGD("192.168.1.2")
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	old.addErr = map[string]error{"TCP": refused, "UDP": refused}
+	_, moved := newFakeIGD("192.168.1.2")
+	moved.sc.Location, _ = url.Parse("http://192.168.1.7:5000/rootDesc.xml")
+	var searches int
+	d.client = &healingClient{healer: &healer{
+		client: old,
+		logf:   d.logf,
+		relocate: func(context.Context) igdClient {
+			searches++
+			return moved
+		},
+	}}
+
+	if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if searches != 1 {
+		t.Fatal("expected one search, got", searches)
+	} else if len(moved.mappings) != 2 {
+		t.Fatal("mappings not created on the relocated router:", moved.mappings)
+	} else if d.Location() != "http://192.168.1.7:5000/rootDesc.xml" {
+		t.Fatal("wrong location:", d.Location())
+	}
+
+	// failures from a router that answered do not trigger a search
+	moved.addErr = map[string]error{"TCP": errors.New("rejected")}
+	if err := d.Forward(9002, "upnp test"); err == nil {
+		t.Fatal("expected an error")
+	} else if searches != 1 {
+		t.Fatal("expected no further searches, got", searches)
+	}
+}
+
+func TestOwnedMappings(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	tag := TagFor("my:app")
+	if !strings.HasPrefix(tag, "my-app:") || tag == TagFor("my:app") {
+		t.Fatal("bad tag:", tag)
+	}
+	if err := d.ForwardOwned(tag, 9001); err != nil {
+		t.Fatal(err)
+	}
+	// another instance's mapping, and one whose description was copied to
+	// another port, must be left alone
+	if err := d.ForwardOwned(TagFor("my:app"), 9002); err != nil {
+		t.Fatal(err)
+	} else if err := d.Forward(9003, OwnedDescription(tag, 9001)); err != nil {
+		t.Fatal(err)
+	}
+
+	owned, err := d.OwnedMappings(tag)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(owned) != 2 || owned[0].ExternalPort != 9001 || owned[1].ExternalPort != 9001 {
+		t.Fatal("wrong owned mappings:", owned)
+	}
+	if n, err := d.ClearOwned(tag); err != nil || n != 2 {
+		t.Fatal("expected 2 mappings to be cleared:", n, err)
+	} else if len(fc.mappings) != 4 {
+		t.Fatal("wrong mappings cleared:", fc.mappings)
+	}
+}
+
+func TestSupportsHairpin(t *testing.T) {
+	d, fc := newFakeIGD("127.0.0.1")
+	// the "external" address leads straight back to this host
+	fc.externalIP = "127.0.0.1"
+	if ok, err := d.SupportsHairpin(); err != nil || !ok {
+		t.Fatal("expected hairpinning to be supported:", ok, err)
+	} else if len(fc.mappings) != 0 {
+		t.Fatal("probe mapping was not cleared:", fc.mappings)
+	}
+
+	// an address that drops the connection attempt is given up on at the
+	// deadline
+	fc.externalIP = "192.0.2.1"
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if ok, err := d.HairpinSupported(ctx); ok {
+		t.Fatal("expected hairpinning not to be supported")
+	} else if err != nil && err != context.DeadlineExceeded {
+		t.Fatal(err)
+	} else if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("the probe outlived its deadline:", elapsed)
+	} else if len(fc.mappings) != 0 {
+		t.Fatal("probe mapping was not cleared:", fc.mappings)
+	}
+}
+
+// TestForwardAdvanced tests that ForwardAdvanced creates each protocol in the
+// state requested, and leaves out absent ones.
+func TestForwardAdvanced(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	key, err := d.ForwardAdvanced(MappingSpec{
+		ExternalPort: 9001,
+		InternalPort: 9101,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolDisabled,
+		Lease:        time.Hour,
+		Description:  "upnp test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if key.String() != ":9001/TCP,UDP" {
+		t.Fatal("wrong key:", key)
+	}
+	for proto, enabled := range map[string]bool{"TCP": true, "UDP": false} {
+		m, ok := fc.mappings[mappingID{"", 9001, proto}]
+		if !ok || m.enabled != enabled || m.internalPort != 9101 || m.internalIP != "192.168.1.2" || m.lease != 3600 || m.desc != "upnp test" {
+			t.Errorf("wrong %v mapping: %+v", proto, m)
+		}
+	}
+
+	key, err = d.ForwardAdvanced(MappingSpec{ExternalPort: 9002, UDP: ProtocolEnabled, Description: "upnp test"})
+	if err != nil {
+		t.Fatal(err)
+	} else if key.String() != ":9002/UDP" {
+		t.Fatal("wrong key:", key)
+	} else if _, ok := fc.mappings[mappingID{"", 9002, "TCP"}]; ok {
+		t.Fatal("absent TCP mapping was created")
+	}
+
+	if _, err := d.ForwardAdvanced(MappingSpec{ExternalPort: 9003}); err == nil {
+		t.Fatal("expected an error with no protocols")
+	} else if len(fc.mappings) != 3 {
+		t.Fatal("wrong mappings:", fc.mappings)
+	}
+}
+
+// TestClearKey tests that the key returned by ForwardAdvanced removes exactly
+// the mappings it created, and that a strict failure leaves none behind.
+func TestClearKey(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.ForwardAdvanced(MappingSpec{
+		RemoteHost:   "203.0.113.5",
+		ExternalPort: 9001,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Description:  "upnp test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if key.String() != "203.0.113.5:9001/TCP,UDP" {
+		t.Fatal("wrong key:", key)
+	}
+	if err := d.ClearKey(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, proto := range []string{"TCP", "UDP"} {
+		if _, ok := fc.mappings[mappingID{"203.0.113.5", 9001, proto}]; ok {
+			t.Errorf("%v mapping from the remote host was not cleared", proto)
+		} else if _, ok := fc.mappings[mappingID{"", 9001, proto}]; !ok {
+			t.Errorf("%v mapping from any host was cleared", proto)
+		}
+	}
+	d.mu.Lock()
+	tracked := len(d.tracked)
+	d.mu.Unlock()
+	if tracked != 2 {
+		t.Fatal("expected 2 tracked mappings, got", tracked)
+	}
+
+	fc.addErr = map[string]error{"UDP": errors.New("UDP refused")}
+	key, err = d.ForwardAdvanced(MappingSpec{
+		RemoteHost:   "203.0.113.5",
+		ExternalPort: 9002,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Mode:         Strict,
+	})
+	if err == nil {
+		t.Fatal("expected ForwardAdvanced to fail")
+	} else if key.String() != "203.0.113.5:9002/" {
+		t.Fatal("expected a key with no protocols, got", key)
+	} else if _, ok := fc.mappings[mappingID{"203.0.113.5", 9002, "TCP"}]; ok {
+		t.Fatal("TCP mapping was not rolled back")
+	}
+	d.mu.Lock()
+	tracked = len(d.tracked)
+	d.mu.Unlock()
+	if tracked != 2 {
+		t.Fatal("rolled back mapping is still tracked")
+	}
+	if err := d.ClearKey(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLeaseFallback tests that, with WithLeaseFallback, a permanent mapping
+// that the router refuses is requested again with a lease and renewed until
+// it is cleared, that other failures are not retried, and that the retry's
+// failure is reported.
+func TestLeaseFallback(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	clock := newFakeClock()
+	d.clock = clock
+	d.leaseFallback = time.Hour
+	f := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+	f.UPnPError.ErrorCode = 402
+	f.UPnPError.ErrorDescription = "Invalid Args"
+	fc.permanentErr = f
+
+	if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, proto := range []string{"TCP", "UDP"} {
+		if m := fc.mappings[mappingID{"", 9001, proto}]; m.lease != 3600 {
+			t.Fatalf("expected a %v mapping with the fallback lease, got %+v", proto, m)
+		}
+	}
+	if iv := clock.intervals(); len(iv) != 2 || iv[0] != 30*time.Minute || iv[1] != 30*time.Minute {
+		t.Fatal("expected a renewal every 30 minutes for each protocol, got", iv)
+	}
+
+	// a mapping that has expired is renewed
+	fc.mu.Lock()
+	delete(fc.mappings, mappingID{"", 9001, "TCP"})
+	fc.mu.Unlock()
+	clock.Advance(30 * time.Minute)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		fc.mu.Lock()
+		m, ok := fc.mappings[mappingID{"", 9001, "TCP"}]
+		fc.mu.Unlock()
+		if ok && m.lease == 3600 {
+			break
+		} else if time.Since(start) > time.Second {
+			t.Fatal("mapping was not renewed")
+		}
+	}
+
+	if err := d.Clear(9001); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); len(clock.intervals()) != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("renewals were not stopped:", clock.intervals())
+		}
+	}
+
+	// a conflict is not a refusal of permanent mappings
+	f.UPnPError.ErrorCode = ErrCodeConflictInMappingEntry
+	if err := d.Forward(9002, "upnp test"); faultCode(err) != ErrCodeConflictInMappingEntry {
+		t.Fatal("expected the conflict to be returned, got", err)
+	} else if len(fc.mappings) != 0 {
+		t.Fatal("wrong mappings:", fc.mappings)
+	}
+
+	// if the retry also fails, its error is returned
+	f.UPnPError.ErrorCode = 402
+	lf := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+	lf.UPnPError.ErrorCode = errCodeNoPortMapsAvailable
+	lf.UPnPError.ErrorDescription = "NoPortMapsAvailable"
+	fc.leaseErr = lf
+	if err := d.Forward(9003, "upnp test"); faultCode(err) != errCodeNoPortMapsAvailable {
+		t.Fatal("expected the retry's error, got", err)
+	} else if len(fc.mappings) != 0 || len(clock.intervals()) != 0 {
+		t.Fatal("expected nothing to be forwarded or renewed:", fc.mappings, clock.intervals())
+	}
+}
+
+// A blockingClient is a fakeClient whose AddPortMapping waits for release to
+// be closed, counting the calls in progress.
+type blockingClient struct {
+	*fakeClient
+	release chan struct{}
+
+	mu                 sync.Mutex
+	inFlight, maxCalls int
+}
+
+func (bc *blockingClient) AddPortMapping(remoteHost string, extPort uint16, proto string, intPort uint16, client string, enabled bool, desc string, lease uint32) error {
+	bc.mu.Lock()
+	bc.inFlight++
+	if bc.inFlight > bc.maxCalls {
+		bc.maxCalls = bc.inFlight
+	}
+	bc.mu.Unlock()
+	<-bc.release
+	bc.mu.Lock()
+	bc.inFlight--
+	bc.mu.Unlock()
+	return bc.fakeClient.AddPortMapping(remoteHost, extPort, proto, intPort, client, enabled, desc, lease)
+}
+
+// TestForwardTimeout tests that ForwardTimeout requests a lease of the given
+// duration, and that a router that only supports permanent mappings gets one,
+// reported by a *LeaseFallbackError.
+func TestForwardTimeout(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.ForwardTimeout(9001, "upnp test", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, proto := range []string{"TCP", "UDP"} {
+		if m := fc.mappings[mappingID{"", 9001, proto}]; m.lease != 3600 {
+			t.Fatalf("expected a %v mapping with a lease of 3600s, got %+v", proto, m)
+		}
+	}
+
+	f := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+	f.UPnPError.ErrorCode = ErrCodeOnlyPermanentLeasesSupported
+	f.UPnPError.ErrorDescription = "OnlyPermanentLeasesSupported"
+	fc.leaseErr = f
+	err := d.ForwardTimeout(9002, "upnp test", time.Hour)
+	var lfe *LeaseFallbackError
+	if !errors.As(err, &lfe) || lfe.Requested != time.Hour {
+		t.Fatal("expected a LeaseFallbackError for 1h, got", err)
+	}
+	for _, proto := range []string{"TCP", "UDP"} {
+		if m, ok := fc.mappings[mappingID{"", 9002, proto}]; !ok || m.lease != 0 {
+			t.Fatalf("expected a permanent %v mapping, got %+v", proto, m)
+		}
+	}
+
+	// other failures are returned as they are
+	fc.addErr = map[string]error{"TCP": errors.New("router on fire")}
+	if err := d.ForwardTimeout(9003, "upnp test", time.Hour); err == nil || errors.As(err, &lfe) {
+		t.Fatal("expected the router's error, got", err)
+	}
+}
+
+// TestForwardAsymmetric tests that ForwardAsymmetric maps the external port
+// to a different internal port, and that ClearExternal removes the mappings
+// by their external port.
+func TestForwardAsymmetric(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.ForwardAsymmetric(443, 8443, "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, proto := range []string{"TCP", "UDP"} {
+		if m, ok := fc.mappings[mappingID{"", 443, proto}]; !ok || m.internalPort != 8443 || m.internalIP != "192.168.1.2" {
+			t.Fatalf("expected %v 443 to map to 8443, got %+v", proto, m)
+		} else if m := fc.mappings[mappingID{"", 9001, proto}]; m.internalPort != 9001 {
+			t.Fatalf("expected Forward to map %v 9001 to 9001, got %+v", proto, m)
+		}
+	}
+
+	if err := d.ClearExternal(443); err != nil {
+		t.Fatal(err)
+	}
+	for _, proto := range []string{"TCP", "UDP"} {
+		if _, ok := fc.mappings[mappingID{"", 443, proto}]; ok {
+			t.Fatalf("%v 443 was not cleared", proto)
+		} else if _, ok := fc.mappings[mappingID{"", 9001, proto}]; !ok {
+			t.Fatalf("%v 9001 was cleared", proto)
+		}
+	}
+}
+
+// TestForwardTo tests that ForwardTo maps a well-known external port to a
+// high internal port, and that ClearExternal removes it.
+func TestForwardTo(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.ForwardTo(80, 38080, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, proto := range []string{"TCP", "UDP"} {
+		if m, ok := fc.mappings[mappingID{"", 80, proto}]; !ok || m.internalPort != 38080 || m.internalIP != "192.168.1.2" {
+			t.Fatalf("expected %v 80 to map to 38080, got %+v", proto, m)
+		} else if _, ok := fc.mappings[mappingID{"", 38080, proto}]; ok {
+			t.Fatalf("%v 38080 was forwarded", proto)
+		}
+	}
+	if ok, err := d.IsForwardedTCP(80); err != nil || !ok {
+		t.Fatal("expected 80 to be forwarded, got", ok, err)
+	}
+	if err := d.ClearExternal(80); err != nil {
+		t.Fatal(err)
+	} else if len(fc.mappings) != 0 {
+		t.Fatal("mappings were not cleared:", fc.mappings)
+	}
+	if err := d.ClearExternal(80); err == nil {
+		t.Fatal("expected clearing an unmapped port to fail")
+	}
+}
+
+// TestForwardProtocol tests that ForwardProtocol and ClearProtocol act on a
+// single protocol, given in any case, and reject unknown protocols without
+// asking the router.
+func TestForwardProtocol(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.ForwardProtocol(9001, "udp", "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if err := d.ForwardProtocol(9002, "Tcp", "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if err := d.ForwardProtocol(9003, "SCTP", "upnp test"); err == nil {
+		t.Fatal("expected an unknown protocol to be rejected")
+	}
+	if len(fc.mappings) != 2 {
+		t.Fatal("expected 2 mappings, got", len(fc.mappings))
+	} else if _, ok := fc.mappings[mappingID{"", 9001, "UDP"}]; !ok {
+		t.Fatal("9001/UDP was not forwarded")
+	} else if _, ok := fc.mappings[mappingID{"", 9002, "TCP"}]; !ok {
+		t.Fatal("9002/TCP was not forwarded")
+	}
+
+	if err := d.ClearProtocol(9001, "sctp"); err == nil {
+		t.Fatal("expected an unknown protocol to be rejected")
+	} else if err := d.ClearProtocol(9001, "Udp"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := fc.mappings[mappingID{"", 9001, "UDP"}]; ok {
+		t.Fatal("9001/UDP was not cleared")
+	} else if len(fc.mappings) != 1 {
+		t.Fatal("expected 1 mapping, got", len(fc.mappings))
+	}
+}
+
+// TestIsForwarded tests that IsForwarded reports any mapping of the port and
+// protocol, including disabled ones and ones to other hosts, and reports
+// failures other than a missing entry as errors.
+func TestIsForwarded(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.ForwardTCP(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	fc.mappings[mappingID{"", 9002, "UDP"}] = trackedMapping{internalPort: 9002, internalIP: "192.168.1.9", enabled: false, desc: "other host"}
+	for _, test := range []struct {
+		port  uint16
+		proto string
+		want  bool
+	}{
+		{9001, "tcp", true},
+		{9001, "UDP", false},
+		{9002, "UDP", true},
+		{9003, "TCP", false},
+	} {
+		if ok, err := d.IsForwarded(test.port, test.proto); err != nil || ok != test.want {
+			t.Errorf("%d/%s: expected %v, got %v, %v", test.port, test.proto, test.want, ok, err)
+		}
+	}
+	if _, err := d.IsForwarded(9001, "SCTP"); err == nil {
+		t.Fatal("expected an unknown protocol to be rejected")
+	}
+	fc.entryErr = errors.New("router on fire")
+	if ok, err := d.IsForwarded(9001, "TCP"); err == nil || ok {
+		t.Fatal("expected the router's error, got", ok, err)
+	}
+}
+
+// TestForwardFrom tests that ForwardFrom and ForwardAsymmetricFrom map ports
+// to the given internal IP without detecting this host's, and reject an
+// address that does not parse.
+func TestForwardFrom(t *testing.T) {
+	d, fc := newFakeIGD("")
+	// a router on no local subnet, so detection would fail
+	loc, _ := url.Parse("http://198.51.100.1:5000/rootDesc.xml")
+	fc.sc.RootDevice.URLBase = *loc
+	if err := d.Forward(9001, "upnp test"); !errors.Is(err, ErrNoInternalIP) {
+		t.Fatal("expected ErrNoInternalIP, got", err)
+	}
+
+	if err := d.ForwardFrom("192.168.1.9", 9002, "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if err := d.ForwardAsymmetricFrom("192.168.1.9", 443, 8443, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, proto := range []string{"TCP", "UDP"} {
+		if m := fc.mappings[mappingID{"", 9002, proto}]; m.internalIP != "192.168.1.9" || m.internalPort != 9002 {
+			t.Fatalf("wrong %v mapping of 9002: %+v", proto, m)
+		} else if m := fc.mappings[mappingID{"", 443, proto}]; m.internalIP != "192.168.1.9" || m.internalPort != 8443 {
+			t.Fatalf("wrong %v mapping of 443: %+v", proto, m)
+		}
+	}
+
+	for _, bad := range []string{"", "192.168.1", "host.lan"} {
+		if err := d.ForwardFrom(bad, 9003, "upnp test"); err == nil {
+			t.Errorf("%q: expected an invalid internal IP to be rejected", bad)
+		} else if err := d.ForwardAsymmetricFrom(bad, 9004, 9005, "upnp test"); err == nil {
+			t.Errorf("%q: expected an invalid internal IP to be rejected", bad)
+		}
+	}
+	if len(fc.mappings) != 4 {
+		t.Fatal("expected 4 mappings, got", len(fc.mappings))
+	}
+}
+
+// TestForwardMany tests that ForwardMany reports the outcome of each port in
+// order, clears the forwarded ports on request if any port fails, and only
+// returns an error if no port could be attempted.
+func TestForwardMany(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	// another host holds TCP 9002
+	fc.mappings[mappingID{"", 9002, "TCP"}] = trackedMapping{internalPort: 9002, internalIP: "192.168.1.9", enabled: true}
+	mapped := func(port uint16) bool {
+		_, tcp := fc.mappings[mappingID{"", port, "TCP"}]
+		_, udp := fc.mappings[mappingID{"", port, "UDP"}]
+		return tcp && udp
+	}
+
+	for _, rollback := range []bool{false, true} {
+		ports := []uint16{9001, 9002, 9003}
+		if rollback {
+			ports = []uint16{9004, 9002, 9005}
+		}
+		results, err := d.ForwardMany(ports, "upnp test", rollback)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(results) != 3 {
+			t.Fatal("expected 3 results, got", results)
+		}
+		for i, r := range results {
+			if r.Port != ports[i] || (r.Err != nil) != (i == 1) {
+				t.Errorf("rollback %v: wrong result %d: %+v", rollback, i, r)
+			}
+		}
+		if mapped(ports[0]) == rollback || mapped(ports[2]) == rollback {
+			t.Errorf("rollback %v: expected forwarding of %v and %v to be %v", rollback, ports[0], ports[2], !rollback)
+		}
+	}
+
+	loc, _ := url.Parse("http://198.51.100.1:5000/rootDesc.xml")
+	fc.sc.RootDevice.URLBase = *loc
+	d.localIP = ""
+	if results, err := d.ForwardMany([]uint16{9006}, "upnp test", false); !errors.Is(err, ErrNoInternalIP) || results != nil {
+		t.Fatal("expected ErrNoInternalIP and no results, got", results, err)
+	}
+}
+
+// A silentClient is a fakeClient that reports success for mappings of one
+// protocol without installing them, or installs them disabled, as some
+// routers do.
+type silentClient struct {
+	*fakeClient
+	proto   string
+	disable bool
+}
+
+func (sc silentClient) AddPortMapping(remoteHost string, extPort uint16, proto string, intPort uint16, client string, enabled bool, desc string, lease uint32) error {
+	if proto != sc.proto {
+		return sc.fakeClient.AddPortMapping(remoteHost, extPort, proto, intPort, client, enabled, desc, lease)
+	} else if sc.disable {
+		return sc.fakeClient.AddPortMapping(remoteHost, extPort, proto, intPort, client, false, desc, lease)
+	}
+	return nil
+}
+
+// TestForwardVerified tests that ForwardVerified reports a mapping that the
+// router accepted but did not install as requested with a
+// *VerificationError, and leaves the mappings in place.
+func TestForwardVerified(t *testing.T) {
+	_, fc := newFakeIGD("192.168.1.2")
+	for _, test := range []struct {
+		client igdClient
+		want   *VerificationError
+		mapped int
+	}{
+		{fc, nil, 2},
+		{silentClient{fakeClient: fc, proto: "UDP"}, &VerificationError{Port: 9001, Protocol: "UDP"}, 1},
+		{silentClient{fakeClient: fc, proto: "TCP", disable: true}, &VerificationError{Port: 9001, Protocol: "TCP", InternalClient: "192.168.1.2"}, 2},
+	} {
+		fc.mu.Lock()
+		fc.mappings = make(map[mappingID]trackedMapping)
+		fc.mu.Unlock()
+		d := newIGD(test.client)
+		d.localIP = "192.168.1.2"
+		err := d.ForwardVerified(9001, "upnp test")
+		var ve *VerificationError
+		if test.want == nil {
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else if !errors.As(err, &ve) || *ve != *test.want {
+			t.Fatalf("expected %+v, got %v", test.want, err)
+		}
+		if n := len(fc.mappings); n != test.mapped {
+			t.Fatalf("expected %v mappings to be left in place, got %v", test.mapped, n)
+		}
+	}
+}
+
+// TestForwardAsync tests that ForwardAsync delivers the result of each
+// Forward, and runs no more than maxAsyncForwards of them at once.
+func TestForwardAsync(t *testing.T) {
+	_, fc := newFakeIGD("192.168.1.2")
+	bc := &blockingClient{fakeClient: fc, release: make(chan struct{})}
+	d := newIGD(bc)
+	d.localIP = "192.168.1.2"
+	var results []<-chan error
+	for port := uint16(9001); port <= 9010; port++ {
+		results = append(results, d.ForwardAsync(port, "upnp test"))
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		bc.mu.Lock()
+		n := bc.inFlight
+		bc.mu.Unlock()
+		if n == maxAsyncForwards {
+			break
+		} else if time.Since(start) > time.Second {
+			t.Fatalf("expected %v forwards in progress, got %v", maxAsyncForwards, n)
+		}
+	}
+	close(bc.release)
+	for _, errCh := range results {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bc.maxCalls != maxAsyncForwards {
+		t.Fatalf("expected at most %v forwards at once, got %v", maxAsyncForwards, bc.maxCalls)
+	} else if len(fc.mappings) != 20 {
+		t.Fatal("expected 20 mappings, got", len(fc.mappings))
+	}
+}
+
+// TestForwardBestEffort tests that ForwardAdvanced in BestEffort mode keeps
+// the protocols that were forwarded and names those that were not, and that
+// Strict mode, the default, keeps neither.
+func TestForwardBestEffort(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.addErr = map[string]error{"UDP": errors.New("UDP refused")}
+	spec := MappingSpec{ExternalPort: 9001, TCP: ProtocolEnabled, UDP: ProtocolEnabled, Description: "upnp test"}
+	if _, err := d.ForwardAdvanced(spec); err == nil || errors.As(err, new(*PartialForwardError)) {
+		t.Fatal("expected Strict mode to fail outright, got", err)
+	} else if len(fc.mappings) != 0 {
+		t.Fatal("Strict mode left mappings behind:", fc.mappings)
+	}
+
+	spec.Mode = BestEffort
+	key, err := d.ForwardAdvanced(spec)
+	var perr *PartialForwardError
+	if !errors.As(err, &perr) || strings.Join(perr.Succeeded, ",") != "TCP" || strings.Join(perr.Failed, ",") != "UDP" {
+		t.Fatal("expected a PartialForwardError naming UDP, got", err)
+	} else if key.String() != ":9001/TCP" {
+		t.Fatal("wrong key:", key)
+	} else if forwarded, err := d.IsForwardedTCP(9001); err != nil || !forwarded {
+		t.Fatal("TCP mapping was not kept:", err)
+	}
+
+	fc.addErr["TCP"] = errors.New("TCP refused")
+	spec.ExternalPort = 9002
+	if key, err := d.ForwardAdvanced(spec); err == nil || errors.As(err, &perr) {
+		t.Fatal("expected a plain error when nothing was forwarded, got", err)
+	} else if key.String() != ":9002/" {
+		t.Fatal("wrong key:", key)
+	}
+}
+
+// TestExternalIPFamilies tests that ExternalIPv4 rejects an IPv6 answer from
+// the router, and that ExternalIPv6 reports the host's own address on the
+// router's interface rather than asking the router, refusing one that is not
+// global.
+func TestExternalIPFamilies(t *testing.T) {
+	d, fc := newFakeIGD("127.0.0.1")
+	if ip, err := d.ExternalIPv4(); err != nil || ip != "203.0.113.1" {
+		t.Fatal("expected 203.0.113.1, got", ip, err)
+	}
+	fc.mu.Lock()
+	fc.externalIP = "2001:db8::1"
+	fc.mu.Unlock()
+	if _, err := d.ExternalIPv4(); err == nil {
+		t.Fatal("expected an error for an IPv6 external address")
+	}
+
+	loc, _ := url.Parse("http://127.0.0.1:5000/rootDesc.xml")
+	fc.sc.RootDevice.URLBase = *loc
+	if ip, err := d.InternalIP(IPv4); err != nil {
+		t.Skip(err) // no loopback interface
+	} else if ip != "127.0.0.1" {
+		t.Fatal("expected the loopback address, got", ip)
+	}
+	// the loopback interface has no global IPv6 address
+	if ip, err := d.ExternalIPv6(); err == nil {
+		t.Fatal("expected no IPv6 address, got", ip)
+	}
+}
+
+// TestExternalIPParsed tests that ExternalIPParsed returns the router's
+// address as a net.IP, and ErrNoExternalIP, rather than a transport error,
+// for an address that is missing or unusable.
+func TestExternalIPParsed(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if ip, err := d.ExternalIPParsed(); err != nil || !ip.Equal(net.IPv4(203, 0, 113, 1)) {
+		t.Fatal("expected 203.0.113.1, got", ip, err)
+	}
+	for _, bad := range []string{"", "0.0.0.0", "::", "not an address"} {
+		fc.externalIP = bad
+		if ip, err := d.ExternalIPParsed(); err != ErrNoExternalIP {
+			t.Errorf("%q: expected ErrNoExternalIP, got %v, %v", bad, ip, err)
+		}
+	}
+	fc.ipErr = errors.New("router on fire")
+	if _, err := d.ExternalIPParsed(); err == nil || errors.Is(err, ErrNoExternalIP) {
+		t.Fatal("expected the router's error, got", err)
+	}
+}
+
+// TestIsPubliclyRoutable tests that IsPubliclyRoutable accepts a public
+// external IP, and rejects private and carrier-grade NAT ones with a
+// *NotRoutableError saying why.
+func TestIsPubliclyRoutable(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if ok, err := d.IsPubliclyRoutable(); !ok || err != nil {
+		t.Fatal("expected 203.0.113.1 to be routable, got", ok, err)
+	}
+	for ip, reason := range map[string]string{
+		"10.0.0.1":      "RFC 1918",
+		"172.16.5.4":    "RFC 1918",
+		"192.168.0.1":   "RFC 1918",
+		"100.64.0.1":    "RFC 6598",
+		"100.127.255.1": "RFC 6598",
+		"fd00::1":       "RFC 4193",
+	} {
+		fc.externalIP = ip
+		ok, err := d.IsPubliclyRoutable()
+		var nre *NotRoutableError
+		if ok || !errors.As(err, &nre) {
+			t.Errorf("%v: expected a *NotRoutableError, got %v, %v", ip, ok, err)
+		} else if !nre.IP.Equal(net.ParseIP(ip)) || !strings.Contains(err.Error(), reason) {
+			t.Errorf("%v: wrong error: %v", ip, err)
+		}
+	}
+	// just outside the shared address space
+	fc.externalIP = "100.128.0.1"
+	if ok, err := d.IsPubliclyRoutable(); !ok || err != nil {
+		t.Fatal("expected 100.128.0.1 to be routable, got", ok, err)
+	}
+	fc.ipErr = errors.New("router on fire")
+	if ok, err := d.IsPubliclyRoutable(); ok || err != fc.ipErr {
+		t.Fatal("expected the router's error, got", ok, err)
+	}
+}
+
+// TestInternalIPv6 tests that, for a router reached over IPv6, InternalIP
+// returns a routable IPv6 address of the interface shared with the router,
+// preferring a global one.
+func TestInternalIPv6(t *testing.T) {
+	var iface net.Interface
+	var subnet *net.IPNet
+	ifaces, _ := net.Interfaces()
+	for _, i := range ifaces {
+		addrs, _ := i.Addrs()
+		for _, a := range addrs {
+			if x, ok := a.(*net.IPNet); ok && x.IP.To4() == nil && x.IP.IsGlobalUnicast() && subnet == nil {
+				iface, subnet = i, x
+			}
+		}
+	}
+	if subnet == nil {
+		t.Skip("no routable IPv6 address")
+	}
+	routerIP := subnet.IP.Mask(subnet.Mask)
+	routerIP[len(routerIP)-1] = 1
+	if routerIP.Equal(subnet.IP) {
+		routerIP[len(routerIP)-1] = 2
+	}
+
+	d, fc := newFakeIGD("")
+	loc, _ := url.Parse("http://" + net.JoinHostPort(routerIP.String(), "5000") + "/rootDesc.xml")
+	fc.sc.RootDevice.URLBase = *loc
+	ip, err := d.InternalIP(IPv6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil || !parsed.IsGlobalUnicast() {
+		t.Fatal("expected a routable IPv6 address, got", ip)
+	}
+	addrs, _ := iface.Addrs()
+	onIface, global := false, false
+	for _, a := range addrs {
+		if x, ok := a.(*net.IPNet); ok {
+			onIface = onIface || x.IP.Equal(parsed)
+			global = global || (x.IP.To4() == nil && x.IP.IsGlobalUnicast() && !isUniqueLocal(x.IP))
+		}
+	}
+	if !onIface {
+		t.Fatalf("%v is not an address of %v", ip, iface.Name)
+	} else if global && isUniqueLocal(parsed) {
+		t.Fatal("a unique local address was preferred to a global one:", ip)
+	}
+}
+
+// TestRouteBasedInternalIP tests that WithRouteBasedInternalIP finds the
+// internal IP from the route to the router, even when the router shares no
+// subnet with this host.
+func TestRouteBasedInternalIP(t *testing.T) {
+	d, fc := newFakeIGD("")
+	loc, _ := url.Parse("http://198.51.100.1:5000/rootDesc.xml")
+	fc.sc.RootDevice.URLBase = *loc
+	if _, err := d.getInternalIP(); !errors.Is(err, ErrNoInternalIP) {
+		t.Fatal("expected no interface to share a subnet with the router, got", err)
+	}
+
+	newOptions([]Option{WithRouteBasedInternalIP()}).configure(d)
+	ip, err := d.getInternalIP()
+	if err != nil {
+		t.Skip(err) // no route to the router
+	}
+	conn, err := net.Dial("udp", "198.51.100.1:1900")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if want := conn.LocalAddr().(*net.UDPAddr).IP.String(); ip != want {
+		t.Fatalf("expected the route's source address %v, got %v", want, ip)
+	}
+}
+
+// TestSpecVersion tests that SpecVersion reports the version in the device
+// description, and an error if the router gave none.
+func TestSpecVersion(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if _, _, err := d.SpecVersion(); err == nil {
+		t.Fatal("expected an error for a description without a spec version")
+	}
+	fc.sc.RootDevice.SpecVersion = goupnp.SpecVersion{Major: 1, Minor: 1}
+	if major, minor, err := d.SpecVersion(); err != nil || major != 1 || minor != 1 {
+		t.Fatal("expected spec version 1.1, got", major, minor, err)
+	}
+}
+
+// TestDeviceInfo tests that DeviceInfo reports the metadata of the router's
+// device description, and an error if there is none.
+func TestDeviceInfo(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	dev := &fc.sc.RootDevice.Device
+	dev.Manufacturer = "Acme"
+	dev.ModelName = "Gateway"
+	dev.ModelNumber = "GW-1"
+	dev.FriendlyName = "Acme Gateway"
+	dev.SerialNumber = "1234"
+	want := Info{Manufacturer: "Acme", ModelName: "Gateway", ModelNumber: "GW-1", FriendlyName: "Acme Gateway", SerialNumber: "1234"}
+	if info, err := d.DeviceInfo(); err != nil || info != want {
+		t.Fatalf("expected %+v, got %+v, %v", want, info, err)
+	}
+
+	fc.sc.RootDevice = nil
+	if _, err := d.DeviceInfo(); err == nil {
+		t.Fatal("expected an error without a device description")
+	}
+}
+
+// TestDeviceInfoDescription tests that DeviceInfo reports the metadata parsed
+// from the device description that Load fetched, without contacting the
+// router again.
+func TestDeviceInfoDescription(t *testing.T) {
+	const ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>` +
+		`<friendlyName>Acme Gateway</friendlyName><manufacturer>Acme</manufacturer>` +
+		`<modelName>Gateway</modelName><modelNumber>GW-1</modelNumber><serialNumber>1234</serialNumber><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	var mu sync.Mutex
+	requests := 0
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(desc))
+	}))
+	defer router.Close()
+
+	d, err := Load(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	before := requests
+	mu.Unlock()
+	want := Info{Manufacturer: "Acme", ModelName: "Gateway", ModelNumber: "GW-1", FriendlyName: "Acme Gateway", SerialNumber: "1234"}
+	if info, err := d.DeviceInfo(); err != nil || info != want {
+		t.Fatalf("expected %+v, got %+v, %v", want, info, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != before {
+		t.Fatal("DeviceInfo contacted the router")
+	}
+}
+
+// TestFailFastNoMulticast tests that WithFailFastNoMulticast makes Discover
+// fail at once on hosts that cannot send a multicast search, and has no
+// effect on hosts that can.
+func TestFailFastNoMulticast(t *testing.T) {
+	if err := newOptions(nil).checkMulticast(); err != nil {
+		t.Fatal("checked for multicast without WithFailFastNoMulticast:", err)
+	}
+	can, err := haveMulticastInterface()
+	if err != nil {
+		t.Skip(err)
+	}
+	err = newOptions([]Option{WithFailFastNoMulticast()}).checkMulticast()
+	if can && err != nil {
+		t.Fatal("host with a multicast interface failed the check:", err)
+	} else if can {
+		return
+	} else if err != ErrNoMulticastInterface {
+		t.Fatal("expected ErrNoMulticastInterface, got", err)
+	}
+	start := time.Now()
+	if _, err := Discover(WithFailFastNoMulticast()); err != ErrNoMulticastInterface {
+		t.Fatal("expected ErrNoMulticastInterface, got", err)
+	} else if time.Since(start) > time.Second {
+		t.Fatal("Discover did not fail fast")
+	}
+}
+
+// TestMonitor tests that Monitor reports changes to the connection status and
+// external IP, and reports a lost mapping only once.
+func TestMonitor(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	clock := newFakeClock()
+	d.clock = clock
+	if err := d.ForwardTCP(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := d.Monitor(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); len(clock.intervals()) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("Monitor did not start its ticker")
+		}
+	}
+	expect := func(want MonitorEvent) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e != want {
+				t.Fatalf("expected %+v, got %+v", want, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %+v, got nothing", want)
+		}
+	}
+	setStatus := func(status string) {
+		fc.mu.Lock()
+		fc.status = status
+		fc.mu.Unlock()
+	}
+
+	setStatus("Disconnected")
+	fc.mu.Lock()
+	fc.externalIP = "203.0.113.2"
+	delete(fc.mappings, mappingID{"", 9001, "TCP"})
+	fc.mu.Unlock()
+	clock.Advance(time.Minute)
+	expect(MonitorEvent{Type: ConnectionStatusChanged, Status: "Disconnected"})
+	expect(MonitorEvent{Type: ExternalIPChanged, ExternalIP: "203.0.113.2"})
+	expect(MonitorEvent{Type: MappingLost, ExternalPort: 9001, Protocol: "TCP"})
+
+	// the mapping is still lost, but is not reported again
+	setStatus("Connected")
+	clock.Advance(time.Minute)
+	expect(MonitorEvent{Type: ConnectionStatusChanged, Status: "Connected"})
+	setStatus("Disconnected")
+	clock.Advance(time.Minute)
+	expect(MonitorEvent{Type: ConnectionStatusChanged, Status: "Disconnected"})
+
+	cancel()
+	for range events {
+	}
+}
+
+// TestStats tests that Stats reads the four traffic counters from the
+// router's WANCommonInterfaceConfig service, and reports ErrUnsupported for a
+// router without one.
+func TestStats(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	if _, err := d.Stats(); err != ErrUnsupported {
+		t.Fatal("expected ErrUnsupported, got", err)
+	}
+
+	const (
+		ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+		common = "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1"
+	)
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + common + `</serviceType>` +
+		`<serviceId>urn:upnp-org:serviceId:WANCommonIFC1</serviceId><controlURL>/common</controlURL></service>` +
+		`<service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	// the argument and value returned by each action
+	counters := map[string][2]string{
+		"GetTotalBytesSent":       {"NewTotalBytesSent", "1000"},
+		"GetTotalBytesReceived":   {"NewTotalBytesReceived", "2000"},
+		"GetTotalPacketsSent":     {"NewTotalPacketsSent", "10"},
+		"GetTotalPacketsReceived": {"NewTotalPacketsReceived", "4294967295"},
+	}
+	var mu sync.Mutex
+	failing := ""
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rootDesc.xml" {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+			return
+		}
+		action := r.Header.Get("SOAPAction")
+		action = strings.Trim(action[strings.Index(action, "#")+1:], `"`)
+		mu.Lock()
+		counter, ok := counters[action]
+		ok = ok && action != failing
+		mu.Unlock()
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		if !ok {
+			w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+				`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>` +
+				`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>501</errorCode>` +
+				`<errorDescription>Action Failed</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`))
+			return
+		}
+		arg := "<" + counter[0] + ">" + counter[1] + "</" + counter[0] + ">"
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+			`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+			`<u:` + action + `Response xmlns:u="` + common + `">` + arg + `</u:` + action + `Response>` +
+			`</s:Body></s:Envelope>`))
+	}))
+	defer router.Close()
+
+	d, err := Load(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Stats{BytesSent: 1000, BytesReceived: 2000, PacketsSent: 10, PacketsReceived: 4294967295}
+	if s, err := d.Stats(); err != nil || s != want {
+		t.Fatalf("expected %+v, got %+v, %v", want, s, err)
+	}
+	mu.Lock()
+	failing = "GetTotalPacketsSent"
+	mu.Unlock()
+	if s, err := d.Stats(); err == nil || s != (Stats{}) {
+		t.Fatalf("expected the router's fault and no counters, got %+v, %v", s, err)
+	}
+}
+
+// TestForwardStatus tests that ForwardStatus reports whether it created,
+// left alone or replaced the mappings of a port.
+func TestForwardStatus(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	for _, test := range []struct {
+		prepare func()
+		outcome ForwardOutcome
+	}{
+		{func() {}, Created},
+		{func() {}, AlreadyExists},
+		{func() {
+			m := fc.mappings[mappingID{"", 9001, "UDP"}]
+			m.desc = "old description"
+			fc.mappings[mappingID{"", 9001, "UDP"}] = m
+		}, Replaced},
+		{func() { delete(fc.mappings, mappingID{"", 9001, "UDP"}) }, Created},
+	} {
+		test.prepare()
+		if outcome, err := d.ForwardStatus(9001, "upnp test"); err != nil {
+			t.Fatal(err)
+		} else if outcome != test.outcome {
+			t.Fatalf("expected %v, got %v", test.outcome, outcome)
+		}
+		for _, proto := range []string{"TCP", "UDP"} {
+			if m := fc.mappings[mappingID{"", 9001, proto}]; m.desc != "upnp test" || !m.enabled {
+				t.Fatalf("wrong %v mapping after %v: %+v", proto, test.outcome, m)
+			}
+		}
+	}
+}
+
+// A repeatingClient is a fakeClient that reports each entry of its mapping
+// table twice when the table is walked, the second time with the protocol in
+// lower case, as routers that reorder their table may.
+type repeatingClient struct {
+	*fakeClient
+}
+
+func (rc repeatingClient) GetGenericPortMappingEntry(index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	remoteHost, extPort, proto, intPort, client, enabled, desc, lease, err := rc.fakeClient.GetGenericPortMappingEntry(index / 2)
+	if index%2 == 1 {
+		proto = strings.ToLower(proto)
+	}
+	return remoteHost, extPort, proto, intPort, client, enabled, desc, lease, err
+}
+
+// TestListMappingsDuplicates tests that ListMappings returns an entry that
+// the router reports more than once only once.
+func TestListMappingsDuplicates(t *testing.T) {
+	_, fc := newFakeIGD("192.168.1.2")
+	d := newIGD(repeatingClient{fc})
+	d.localIP = "192.168.1.2"
+	for _, port := range []uint16{9001, 9002} {
+		if err := d.Forward(port, "upnp test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mappings, err := d.ListMappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range mappings {
+		got = append(got, fmt.Sprintf("%d/%s", m.ExternalPort, m.Protocol))
+	}
+	if strings.Join(got, " ") != "9001/TCP 9001/UDP 9002/TCP 9002/UDP" {
+		t.Fatal("wrong mappings:", got)
+	}
+}
+
+// TestMappingsForClient tests that MappingsForClient returns only the
+// mappings pointing at the given internal client.
+func TestMappingsForClient(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	fc.mu.Lock()
+	fc.mappings[mappingID{"", 9100, "TCP"}] = trackedMapping{internalPort: 9100, internalIP: "192.168.1.3", enabled: true, desc: "other host"}
+	fc.mu.Unlock()
+
+	for _, test := range []struct {
+		client string
+		want   string
+	}{
+		{"192.168.1.2", "9001/TCP 9001/UDP"},
+		{"192.168.1.3", "9100/TCP"},
+		{"192.168.1.4", ""},
+	} {
+		mappings, err := d.MappingsForClient(test.client)
+		if err != nil {
+			t.Fatal(err)
+		} else if mappings == nil {
+			t.Fatal("expected an empty slice, not nil")
+		}
+		var got []string
+		for _, m := range mappings {
+			got = append(got, fmt.Sprintf("%d/%s", m.ExternalPort, m.Protocol))
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%v: wrong mappings: %v", test.client, got)
+		}
+	}
+	if _, err := d.MappingsForClient("not an ip"); err == nil {
+		t.Fatal("expected an invalid IP to be rejected")
+	}
+}
+
+// TestPortMappingCount tests that PortMappingCount returns the number of
+// entries the router reports, ErrUnsupported if it lacks the action, and the
+// router's fault otherwise.
+func TestPortMappingCount(t *testing.T) {
+	const ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	var mu sync.Mutex
+	fault := 0
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rootDesc.xml" {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+			return
+		}
+		mu.Lock()
+		code := fault
+		mu.Unlock()
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		if code != 0 || !strings.Contains(r.Header.Get("SOAPAction"), "#GetPortMappingNumberOfEntries") {
+			w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+				`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>` +
+				`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>` + strconv.Itoa(code) + `</errorCode>` +
+				`<errorDescription>Error</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`))
+			return
+		}
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+			`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+			`<u:GetPortMappingNumberOfEntriesResponse xmlns:u="` + ipConn + `">` +
+			`<NewPortMappingNumberOfEntries>3</NewPortMappingNumberOfEntries></u:GetPortMappingNumberOfEntriesResponse>` +
+			`</s:Body></s:Envelope>`))
+	}))
+	defer router.Close()
+
+	d, err := Load(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.PortMappingCount(); err != nil || n != 3 {
+		t.Fatal("expected 3 entries, got", n, err)
+	}
+	for _, test := range []struct {
+		code        int
+		unsupported bool
+	}{
+		{401, true},
+		{602, true},
+		{501, false},
+	} {
+		mu.Lock()
+		fault = test.code
+		mu.Unlock()
+		n, err := d.PortMappingCount()
+		if err == nil || (err == ErrUnsupported) != test.unsupported {
+			t.Errorf("fault %v: expected an error (unsupported: %v), got %v, %v", test.code, test.unsupported, n, err)
+		} else if !test.unsupported && faultCode(err) != test.code {
+			t.Errorf("fault %v: expected the router's fault, got %v", test.code, err)
+		}
+	}
+}
+
+// TestServiceClient tests that ServiceClient returns the client of the
+// discovered connection service, with which an action that the package does
+// not wrap can be performed.
+func TestServiceClient(t *testing.T) {
+	const ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	var mu sync.Mutex
+	var action string
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rootDesc.xml" {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+			return
+		}
+		mu.Lock()
+		action = r.Header.Get("SOAPAction")
+		mu.Unlock()
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+			`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+			`<u:GetNATRSIPStatusResponse xmlns:u="` + ipConn + `">` +
+			`<NewRSIPAvailable>0</NewRSIPAvailable><NewNATEnabled>1</NewNATEnabled></u:GetNATRSIPStatusResponse>` +
+			`</s:Body></s:Envelope>`))
+	}))
+	defer router.Close()
+
+	d, err := Load(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := d.ServiceClient()
+	if sc == nil || sc.Service.ServiceType != ipConn {
+		t.Fatal("wrong service client:", sc)
+	}
+	var resp struct {
+		NewRSIPAvailable string
+		NewNATEnabled    string
+	}
+	if err := sc.SOAPClient.PerformAction(ipConn, "GetNATRSIPStatus", &struct{}{}, &resp); err != nil {
+		t.Fatal(err)
+	} else if resp.NewNATEnabled != "1" || resp.NewRSIPAvailable != "0" {
+		t.Fatal("wrong response:", resp)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if action != `"`+ipConn+`#GetNATRSIPStatus"` {
+		t.Fatal("wrong action:", action)
+	}
+}
+
+// TestUpdateMapping tests that UpdateMapping rewrites the description and
+// lease of an existing mapping in place, keeping its internal port, and that
+// it reports the router's refusal to overwrite another host's mapping.
+func TestUpdateMapping(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.mappings[mappingID{"", 9001, "TCP"}] = trackedMapping{internalPort: 8080, internalIP: "192.168.1.2", enabled: true, desc: "old", lease: 0}
+	if err := d.UpdateMapping(9001, "tcp", "new", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	want := trackedMapping{internalPort: 8080, internalIP: "192.168.1.2", enabled: true, desc: "new", lease: 3600}
+	if m := fc.mappings[mappingID{"", 9001, "TCP"}]; m != want {
+		t.Fatal("wrong mapping:", m)
+	}
+
+	// another host's mapping
+	theirs := trackedMapping{internalPort: 9002, internalIP: "192.168.1.3", enabled: true, desc: "theirs"}
+	fc.mappings[mappingID{"", 9002, "UDP"}] = theirs
+	if err := d.UpdateMapping(9002, "UDP", "mine", 0); faultCode(err) != ErrCodeConflictInMappingEntry {
+		t.Fatal("expected a conflict, got", err)
+	} else if m := fc.mappings[mappingID{"", 9002, "UDP"}]; m != theirs {
+		t.Fatal("mapping was changed:", m)
+	}
+
+	// no mapping to update
+	if err := d.UpdateMapping(9003, "TCP", "new", 0); faultCode(err) != errCodeNoSuchEntry {
+		t.Fatal("expected NoSuchEntryInArray, got", err)
+	} else if _, ok := fc.mappings[mappingID{"", 9003, "TCP"}]; ok {
+		t.Fatal("mapping was created")
+	}
+	if err := d.UpdateMapping(9001, "SCTP", "new", 0); err == nil {
+		t.Fatal("expected an invalid protocol to be rejected")
+	}
+}
+
+// TestMappings tests that Mappings reports every entry in the router's table,
+// with each of its fields, and an empty slice for an empty table.
+func TestMappings(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if ms, err := d.Mappings(); err != nil || ms == nil || len(ms) != 0 {
+		t.Fatal("expected an empty slice, got", ms, err)
+	}
+	fc.mappings[mappingID{"", 443, "TCP"}] = trackedMapping{internalPort: 8443, internalIP: "192.168.1.2", enabled: true, desc: "web", lease: 3600}
+	fc.mappings[mappingID{"203.0.113.5", 9001, "UDP"}] = trackedMapping{internalPort: 9001, internalIP: "192.168.1.3", enabled: false, desc: "game"}
+	ms, err := d.Mappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PortMapping{
+		{ExternalPort: 443, InternalPort: 8443, Protocol: "TCP", InternalClient: "192.168.1.2", Description: "web", Enabled: true, LeaseDuration: time.Hour},
+		{RemoteHost: "203.0.113.5", ExternalPort: 9001, InternalPort: 9001, Protocol: "UDP", InternalClient: "192.168.1.3", Description: "game"},
+	}
+	if len(ms) != len(want) {
+		t.Fatal("expected 2 mappings, got", ms)
+	}
+	for i := range want {
+		if ms[i] != want[i] {
+			t.Errorf("wrong mapping: %+v, expected %+v", ms[i], want[i])
+		}
+	}
+}
+
+// TestClose tests that Close removes every mapping created through the IGD,
+// for the protocols that were forwarded, and no others, and carries on past
+// mappings that cannot be removed.
+func TestClose(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if err := d.ForwardUDP(9002, "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if err := d.Forward(9003, "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if err := d.Clear(9003); err != nil {
+		t.Fatal(err)
+	}
+	// a mapping that another handle created
+	fc.mappings[mappingID{"", 9100, "TCP"}] = trackedMapping{internalPort: 9100, internalIP: "192.168.1.2", enabled: true}
+	fc.delErr = map[uint16]error{9001: errors.New("router on fire")}
+
+	err := d.Close()
+	if err == nil || !strings.Contains(err.Error(), "2 of 3") || !strings.Contains(err.Error(), "router on fire") {
+		t.Fatal("expected 2 of 3 mappings to fail, got", err)
+	}
+	if _, ok := fc.mappings[mappingID{"", 9002, "UDP"}]; ok {
+		t.Fatal("9002/UDP was not cleared")
+	} else if _, ok := fc.mappings[mappingID{"", 9100, "TCP"}]; !ok {
+		t.Fatal("a mapping created by another handle was cleared")
+	} else if len(fc.mappings) != 3 {
+		t.Fatal("expected 3 mappings to remain, got", len(fc.mappings))
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal("expected nothing left to close, got", err)
+	}
+}
+
+// TestForwardAndListen tests that ForwardAndListen forwards a port and
+// listens on it, that its cleanup undoes both once, and that the mapping is
+// removed if the port cannot be listened on.
+func TestForwardAndListen(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer busy.Close()
+	port := uint16(busy.Addr().(*net.TCPAddr).Port)
+
+	d, fc := newFakeIGD("192.168.1.2")
+	if _, _, err := d.ForwardAndListen(port, "upnp test"); err == nil {
+		t.Fatal("expected listening on a busy port to fail")
+	} else if len(fc.mappings) != 0 {
+		t.Fatal("mapping was not removed:", fc.mappings)
+	}
+	busy.Close()
+
+	l, cleanup, err := d.ForwardAndListen(port, "upnp test")
+	if err != nil {
+		t.Fatal(err)
+	} else if l.Addr().(*net.TCPAddr).Port != int(port) {
+		t.Fatal("listening on the wrong port:", l.Addr())
+	} else if len(fc.mappings) != 2 {
+		t.Fatal("port was not forwarded:", fc.mappings)
+	}
+	if err := cleanup(); err != nil {
+		t.Fatal(err)
+	} else if len(fc.mappings) != 0 {
+		t.Fatal("port was not cleared")
+	} else if _, err := l.Accept(); err == nil {
+		t.Fatal("listener was not closed")
+	}
+	if err := cleanup(); err != nil {
+		t.Fatal("second cleanup failed:", err)
+	}
+}
+
+// TestDefaultConnectionService tests that, on a router with more than one WAN
+// connection, the IGD uses the one named by Layer3Forwarding as the default,
+// unless WithConnectionPreference chooses the kind of service, and that it
+// falls back to the first connection if the default cannot be found.
+func TestDefaultConnectionService(t *testing.T) {
+	connection := func(udn, id, ctl string) string {
+		return `<device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>` +
+			`<UDN>` + udn + `</UDN><serviceList><service>` +
+			`<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>` +
+			`<serviceId>` + id + `</serviceId>` +
+			`<controlURL>` + ctl + `</controlURL></service></serviceList></device>`
+	}
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>` +
+		`<serviceId>urn:upnp-org:serviceId:L3Forwarding1</serviceId><controlURL>/l3f</controlURL></service></serviceList>` +
+		`<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType><UDN>uuid:wan</UDN>` +
+		`<deviceList>` + connection("uuid:conn1", "urn:upnp-org:serviceId:WANIPConn1", "/ctl1") +
+		connection("uuid:conn2", "urn:upnp-org:serviceId:WANIPConn2", "/ctl2") + `</deviceList>` +
+		`</device></deviceList></device></root>`
+	// a router whose connections share a service ID
+	shared := strings.Replace(desc, "WANIPConn2", "WANIPConn1", 1)
+	respond := func(w http.ResponseWriter, action, urn, arg, value string) {
+		body := `<u:` + action + `Response xmlns:u="` + urn + `"><` + arg + `>` + value + `</` + arg + `></u:` + action + `Response>`
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+			`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` + body + `</s:Body></s:Envelope>`))
+	}
+	var mu sync.Mutex
+	var defaultService, l3Agent string
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+		switch r.URL.Path {
+		case "/rootDesc.xml":
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+		case "/shared.xml":
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(shared))
+		case "/l3f":
+			mu.Lock()
+			name := defaultService
+			l3Agent = r.Header.Get("User-Agent")
+			mu.Unlock()
+			if name == "" {
+				http.Error(w, "not implemented", http.StatusInternalServerError)
+				return
+			}
+			respond(w, "GetDefaultConnectionService", "urn:schemas-upnp-org:service:Layer3Forwarding:1",
+				"NewDefaultConnectionService", name)
+		case "/ctl1":
+			respond(w, "GetExternalIPAddress", ipConn, "NewExternalIPAddress", "203.0.113.1")
+		case "/ctl2":
+			respond(w, "GetExternalIPAddress", ipConn, "NewExternalIPAddress", "203.0.113.2")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer router.Close()
+
+	for _, test := range []struct {
+		defaultService string
+		opts           []Option
+		ip             string
+	}{
+		{"uuid:conn2,urn:upnp-org:serviceId:WANIPConn2", nil, "203.0.113.2"},
+		// some routers omit the UDN
+		{"urn:upnp-org:serviceId:WANIPConn2", nil, "203.0.113.2"},
+		// an explicit preference overrides the default
+		{"uuid:conn2,urn:upnp-org:serviceId:WANIPConn2", []Option{WithConnectionPreference(PreferIP)}, "203.0.113.1"},
+		// a default that does not exist, or none at all
+		{"uuid:conn3,urn:upnp-org:serviceId:WANIPConn3", nil, "203.0.113.1"},
+		{"uuid:conn1,urn:upnp-org:serviceId:WANIPConn2", nil, "203.0.113.1"},
+		{"", nil, "203.0.113.1"},
+	} {
+		mu.Lock()
+		defaultService = test.defaultService
+		mu.Unlock()
+		d, err := Load(router.URL+"/rootDesc.xml", test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip, err := d.ExternalIP(); err != nil || ip != test.ip {
+			t.Errorf("default %q: expected IP %v, got %q, %v", test.defaultService, test.ip, ip, err)
+		}
+	}
+
+	// connections that share a service ID are told apart by their UDN
+	mu.Lock()
+	defaultService = "uuid:conn2,urn:upnp-org:serviceId:WANIPConn1"
+	mu.Unlock()
+	d, err := Load(router.URL + "/shared.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := d.ExternalIP(); err != nil || ip != "203.0.113.2" {
+		t.Fatalf("expected the default connection's IP 203.0.113.2, got %q, %v", ip, err)
+	}
+
+	// the router is asked for its default through the configured transport
+	d, err = Load(router.URL+"/rootDesc.xml", WithUserAgent("upnp test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	agent := l3Agent
+	mu.Unlock()
+	if agent != "upnp test" {
+		t.Fatalf("expected the default connection to be requested with the User-Agent %q, got %q", "upnp test", agent)
+	}
+
+	// DiscoverAll returns each connection that the preference selects, even
+	// if the router names another as its default
+	mu.Lock()
+	defaultService = "uuid:conn2,urn:upnp-org:serviceId:WANIPConn2"
+	mu.Unlock()
+	loc, _ := url.Parse(router.URL + "/rootDesc.xml")
+	search := withSearch(func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error) {
+		if urn != internetgateway1.URN_WANIPConnection_1 {
+			return nil, nil, nil
+		}
+		clients, err := goupnp.NewServiceClientsByURL(loc, urn)
+		return clients, nil, err
+	})
+	for _, test := range []struct {
+		opts []Option
+		n    int
+	}{
+		{nil, 1},
+		{[]Option{WithConnectionPreference(PreferIP)}, 2},
+	} {
+		if igds, err := DiscoverAll(append(test.opts, search)...); err != nil || len(igds) != test.n {
+			t.Errorf("%d options: expected %d routers, got %v, %v", len(test.opts), test.n, len(igds), err)
+		}
+	}
+}
+
+// TestProbe tests that each router sent by DiscoverStream is configured and
+// validated by its options, and that asking the router for its default
+// connection is abandoned once the search is cancelled.
+func TestProbe(t *testing.T) {
+	const ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>` +
+		`<serviceId>urn:upnp-org:serviceId:L3Forwarding1</serviceId><controlURL>/l3f</controlURL></service>` +
+		`<service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	var mu sync.Mutex
+	var l3Requests int
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rootDesc.xml":
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+		case "/l3f":
+			mu.Lock()
+			l3Requests++
+			mu.Unlock()
+			http.Error(w, "not implemented", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer router.Close()
+	requests := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return l3Requests
+	}
+
+	loc, _ := url.Parse(router.URL + "/rootDesc.xml")
+	root, err := goupnp.DeviceByURL(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maybe := goupnp.MaybeRootDevice{Root: root, Location: loc}
+	wrap := func(sc goupnp.ServiceClient) igdClient {
+		return &internetgateway1.WANIPConnection1{ServiceClient: sc}
+	}
+
+	o := newOptions([]Option{WithValidator(func(*IGD) error { return errors.New("rejected") })})
+	if d := o.probe(context.Background(), maybe, ipConn, wrap); d != nil {
+		t.Fatal("a router that failed validation was sent")
+	}
+	var validated bool
+	o = newOptions([]Option{WithDryRun(nil), WithValidator(func(*IGD) error {
+		validated = true
+		return nil
+	})})
+	if d := o.probe(context.Background(), maybe, ipConn, wrap); d == nil {
+		t.Fatal("a router that passed validation was not sent")
+	} else if !validated || d.plan == nil {
+		t.Fatal("the router was not validated and configured")
+	} else if requests() != 2 {
+		t.Fatal("the router was not asked for its default connection:", requests())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if d := o.probe(ctx, maybe, ipConn, wrap); d == nil {
+		t.Fatal("expected the router's connection service")
+	} else if requests() != 2 {
+		t.Fatal("the router was asked for its default connection after the search was cancelled")
+	}
+}
+
+// TestKeepAliveClock tests that KeepAlive schedules its renewals by the IGD's
+// Clock, at half the lease, and renews a mapping that the router has lost.
+func TestKeepAliveClock(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	clock := newFakeClock()
+	d.SetClock(clock)
+	stop, err := d.KeepAlive(9001, "upnp test", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if iv := clock.intervals(); len(iv) != 2 || iv[0] != 30*time.Minute || iv[1] != 30*time.Minute {
+		t.Fatal("expected renewals every 30 minutes, got", iv)
+	}
+
+	// the router loses the mappings
+	fc.mu.Lock()
+	fc.mappings = make(map[mappingID]trackedMapping)
+	fc.mu.Unlock()
+	mapped := func() int {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		return len(fc.mappings)
+	}
+	clock.Advance(29 * time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	if n := mapped(); n != 0 {
+		t.Fatal("renewed before half the lease had passed:", n)
+	}
+	clock.Advance(time.Minute)
+	for start := time.Now(); mapped() != 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("mappings were not renewed at half the lease:", mapped())
+		}
+	}
+	fc.mu.Lock()
+	m := fc.mappings[mappingID{"", 9001, "UDP"}]
+	fc.mu.Unlock()
+	if m.lease != 3600 {
+		t.Fatal("renewed with the wrong lease:", m.lease)
+	}
+
+	stop()
+	for start := time.Now(); len(clock.intervals()) != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("renewals were not stopped:", clock.intervals())
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if d := jitter(10*time.Second, 0); d != 10*time.Second {
+		t.Fatal("zero jitter changed the wait:", d)
+	}
+	for i := 0; i < 100; i++ {
+		if d := jitter(10*time.Second, 0.5); d <= 5*time.Second || d > 10*time.Second {
+			t.Fatal("jittered wait out of range:", d)
+		}
+	}
+}
+
+func TestDiscoveryCache(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	var mu sync.Mutex
+	searches := 0
+	failing := false
+	c := NewDiscoveryCache(50 * time.Millisecond)
+	c.discover = func(*net.Interface) (*IGD, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		searches++
+		if failing {
+			return nil, ErrNoGateway
+		}
+		return d, nil
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return searches
+	}
+
+	for i := 0; i < 3; i++ {
+		if got, err := c.Discover(); err != nil || got != d {
+			t.Fatal("wrong router:", got, err)
+		}
+	}
+	if n := count(); n != 1 {
+		t.Fatal("expected 1 search, got", n)
+	}
+
+	// once stale, the router is returned while it is searched for again
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if got, err := c.Discover(); err != nil || got != d {
+		t.Fatal("stale router not returned:", got, err)
+	}
+	// the failed search makes it forgotten
+	for {
+		c.mu.Lock()
+		n := len(c.entries)
+		c.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := c.Discover(); err != ErrNoGateway {
+		t.Fatal("expected the failed router to be forgotten, got", err)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if _, err := c.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	c.Invalidate()
+	before := count()
+	if _, err := c.Discover(); err != nil {
+		t.Fatal(err)
+	} else if count() != before+1 {
+		t.Fatal("Invalidate did not force a search")
+	}
+}
+
+func TestConnectionPreference(t *testing.T) {
+	order := func(p ConnectionPreference) string {
+		var urns []string
+		for _, srv := range newOptions([]Option{WithConnectionPreference(p)}).services() {
+			urns = append(urns, srv.urn[strings.LastIndex(srv.urn, ":service:")+9:])
+		}
+		return strings.Join(urns, ",")
+	}
+	for _, test := range []struct {
+		pref  ConnectionPreference
+		order string
+	}{
+		{PreferDefault, "WANIPConnection:2,WANPPPConnection:1,WANIPConnection:1"},
+		{PreferIP, "WANIPConnection:2,WANIPConnection:1,WANPPPConnection:1"},
+		{PreferPPP, "WANPPPConnection:1,WANIPConnection:2,WANIPConnection:1"},
+	} {
+		if got := order(test.pref); got != test.order {
+			t.Errorf("preference %v: expected %v, got %v", test.pref, test.order, got)
+		}
+	}
+}
+
+// TestForwardMapping tests that ForwardMapping reports the mappings it
+// installed.
+func TestForwardMapping(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	fm, err := d.ForwardMapping(MappingSpec{
+		ExternalPort: 9001,
+		InternalPort: 9002,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Lease:        time.Hour,
+		Description:  "upnp test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(fm.Protocols) != 2 || fm.Protocols[0] != "TCP" || fm.Protocols[1] != "UDP" {
+		t.Fatal("wrong protocols:", fm.Protocols)
+	} else if fm.ExternalPort != 9001 || fm.InternalPort != 9002 || fm.InternalIP != "192.168.1.2" {
+		t.Fatalf("wrong mapping: %+v", fm)
+	} else if fm.Lease != time.Hour || fm.ExternalIP != "203.0.113.1" || fm.Description != "upnp test" {
+		t.Fatalf("wrong lease, external IP or description: %+v", fm)
+	}
+
+	fc.addErr = map[string]error{"UDP": errors.New("refused")}
+	fm, err = d.ForwardMapping(MappingSpec{
+		ExternalPort: 9003,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Mode:         BestEffort,
+	})
+	var perr *PartialForwardError
+	if !errors.As(err, &perr) {
+		t.Fatal("expected a PartialForwardError, got", err)
+	} else if len(fm.Protocols) != 1 || fm.Protocols[0] != "TCP" || fm.Lease != 0 {
+		t.Fatalf("wrong mapping: %+v", fm)
+	}
+}
+
+// TestResolveExternalIP tests that ResolveExternalIP prefers the router's
+// answer, and otherwise uses the first resolver with a usable one.
+func TestResolveExternalIP(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("198.51.100.7\n"))
+	}))
+	defer srv.Close()
+	d.resolvers = []IPResolver{
+		{Name: "broken", Resolve: func(context.Context) (string, error) { return "", errors.New("broken") }},
+		{Name: "slow", Timeout: 10 * time.Millisecond, Resolve: func(context.Context) (string, error) {
+			time.Sleep(time.Second)
+			return "198.51.100.1", nil
+		}},
+		HTTPResolver(srv.URL),
+	}
+
+	if ip, source, err := d.ResolveExternalIP(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if ip != "203.0.113.1" || source != SourceUPnP {
+		t.Fatal("expected the router's address, got", ip, source)
+	}
+
+	// behind another NAT, the router's address is not usable
+	fc.externalIP = "10.0.0.1"
+	if ip, source, err := d.ResolveExternalIP(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if ip != "198.51.100.7" || source != srv.URL {
+		t.Fatal("expected the HTTP resolver's address, got", ip, source)
+	}
+
+	d.resolvers = d.resolvers[:2]
+	if _, _, err := d.ResolveExternalIP(context.Background()); !errors.Is(err, ErrNoExternalIP) {
+		t.Fatal("expected ErrNoExternalIP, got", err)
+	}
+}
+
+// TestRefreshMappings tests that RefreshMappings moves this host's mappings
+// to its new address, even if another mapping was created after the address
+// changed, and leaves those of other hosts alone.
+func TestRefreshMappings(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if err := d.ForwardFrom("192.168.1.9", 9003, "other host"); err != nil {
+		t.Fatal(err)
+	}
+	// the DHCP lease is renewed with a new address
+	d.localIP = "192.168.1.5"
+	if err := d.Forward(9002, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RefreshMappings(); err != nil {
+		t.Fatal(err)
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for _, want := range []struct {
+		port uint16
+		ip   string
+	}{{9001, "192.168.1.5"}, {9002, "192.168.1.5"}, {9003, "192.168.1.9"}} {
+		for _, proto := range []string{"TCP", "UDP"} {
+			if m := fc.mappings[mappingID{"", want.port, proto}]; m.internalIP != want.ip {
+				t.Errorf("%d/%s forwards to %q, expected %q", want.port, proto, m.internalIP, want.ip)
+			}
+		}
+	}
+}
+
+// TestRefreshMappingsFailure tests that RefreshMappings reports a mapping
+// that could not be deleted or re-created, and keeps it tracked under its old
+// address so that the next call moves it.
+func TestRefreshMappingsFailure(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	d.localIP = "192.168.1.5"
+	tracked := func() string {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.tracked[mappingID{"", 9001, "TCP"}].internalIP
+	}
+
+	fc.mu.Lock()
+	fc.delErr = map[uint16]error{9001: errors.New("router busy")}
+	fc.mu.Unlock()
+	if err := d.RefreshMappings(); err == nil {
+		t.Fatal("expected the failed delete to be reported")
+	} else if ip := tracked(); ip != "192.168.1.2" {
+		t.Fatal("expected the mapping to stay tracked under the old address, got", ip)
+	}
+
+	fc.mu.Lock()
+	fc.delErr = nil
+	fc.addErr = map[string]error{"TCP": errors.New("router busy")}
+	fc.mu.Unlock()
+	if err := d.RefreshMappings(); err == nil {
+		t.Fatal("expected the failed add to be reported")
+	} else if ip := tracked(); ip != "192.168.1.2" {
+		t.Fatal("expected the mapping to stay tracked under the old address, got", ip)
+	}
+
+	fc.mu.Lock()
+	fc.addErr = nil
+	fc.mu.Unlock()
+	if err := d.RefreshMappings(); err != nil {
+		t.Fatal(err)
+	} else if ip := tracked(); ip != "192.168.1.5" {
+		t.Fatal("expected the mapping to be moved, got", ip)
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if m := fc.mappings[mappingID{"", 9001, "TCP"}]; m.internalIP != "192.168.1.5" {
+		t.Fatal("expected the router's mapping to be moved, got", m.internalIP)
+	}
+}
+
+// TestPortMapper tests that a PortMapper renews the leases of its ports,
+// falls back to permanent mappings on a router that only supports them, and
+// removes every port when it is closed.
+func TestPortMapper(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	clock := newFakeClock()
+	d.SetClock(clock)
+	pm := NewPortMapper(d)
+	if err := pm.ForwardLease(9001, "upnp test", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	fc.mu.Lock()
+	for _, proto := range []string{"TCP", "UDP"} {
+		if m, ok := fc.mappings[mappingID{"", 9001, proto}]; !ok || m.lease != 3600 {
+			t.Fatalf("expected a %v mapping with a lease of 3600s, got %+v", proto, m)
+		}
+	}
+	// the leases expire
+	fc.mappings = make(map[mappingID]trackedMapping)
+	fc.mu.Unlock()
+	mapped := func(port uint16) (n int) {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		for id := range fc.mappings {
+			if id.externalPort == port {
+				n++
+			}
+		}
+		return n
+	}
+	clock.Advance(30 * time.Minute)
+	for start := time.Now(); mapped(9001) != 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("mappings were not renewed:", mapped(9001))
+		}
+	}
+
+	f := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+	f.UPnPError.ErrorCode = ErrCodeOnlyPermanentLeasesSupported
+	f.UPnPError.ErrorDescription = "OnlyPermanentLeasesSupported"
+	fc.mu.Lock()
+	fc.leaseErr = f
+	fc.mu.Unlock()
+	if err := pm.ForwardLease(9002, "upnp test", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	fc.mu.Lock()
+	for _, proto := range []string{"TCP", "UDP"} {
+		if m, ok := fc.mappings[mappingID{"", 9002, proto}]; !ok || m.lease != 0 {
+			t.Fatalf("expected a permanent %v mapping, got %+v", proto, m)
+		}
+	}
+	fc.leaseErr = nil
+	fc.mu.Unlock()
+
+	if err := pm.Close(); err != nil {
+		t.Fatal(err)
+	} else if n := mapped(9001) + mapped(9002); n != 0 {
+		t.Fatal("mappings were not cleared:", n)
+	}
+	for start := time.Now(); len(clock.intervals()) != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("renewals were not stopped:", clock.intervals())
+		}
+	}
+	clock.Advance(time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	if n := mapped(9001); n != 0 {
+		t.Fatal("a port was renewed after Close:", n)
+	}
+}
+
+// TestKeepAliveErrors tests that KeepAlive refuses a lease too short to
+// renew, passes renewal failures to onErr while continuing to renew, and
+// stops renewing when the port is cleared.
+func TestKeepAliveErrors(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	clock := newFakeClock()
+	d.SetClock(clock)
+	if _, err := d.KeepAlive(9001, "upnp test", time.Second, nil); err == nil {
+		t.Fatal("expected a 1s lease to be refused")
+	} else if len(fc.mappings) != 0 {
+		t.Fatal("forwarded despite the refused lease")
+	}
+
+	errs := make(chan error, 10)
+	stop, err := d.KeepAlive(9001, "upnp test", time.Hour, func(err error) { errs <- err })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	// the router starts refusing TCP mappings
+	fc.mu.Lock()
+	fc.addErr = map[string]error{"TCP": errors.New("router on fire")}
+	fc.mu.Unlock()
+	for round := 0; round < 2; round++ {
+		clock.Advance(30 * time.Minute)
+		select {
+		case err := <-errs:
+			if err == nil || !strings.Contains(err.Error(), "router on fire") {
+				t.Fatal("wrong renewal error:", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("renewal failure was not reported in round", round)
+		}
+	}
+	select {
+	case err := <-errs:
+		t.Fatal("unexpected renewal error:", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err := d.Clear(9001); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); len(clock.intervals()) != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("renewals were not stopped by Clear:", clock.intervals())
+		}
+	}
+}
+
+// TestDiscoverCached tests that DiscoverCached loads the router from the
+// saved location, and discovers it, saving its location, when the file is
+// missing, stale, corrupt or unreadable.
+func TestDiscoverCached(t *testing.T) {
+	const ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(desc))
+	}))
+	defer router.Close()
+	location := router.URL + "/rootDesc.xml"
+	var mu sync.Mutex
+	searches := 0
+	search := withSearch(func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error) {
+		if urn != ipConn {
+			return nil, nil, nil
+		}
+		mu.Lock()
+		searches++
+		mu.Unlock()
+		loc, _ := url.Parse(location)
+		clients, err := goupnp.NewServiceClientsByURL(loc, urn)
+		return clients, nil, err
+	})
+	discovered := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := searches
+		searches = 0
+		return n
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "location")
+	for _, test := range []struct {
+		name     string
+		contents string
+		discover bool
+	}{
+		{"missing", "", true},
+		{"saved", location + "\n", false},
+		{"stale", "http://127.0.0.1:1/rootDesc.xml\n", true},
+		{"corrupt", "\x00\xff not a URL", true},
+	} {
+		if test.contents != "" {
+			if err := ioutil.WriteFile(path, []byte(test.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		d, err := DiscoverCached(path, search)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		} else if d.Location() != location {
+			t.Fatalf("%v: wrong router: %v", test.name, d.Location())
+		} else if n := discovered(); (n != 0) != test.discover {
+			t.Fatalf("%v: expected discovery %v, got %v searches", test.name, test.discover, n)
+		}
+		if saved, err := ioutil.ReadFile(path); err != nil || strings.TrimSpace(string(saved)) != location {
+			t.Fatalf("%v: location was not saved: %q, %v", test.name, saved, err)
+		}
+	}
+
+	// a directory can be neither read nor written as a file
+	if d, err := DiscoverCached(dir, search); err != nil || d.Location() != location {
+		t.Fatal("expected an unreadable cache to be ignored, got", err)
+	} else if discovered() == 0 {
+		t.Fatal("expected discovery")
+	}
+}
+
+// TestPinholes tests that OpenPinhole asks the router to open a pinhole to
+// this host's global IPv6 address, refuses bad arguments and addresses
+// without asking, that ClosePinhole deletes the pinhole, and that a router
+// without IPv6 firewall control is reported as such.
+func TestPinholes(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	if _, err := d.IPv6(); err != ErrNoIPv6FirewallControl {
+		t.Fatal("expected ErrNoIPv6FirewallControl, got", err)
+	}
+
+	const (
+		ipConn   = "urn:schemas-upnp-org:service:WANIPConnection:1"
+		firewall = "urn:schemas-upnp-org:service:WANIPv6FirewallControl:1"
+	)
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:2</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + firewall + `</serviceType>` +
+		`<serviceId>urn:upnp-org:serviceId:WANIPv6Firewall1</serviceId><controlURL>/fw</controlURL></service>` +
+		`<service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	var mu sync.Mutex
+	var requests []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rootDesc.xml" {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+			return
+		}
+		req, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, string(req))
+		mu.Unlock()
+		var body string
+		switch action := r.Header.Get("SOAPAction"); {
+		case strings.Contains(action, "#AddPinhole"):
+			body = `<u:AddPinholeResponse xmlns:u="` + firewall + `"><UniqueID>7</UniqueID></u:AddPinholeResponse>`
+		case strings.Contains(action, "#DeletePinhole") && strings.Contains(string(req), "<UniqueID>7</UniqueID>"):
+			body = `<u:DeletePinholeResponse xmlns:u="` + firewall + `"></u:DeletePinholeResponse>`
+		default:
+			w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+			w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+				`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>` +
+				`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>704</errorCode>` +
+				`<errorDescription>NoSuchEntry</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`))
+			return
+		}
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+			`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` + body + `</s:Body></s:Envelope>`))
+	})
+	sent := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		r := requests
+		requests = nil
+		return r
+	}
+
+	// on loopback, this host has no global IPv6 address
+	router := httptest.NewServer(handler)
+	defer router.Close()
+	d, err := Load(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := d.IPv6()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []struct {
+		proto string
+		lease time.Duration
+	}{
+		{"TCP", 0},
+		{"TCP", 25 * time.Hour},
+		{"SCTP", time.Hour},
+		{"UDP", time.Hour},
+	} {
+		if _, err := fw.OpenPinhole(9001, bad.proto, bad.lease); err == nil {
+			t.Errorf("%v for %v: expected an error", bad.proto, bad.lease)
+		}
+	}
+	if r := sent(); len(r) != 0 {
+		t.Fatal("asked the router to open a pinhole:", r)
+	}
+	if err := fw.ClosePinhole(7); err != nil {
+		t.Fatal(err)
+	} else if err := fw.ClosePinhole(8); err == nil {
+		t.Fatal("expected the router's fault for an unknown pinhole")
+	}
+	if r := sent(); len(r) != 2 || !strings.Contains(r[0], "<UniqueID>7</UniqueID>") {
+		t.Fatal("wrong DeletePinhole requests:", r)
+	}
+
+	// a router reached over a global IPv6 address
+	var global net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if x, ok := a.(*net.IPNet); ok && x.IP.To4() == nil && x.IP.IsGlobalUnicast() && !isUniqueLocal(x.IP) {
+			global = x.IP
+		}
+	}
+	if global == nil {
+		t.Log("no global IPv6 address; skipping OpenPinhole")
+		return
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(global.String(), "0"))
+	if err != nil {
+		t.Skip(err)
+	}
+	router6 := httptest.NewUnstartedServer(handler)
+	router6.Listener = l
+	router6.Start()
+	defer router6.Close()
+	d, err = Load(router6.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	} else if fw, err = d.IPv6(); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := fw.OpenPinhole(9001, "udp", time.Hour); err != nil || id != 7 {
+		t.Fatal("expected pinhole 7, got", id, err)
+	}
+	r := sent()
+	if len(r) != 1 || !strings.Contains(r[0], "<InternalClient>"+global.String()+"</InternalClient>") ||
+		!strings.Contains(r[0], "<InternalPort>9001</InternalPort>") || !strings.Contains(r[0], "<Protocol>17</Protocol>") ||
+		!strings.Contains(r[0], "<LeaseTime>3600</LeaseTime>") {
+		t.Fatal("wrong AddPinhole request:", r)
+	}
+}
+
+// TestDiscoverCtx tests that DiscoverCtx and LoadCtx return ctx.Err()
+// promptly when ctx is done before a router is found, without trying the
+// remaining searches or the NAT-PMP fallback.
+func TestDiscoverCtx(t *testing.T) {
+	var mu sync.Mutex
+	searches := 0
+	search := withSearch(func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error) {
+		mu.Lock()
+		searches++
+		mu.Unlock()
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DiscoverCtx(ctx, search); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	} else if searches != 0 {
+		t.Fatal("searched with a cancelled context")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := DiscoverCtx(ctx, search); err != context.DeadlineExceeded {
+		t.Fatal("expected context.DeadlineExceeded, got", err)
+	} else if time.Since(start) > time.Second {
+		t.Fatal("discovery outlasted the deadline:", time.Since(start))
+	}
+	mu.Lock()
+	n := searches
+	mu.Unlock()
+	if n != len(newOptions(nil).services()) {
+		t.Fatal("expected a single round of searches, got", n)
+	}
+
+	// a router that never answers
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := LoadCtx(ctx, srv.URL+"/rootDesc.xml"); err != context.DeadlineExceeded {
+		t.Fatal("expected context.DeadlineExceeded, got", err)
+	} else if time.Since(start) > time.Second {
+		t.Fatal("Load outlasted the deadline:", time.Since(start))
+	}
+}
+
+// TestSentinelErrors tests that Discover, Load, getInternalIP and ExternalIP
+// report their common failures with errors that errors.Is recognises.
+func TestSentinelErrors(t *testing.T) {
+	none := withSearch(func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error) {
+		return nil, nil, nil
+	})
+	if _, err := Discover(none, WithRetries(1), WithoutNATPMP()); !errors.Is(err, ErrNoGateway) {
+		t.Fatal("expected ErrNoGateway from Discover, got", err)
+	}
+
+	// a device without a connection service
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+			`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+			`<deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType><UDN>uuid:tv</UDN></device></root>`))
+	}))
+	defer router.Close()
+	rawurl := router.URL + "/rootDesc.xml"
+	if _, err := Load(rawurl); !errors.Is(err, ErrNoGateway) || !strings.Contains(err.Error(), rawurl) {
+		t.Fatal("expected ErrNoGateway naming the URL from Load, got", err)
+	}
+
+	d, fc := newFakeIGD("")
+	loc, _ := url.Parse("http://198.51.100.1:5000/rootDesc.xml")
+	fc.sc.RootDevice.URLBase = *loc
+	if _, err := d.getInternalIP(); !errors.Is(err, ErrNoInternalIP) {
+		t.Fatal("expected ErrNoInternalIP, got", err)
+	}
+
+	fc.externalIP = ""
+	if _, err := d.ExternalIP(); !errors.Is(err, ErrNoExternalIP) {
+		t.Fatal("expected ErrNoExternalIP, got", err)
+	}
+	fc.ipErr = errors.New("router on fire")
+	if _, err := d.ExternalIP(); err == nil || errors.Is(err, ErrNoExternalIP) {
+		t.Fatal("expected the router's error, got", err)
+	}
+}
+
+// TestDiscoverAll tests that DiscoverAll returns every router found, once
+// each however many connection services find it, except those that fail
+// validation.
+func TestDiscoverAll(t *testing.T) {
+	client := func(rawurl, udn string) goupnp.ServiceClient {
+		loc, _ := url.Parse(rawurl)
+		root := &goupnp.RootDevice{URLBase: *loc}
+		root.Device.UDN = udn
+		return goupnp.ServiceClient{
+			SOAPClient: soap.NewSOAPClient(*loc),
+			RootDevice: root,
+			Location:   loc,
+			Service:    &goupnp.Service{ServiceId: "urn:upnp-org:serviceId:WANIPConn1"},
+		}
+	}
+	a := client("http://192.168.1.1:5000/rootDesc.xml", "uuid:a")
+	b := client("http://192.168.2.1:5000/rootDesc.xml", "uuid:b")
+	search := withSearch(func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error) {
+		switch urn {
+		case internetgateway2.URN_WANIPConnection_2:
+			return []goupnp.ServiceClient{a, b}, nil, nil
+		case internetgateway1.URN_WANIPConnection_1:
+			return []goupnp.ServiceClient{a}, nil, nil
+		}
+		return nil, nil, nil
+	})
+	locations := func(igds []*IGD) string {
+		var locs []string
+		for _, d := range igds {
+			locs = append(locs, d.Location())
+		}
+		return strings.Join(locs, " ")
+	}
+
+	igds, err := DiscoverAll(search)
+	if err != nil {
+		t.Fatal(err)
+	} else if got := locations(igds); got != a.Location.String()+" "+b.Location.String() {
+		t.Fatal("wrong routers:", got)
+	}
+	notB := WithValidator(func(d *IGD) error {
+		if d.Location() == b.Location.String() {
+			return errors.New("wrong router")
+		}
+		return nil
+	})
+	if igds, err := DiscoverAll(search, notB); err != nil {
+		t.Fatal(err)
+	} else if got := locations(igds); got != a.Location.String() {
+		t.Fatal("wrong routers:", got)
+	}
+
+	none := withSearch(func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error) {
+		return nil, nil, nil
+	})
+	if _, err := DiscoverAll(none); err != ErrNoGateway {
+		t.Fatal("expected ErrNoGateway, got", err)
+	}
+}
+
+// A lineLogger is a Logger that records the lines logged to it.
+type lineLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *lineLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// take returns the lines logged since the last call.
+func (l *lineLogger) take() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines := strings.Join(l.lines, "\n")
+	l.lines = nil
+	return lines
+}
+
+// TestSetLogger tests that the Logger given to SetLogger receives the
+// routers found by Discover, the one chosen, and the port mappings added and
+// deleted, and that nothing is logged once it is removed.
+func TestSetLogger(t *testing.T) {
+	l := new(lineLogger)
+	SetLogger(l)
+	defer SetLogger(nil)
+
+	_, fc := newFakeIGD("192.168.1.2")
+	search := withSearch(func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error) {
+		if urn != internetgateway1.URN_WANIPConnection_1 {
+			return nil, nil, nil
+		}
+		return []goupnp.ServiceClient{fc.sc}, nil, nil
+	})
+	if _, err := Discover(search); err != nil {
+		t.Fatal(err)
+	}
+	lines := l.take()
+	if !strings.Contains(lines, "found "+internetgateway1.URN_WANIPConnection_1+" at http://192.168.1.1:5000/rootDesc.xml") {
+		t.Error("candidate router was not logged:", lines)
+	} else if !strings.Contains(lines, "using http://192.168.1.1:5000/rootDesc.xml") {
+		t.Error("chosen router was not logged:", lines)
+	}
+
+	d, fc := newFakeIGD("192.168.1.2")
+	fc.delErr = map[uint16]error{9001: errors.New("router on fire")}
+	d.ForwardTCP(9001, "upnp test")
+	d.ClearTCP(9001)
+	lines = l.take()
+	if !strings.Contains(lines, `AddPortMapping("", 9001, TCP, 9001, "192.168.1.2", true, "upnp test", 0): <nil>`) {
+		t.Error("AddPortMapping was not logged:", lines)
+	} else if !strings.Contains(lines, `DeletePortMapping("", 9001, TCP): `) || !strings.Contains(lines, "router on fire") {
+		t.Error("DeletePortMapping was not logged with its error:", lines)
+	}
+
+	SetLogger(nil)
+	d.ForwardTCP(9002, "upnp test")
+	if lines := l.take(); lines != "" {
+		t.Fatal("logged without a Logger:", lines)
+	}
+}
+
+// TestDiscoverRetry tests that DiscoverRetry searches up to the given number
+// of times, doubling the backoff between searches, returns the first router
+// found, and gives up when ctx is done.
+func TestDiscoverRetry(t *testing.T) {
+	_, fc := newFakeIGD("192.168.1.2")
+	var mu sync.Mutex
+	rounds, foundIn := 0, 0
+	search := withSearch(func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error) {
+		if urn != internetgateway1.URN_WANIPConnection_1 {
+			return nil, nil, nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		rounds++
+		if rounds == foundIn {
+			return []goupnp.ServiceClient{fc.sc}, nil, nil
+		}
+		return nil, nil, nil
+	})
+	reset := func(found int) {
+		mu.Lock()
+		rounds, foundIn = 0, found
+		mu.Unlock()
+	}
+
+	reset(0)
+	start := time.Now()
+	if _, err := DiscoverRetry(3, 20*time.Millisecond, search); err != ErrNoGateway {
+		t.Fatal("expected ErrNoGateway, got", err)
+	} else if rounds != 3 {
+		t.Fatal("expected 3 searches, got", rounds)
+	} else if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Fatal("the backoff was not doubled:", elapsed)
+	}
+
+	reset(2)
+	if d, err := DiscoverRetry(3, time.Millisecond, search); err != nil || d == nil {
+		t.Fatal("expected the router found by the second search, got", err)
+	} else if rounds != 2 {
+		t.Fatal("expected 2 searches, got", rounds)
+	}
+
+	reset(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := DiscoverRetryCtx(ctx, 3, time.Hour, search); err != context.DeadlineExceeded {
+		t.Fatal("expected context.DeadlineExceeded, got", err)
+	} else if time.Since(start) > time.Second {
+		t.Fatal("the backoff outlasted the deadline")
+	}
+}
+
+// TestOptions tests that Load with no Options behaves as it always has, and
+// that Options are applied in order, so that a later one overrides an earlier
+// one.
+func TestOptions(t *testing.T) {
+	const ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	var mu sync.Mutex
+	var agents []string
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents = append(agents, r.UserAgent())
+		mu.Unlock()
+		if r.URL.Path == "/rootDesc.xml" {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+			return
+		}
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+			`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+			`<u:GetExternalIPAddressResponse xmlns:u="` + ipConn + `">` +
+			`<NewExternalIPAddress>203.0.113.1</NewExternalIPAddress></u:GetExternalIPAddressResponse>` +
+			`</s:Body></s:Envelope>`))
+	}))
+	defer router.Close()
+	take := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		a := agents
+		agents = nil
+		return a
+	}
+
+	for _, test := range []struct {
+		opts  []Option
+		agent string
+	}{
+		{nil, "Go-http-client/1.1"},
+		{[]Option{WithUserAgent("first"), WithDefaultTimeout(time.Second), WithUserAgent("second")}, "second"},
+	} {
+		d, err := Load(router.URL+"/rootDesc.xml", test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		} else if ip, err := d.ExternalIP(); err != nil || ip != "203.0.113.1" {
+			t.Fatal("expected 203.0.113.1, got", ip, err)
+		}
+		agents := take()
+		if len(agents) < 2 {
+			t.Fatal("expected the description and SOAP requests, got", agents)
+		}
+		for _, a := range agents {
+			if a != test.agent {
+				t.Errorf("expected the User-Agent %q, got %q", test.agent, a)
+			}
+		}
+	}
+}
+
+// TestWithValidator tests that Discover skips routers that fail validation,
+// and returns the errors of every validator that rejected one if none pass.
+func TestWithValidator(t *testing.T) {
+	_, fc := newFakeIGD("192.168.1.2")
+	other := fc.sc
+	other.Location, _ = url.Parse("http://192.168.2.1:5000/rootDesc.xml")
+	search := func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error) {
+		if urn != internetgateway1.URN_WANIPConnection_1 {
+			return nil, nil, nil
+		}
+		return []goupnp.ServiceClient{fc.sc, other}, nil, nil
+	}
+	errRejected := errors.New("rejected")
+	reject := func(host string) Option {
+		return WithValidator(func(d *IGD) error {
+			if strings.Contains(d.Location(), host) {
+				return fmt.Errorf("%w %s", errRejected, host)
+			}
+			return nil
+		})
+	}
+
+	o := newOptions([]Option{reject("192.168.1.1")})
+	o.search = search
+	if d, err := discoverOnce(context.Background(), o); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(d.Location(), "192.168.2.1") {
+		t.Fatal("expected the router that passed validation, got", d.Location())
+	}
+
+	o = newOptions([]Option{reject("192.168.1.1"), reject("192.168.2.1")})
+	o.search = search
+	if _, err := discoverOnce(context.Background(), o); err == nil {
+		t.Fatal("expected every router to be rejected")
+	} else if !strings.Contains(err.Error(), "rejected 192.168.1.1") || !strings.Contains(err.Error(), "rejected 192.168.2.1") {
+		t.Fatal("expected both validation errors, got", err)
+	} else if !errors.Is(err, errRejected) {
+		t.Fatal("expected the validation errors to be wrapped, got", err)
+	}
+}
+
+// TestRouterTime tests that RouterTime reads the time from a router's Time
+// service, with or without a zone, and returns ErrUnsupported on routers
+// without one.
+func TestRouterTime(t *testing.T) {
+	d, _ := newFakeIGD("192.168.1.2")
+	if _, err := d.RouterTime(); err != ErrUnsupported {
+		t.Fatal("expected ErrUnsupported, got", err)
+	}
+
+	const ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + urnTime1 + `</serviceType>` +
+		`<serviceId>urn:dslforum-org:serviceId:Time1</serviceId><controlURL>/time</controlURL></service>` +
+		`<service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	var mu sync.Mutex
+	localTime := "2020-01-02T03:04:05+01:00"
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rootDesc.xml":
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+		case "/time":
+			mu.Lock()
+			body := `<u:GetInfoResponse xmlns:u="` + urnTime1 + `"><NewCurrentLocalTime>` + localTime +
+				`</NewCurrentLocalTime></u:GetInfoResponse>`
+			mu.Unlock()
+			w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+			w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+				`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` + body + `</s:Body></s:Envelope>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer router.Close()
+
+	d, err := Load(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2020, 1, 2, 2, 4, 5, 0, time.UTC)
+	if rt, err := d.RouterTime(); err != nil || !rt.Equal(want) {
+		t.Fatalf("expected %v, got %v, %v", want, rt, err)
+	}
+	mu.Lock()
+	localTime = "2020-01-02T03:04:05"
+	mu.Unlock()
+	if rt, err := d.RouterTime(); err != nil || rt.Hour() != 3 || rt.Minute() != 4 {
+		t.Fatalf("expected 03:04 local time, got %v, %v", rt, err)
+	}
+}
+
+// TestLoadIGDv2 tests that Load uses a WANIPConnection:2 service in
+// preference to a WANIPConnection:1 one, finds it on a router that offers no
+// IGDv1 service at all, and still uses an IGDv1-only router.
+func TestLoadIGDv2(t *testing.T) {
+	service := func(version string) string {
+		return `<service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:` + version + `</serviceType>` +
+			`<serviceId>urn:upnp-org:serviceId:WANIPConn` + version + `</serviceId>` +
+			`<controlURL>/ctl` + version + `</controlURL></service>`
+	}
+	for _, services := range [][]string{{"1", "2"}, {"2"}, {"1"}} {
+		want := services[len(services)-1]
+		desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+			`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+			`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:2</deviceType><UDN>uuid:igd</UDN><serviceList>`
+		for _, v := range services {
+			desc += service(v)
+		}
+		desc += `</serviceList></device></root>`
+		router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/rootDesc.xml":
+				w.Header().Set("Content-Type", "text/xml")
+				w.Write([]byte(desc))
+			case "/ctl1", "/ctl2":
+				v := r.URL.Path[len("/ctl"):]
+				w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+				w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+					`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+					`<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:` + v + `">` +
+					`<NewExternalIPAddress>203.0.113.` + v + `</NewExternalIPAddress></u:GetExternalIPAddressResponse>` +
+					`</s:Body></s:Envelope>`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		d, err := Load(router.URL + "/rootDesc.xml")
+		if err != nil {
+			router.Close()
+			t.Fatal(err)
+		} else if d.IsV2() != (want == "2") {
+			t.Errorf("%v: expected the WANIPConnection:%v service to be used", services, want)
+		}
+		if ip, err := d.ExternalIP(); err != nil || ip != "203.0.113."+want {
+			t.Errorf("%v: expected the WANIPConnection:%v service to answer, got %v, %v", services, want, ip, err)
+		}
+		router.Close()
+	}
+}
+
+// v2Router is a minimal IGDv2 router, for testing the WANIPConnection:2
+// actions that a fakeClient cannot stand in for. It records the SOAP actions
+// it is sent, in order.
+type v2Router struct {
+	*httptest.Server
+	mu      sync.Mutex
+	actions []string
+}
+
+// newV2Router starts a v2Router that answers each SOAP action with the
+// response arguments returned by answer, given the request body, or with the
+// UPnP error code answer returns, if it is not zero.
+func newV2Router(answer func(action, body string) (string, int)) *v2Router {
+	r := new(v2Router)
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/rootDesc.xml" {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(`<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+				`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+				`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:2</deviceType><UDN>uuid:igd</UDN><serviceList>` +
+				`<service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:2</serviceType>` +
+				`<serviceId>urn:upnp-org:serviceId:WANIPConn2</serviceId><controlURL>/ctl</controlURL></service>` +
+				`</serviceList></device></root>`))
+			return
+		}
+		action := req.Header.Get("SOAPAction")
+		action = strings.Trim(action[strings.Index(action, "#")+1:], `"`)
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		r.actions = append(r.actions, action)
+		args, code := answer(action, string(body))
+		r.mu.Unlock()
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		resp := `<u:` + action + `Response xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:2">` + args + `</u:` + action + `Response>`
+		if code != 0 {
+			resp = `<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>` +
+				`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>` + strconv.Itoa(code) + `</errorCode>` +
+				`<errorDescription>refused</errorDescription></UPnPError></detail></s:Fault>`
+		}
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+			`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` + resp + `</s:Body></s:Envelope>`))
+	}))
+	return r
+}
+
+// take returns the actions r has been sent since the last call.
+func (r *v2Router) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a := r.actions
+	r.actions = nil
+	return a
+}
+
+// TestForwardAny tests that ForwardAny lets an IGDv2 router choose the
+// external port with AddAnyPortMapping, and forwards UDP on the same port.
+func TestForwardAny(t *testing.T) {
+	router := newV2Router(func(action, body string) (string, int) {
+		if action == "AddAnyPortMapping" {
+			return "<NewReservedPort>9004</NewReservedPort>", 0
+		}
+		return "", 0
+	})
+	defer router.Close()
+
+	d, err := Load(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	} else if !d.IsV2() {
+		t.Fatal("expected an IGDv2 connection service")
+	}
+	port, err := d.ForwardAny(9002, "upnp test")
+	if err != nil {
+		t.Skip(err) // no loopback interface
+	} else if port != 9004 {
+		t.Fatal("expected the router's choice of port, got", port)
+	}
+	if actions := router.take(); len(actions) != 2 || actions[0] != "AddAnyPortMapping" || actions[1] != "AddPortMapping" {
+		t.Fatal("expected the router to choose the port, got", actions)
+	}
+	for _, proto := range []string{"TCP", "UDP"} {
+		if m, ok := d.tracked[mappingID{"", 9004, proto}]; !ok || m.internalPort != 9002 {
+			t.Fatalf("wrong %v mapping tracked: %+v", proto, m)
+		}
+	}
+}
+
+// TestClearRangeV2 tests that ClearRange asks an IGDv2 router to delete the
+// range in one request, and deletes the mappings one at a time if the router
+// refuses.
+func TestClearRangeV2(t *testing.T) {
+	var ports []int
+	var rangeBody string
+	refuse := false
+	arg := func(body, name string) int {
+		i := strings.Index(body, "<"+name+">") + len(name) + 2
+		n, _ := strconv.Atoi(body[i : i+strings.Index(body[i:], "<")])
+		return n
+	}
+	router := newV2Router(func(action, body string) (string, int) {
+		switch action {
+		case "DeletePortMappingRange":
+			rangeBody = body
+			if refuse {
+				return "", 401
+			}
+			start, end := arg(body, "NewStartPort"), arg(body, "NewEndPort")
+			var left []int
+			for _, p := range ports {
+				if p < start || p > end {
+					left = append(left, p)
+				}
+			}
+			if len(left) == len(ports) {
+				return "", errCodePortMappingNotFound
+			}
+			ports = left
+		case "GetGenericPortMappingEntry":
+			i := arg(body, "NewPortMappingIndex")
+			if i >= len(ports) {
+				return "", 713
+			}
+			return fmt.Sprintf("<NewRemoteHost></NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>TCP</NewProtocol>"+
+				"<NewInternalPort>%d</NewInternalPort><NewInternalClient>192.168.1.2</NewInternalClient><NewEnabled>1</NewEnabled>"+
+				"<NewPortMappingDescription>upnp test</NewPortMappingDescription><NewLeaseDuration>0</NewLeaseDuration>", ports[i], ports[i]), 0
+		case "DeletePortMapping":
+			p := arg(body, "NewExternalPort")
+			for i := range ports {
+				if ports[i] == p {
+					ports = append(ports[:i], ports[i+1:]...)
+					return "", 0
+				}
+			}
+			return "", errCodeNoSuchEntry
+		}
+		return "", 0
+	})
+	defer router.Close()
+	d, err := Load(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := func() string {
+		router.mu.Lock()
+		defer router.mu.Unlock()
+		return fmt.Sprint(ports)
+	}
+
+	ports = []int{9001, 9002, 9100}
+	if err := d.ClearRange(9000, 9099, "TCP"); err != nil {
+		t.Fatal(err)
+	} else if left := left(); left != "[9100]" {
+		t.Fatal("wrong mappings left:", left)
+	} else if actions := router.take(); len(actions) != 1 || actions[0] != "DeletePortMappingRange" {
+		t.Fatal("expected a single DeletePortMappingRange, got", actions)
+	}
+	// an empty range is already clear
+	if err := d.ClearRange(9000, 9099, "TCP"); err != nil {
+		t.Fatal(err)
+	}
+
+	router.mu.Lock()
+	ports, refuse = []int{9001, 9002, 9100}, true
+	router.mu.Unlock()
+	router.take()
+	if err := d.ClearRange(9000, 9099, "TCP"); err != nil {
+		t.Fatal(err)
+	} else if left := left(); left != "[9100]" {
+		t.Fatal("wrong mappings left:", left)
+	}
+	actions, deletes := router.take(), 0
+	for _, a := range actions {
+		if a == "DeletePortMapping" {
+			deletes++
+		}
+	}
+	if actions[0] != "DeletePortMappingRange" || deletes != 2 {
+		t.Fatal("expected a DeletePortMapping per mapping after the refusal, got", actions)
+	}
+
+	// the range is checked, and the router's quirks apply to the request
+	if err := d.ClearRange(9099, 9000, "TCP"); err == nil {
+		t.Fatal("expected an error for an inverted range")
+	}
+	d, err = Load(router.URL+"/rootDesc.xml", WithQuirks("", "", Quirks{LowercaseProtocol: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.mu.Lock()
+	ports, refuse = []int{9001}, false
+	router.mu.Unlock()
+	if err := d.ClearRange(9000, 9099, "TCP"); err != nil {
+		t.Fatal(err)
+	}
+	router.mu.Lock()
+	body := rangeBody
+	router.mu.Unlock()
+	if !strings.Contains(body, "<NewProtocol>tcp</NewProtocol>") {
+		t.Fatal("expected the quirk-adjusted protocol, got", body)
+	}
+}
+
+// withSearch returns an Option that replaces the SSDP search for connection
+// services with search.
+func withSearch(search func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error)) Option {
+	return func(o *options) {
+		o.search = search
+	}
+}
+
+// TestLocationRefresh tests that, with WithLocationRefresh, Load finds a
+// router whose description has moved by searching for one at the same host
+// with the same UDN.
+func TestLocationRefresh(t *testing.T) {
+	client := func(rawurl, udn string) goupnp.ServiceClient {
+		loc, _ := url.Parse(rawurl)
+		root := &goupnp.RootDevice{URLBase: *loc}
+		root.Device.UDN = udn
+		return goupnp.ServiceClient{
+			SOAPClient: soap.NewSOAPClient(*loc),
+			RootDevice: root,
+			Location:   loc,
+			Service:    &goupnp.Service{},
+		}
+	}
+	search := withSearch(func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error) {
+		if urn != internetgateway1.URN_WANIPConnection_1 {
+			return nil, nil, nil
+		}
+		return []goupnp.ServiceClient{
+			client("http://192.168.1.1:5000/rootDesc.xml", "uuid:moved"),
+			client("http://127.0.0.1:5001/rootDesc.xml", "uuid:other"),
+			client("http://127.0.0.1:5002/rootDesc.xml", "uuid:moved"),
+		}, nil, nil
+	})
+	// nothing listens on port 1
+	const stale = "http://127.0.0.1:1/rootDesc.xml"
+
+	if _, err := Load(stale, search); !errors.Is(err, ErrNoGateway) {
+		t.Fatal("expected ErrNoGateway without WithLocationRefresh, got", err)
+	}
+	for _, test := range []struct {
+		udn, location string
+	}{
+		{"uuid:moved", "http://127.0.0.1:5002/rootDesc.xml"},
+		{"", "http://127.0.0.1:5001/rootDesc.xml"},
+	} {
+		d, err := Load(stale, search, WithLocationRefresh(test.udn))
+		if err != nil {
+			t.Fatal(err)
+		} else if d.Location() != test.location {
+			t.Errorf("UDN %q: expected the router at %v, got %v", test.udn, test.location, d.Location())
+		}
+	}
+	if _, err := Load(stale, search, WithLocationRefresh("uuid:gone")); !errors.Is(err, ErrNoGateway) {
+		t.Fatal("expected ErrNoGateway for a router that is not found, got", err)
+	}
+}
+
+// TestDiscoverInterface tests that DiscoverInterface searches from the given
+// interface, forwards ports to its address, and skips routers that fail
+// validation.
+func TestDiscoverInterface(t *testing.T) {
+	if _, err := DiscoverInterface(&net.Interface{Name: "none"}); !errors.Is(err, ErrNoInternalIP) {
+		t.Fatal("expected ErrNoInternalIP for an interface without an address, got", err)
+	}
+
+	var iface *net.Interface
+	var localIP net.IP
+	ifaces, _ := net.Interfaces()
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagUp == 0 || ifaces[i].Flags&net.FlagMulticast == 0 || ifaces[i].Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifaces[i].Addrs()
+		for _, a := range addrs {
+			if x, ok := a.(*net.IPNet); ok && x.IP.To4() != nil && iface == nil {
+				iface, localIP = &ifaces[i], x.IP
+			}
+		}
+	}
+	if iface == nil {
+		t.Skip("no multicast interface")
+	}
+	conn, err := net.ListenMulticastUDP("udp4", iface, &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	const ipConn = "urn:schemas-upnp-org:service:WANIPConnection:2"
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:2</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(desc))
+	}))
+	defer router.Close()
+
+	// answer each search for the connection service, noting where it came
+	// from
+	from := make(chan net.IP, 10)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := string(buf[:n])
+			if !strings.HasPrefix(req, "M-SEARCH * HTTP/1.1\r\n") || !strings.Contains(req, "ST: "+ipConn+"\r\n") {
+				continue
+			}
+			from <- addr.IP
+			conn.WriteToUDP([]byte("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=1800\r\nST: "+ipConn+"\r\n"+
+				"USN: uuid:igd::"+ipConn+"\r\nLOCATION: "+router.URL+"/rootDesc.xml\r\n\r\n"), addr)
+		}
+	}()
+
+	d, err := DiscoverInterface(iface)
+	if err != nil {
+		t.Skip("multicast search was not delivered:", err)
+	} else if d.Location() != router.URL+"/rootDesc.xml" {
+		t.Fatal("wrong router:", d.Location())
+	} else if src := <-from; !src.Equal(localIP) {
+		t.Fatalf("search was sent from %v, not %v on %v", src, localIP, iface.Name)
+	}
+	if ip, err := d.getInternalIP(); err != nil || ip != localIP.String() {
+		t.Fatalf("expected ports to be forwarded to %v, got %v, %v", localIP, ip, err)
+	}
+
+	// a router that fails validation is skipped
+	errRejected := errors.New("rejected")
+	reject := WithValidator(func(*IGD) error { return errRejected })
+	if _, err := DiscoverInterface(iface, reject, WithSearchTimeout(time.Second)); !errors.Is(err, errRejected) {
+		t.Fatal("expected the validation error, got", err)
+	}
+}
+
+// TestDiscoverUnicast tests that DiscoverUnicast sends its search to the
+// gateway's SSDP port, and connects to the router that answers unless it
+// fails validation.
+func TestDiscoverUnicast(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:1900")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	const ipConn = "urn:schemas-upnp-org:service:WANIPConnection:2"
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:2</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rootDesc.xml":
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+		case "/ctl":
+			w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+			w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+				`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+				`<u:GetExternalIPAddressResponse xmlns:u="` + ipConn + `"><NewExternalIPAddress>203.0.113.9</NewExternalIPAddress>` +
+				`</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer router.Close()
+
+	// answer each search for the connection service
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := string(buf[:n])
+			if !strings.HasPrefix(req, "M-SEARCH * HTTP/1.1\r\n") || !strings.Contains(req, "ST: "+ipConn+"\r\n") {
+				continue
+			}
+			conn.WriteTo([]byte("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=1800\r\nST: "+ipConn+"\r\n"+
+				"USN: uuid:igd::"+ipConn+"\r\nLOCATION: "+router.URL+"/rootDesc.xml\r\n\r\n"), addr)
+		}
+	}()
+
+	d, err := DiscoverUnicast(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	} else if d.Location() != router.URL+"/rootDesc.xml" {
+		t.Fatal("wrong router:", d.Location())
+	} else if ip, err := d.ExternalIP(); err != nil || ip != "203.0.113.9" {
+		t.Fatal("expected 203.0.113.9, got", ip, err)
+	}
+
+	// a router that fails validation is skipped
+	errRejected := errors.New("rejected")
+	reject := WithValidator(func(*IGD) error { return errRejected })
+	if _, err := DiscoverUnicast(net.IPv4(127, 0, 0, 1), reject, WithSearchTimeout(time.Second)); !errors.Is(err, errRejected) {
+		t.Fatal("expected the validation error, got", err)
+	}
+}
+
+// deleteRecorder is a fakeClient that records the mappings it is asked to
+// delete.
+type deleteRecorder struct {
+	*fakeClient
+	deletes []mappingID
+}
+
+func (dr *deleteRecorder) DeletePortMapping(remoteHost string, extPort uint16, proto string) error {
+	dr.deletes = append(dr.deletes, mappingID{remoteHost, extPort, proto})
+	return dr.fakeClient.DeletePortMapping(remoteHost, extPort, proto)
+}
+
+// TestClearRange tests that ClearRange reads the mapping table and deletes
+// only the mappings in the range that exist.
+func TestClearRange(t *testing.T) {
+	_, fc := newFakeIGD("192.168.1.2")
+	dr := &deleteRecorder{fakeClient: fc}
+	d := newIGD(dr)
+	d.localIP = "192.168.1.2"
+	for _, port := range []uint16{9001, 9002} {
+		if err := d.Forward(port, "upnp test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fc.AddPortMapping("", 9100, "TCP", 9100, "192.168.1.2", true, "upnp test", 0)
+
+	if err := d.ClearRange(9000, 9099, "tcp"); err != nil {
+		t.Fatal(err)
+	}
+	if len(dr.deletes) != 2 {
+		t.Fatal("expected a DeletePortMapping per existing mapping, got", dr.deletes)
+	}
+	for _, id := range dr.deletes {
+		if id.protocol != "TCP" {
+			t.Fatalf("wrong delete: %+v", id)
+		}
+	}
+	mappings, err := d.ListMappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, m := range mappings {
+		left = append(left, fmt.Sprintf("%d/%s", m.ExternalPort, m.Protocol))
+	}
+	if strings.Join(left, " ") != "9001/UDP 9002/UDP 9100/TCP" {
+		t.Fatal("wrong mappings left:", left)
+	}
+	if err := d.ClearRange(9000, 9099, "sctp"); err == nil {
+		t.Fatal("expected an error for an unrecognized protocol")
+	}
+}
+
+// A brokenTableClient is a fakeClient whose mapping table cannot be read.
+type brokenTableClient struct {
+	*fakeClient
+}
+
+func (bc brokenTableClient) GetGenericPortMappingEntry(index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	return "", 0, "", 0, "", false, "", 0, errors.New("connection reset")
+}
+
+// An endFaultClient is a fakeClient that reports the end of its mapping
+// table with the fault code, in place of SpecifiedArrayIndexInvalid.
+type endFaultClient struct {
+	*fakeClient
+	code int
+}
+
+func (ec endFaultClient) GetGenericPortMappingEntry(index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	remoteHost, extPort, proto, intPort, client, enabled, desc, lease, err := ec.fakeClient.GetGenericPortMappingEntry(index)
+	if faultCode(err) == errCodeArrayIndexInvalid {
+		f := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+		f.UPnPError.ErrorCode = ec.code
+		f.UPnPError.ErrorDescription = "Error"
+		err = f
+	}
+	return remoteHost, extPort, proto, intPort, client, enabled, desc, lease, err
+}
+
+// TestListMappings tests that ListMappings reads every field of each entry
+// until the router reports the end of the table, returns an empty slice for
+// an empty table, and returns any other fault.
+func TestListMappings(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if ms, err := d.ListMappings(); err != nil || ms == nil || len(ms) != 0 {
+		t.Fatalf("expected an empty slice, got %#v, %v", ms, err)
+	}
+
+	if err := d.ForwardTimeout(9001, "upnp lease", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	fc.AddPortMapping("", 9002, "TCP", 9002, "192.168.1.2", true, "upnp permanent", 0)
+	ms, err := d.ListMappings()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ms) != 3 {
+		t.Fatal("expected 3 mappings, got", ms)
+	}
+	for _, m := range ms {
+		if m.InternalPort != m.ExternalPort || m.InternalClient != "192.168.1.2" || !m.Enabled {
+			t.Errorf("wrong mapping: %+v", m)
+		} else if m.ExternalPort == 9001 && (m.Description != "upnp lease" || m.LeaseDuration != time.Hour) {
+			t.Errorf("wrong leased mapping: %+v", m)
+		} else if m.ExternalPort == 9002 && (m.Protocol != "TCP" || m.Description != "upnp permanent" || m.LeaseDuration != 0) {
+			t.Errorf("wrong permanent mapping: %+v", m)
+		}
+	}
+
+	// NoSuchEntryInArray after the first entry also ends the table, but any
+	// other fault is an error
+	d = newIGD(endFaultClient{fc, errCodeNoSuchEntry})
+	if ms, err := d.ListMappings(); err != nil || len(ms) != 3 {
+		t.Fatal("expected 3 mappings, got", ms, err)
+	}
+	d = newIGD(endFaultClient{fc, 501})
+	if _, err := d.ListMappings(); faultCode(err) != 501 {
+		t.Fatal("expected the router's fault, got", err)
+	}
+
+	// a failure other than the end of the table is an error
+	d = newIGD(brokenTableClient{fc})
+	if _, err := d.ListMappings(); err == nil {
+		t.Fatal("expected an error from a table that cannot be read")
+	}
+}
+
+// A statusFaultClient is a fakeClient whose router refuses GetStatusInfo.
+type statusFaultClient struct {
+	*fakeClient
+}
+
+func (sc statusFaultClient) GetStatusInfo() (string, string, uint32, error) {
+	f := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+	f.UPnPError.ErrorCode = 501
+	f.UPnPError.ErrorDescription = "Action Failed"
+	return "", "", 0, f
+}
+
+// TestConnectionStatus tests that ConnectionStatus reports the status and
+// uptime of the connection service, and the router's fault if it refuses.
+func TestConnectionStatus(t *testing.T) {
+	d, fc := newFakeIGD("192.168.1.2")
+	if status, uptime, err := d.ConnectionStatus(); err != nil || status != "Connected" || uptime != time.Hour {
+		t.Fatalf("expected Connected for 1h, got %q, %v, %v", status, uptime, err)
+	}
+	fc.status = "Disconnected"
+	if status, _, err := d.ConnectionStatus(); err != nil || status != "Disconnected" {
+		t.Fatalf("expected Disconnected, got %q, %v", status, err)
+	}
+	d = newIGD(statusFaultClient{fc})
+	if _, _, err := d.ConnectionStatus(); faultCode(err) != 501 {
+		t.Fatal("expected the router's fault, got", err)
+	}
+}
+
+// TestSetTimeout tests that SetTimeout bounds the subsequent calls on an IGD,
+// and that zero removes the bound.
+func TestSetTimeout(t *testing.T) {
+	const ipConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	var mu sync.Mutex
+	var delay time.Duration
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rootDesc.xml":
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+		case "/ctl":
+			mu.Lock()
+			wait := delay
+			mu.Unlock()
+			select {
+			case <-time.After(wait):
+			case <-r.Context().Done():
+				return
+			}
+			w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+			w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+				`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+				`<u:GetExternalIPAddressResponse xmlns:u="` + ipConn + `"><NewExternalIPAddress>1.2.3.4</NewExternalIPAddress>` +
+				`</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer router.Close()
+	setDelay := func(d time.Duration) {
+		mu.Lock()
+		delay = d
+		mu.Unlock()
+	}
+
+	d, err := Load(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetTimeout(50 * time.Millisecond)
+	setDelay(time.Second)
+	start := time.Now()
+	if _, err := d.ExternalIP(); err == nil {
+		t.Fatal("expected ExternalIP to time out")
+	} else if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatal("ExternalIP was not bounded by the timeout:", elapsed)
+	}
+
+	d.SetTimeout(0)
+	setDelay(100 * time.Millisecond)
+	if ip, err := d.ExternalIP(); err != nil || ip != "1.2.3.4" {
+		t.Fatal("expected ExternalIP to succeed without a timeout:", ip, err)
+	}
+}
+
+// TestPinholeRenewal tests that RenewPinhole and PinholeWorking address the
+// pinhole given, and that PinholeWorking reports ErrUnsupported on routers
+// without CheckPinholeWorking.
+func TestPinholeRenewal(t *testing.T) {
+	const (
+		ipConn   = "urn:schemas-upnp-org:service:WANIPConnection:1"
+		firewall = "urn:schemas-upnp-org:service:WANIPv6FirewallControl:1"
+	)
+	desc := `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:2</deviceType><UDN>uuid:igd</UDN>` +
+		`<serviceList><service><serviceType>` + firewall + `</serviceType>` +
+		`<serviceId>urn:upnp-org:serviceId:WANIPv6Firewall1</serviceId><controlURL>/fw</controlURL></service>` +
+		`<service><serviceType>` + ipConn + `</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>` +
+		`<controlURL>/ctl</controlURL></service></serviceList></device></root>`
+	var mu sync.Mutex
+	var updates []string
+	checkSupported := true
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rootDesc.xml" {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(desc))
+			return
+		}
+		req, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		var body string
+		switch action := r.Header.Get("SOAPAction"); {
+		case strings.Contains(action, "#UpdatePinhole"):
+			updates = append(updates, string(req))
+			body = `<u:UpdatePinholeResponse xmlns:u="` + firewall + `"></u:UpdatePinholeResponse>`
+		case strings.Contains(action, "#CheckPinholeWorking") && checkSupported:
+			working := "0"
+			if strings.Contains(string(req), "<UniqueID>7</UniqueID>") {
+				working = "1"
+			}
+			body = `<u:CheckPinholeWorkingResponse xmlns:u="` + firewall + `"><IsWorking>` + working +
+				`</IsWorking></u:CheckPinholeWorkingResponse>`
+		default:
+			w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+			w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+				`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>` +
+				`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>401</errorCode>` +
+				`<errorDescription>Invalid Action</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`))
+			return
+		}
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+			`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` + body + `</s:Body></s:Envelope>`))
+	}))
+	defer router.Close()
+
+	d, err := Load(router.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := d.IPv6()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fw.RenewPinhole(7, 25*time.Hour); err == nil {
+		t.Fatal("expected an error for a lease over 24 hours")
+	} else if err := fw.RenewPinhole(7, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(updates) != 1 || !strings.Contains(updates[0], "<UniqueID>7</UniqueID>") || !strings.Contains(updates[0], "<NewLeaseTime>3600</NewLeaseTime>") {
+		t.Fatal("wrong UpdatePinhole requests:", updates)
+	}
+	mu.Unlock()
+
+	if working, err := fw.PinholeWorking(7); err != nil || !working {
+		t.Fatal("expected pinhole 7 to be working:", working, err)
+	} else if working, err := fw.PinholeWorking(8); err != nil || working {
+		t.Fatal("expected pinhole 8 not to be working:", working, err)
+	}
+	mu.Lock()
+	checkSupported = false
+	mu.Unlock()
+	if _, err := fw.PinholeWorking(7); err != ErrUnsupported {
+		t.Fatal("expected ErrUnsupported, got", err)
+	}
+}
+
+// TestDiscoverParallel tests that Discover searches for every connection
+// service at once, uses the most preferred service found without waiting out
+// the searches for the others, and cancels them.
+func TestDiscoverParallel(t *testing.T) {
+	_, fc := newFakeIGD("192.168.1.2")
+	srvs := newOptions(nil).services()
+	for _, found := range []int{0, 1} {
+		var mu sync.Mutex
+		cancelled := make(map[string]bool)
+		o := newOptions(nil)
+		o.search = func(ctx context.Context, urn string, wait int, so goupnp.SearchOptions) ([]goupnp.ServiceClient, []error, error) {
+			switch urn {
+			case srvs[found].urn:
+				return []goupnp.ServiceClient{fc.sc}, nil, nil
+			case srvs[0].urn:
+				// a more preferred search that finds nothing must be waited
+				// for
+				time.Sleep(50 * time.Millisecond)
+				return nil, nil, nil
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+			mu.Lock()
+			cancelled[urn] = ctx.Err() != nil
+			mu.Unlock()
+			return nil, nil, ctx.Err()
+		}
+		start := time.Now()
+		d, err := discoverOnce(context.Background(), o)
+		if err != nil {
+			t.Fatal(err)
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatal("discovery waited for the other searches")
+		}
+		if d.IsV2() != (found == 0) {
+			t.Fatalf("expected the service found by search %v to be used", found)
+		}
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			mu.Lock()
+			n := len(cancelled)
+			mu.Unlock()
+			if n == len(srvs)-1-found {
+				break
+			} else if time.Since(start) > time.Second {
+				t.Fatal("the remaining searches were not cancelled")
+			}
+		}
+		mu.Lock()
+		for urn, ok := range cancelled {
+			if !ok {
+				t.Errorf("search for %v was not cancelled", urn)
+			}
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,448 @@
+package upnptest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceType   = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	serviceTypeV2 = "urn:schemas-upnp-org:service:WANIPConnection:2"
+)
+
+// rootDesc is the description served by a Server. It describes a single
+// WANIPConnection:1 service, in the usual place; NewServerV2 serves it with
+// the service type replaced.
+const rootDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<friendlyName>upnptest router</friendlyName>
+<manufacturer>upnptest</manufacturer>
+<modelName>Server</modelName>
+<UDN>uuid:00000000-0000-0000-0000-000000000001</UDN>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<UDN>uuid:00000000-0000-0000-0000-000000000002</UDN>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<UDN>uuid:00000000-0000-0000-0000-000000000003</UDN>
+<serviceList><service>
+<serviceType>` + serviceType + `</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+<SCPDURL>/scpd.xml</SCPDURL>
+<controlURL>/ctl</controlURL>
+<eventSubURL>/evt</eventSubURL>
+</service></serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`
+
+// scpd is the service description served by a Server, a format string
+// taking the declarations of any actions beyond WANIPConnection:1. It
+// declares the actions that the Server implements.
+const scpd = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>GetExternalIPAddress</name></action>
+<action><name>GetStatusInfo</name></action>
+<action><name>GetNATRSIPStatus</name></action>
+<action><name>AddPortMapping</name></action>
+<action><name>DeletePortMapping</name></action>
+<action><name>GetSpecificPortMappingEntry</name></action>
+<action><name>GetGenericPortMappingEntry</name></action>
+%s</actionList>
+<serviceStateTable>
+<stateVariable sendEvents="no"><name>PortMappingLeaseDuration</name><dataType>ui4</dataType>
+<allowedValueRange><minimum>0</minimum><maximum>604800</maximum></allowedValueRange></stateVariable>
+</serviceStateTable>
+</scpd>`
+
+// A Mapping is an entry in a Server's port mapping table.
+type Mapping struct {
+	// RemoteHost is the host that the mapping is restricted to, or empty if
+	// it accepts traffic from any host.
+	RemoteHost     string
+	ExternalPort   uint16
+	Protocol       string
+	InternalPort   uint16
+	InternalClient string
+	Enabled        bool
+	Description    string
+	LeaseDuration  uint32
+}
+
+// A Server is a fake router that serves a device description and answers
+// SOAP actions over HTTP, so that upnp.Load and the methods of the IGD it
+// returns can be exercised without a router. It implements
+// GetExternalIPAddress, GetStatusInfo, GetNATRSIPStatus, AddPortMapping,
+// DeletePortMapping, GetSpecificPortMappingEntry and
+// GetGenericPortMappingEntry, and, if started by NewServerV2,
+// AddAnyPortMapping and GetListOfPortMappings. It does not answer SSDP
+// searches, so Discover cannot find it.
+type Server struct {
+	// URL is the location of the device description, to be passed to
+	// upnp.Load.
+	URL string
+
+	srv *httptest.Server
+	// urn is the type of the connection service.
+	urn string
+
+	mu         sync.Mutex
+	externalIP string
+	bridged    bool
+	mappings   map[string]Mapping
+	faults     map[string]int
+	delay      time.Duration
+}
+
+// NewServer starts a Server on the loopback interface. It reports
+// externalIP as its external address. The caller should call Close when
+// finished.
+func NewServer(externalIP string) *Server {
+	return newServer(externalIP, serviceType, "")
+}
+
+// NewServerV2 is the same as NewServer, but the Server offers a
+// WANIPConnection:2 service, which also implements AddAnyPortMapping and
+// GetListOfPortMappings.
+func NewServerV2(externalIP string) *Server {
+	return newServer(externalIP, serviceTypeV2, "<action><name>AddAnyPortMapping</name></action>\n"+
+		"<action><name>GetListOfPortMappings</name></action>\n")
+}
+
+// newServer starts a Server whose connection service is of type urn, and
+// declares the extra actions in its service description.
+func newServer(externalIP, urn, actions string) *Server {
+	s := &Server{
+		urn:        urn,
+		externalIP: externalIP,
+		mappings:   make(map[string]Mapping),
+		faults:     make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		io.WriteString(w, strings.Replace(rootDesc, serviceType, urn, 1))
+	})
+	mux.HandleFunc("/scpd.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, scpd, actions)
+	})
+	mux.HandleFunc("/ctl", s.control)
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL + "/rootDesc.xml"
+	return s
+}
+
+// Close shuts down the Server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// SetExternalIP changes the address reported by GetExternalIPAddress.
+func (s *Server) SetExternalIP(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.externalIP = ip
+}
+
+// SetBridged makes GetNATRSIPStatus report that NAT is disabled, as on a
+// router in bridge mode.
+func (s *Server) SetBridged(bridged bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bridged = bridged
+}
+
+// Fail makes every subsequent call of the named action, e.g.
+// "AddPortMapping", fail with the UPnP error code. A code of 0 makes it
+// succeed again.
+func (s *Server) Fail(action string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if code == 0 {
+		delete(s.faults, action)
+	} else {
+		s.faults[action] = code
+	}
+}
+
+// SetDelay makes the Server wait for d before answering each SOAP action, as
+// a slow or unresponsive router does. A delay of 0 makes it answer at once.
+func (s *Server) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = d
+}
+
+// Mappings returns the Server's port mapping table, ordered by port and
+// protocol.
+func (s *Server) Mappings() []Mapping {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedMappings()
+}
+
+func (s *Server) sortedMappings() []Mapping {
+	ms := make([]Mapping, 0, len(s.mappings))
+	for _, m := range s.mappings {
+		ms = append(ms, m)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].ExternalPort != ms[j].ExternalPort {
+			return ms[i].ExternalPort < ms[j].ExternalPort
+		} else if ms[i].Protocol != ms[j].Protocol {
+			return ms[i].Protocol < ms[j].Protocol
+		}
+		return ms[i].RemoteHost < ms[j].RemoteHost
+	})
+	return ms
+}
+
+// control answers a SOAP action.
+func (s *Server) control(w http.ResponseWriter, r *http.Request) {
+	soapAction := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	action := soapAction[strings.LastIndex(soapAction, "#")+1:]
+	args, err := decodeArgs(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	delay := s.delay
+	s.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if code, ok := s.faults[action]; ok {
+		writeFault(w, code, "upnptest fault")
+		return
+	}
+	key := mappingKey(args["NewRemoteHost"], args["NewExternalPort"], args["NewProtocol"])
+	switch action {
+	case "GetExternalIPAddress":
+		s.writeResponse(w, action, "NewExternalIPAddress", s.externalIP)
+	case "GetStatusInfo":
+		s.writeResponse(w, action, "NewConnectionStatus", "Connected", "NewLastConnectionError", "ERROR_NONE", "NewUptime", "1")
+	case "GetNATRSIPStatus":
+		natEnabled := "1"
+		if s.bridged {
+			natEnabled = "0"
+		}
+		s.writeResponse(w, action, "NewRSIPAvailable", "0", "NewNATEnabled", natEnabled)
+	case "AddPortMapping":
+		port, _ := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+		intPort, _ := strconv.ParseUint(args["NewInternalPort"], 10, 16)
+		lease, _ := strconv.ParseUint(args["NewLeaseDuration"], 10, 32)
+		if m, ok := s.mappings[key]; ok && m.InternalClient != args["NewInternalClient"] {
+			writeFault(w, 718, "ConflictInMappingEntry")
+			return
+		}
+		s.mappings[key] = Mapping{
+			RemoteHost:     args["NewRemoteHost"],
+			ExternalPort:   uint16(port),
+			Protocol:       args["NewProtocol"],
+			InternalPort:   uint16(intPort),
+			InternalClient: args["NewInternalClient"],
+			Enabled:        args["NewEnabled"] == "1",
+			Description:    args["NewPortMappingDescription"],
+			LeaseDuration:  uint32(lease),
+		}
+		s.writeResponse(w, action)
+	case "AddAnyPortMapping":
+		if s.urn != serviceTypeV2 {
+			writeFault(w, 401, "Invalid Action")
+			return
+		}
+		// the requested port is granted if it is free, and the next free
+		// one otherwise
+		port, _ := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+		intPort, _ := strconv.ParseUint(args["NewInternalPort"], 10, 16)
+		lease, _ := strconv.ParseUint(args["NewLeaseDuration"], 10, 32)
+		for ; port <= 0xFFFF; port++ {
+			key = mappingKey(args["NewRemoteHost"], strconv.Itoa(int(port)), args["NewProtocol"])
+			if m, ok := s.mappings[key]; !ok || m.InternalClient == args["NewInternalClient"] {
+				break
+			}
+		}
+		if port > 0xFFFF {
+			writeFault(w, 728, "NoPortMapsAvailable")
+			return
+		}
+		s.mappings[key] = Mapping{
+			RemoteHost:     args["NewRemoteHost"],
+			ExternalPort:   uint16(port),
+			Protocol:       args["NewProtocol"],
+			InternalPort:   uint16(intPort),
+			InternalClient: args["NewInternalClient"],
+			Enabled:        args["NewEnabled"] == "1",
+			Description:    args["NewPortMappingDescription"],
+			LeaseDuration:  uint32(lease),
+		}
+		s.writeResponse(w, action, "NewReservedPort", strconv.Itoa(int(port)))
+	case "DeletePortMapping":
+		if _, ok := s.mappings[key]; !ok {
+			writeFault(w, 714, "NoSuchEntryInArray")
+			return
+		}
+		delete(s.mappings, key)
+		s.writeResponse(w, action)
+	case "GetSpecificPortMappingEntry":
+		m, ok := s.mappings[key]
+		if !ok {
+			writeFault(w, 714, "NoSuchEntryInArray")
+			return
+		}
+		s.writeResponse(w, action, mappingArgs(m)[6:]...)
+	case "GetGenericPortMappingEntry":
+		i, _ := strconv.Atoi(args["NewPortMappingIndex"])
+		ms := s.sortedMappings()
+		if i < 0 || i >= len(ms) {
+			writeFault(w, 713, "SpecifiedArrayIndexInvalid")
+			return
+		}
+		s.writeResponse(w, action, mappingArgs(ms[i])...)
+	case "GetListOfPortMappings":
+		if s.urn != serviceTypeV2 {
+			writeFault(w, 401, "Invalid Action")
+			return
+		}
+		start, _ := strconv.ParseUint(args["NewStartPort"], 10, 16)
+		end, _ := strconv.ParseUint(args["NewEndPort"], 10, 16)
+		var b strings.Builder
+		b.WriteString(`<p:PortMappingList xmlns:p="urn:schemas-upnp-org:gw:WANIPConnection">`)
+		n := 0
+		for _, m := range s.sortedMappings() {
+			if m.Protocol != args["NewProtocol"] || uint64(m.ExternalPort) < start || uint64(m.ExternalPort) > end {
+				continue
+			}
+			b.WriteString("<p:PortMappingEntry>")
+			entry := mappingArgs(m)
+			entry[12] = "NewDescription"
+			entry[14] = "NewLeaseTime"
+			for i := 0; i+1 < len(entry); i += 2 {
+				fmt.Fprintf(&b, "<p:%s>", entry[i])
+				xml.EscapeText(&b, []byte(entry[i+1]))
+				fmt.Fprintf(&b, "</p:%s>", entry[i])
+			}
+			b.WriteString("</p:PortMappingEntry>")
+			n++
+		}
+		b.WriteString("</p:PortMappingList>")
+		if n == 0 {
+			writeFault(w, 730, "PortMappingNotFound")
+			return
+		}
+		s.writeResponse(w, action, "NewPortListing", b.String())
+	default:
+		writeFault(w, 401, "Invalid Action")
+	}
+}
+
+// mappingKey returns the key of the mapping with the given arguments in a
+// Server's table.
+func mappingKey(remoteHost, externalPort, protocol string) string {
+	return remoteHost + "/" + externalPort + "/" + protocol
+}
+
+// mappingArgs returns the arguments describing m, in the order used by
+// GetGenericPortMappingEntry. The first three are omitted by
+// GetSpecificPortMappingEntry.
+func mappingArgs(m Mapping) []string {
+	enabled := "0"
+	if m.Enabled {
+		enabled = "1"
+	}
+	return []string{
+		"NewRemoteHost", m.RemoteHost,
+		"NewExternalPort", strconv.Itoa(int(m.ExternalPort)),
+		"NewProtocol", m.Protocol,
+		"NewInternalPort", strconv.Itoa(int(m.InternalPort)),
+		"NewInternalClient", m.InternalClient,
+		"NewEnabled", enabled,
+		"NewPortMappingDescription", m.Description,
+		"NewLeaseDuration", strconv.Itoa(int(m.LeaseDuration)),
+	}
+}
+
+// decodeArgs returns the arguments of the action in a SOAP request body.
+func decodeArgs(body io.Reader) (map[string]string, error) {
+	args := make(map[string]string)
+	dec := xml.NewDecoder(body)
+	// the arguments are the elements at depth 4: Envelope, Body, action
+	depth := 0
+	var name string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return args, nil
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 4 {
+				name = t.Name.Local
+				args[name] = ""
+			}
+		case xml.CharData:
+			if depth == 4 {
+				args[name] += string(t)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// writeResponse writes a successful response to action, with the given
+// argument names and values.
+func (s *Server) writeResponse(w http.ResponseWriter, action string, args ...string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<u:%sResponse xmlns:u="%s">`, action, s.urn)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, "<%s>", args[i])
+		xml.EscapeText(&b, []byte(args[i+1]))
+		fmt.Fprintf(&b, "</%s>", args[i])
+	}
+	fmt.Fprintf(&b, "</u:%sResponse>", action)
+	writeEnvelope(w, b.String())
+}
+
+// writeFault writes a SOAP fault carrying a UPnP error.
+func writeFault(w http.ResponseWriter, code int, desc string) {
+	writeEnvelope(w, fmt.Sprintf(`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>`+
+		`<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode>`+
+		`<errorDescription>%s</errorDescription></UPnPError></detail></s:Fault>`, code, desc))
+}
+
+// writeEnvelope writes body in a SOAP envelope. Faults are sent with status
+// 200, rather than the 500 that routers use, as goupnp only decodes the body
+// of successful responses.
+func writeEnvelope(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" `+
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`+body+`</s:Body></s:Envelope>`)
+}
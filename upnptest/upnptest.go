@@ -0,0 +1,128 @@
+// Package upnptest provides fake routers for testing code that uses the upnp
+// package. A MockIGD stands in for an IGD behind the upnp.Gateway interface;
+// a Server is a fake router on the loopback interface that upnp.Load can
+// connect to, exercising the real SOAP code paths.
+package upnptest
+
+import (
+	"sync"
+
+	"gitlab.com/NebulousLabs/go-upnp"
+)
+
+// A Call records a call to Forward or Clear on a MockIGD.
+type Call struct {
+	// Method is "Forward" or "Clear".
+	Method string
+	Port   uint16
+	// Desc is the description passed to Forward.
+	Desc string
+}
+
+// MockIGD is an in-memory upnp.Gateway. Its exported fields may be set to
+// control its behavior before it is used; afterwards, use its methods, which
+// are safe for concurrent use.
+type MockIGD struct {
+	// IP is returned by ExternalIP.
+	IP string
+	// URL is returned by Location.
+	URL string
+	// Info is returned by DeviceInfo.
+	Info upnp.Info
+	// Err, if not nil, is returned by every method that returns an error,
+	// and makes Forward and Clear fail without changing anything.
+	Err error
+
+	mu        sync.Mutex
+	calls     []Call
+	forwarded map[uint16]string
+}
+
+var _ upnp.Gateway = (*MockIGD)(nil)
+
+// ExternalIP implements upnp.Gateway.
+func (m *MockIGD) ExternalIP() (string, error) {
+	if m.Err != nil {
+		return "", m.Err
+	}
+	return m.IP, nil
+}
+
+// Forward implements upnp.Gateway.
+func (m *MockIGD) Forward(port uint16, desc string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, Call{Method: "Forward", Port: port, Desc: desc})
+	if m.Err != nil {
+		return m.Err
+	}
+	if m.forwarded == nil {
+		m.forwarded = make(map[uint16]string)
+	}
+	m.forwarded[port] = desc
+	return nil
+}
+
+// Clear implements upnp.Gateway.
+func (m *MockIGD) Clear(port uint16) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, Call{Method: "Clear", Port: port})
+	if m.Err != nil {
+		return m.Err
+	}
+	delete(m.forwarded, port)
+	return nil
+}
+
+// IsForwardedTCP implements upnp.Gateway.
+func (m *MockIGD) IsForwardedTCP(port uint16) (bool, error) {
+	return m.isForwarded(port)
+}
+
+// IsForwardedUDP implements upnp.Gateway.
+func (m *MockIGD) IsForwardedUDP(port uint16) (bool, error) {
+	return m.isForwarded(port)
+}
+
+func (m *MockIGD) isForwarded(port uint16) (bool, error) {
+	if m.Err != nil {
+		return false, m.Err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.forwarded[port]
+	return ok, nil
+}
+
+// Location implements upnp.Gateway.
+func (m *MockIGD) Location() string {
+	return m.URL
+}
+
+// DeviceInfo implements upnp.Gateway.
+func (m *MockIGD) DeviceInfo() (upnp.Info, error) {
+	if m.Err != nil {
+		return upnp.Info{}, m.Err
+	}
+	return m.Info, nil
+}
+
+// Calls returns the calls made to Forward and Clear, in order.
+func (m *MockIGD) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// Forwarded returns the description of each port that is currently
+// forwarded.
+func (m *MockIGD) Forwarded() map[uint16]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	forwarded := make(map[uint16]string, len(m.forwarded))
+	for port, desc := range m.forwarded {
+		forwarded[port] = desc
+	}
+	return forwarded
+}
@@ -0,0 +1,848 @@
+package upnptest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/go-upnp"
+)
+
+// openPort is an example of code under test, which depends on a upnp.Gateway
+// rather than on a real router.
+func openPort(g upnp.Gateway, port uint16) (string, error) {
+	if err := g.Forward(port, "example"); err != nil {
+		return "", err
+	}
+	ip, err := g.ExternalIP()
+	if err != nil {
+		g.Clear(port)
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", ip, port), nil
+}
+
+func ExampleMockIGD() {
+	m := &MockIGD{IP: "203.0.113.1"}
+	addr, err := openPort(m, 9980)
+	fmt.Println(addr, err)
+	fmt.Println(m.Calls())
+	// Output:
+	// 203.0.113.1:9980 <nil>
+	// [{Forward 9980 example}]
+}
+
+// TestMockIGDErr tests that an injected error fails every operation without
+// forwarding anything.
+func TestMockIGDErr(t *testing.T) {
+	m := &MockIGD{Err: errors.New("router on fire")}
+	if _, err := openPort(m, 9980); err != m.Err {
+		t.Fatalf("expected %v, got %v", m.Err, err)
+	}
+	if len(m.Forwarded()) != 0 {
+		t.Fatal("port was forwarded despite error")
+	}
+	if forwarded, err := m.IsForwardedTCP(9980); forwarded || err != m.Err {
+		t.Fatalf("expected (false, %v), got (%v, %v)", m.Err, forwarded, err)
+	}
+}
+
+// TestServer tests that an IGD loaded from a Server forwards, lists and
+// clears ports.
+func TestServer(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	d, err := upnp.Load(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := d.ExternalIP(); err != nil || ip != "203.0.113.1" {
+		t.Fatalf("expected 203.0.113.1, got %q, %v", ip, err)
+	}
+	if err := d.Forward(9980, "upnptest"); err != nil {
+		t.Fatal(err)
+	}
+	if forwarded, err := d.IsForwardedTCP(9980); err != nil || !forwarded {
+		t.Fatalf("expected port to be forwarded, got %v, %v", forwarded, err)
+	}
+	if ms, err := d.ListMappings(); err != nil || len(ms) != 2 {
+		t.Fatalf("expected 2 mappings, got %v, %v", ms, err)
+	}
+	if err := d.Clear(9980); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Mappings()) != 0 {
+		t.Fatal("mappings were not cleared:", s.Mappings())
+	}
+
+	s.Fail("AddPortMapping", upnp.ErrCodeConflictInMappingEntry)
+	if err := d.Forward(9980, "upnptest"); !errors.Is(err, upnp.ErrMappingConflict) {
+		t.Fatal("expected a mapping conflict, got", err)
+	}
+}
+
+// countingTransport counts the requests it sends.
+type countingTransport struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.n++
+	t.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// concurrencyTransport records the largest number of requests it has had in
+// flight at once.
+type concurrencyTransport struct {
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (t *concurrencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.inFlight++
+	if t.inFlight > t.max {
+		t.max = t.inFlight
+	}
+	t.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	t.mu.Lock()
+	t.inFlight--
+	t.mu.Unlock()
+	return resp, err
+}
+
+// TestMaxInFlight tests that an IGD sends only as many SOAP actions at once
+// as WithMaxInFlight allows.
+func TestMaxInFlight(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	for _, n := range []int{1, 2} {
+		transport := new(concurrencyTransport)
+		d, err := upnp.Load(s.URL, upnp.WithHTTPClient(&http.Client{Transport: transport}), upnp.WithMaxInFlight(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := d.ExternalIP(); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if transport.max > n {
+			t.Fatalf("expected at most %v actions in flight, got %v", n, transport.max)
+		}
+	}
+}
+
+// TestWithHTTPClient tests that the client given to Load is used both for
+// the device description and for SOAP actions.
+func TestWithHTTPClient(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	transport := new(countingTransport)
+	d, err := upnp.Load(s.URL, upnp.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := transport.n
+	if loaded == 0 {
+		t.Fatal("description was not fetched with the client")
+	}
+	if _, err := d.ExternalIP(); err != nil {
+		t.Fatal(err)
+	} else if transport.n != loaded+1 {
+		t.Fatal("SOAP action was not performed with the client")
+	}
+}
+
+// logBuffer is a upnp.Logger that records what it is given.
+type logBuffer struct {
+	lines []string
+}
+
+func (l *logBuffer) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// TestSOAPTrace tests that WithSOAPTrace records each action, and that
+// WithDebug logs it to the Logger given with WithLogger.
+func TestSOAPTrace(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	var traces []upnp.SOAPTrace
+	l := new(logBuffer)
+	d, err := upnp.Load(s.URL, upnp.WithSOAPTrace(func(tr upnp.SOAPTrace) {
+		traces = append(traces, tr)
+	}), upnp.WithDebug(), upnp.WithLogger(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Fail("DeletePortMapping", 714)
+	d.Clear(9980)
+	if len(traces) != 2 {
+		t.Fatalf("expected 2 traces, got %v", traces)
+	}
+	tr := traces[0]
+	if tr.Action != "DeletePortMapping" || tr.Err == nil || len(tr.Response) == 0 || len(tr.Args) != 3 || tr.Args[1] != [2]string{"NewExternalPort", "9980"} {
+		t.Fatalf("wrong trace: %+v", tr)
+	}
+	found := false
+	for _, line := range l.lines {
+		if strings.Contains(line, "DeletePortMapping(NewRemoteHost=, NewExternalPort=9980, NewProtocol=TCP)") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("trace was not logged:", l.lines)
+	}
+}
+
+// countingMetrics is a upnp.Metrics that counts SOAP calls by error code.
+type countingMetrics struct {
+	mu    sync.Mutex
+	calls map[int]int
+}
+
+func (m *countingMetrics) DiscoveryAttempt(bool, time.Duration) {}
+func (m *countingMetrics) Renewal(error)                        {}
+func (m *countingMetrics) SOAPCall(action string, latency time.Duration, code int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls[code]++
+}
+
+// TestWithMetrics tests that SOAP actions are reported with their error
+// codes.
+func TestWithMetrics(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	m := &countingMetrics{calls: make(map[int]int)}
+	d, err := upnp.Load(s.URL, upnp.WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.ExternalIP()
+	s.Fail("DeletePortMapping", 714)
+	d.ClearProtocol(9980, "TCP")
+	if m.calls[0] != 1 || m.calls[714] != 1 {
+		t.Fatal("wrong calls reported:", m.calls)
+	}
+}
+
+// TestSnapshot tests that an IGD is restored from a snapshot without
+// contacting the router.
+func TestSnapshot(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	d, err := upnp.Load(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := new(countingTransport)
+	r, err := upnp.Restore(snap, upnp.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	} else if transport.n != 0 {
+		t.Fatal("Restore contacted the router")
+	} else if r.Location() != d.Location() {
+		t.Fatalf("expected location %v, got %v", d.Location(), r.Location())
+	}
+	if ip, err := r.ExternalIP(); err != nil || ip != "203.0.113.1" {
+		t.Fatalf("expected 203.0.113.1, got %q, %v", ip, err)
+	}
+	if info, err := r.DeviceInfo(); err != nil || info.FriendlyName != "upnptest router" {
+		t.Fatalf("wrong device info: %+v, %v", info, err)
+	}
+}
+
+// TestPing tests that Ping succeeds while the router answers, and fails once
+// it has gone.
+func TestPing(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	d, err := upnp.Load(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := d.Ping(context.Background()); err == nil {
+		t.Fatal("expected Ping to fail after the router went away")
+	}
+}
+
+// TestRequestConnection tests that re-dialing is refused for routers that do
+// not use PPP.
+func TestRequestConnection(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	d, err := upnp.Load(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	} else if d.IsPPP() {
+		t.Fatal("WANIPConnection router reported as PPP")
+	}
+	if err := d.RequestConnection(); err != upnp.ErrUnsupported {
+		t.Fatal("expected ErrUnsupported, got", err)
+	} else if err := d.ForceTermination(); err != upnp.ErrUnsupported {
+		t.Fatal("expected ErrUnsupported, got", err)
+	}
+}
+
+// TestNATEnabled tests that NATEnabled reports a router in bridge mode.
+func TestNATEnabled(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	d, err := upnp.Load(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := d.NATEnabled(); err != nil || !enabled {
+		t.Fatal("expected NAT to be enabled:", enabled, err)
+	}
+	s.SetBridged(true)
+	if enabled, err := d.NATEnabled(); err != nil || enabled {
+		t.Fatal("expected NAT to be disabled:", enabled, err)
+	}
+}
+
+// TestDryRun tests that WithDryRun reports the actions that would change the
+// router without performing them, while reads still reach the router.
+func TestDryRun(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	var planned []upnp.PlannedAction
+	d, err := upnp.Load(s.URL, upnp.WithDryRun(func(a upnp.PlannedAction) {
+		planned = append(planned, a)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := d.ExternalIP(); err != nil || ip != "203.0.113.1" {
+		t.Fatalf("expected 203.0.113.1, got %q, %v", ip, err)
+	}
+	if err := d.Forward(9980, "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if err := d.Clear(9980); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Mappings()) != 0 {
+		t.Fatal("dry run changed the router:", s.Mappings())
+	}
+	var actions []string
+	for _, a := range planned {
+		actions = append(actions, a.Action)
+	}
+	if strings.Join(actions, ",") != "AddPortMapping,AddPortMapping,DeletePortMapping,DeletePortMapping" {
+		t.Fatal("wrong actions planned:", planned)
+	} else if !strings.Contains(planned[0].String(), "NewExternalPort=9980") {
+		t.Fatal("wrong arguments planned:", planned[0])
+	}
+
+	// actions performed with Invoke are planned too, unless they only read
+	var trace []string
+	d, err = upnp.Load(s.URL, upnp.WithDryRun(func(a upnp.PlannedAction) {
+		planned = append(planned, a)
+	}), upnp.WithSOAPTrace(func(tr upnp.SOAPTrace) {
+		trace = append(trace, tr.Action)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	planned = nil
+	args := &struct {
+		NewRemoteHost   string
+		NewExternalPort string
+		NewProtocol     string
+	}{"", "9981", "TCP"}
+	if err := d.Invoke(context.Background(), "", "DeletePortMapping", args, nil); err != nil {
+		t.Fatal(err)
+	} else if err := d.Invoke(context.Background(), serviceType, "ForceTermination", nil, nil); err != nil {
+		t.Fatal(err)
+	} else if err := d.Invoke(context.Background(), serviceType, "X_VendorReset", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	out := &struct{ NewExternalIPAddress string }{}
+	if err := d.Invoke(context.Background(), serviceType, "GetExternalIPAddress", nil, out); err != nil {
+		t.Fatal(err)
+	}
+	actions = nil
+	for _, a := range planned {
+		actions = append(actions, a.Action)
+	}
+	if strings.Join(actions, ",") != "DeletePortMapping,ForceTermination,X_VendorReset" {
+		t.Fatal("wrong actions planned:", planned)
+	} else if strings.Join(trace, ",") != "GetExternalIPAddress" {
+		t.Fatal("dry run performed actions:", trace)
+	}
+}
+
+// TestCapabilities tests that Capabilities reads the features declared in
+// the service description.
+func TestCapabilities(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	d, err := upnp.Load(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caps := d.Capabilities()
+	if len(caps.Actions) != 7 || caps.Actions[3] != "AddPortMapping" {
+		t.Fatal("wrong actions:", caps.Actions)
+	} else if caps.AddAnyPortMapping || caps.DeletePortMappingRange || caps.ConnectionControl {
+		t.Fatalf("undeclared actions reported: %+v", caps)
+	} else if caps.MaxLease != 7*24*time.Hour || caps.PermanentOnly {
+		t.Fatalf("wrong lease limits: %+v", caps)
+	} else if !caps.NATEnabled || caps.TrafficStats || caps.IPv6Firewall {
+		t.Fatalf("wrong services: %+v", caps)
+	}
+}
+
+// TestRateLimit tests that WithRateLimit spaces SOAP actions apart.
+func TestRateLimit(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	d, err := upnp.Load(s.URL, upnp.WithRateLimit(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := d.ExternalIP(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatal("actions were not rate limited: 3 took", elapsed)
+	}
+}
+
+// headerTransport records the User-Agent of each request it sends.
+type headerTransport struct {
+	mu     sync.Mutex
+	agents []string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.agents = append(t.agents, req.Header.Get("User-Agent"))
+	t.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// TestWithUserAgent tests that the User-Agent given to Load is sent both for
+// the device description and for SOAP actions.
+func TestWithUserAgent(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	transport := new(headerTransport)
+	d, err := upnp.Load(s.URL, upnp.WithHTTPClient(&http.Client{Transport: transport}), upnp.WithUserAgent("upnptest/1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ExternalIP(); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.agents) < 2 {
+		t.Fatal("expected a description fetch and a SOAP action, got", transport.agents)
+	}
+	for _, agent := range transport.agents {
+		if agent != "upnptest/1.0" {
+			t.Fatal("wrong User-Agent:", transport.agents)
+		}
+	}
+}
+
+// TestInvoke tests that Invoke performs raw actions on the router.
+func TestInvoke(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	d, err := upnp.Load(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &struct{ NewExternalIPAddress string }{}
+	if err := d.Invoke(context.Background(), "", "GetExternalIPAddress", nil, out); err != nil {
+		t.Fatal(err)
+	} else if out.NewExternalIPAddress != "203.0.113.1" {
+		t.Fatal("wrong external IP:", out.NewExternalIPAddress)
+	}
+	if err := d.Invoke(context.Background(), serviceType, "GetExternalIPAddress", nil, out); err != nil {
+		t.Fatal(err)
+	}
+
+	var upnpErr *upnp.UPnPError
+	if err := d.Invoke(context.Background(), "", "X_VendorAction", nil, nil); !errors.As(err, &upnpErr) || upnpErr.Code != 401 {
+		t.Fatal("expected a 401 UPnPError, got", err)
+	}
+	if err := d.Invoke(context.Background(), "urn:example-com:service:Vendor:1", "Anything", nil, nil); err != upnp.ErrUnsupported {
+		t.Fatal("expected ErrUnsupported, got", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	d, err := upnp.Load(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Forward(9000, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	session := d.NewSession(time.Second)
+	for _, port := range []uint16{9001, 9002} {
+		if err := session.Forward(port, "upnp test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(s.Mappings()); n != 6 {
+		t.Fatal("expected 6 mappings, got", n)
+	}
+
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// only the mappings created through the session are removed
+	if m := s.Mappings(); len(m) != 2 || m[0].ExternalPort != 9000 || m[1].ExternalPort != 9000 {
+		t.Fatal("wrong mappings after Close:", m)
+	}
+	if err := session.Forward(9003, "upnp test"); err != upnp.ErrSessionClosed {
+		t.Fatal("expected ErrSessionClosed, got", err)
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal("second Close failed:", err)
+	}
+}
+
+func TestQuirks(t *testing.T) {
+	s := NewServer("203.0.113.1")
+	defer s.Close()
+
+	q := upnp.Quirks{PermanentLeases: true, LowercaseProtocol: true}
+	d, err := upnp.Load(s.URL, upnp.WithQuirks("UPNPTEST", "", q))
+	if err != nil {
+		t.Fatal(err)
+	} else if d.Quirks() != q {
+		t.Fatalf("wrong quirks: %+v", d.Quirks())
+	}
+	if err := d.ForwardTimeout(9001, "upnp test", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range s.Mappings() {
+		if m.Protocol != "tcp" && m.Protocol != "udp" {
+			t.Fatal("protocol was not lowercased:", m.Protocol)
+		} else if m.LeaseDuration != 0 {
+			t.Fatal("lease was not dropped:", m.LeaseDuration)
+		}
+	}
+	if ok, err := d.IsForwarded(9001, "TCP"); err != nil || !ok {
+		t.Fatal("expected 9001 to be forwarded:", ok, err)
+	} else if err := d.Clear(9001); err != nil {
+		t.Fatal(err)
+	} else if n := len(s.Mappings()); n != 0 {
+		t.Fatal("expected no mappings, got", n)
+	}
+
+	d, err = upnp.Load(s.URL, upnp.WithQuirks("upnptest", "", q), upnp.WithoutQuirks())
+	if err != nil {
+		t.Fatal(err)
+	} else if d.Quirks() != (upnp.Quirks{}) {
+		t.Fatalf("WithoutQuirks did not disable quirks: %+v", d.Quirks())
+	}
+}
+
+// TestCallTimeout tests that a slow router makes calls fail once the
+// timeout given with WithDefaultTimeout, or the deadline of a Ctx variant,
+// has passed, and that the deadline takes precedence over the timeout.
+func TestCallTimeout(t *testing.T) {
+	s := NewServer("1.2.3.4")
+	defer s.Close()
+	d, err := upnp.Load(s.URL, upnp.WithDefaultTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetDelay(time.Second)
+	start := time.Now()
+	if _, err := d.ExternalIP(); err == nil {
+		t.Fatal("expected ExternalIP to time out")
+	} else if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatal("ExternalIP was not bounded by the default timeout:", elapsed)
+	}
+
+	// a context deadline overrides the default
+	s.SetDelay(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if ip, err := d.ExternalIPCtx(ctx); err != nil || ip != "1.2.3.4" {
+		t.Fatal("expected ExternalIPCtx to outlast the default timeout:", ip, err)
+	}
+
+	s.SetDelay(time.Second)
+	d.SetTimeout(0)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.ForwardCtx(ctx, 9001, "upnp test"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected ForwardCtx to exceed its deadline, got", err)
+	}
+
+	s.SetDelay(0)
+	if ip, err := d.ExternalIP(); err != nil || ip != "1.2.3.4" {
+		t.Fatal("expected ExternalIP to succeed once the router answers:", ip, err)
+	}
+}
+
+// TestDetectDoubleNATCtx tests that DetectDoubleNAT aborts its request to
+// a slow router when ctx is done, rather than leaving it running.
+func TestDetectDoubleNATCtx(t *testing.T) {
+	s := NewServer("1.2.3.4")
+	defer s.Close()
+	done := make(chan struct{}, 1)
+	d, err := upnp.Load(s.URL, upnp.WithSOAPTrace(func(tr upnp.SOAPTrace) {
+		if tr.Action == "GetExternalIPAddress" {
+			done <- struct{}{}
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetDelay(time.Second)
+	defer s.SetDelay(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := d.DetectDoubleNAT(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected DetectDoubleNAT to exceed its deadline, got", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("the request was not aborted")
+	}
+}
+
+// TestForwardCtx tests that ForwardCtx, ClearCtx and ExternalIPCtx abort
+// their requests when the context is done, and that ForwardCtx removes a
+// mapping it created before being cancelled.
+func TestForwardCtx(t *testing.T) {
+	s := NewServer("1.2.3.4")
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// cancel once the TCP mapping has been created
+	d, err := upnp.Load(s.URL, upnp.WithSOAPTrace(func(tr upnp.SOAPTrace) {
+		if tr.Action == "AddPortMapping" && tr.Err == nil {
+			cancel()
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ForwardCtx(ctx, 9001, "upnp test"); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	} else if m := s.Mappings(); len(m) != 0 {
+		t.Fatal("TCP mapping was not rolled back:", m)
+	}
+	if err := d.ForwardCtx(context.Background(), 0, "upnp test"); err != upnp.ErrWildcardPort {
+		t.Fatal("expected ErrWildcardPort, got", err)
+	}
+
+	if err := d.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	s.SetDelay(time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := d.ClearCtx(ctx, 9001); err != context.DeadlineExceeded {
+		t.Fatal("expected ClearCtx to exceed its deadline, got", err)
+	} else if _, err := d.ExternalIPCtx(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected ExternalIPCtx to exceed its deadline, got", err)
+	} else if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatal("requests were not aborted:", elapsed)
+	}
+	s.SetDelay(0)
+	if n := len(s.Mappings()); n != 2 {
+		t.Fatal("expected the mappings to remain, got", n)
+	} else if err := d.ClearCtx(context.Background(), 9001); err != nil {
+		t.Fatal(err)
+	} else if n := len(s.Mappings()); n != 0 {
+		t.Fatal("expected no mappings, got", n)
+	}
+}
+
+// TestWildcardHostQuirk tests that the remote host given by a FRITZ!Box style
+// quirk is used by every action that changes the mapping table, so that a
+// Session removes the mappings it created, and ForwardAny and Invoke address
+// the mappings the router stores under the wildcard host.
+func TestWildcardHostQuirk(t *testing.T) {
+	s := NewServerV2("203.0.113.1")
+	defer s.Close()
+	d, err := upnp.Load(s.URL, upnp.WithQuirks("upnptest", "", upnp.Quirks{WildcardHost: "0.0.0.0"}))
+	if err != nil {
+		t.Fatal(err)
+	} else if !d.IsV2() {
+		t.Fatal("expected an IGDv2 connection service")
+	}
+
+	session := d.NewSession(time.Second)
+	if err := session.Forward(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range s.Mappings() {
+		if m.RemoteHost != "0.0.0.0" {
+			t.Fatal("mapping not created under the wildcard host:", m)
+		}
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	} else if m := s.Mappings(); len(m) != 0 {
+		t.Fatal("Close left mappings behind:", m)
+	}
+
+	// another host holds TCP 9002 under the wildcard host
+	s.mu.Lock()
+	s.mappings[mappingKey("0.0.0.0", "9002", "TCP")] = Mapping{RemoteHost: "0.0.0.0", ExternalPort: 9002, Protocol: "TCP", InternalPort: 9002, InternalClient: "192.0.2.99"}
+	s.mu.Unlock()
+	port, err := d.ForwardAny(9002, "upnp test")
+	if err != nil {
+		t.Fatal(err)
+	} else if port != 9003 {
+		t.Fatal("expected the router to grant 9003, got", port)
+	}
+	for _, m := range s.Mappings() {
+		if m.RemoteHost != "0.0.0.0" {
+			t.Fatal("ForwardAny did not use the wildcard host:", m)
+		}
+	}
+
+	req := &struct {
+		NewRemoteHost   string
+		NewExternalPort string
+		NewProtocol     string
+	}{"", "9003", "TCP"}
+	if err := d.Invoke(context.Background(), "", "DeletePortMapping", req, nil); err != nil {
+		t.Fatal(err)
+	} else if req.NewRemoteHost != "" {
+		t.Fatal("Invoke modified its arguments:", req.NewRemoteHost)
+	} else if ok, err := d.IsForwardedTCP(9003); err != nil || ok {
+		t.Fatal("Invoke did not delete the mapping:", ok, err)
+	}
+}
+
+// TestTotalMappingsV2 tests that TotalMappings reads the table of an IGDv2
+// router with GetListOfPortMappings, and walks it if the router refuses.
+func TestTotalMappingsV2(t *testing.T) {
+	s := NewServerV2("203.0.113.1")
+	defer s.Close()
+	var mu sync.Mutex
+	var actions []string
+	d, err := upnp.Load(s.URL, upnp.WithSOAPTrace(func(tr upnp.SOAPTrace) {
+		mu.Lock()
+		defer mu.Unlock()
+		actions = append(actions, tr.Action)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range []uint16{9001, 9002} {
+		if err := d.Forward(port, "upnp test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	actions = nil
+	mu.Unlock()
+	if n, err := d.TotalMappings(); err != nil || n != 4 {
+		t.Fatal("expected 4 mappings, got", n, err)
+	}
+	mu.Lock()
+	if len(actions) != 2 || actions[0] != "GetListOfPortMappings" || actions[1] != "GetListOfPortMappings" {
+		t.Fatal("expected one GetListOfPortMappings per protocol, got", actions)
+	}
+	mu.Unlock()
+
+	s.Fail("GetListOfPortMappings", 606)
+	if n, err := d.TotalMappings(); err != nil || n != 4 {
+		t.Fatal("expected 4 mappings from walking the table, got", n, err)
+	}
+}
+
+// TestListMappingsByProtocolV2 tests that ListMappingsByProtocol asks an
+// IGDv2 router for the mappings of one protocol, and filters the walked
+// table if the router refuses.
+func TestListMappingsByProtocolV2(t *testing.T) {
+	s := NewServerV2("203.0.113.1")
+	defer s.Close()
+	var mu sync.Mutex
+	var actions []string
+	d, err := upnp.Load(s.URL, upnp.WithSOAPTrace(func(tr upnp.SOAPTrace) {
+		mu.Lock()
+		defer mu.Unlock()
+		actions = append(actions, tr.Action)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ForwardTCP(9001, "upnp test"); err != nil {
+		t.Fatal(err)
+	} else if err := d.ForwardTimeout(9002, "upnp lease", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, fail := range []bool{false, true} {
+		if fail {
+			s.Fail("GetListOfPortMappings", 401)
+		}
+		mu.Lock()
+		actions = nil
+		mu.Unlock()
+		ms, err := d.ListMappingsByProtocol("udp")
+		if err != nil {
+			t.Fatal(err)
+		} else if len(ms) != 1 || ms[0].ExternalPort != 9002 || ms[0].Protocol != "UDP" || ms[0].Description != "upnp lease" ||
+			!ms[0].Enabled || ms[0].LeaseDuration != time.Hour {
+			t.Fatalf("wrong UDP mappings: %+v", ms)
+		}
+		mu.Lock()
+		if !fail && (len(actions) != 1 || actions[0] != "GetListOfPortMappings") {
+			t.Fatal("expected a single GetListOfPortMappings, got", actions)
+		} else if fail && actions[len(actions)-1] != "GetGenericPortMappingEntry" {
+			t.Fatal("expected the table to be walked, got", actions)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,102 @@
+package upnp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// verifyTimeout bounds the connection attempt made by VerifyForward.
+const verifyTimeout = 5 * time.Second
+
+// A VerificationError is returned by ForwardVerified when the router accepted
+// a mapping, but does not report it as requested.
+type VerificationError struct {
+	Port     uint16
+	Protocol string
+	// InternalClient and Enabled are what the router reports for the
+	// mapping.
+	InternalClient string
+	Enabled        bool
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("router did not install %s mapping for port %d: it forwards to %q (enabled: %v)", e.Protocol, e.Port, e.InternalClient, e.Enabled)
+}
+
+// ForwardVerified forwards the specified port like Forward, and then reads
+// the mappings back from the router to confirm that they were installed, as
+// some routers report success without doing so. If a mapping is missing, or
+// does not forward to this host, a *VerificationError is returned. The
+// mappings are left in place either way.
+func (d *IGD) ForwardVerified(port uint16, desc string) error {
+	ip, err := d.getInternalIP()
+	if err != nil {
+		return err
+	}
+	key, err := d.ForwardAdvanced(MappingSpec{
+		ExternalPort: port,
+		InternalIP:   ip,
+		TCP:          ProtocolEnabled,
+		UDP:          ProtocolEnabled,
+		Description:  desc,
+	})
+	if err != nil {
+		return err
+	}
+	for _, proto := range key.protocols {
+		time.Sleep(time.Millisecond)
+		_, client, enabled, _, _, err := d.client.GetSpecificPortMappingEntry(key.remoteHost, port, proto)
+		if faultCode(err) == errCodeNoSuchEntry {
+			return &VerificationError{Port: port, Protocol: proto}
+		} else if err != nil {
+			return upnpError(err)
+		}
+		if client != ip || !enabled {
+			return &VerificationError{Port: port, Protocol: proto, InternalClient: client, Enabled: enabled}
+		}
+	}
+	return nil
+}
+
+// VerifyForward checks that the forwarded TCP port is actually reachable,
+// rather than merely mapped, by connecting to the router's external address on
+// that port from this host. Something must be listening on the port's
+// internal end. If the connection fails, an error wrapping ErrPortUnreachable
+// is returned. This relies on the router supporting hairpinning, which many
+// do not; see HairpinSupported, and VerifyForwardExternal for checking from
+// outside instead.
+func (d *IGD) VerifyForward(port uint16) error {
+	return d.VerifyForwardExternal(context.Background(), port, func(ctx context.Context, addr string) error {
+		ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+		defer cancel()
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// VerifyForwardExternal checks that the forwarded port is reachable with a
+// caller-supplied probe, such as a request to an echo service on the
+// internet that connects back to addr, the router's external address and
+// port as "ip:port". If probe fails, its error is returned wrapped with
+// ErrPortUnreachable, unless ctx is done.
+func (d *IGD) VerifyForwardExternal(ctx context.Context, port uint16, probe func(ctx context.Context, addr string) error) error {
+	ip, err := d.ExternalIP()
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	if err := probe(ctx, addr); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %s: %v", ErrPortUnreachable, addr, err)
+	}
+	return nil
+}